@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"ydb-backup-tool/internal/api"
+	cmd "ydb-backup-tool/internal/command"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/repository"
+	"ydb-backup-tool/internal/ydb"
+)
+
+// apiExecutor runs the API requests with the options passed to the daemon.
+type apiExecutor struct {
+	repo repository.Repository
+}
+
+func (e *apiExecutor) ListBackups(ctx context.Context, withSizes bool) ([]cmd.BackupInfo, error) {
+	return cmd.GetBackupsInfo(ctx, e.repo, withSizes)
+}
+
+func (e *apiExecutor) CreateBackup(ctx context.Context, logs io.Writer) (_ string, err error) {
+	defer func() { finishRun(ctx, e.repo, cmd.CreateIncrementalBackup, err) }()
+	fmt.Fprintln(logs, "Creating a new backup")
+	path, err := createBackup(ctx, e.repo, initScheduledLabels())
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(logs, "Created the backup `%s`\n", path)
+	return filepath.Base(path), nil
+}
+
+func (e *apiExecutor) RestoreBackup(ctx context.Context, reference string, source string,
+	request *api.RestoreRequest, logs io.Writer) (err error) {
+	command := cmd.RestoreFromBackup
+	defer func() { finishRun(ctx, e.repo, command, err) }()
+	restoreParams := &ydb.RestoreParams{
+		Path:    *ydbRestorePath,
+		Data:    *ydbRestoreData,
+		Indexes: *ydbRestoreIndexes,
+		DryRun:  isArgFlagPassed(_const.YdbRestoreDryRun) || request.DryRun,
+	}
+	if request.Path != "" {
+		restoreParams.Path = request.Path
+	}
+	if request.Data != nil {
+		restoreParams.Data = boolToUint(*request.Data)
+	}
+	if request.Indexes != nil {
+		restoreParams.Indexes = boolToUint(*request.Indexes)
+	}
+
+	selector := apiSelector(source)
+	ydbParams, target := initYdbParams(), initRestoreTarget()
+	// The daemon backing up the sources from the file has no database of its own
+	if len(sourceJobs) > 0 {
+		job, err := cmd.FindSourceJob(e.repo, sourceJobs, reference, selector)
+		if err != nil {
+			return err
+		}
+		ydbParams, target = job.YdbParams, job.Source
+	}
+
+	fmt.Fprintf(logs, "Restoring from the backup `%s` to `%s`\n", reference, restoreParams.Path)
+	if err := command.RestoreFromBackup(ctx, e.repo, *deleteOrphans, ydbParams, restoreParams, reference, selector,
+		target, initHooks(), initNotifier()); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(logs, "Restored from the backup `%s`\n", reference)
+	return nil
+}
+
+func (e *apiExecutor) DeleteBackup(ctx context.Context, reference string, source string,
+	logs io.Writer) (err error) {
+	command := cmd.DeleteBackup
+	defer func() { finishRun(ctx, e.repo, command, err) }()
+	fmt.Fprintf(logs, "Deleting the backup `%s`\n", reference)
+	return command.DeleteBackup(ctx, e.repo, reference, apiSelector(source))
+}
+
+func (e *apiExecutor) VerifyBackups(ctx context.Context, logs io.Writer) (err error) {
+	defer func() { finishRun(ctx, e.repo, cmd.VerifyBackups, err) }()
+	fmt.Fprintln(logs, "Verifying backups")
+	if err := runVerify(ctx, e.repo); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(logs, "All backups are verified")
+	return nil
+}
+
+// apiSelector scopes the references of a request to the source, the source of the daemon by default. Unlike
+// initReferenceSelector, the tags of the scheduled backups are not applied.
+func apiSelector(source string) *cmd.Selector {
+	if source == "" && backupSource != nil {
+		source = backupSource.Name
+	}
+	return &cmd.Selector{Source: source}
+}
+
+func boolToUint(value bool) uint64 {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	dedup "ydb-backup-tool/internal/btrfs/deduplication/duperemove"
+	cmd "ydb-backup-tool/internal/command"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/envelope"
+	"ydb-backup-tool/internal/repository"
+	"ydb-backup-tool/internal/utils"
+)
+
+// listFlag collects a repeatable option, e.g. `--recipient`.
+type listFlag []string
+
+func (list *listFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *listFlag) Set(value string) error {
+	*list = append(*list, strings.TrimSpace(value))
+	return nil
+}
+
+func passphraseSource() *utils.SecretSource {
+	return &utils.SecretSource{File: *passphraseFile, Env: _const.PassphraseEnv, Prompt: "Passphrase of the archive"}
+}
+
+// validateArchiveArgs checks the options of the commands writing and reading the archives. An archive leaves
+// the repository, so it is written unencrypted only on explicit request.
+func validateArchiveArgs(commandName string) error {
+	switch commandName {
+	case "send":
+		commandName = "export"
+	case "receive":
+		commandName = "import"
+	}
+	writesArchive := commandName == "export" || commandName == "push" || *replicate
+	readsArchive := commandName == "import" || commandName == "pull"
+	usesPassphrase := *passphrase || *passphraseFile != ""
+	if *output != "" && commandName != "export" {
+		return newUsageError("`--%s` is supported only by `export`", _const.OutputArg)
+	}
+	if !writesArchive && (len(recipients) > 0 || *passphrase || *plaintext) {
+		return newUsageError("`--%s`, `--%s` and `--%s` are supported only by `export`, `push` and `--%s`",
+			_const.RecipientArg, _const.PassphraseArg, _const.PlaintextArg, _const.ReplicateArg)
+	}
+	if *passphraseFile != "" && !writesArchive && !readsArchive {
+		return newUsageError("`--%s` is supported only by the commands writing or reading the archives",
+			_const.PassphraseFileArg)
+	}
+	if len(identities) > 0 && !readsArchive && commandName != "keygen" {
+		return newUsageError("`--%s` is supported only by `import`, `pull` and `keygen`", _const.IdentityArg)
+	}
+
+	if writesArchive {
+		if *plaintext && (len(recipients) > 0 || usesPassphrase) {
+			return newUsageError("`--%s` cannot be combined with `--%s` and `--%s`", _const.PlaintextArg,
+				_const.RecipientArg, _const.PassphraseArg)
+		}
+		if !*plaintext && len(recipients) == 0 && !usesPassphrase {
+			return newUsageError("the archive must be encrypted, pass \"--%s=<public key or file>\" or `--%s`, "+
+				"or `--%s` to write it unencrypted", _const.RecipientArg, _const.PassphraseArg, _const.PlaintextArg)
+		}
+	}
+	switch commandName {
+	case "export":
+		if *output == "" {
+			return newUsageError("you need to specify the archive passing \"--%s=<path>\", or `-` for stdout",
+				_const.OutputArg)
+		}
+	case "import":
+		if len(commandArgs) == 0 {
+			return newUsageError("you should specify the archive: import <path>, or `-` for stdin")
+		}
+	case "keygen":
+		if len(identities) != 1 {
+			return newUsageError("you need to specify the identity file passing \"--%s=<path>\"", _const.IdentityArg)
+		}
+	}
+	return nil
+}
+
+func initArchiveEncryption() (*cmd.ArchiveEncryption, error) {
+	if *plaintext {
+		return nil, nil
+	}
+
+	encryption := &cmd.ArchiveEncryption{}
+	for _, value := range recipients {
+		parsed, err := envelope.ParseRecipient(value)
+		if err != nil {
+			return nil, newUsageError("invalid `--%s`: %v", _const.RecipientArg, err)
+		}
+		encryption.Recipients = append(encryption.Recipients, parsed...)
+	}
+	if *passphrase || *passphraseFile != "" {
+		secret, err := passphraseSource().Load(true)
+		if errors.Is(err, utils.ErrNotTerminal) {
+			return nil, fmt.Errorf("the passphrase is required, pass \"--%s=<path>\" or set `%s`",
+				_const.PassphraseFileArg, _const.PassphraseEnv)
+		}
+		if err != nil {
+			return nil, err
+		}
+		encryption.Passphrase = secret
+	}
+	return encryption, nil
+}
+
+func initArchiveDecryption() (*cmd.ArchiveDecryption, error) {
+	decryption := &cmd.ArchiveDecryption{
+		Passphrase: func() ([]byte, error) {
+			secret, err := passphraseSource().Load(false)
+			if errors.Is(err, utils.ErrNotTerminal) {
+				return nil, fmt.Errorf("the passphrase is required, pass \"--%s=<path>\" or set `%s`",
+					_const.PassphraseFileArg, _const.PassphraseEnv)
+			}
+			return secret, err
+		},
+	}
+	for _, path := range identities {
+		parsed, err := envelope.ReadIdentities(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `--%s`: %w", _const.IdentityArg, err)
+		}
+		decryption.Identities = append(decryption.Identities, parsed...)
+	}
+	return decryption, nil
+}
+
+func runExport(ctx context.Context, command *cmd.Command, repo repository.Repository) error {
+	encryption, err := initArchiveEncryption()
+	if err != nil {
+		return err
+	}
+	return command.ExportBackup(ctx, repo, *deleteOrphans, commandReference(), initReferenceSelector(), *output,
+		encryption)
+}
+
+func runImport(ctx context.Context, command *cmd.Command, repo repository.Repository) error {
+	decryption, err := initArchiveDecryption()
+	if err != nil {
+		return err
+	}
+	return command.ImportBackup(ctx, repo, *deleteOrphans, commandArgs[0], decryption, compression,
+		&dedup.Params{BlockSize: *dedupBlockSize})
+}
+
+// runKeygen writes a new identity for the encrypted archives and prints its public key, which is passed to
+// `export --recipient`.
+func runKeygen() error {
+	identity, err := envelope.GenerateIdentity()
+	if err != nil {
+		return err
+	}
+	path := identities[0]
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create the identity file: %w", err)
+	}
+	_, err = fmt.Fprintf(file, "# public key: %s\n%s\n", identity.Recipient(), identity)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("failed to write the identity file `%s`: %w", path, err)
+	}
+
+	fmt.Printf("Created the identity `%s`.\nPublic key: %s\nFingerprint: %s\n", path, identity.Recipient(),
+		identity.Recipient().Fingerprint())
+	return nil
+}
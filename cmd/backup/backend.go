@@ -0,0 +1,88 @@
+package main
+
+import (
+	"compress/flate"
+	"context"
+	"path/filepath"
+	"strings"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/repository"
+)
+
+// The backends the backups are stored with.
+const (
+	backendBtrfs  = "btrfs"
+	backendChunks = "chunks"
+	backendDir    = "dir"
+)
+
+// storeCommands are supported by the chunk store and the plain directories, the rest need the image or its devices.
+var storeCommands = map[string]bool{"ls": true, "list": true, "lss": true, "list-sizes": true, "cr": true,
+	"create": true, "rs": true, "restore": true, "prune": true, "rm": true, "delete": true, "pin": true, "unpin": true,
+	"inspect": true, "fsck": true, "rebuild-meta": true, "metrics": true, "verify": true, "compact": true,
+	"export": true, "send": true, "import": true, "receive": true, "keygen": true, "daemon": true}
+
+// validateBackendArgs checks that the command and the options are supported by the backend.
+func validateBackendArgs(commandName string) error {
+	switch *backend {
+	case backendBtrfs:
+		if *storePath != "" {
+			return newUsageError("`--%s` is supported only with `--%s=%s` or `--%s=%s`", _const.StorePathArg,
+				_const.BackendArg, backendChunks, _const.BackendArg, backendDir)
+		}
+		return nil
+	case backendChunks, backendDir:
+	default:
+		return newUsageError("unknown backend `%s`, expected %s, %s or %s", *backend, backendBtrfs, backendChunks,
+			backendDir)
+	}
+
+	if !storeCommands[commandName] {
+		return newUsageError("`%s` is not supported with `--%s=%s`", commandName, _const.BackendArg, *backend)
+	}
+	if strings.TrimSpace(*storePath) == "" {
+		return newUsageError("you need to specify the store passing the following parameter: \"--%s=<path>\"",
+			_const.StorePathArg)
+	}
+	for _, name := range []string{_const.ReplicateArg, _const.CompressionAlgorithmArg} {
+		if isArgFlagPassed(name) {
+			return newUsageError("`--%s` is not supported with `--%s=%s`", name, _const.BackendArg, *backend)
+		}
+	}
+	return nil
+}
+
+// openRepository opens the chunk store or the plain directories with `--backend`, and mounts the image otherwise.
+func openRepository(ctx context.Context) (repository.Repository, error) {
+	if *backend == backendBtrfs {
+		image := newImage()
+		if err := image.Open(ctx); err != nil {
+			return nil, err
+		}
+		return image, nil
+	}
+
+	root, err := filepath.Abs(strings.TrimSpace(*storePath))
+	if err != nil {
+		return nil, err
+	}
+	var repo repository.Repository
+	dir := repository.Dir{Root: root}
+	if *backend == backendChunks {
+		// The chunks are compressed with DEFLATE, whose levels go up to 9
+		level := flate.DefaultCompression
+		if isArgFlagPassed(_const.CompressionLevelArg) {
+			level = int(*compressionLevel)
+			if level > flate.BestCompression {
+				level = flate.BestCompression
+			}
+		}
+		repo = &repository.Chunks{Dir: dir, Level: level}
+	} else {
+		repo = &dir
+	}
+	if err := repo.Open(ctx); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	cmd "ydb-backup-tool/internal/command"
+	"ydb-backup-tool/internal/device"
+	"ydb-backup-tool/internal/doctor"
+	"ydb-backup-tool/internal/hooks"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/utils"
+)
+
+// Exit codes of the tool, see the README
+const (
+	exitFailure           = 1
+	exitUsage             = 2
+	exitBackupNotFound    = 3
+	exitInsufficientSpace = 4
+	exitBinaryMissing     = 5
+	exitCommandFailed     = 6
+	exitHookFailed        = 7
+	exitMetaCorrupted     = 8
+	exitPreflightFailed   = 9
+	exitInconsistent      = 10
+	exitPartialFailure    = 11
+	exitInterrupted       = 130
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// usageError is returned when the tool is invoked with invalid arguments.
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+func newUsageError(format string, args ...any) error {
+	return &usageError{message: fmt.Sprintf(format, args...)}
+}
+
+func exitCode(err error) int {
+	var usageErr *usageError
+	var hookErr *hooks.HookError
+	var cmdErr *utils.CommandError
+
+	switch {
+	case errors.Is(err, errInterrupted):
+		return exitInterrupted
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.Is(err, cmd.ErrBackupNotFound):
+		return exitBackupNotFound
+	case errors.Is(err, device.ErrInsufficientSpace):
+		return exitInsufficientSpace
+	case errors.Is(err, utils.ErrBinaryMissing):
+		return exitBinaryMissing
+	case errors.As(err, &hookErr):
+		return exitHookFailed
+	case errors.Is(err, doctor.ErrChecksFailed):
+		return exitPreflightFailed
+	case errors.Is(err, cmd.ErrPartialFailure):
+		return exitPartialFailure
+	case errors.Is(err, cmd.ErrInconsistent):
+		return exitInconsistent
+	case errors.Is(err, meta.ErrCorrupted), errors.Is(err, cmd.ErrMetaOutOfDate):
+		return exitMetaCorrupted
+	case errors.As(err, &cmdErr):
+		return exitCommandFailed
+	default:
+		return exitFailure
+	}
+}
+
+// reportError prints the error as a single line. The verbose output adds the chain of causes, one per line,
+// together with the command line and stderr of the failed external command.
+func reportError(w io.Writer, err error, verbose bool) {
+	_, _ = fmt.Fprintf(w, "Error: %v\n", err)
+	if !verbose {
+		return
+	}
+
+	_, _ = fmt.Fprintln(w, "Caused by:")
+	writeCauses(w, err, "  ")
+}
+
+func writeCauses(w io.Writer, err error, indent string) {
+	for err != nil {
+		if cmdErr, ok := err.(*utils.CommandError); ok {
+			_, _ = fmt.Fprintf(w, "%s%s\n", indent, cmdErr.Error())
+			for _, line := range strings.Split(cmdErr.Details(), "\n") {
+				_, _ = fmt.Fprintf(w, "%s  %s\n", indent, line)
+			}
+			return
+		}
+
+		switch unwrapped := err.(type) {
+		case interface{ Unwrap() []error }:
+			// Errors joined with several %w are printed as a whole, followed by each of them
+			_, _ = fmt.Fprintf(w, "%s%s\n", indent, err.Error())
+			for _, cause := range unwrapped.Unwrap() {
+				writeCauses(w, cause, indent+"  ")
+			}
+			return
+		case interface{ Unwrap() error }:
+			cause := unwrapped.Unwrap()
+			if cause == nil {
+				_, _ = fmt.Fprintf(w, "%s%s\n", indent, err.Error())
+				return
+			}
+			// Only the message added on this level is printed, the cause goes to the next line
+			message := strings.TrimSuffix(err.Error(), ": "+cause.Error())
+			_, _ = fmt.Fprintf(w, "%s%s\n", indent, message)
+			err = cause
+		default:
+			_, _ = fmt.Fprintf(w, "%s%s\n", indent, err.Error())
+			return
+		}
+	}
+}
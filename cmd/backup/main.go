@@ -1,15 +1,29 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
+	"ydb-backup-tool/internal/api"
 	"ydb-backup-tool/internal/btrfs"
 	comp "ydb-backup-tool/internal/btrfs/compression"
 	dedup "ydb-backup-tool/internal/btrfs/deduplication/duperemove"
 	cmd "ydb-backup-tool/internal/command"
 	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/daemon"
 	"ydb-backup-tool/internal/device"
+	"ydb-backup-tool/internal/doctor"
+	"ydb-backup-tool/internal/hooks"
+	"ydb-backup-tool/internal/notify"
+	"ydb-backup-tool/internal/repository"
+	"ydb-backup-tool/internal/s3"
+	"ydb-backup-tool/internal/schedule"
 	"ydb-backup-tool/internal/utils"
 	"ydb-backup-tool/internal/ydb"
 )
@@ -30,9 +44,82 @@ var (
 	ydbRestorePath          *string
 	ydbRestoreData          *uint64
 	ydbRestoreIndexes       *uint64
+	pruneKeepLast           *uint64
+	pruneKeepWithin         *time.Duration
+	metricsTextfile         *string
+	metricsListen           *string
+	hookCommands            = map[hooks.Event]*string{}
+	hookTimeout             *time.Duration
+	notifyWebhook           *string
+	notifySmtpAddr          *string
+	notifySmtpFrom          *string
+	notifySmtpTo            *string
+	notifySmtpUser          *string
+	notifyCommand           *string
+	notifyOn                *string
+	daemonScheduleExprs     = map[string]*string{}
+	daemonSchedules         = map[string]*schedule.Schedule{}
+	daemonJitter            *time.Duration
+	daemonStatusListen      *string
+	apiListen               *string
+	apiTokenFile            *string
+	apiTLSCert              *string
+	apiTLSKey               *string
+	verbose                 *bool
+	skipPreflight           *bool
+	fsckRepair              *bool
+	fsckIncompleteAge       *time.Duration
+	assumeYes               *bool
+	deleteOrphans           *bool
+	backupName              *string
+	backupTags              = tagsFlag{}
+	backupNote              *string
+	backupPin               *bool
+	backupAt                *string
+	sourceName              *string
+	allowCrossDatabase      *bool
+	backupSource            *cmd.Source
+	sourcesFilePath         *string
+	parallelDumps           *int
+	sourceJobs              []*cmd.SourceJob
+	ydbDumpParallelism      *int
+	dumpDirect              *bool
+	imageGrowthStep         *string
+	imageMaxSize            *string
+	imageGrowthRemount      *bool
+	imageAllocation         *string
+	imageInitialSize        *string
+	btrfsDataProfile        *string
+	btrfsMetadataProfile    *string
+	btrfsNodeSize           *string
+	backingFileParams       *device.BackingFileParams
+	mkfsParams              *btrfs.MkfsParams
+	imageGrowth             device.GrowthPolicy
+	encrypt                 *bool
+	keyFile                 *string
+	newKeyFile              *string
+	output                  *string
+	recipients              = listFlag{}
+	passphrase              *bool
+	passphraseFile          *string
+	plaintext               *bool
+	identities              = listFlag{}
+	replicate               *bool
+	s3Endpoint              *string
+	s3Bucket                *string
+	s3Prefix                *string
+	s3Region                *string
+	s3PathStyle             *bool
+	s3PartSize              *string
+	remote                  *cmd.Remote
+	backend                 *string
+	storePath               *string
+	commandArgs             []string
 	compression             *comp.Compression
 )
 
+var daemonJobs = []string{"create", "prune", "verify", "compact"}
+
 func init() {
 	ydbEndpoint = flag.String(_const.YdbEndpointArg, "", "YDB endpoint.")
 	ydbName = flag.String(_const.YdbNameArg, "", "YDB database name.")
@@ -49,6 +136,75 @@ func init() {
 	ydbRestorePath = flag.String(_const.YdbRestorePath, ".", "Path to the database directory the data will be imported to. Default is the root directory.")
 	ydbRestoreData = flag.Uint64(_const.YdbRestoreData, 1, "Enables/disables data import, 1 (yes) or 0 (no), defaults to 1.")
 	ydbRestoreIndexes = flag.Uint64(_const.YdbRestoreIndexes, 1, "Enables/disables import of indexes, 1 (yes) or 0 (no), defaults to 1.")
+	pruneKeepLast = flag.Uint64(_const.PruneKeepLastArg, 0, "Number of the newest backups to keep on prune.")
+	pruneKeepWithin = flag.Duration(_const.PruneKeepWithinArg, 0, "Keep backups created within the given duration on prune, e.g. 168h.")
+	metricsTextfile = flag.String(_const.MetricsTextfileArg, "", "Path to the file for the node_exporter textfile collector.")
+	metricsListen = flag.String(_const.MetricsListenArg, "", "Address to serve Prometheus metrics on, e.g. :9469.")
+	for _, event := range hooks.Events {
+		hookCommands[event] = flag.String(_const.HookArgPrefix+string(event), "",
+			fmt.Sprintf("Executable or shell command to run on `%s`.", event))
+	}
+	hookTimeout = flag.Duration(_const.HookTimeoutArg, hooks.DefaultTimeout, "Timeout of a single hook.")
+	notifyWebhook = flag.String(_const.NotifyWebhookArg, "", "URL to post the JSON summary of the run to.")
+	notifySmtpAddr = flag.String(_const.NotifySmtpAddrArg, "", "SMTP server (host:port) to send the summary of the run with.")
+	notifySmtpFrom = flag.String(_const.NotifySmtpFromArg, "", "Sender of the email notifications.")
+	notifySmtpTo = flag.String(_const.NotifySmtpToArg, "", "Comma-separated recipients of the email notifications.")
+	notifySmtpUser = flag.String(_const.NotifySmtpUserArg, "", "SMTP user. The password is read from "+_const.SmtpPasswordEnv+".")
+	notifyCommand = flag.String(_const.NotifyCommandArg, "", "Shell command which receives the JSON summary of the run on stdin.")
+	notifyOn = flag.String(_const.NotifyOnArg, "always", "When to send notifications: always or failure. Default is always.")
+	for _, name := range daemonJobs {
+		daemonScheduleExprs[name] = flag.String(_const.ScheduleArgPrefix+name, "",
+			fmt.Sprintf("Cron expression to run `%s` in the daemon mode.", name))
+	}
+	daemonJitter = flag.Duration(_const.JitterArg, 0, "Random delay added to each scheduled job in the daemon mode.")
+	daemonStatusListen = flag.String(_const.StatusListenArg, "", "Address to serve the daemon status on, e.g. :9470.")
+	apiListen = flag.String(_const.ApiListenArg, "", "Address to serve the control API on in the daemon mode, e.g. :9471.")
+	apiTokenFile = flag.String(_const.ApiTokenFileArg, "", "File with the bearer token of the control API.")
+	apiTLSCert = flag.String(_const.ApiTLSCertArg, "", "TLS certificate file of the control API.")
+	apiTLSKey = flag.String(_const.ApiTLSKeyArg, "", "TLS key file of the control API.")
+	skipPreflight = flag.Bool(_const.SkipPreflightArg, false, "Do not run the checks of `doctor` before `create`.")
+	fsckRepair = flag.Bool(_const.FsckRepairArg, false, "Repair the problems found by `fsck`.")
+	fsckIncompleteAge = flag.Duration(_const.FsckIncompleteAgeArg, 24*time.Hour, "Age after which `fsck` considers a backup which is not completed abandoned.")
+	assumeYes = flag.Bool(_const.AssumeYesArg, false, "Answer yes to the questions, e.g. to adopt orphaned subvolumes on `fsck --repair`.")
+	deleteOrphans = flag.Bool(_const.DeleteOrphansArg, false, "Delete the subvolumes which are not completed backups before each command.")
+	backupName = flag.String(_const.BackupNameArg, "", "Name of the new backup, e.g. pre-migration-v42.")
+	flag.Var(backupTags, _const.BackupTagArg, "Tag key=value of the new backup, or the tag to select the backups by. Repeatable.")
+	backupNote = flag.String(_const.BackupNoteArg, "", "Free-form note of the new backup.")
+	backupPin = flag.Bool(_const.BackupPinArg, false, "Pin the new backup, so that it is never deleted by `prune`.")
+	backupAt = flag.String(_const.BackupAtArg, "", "Select the newest backup created at or before the time, e.g. 2024-05-01T03:00.")
+	sourceName = flag.String(_const.SourceArg, "", "Name of the source the backups of the database are kept under. Default is derived from the endpoint and the database name.")
+	allowCrossDatabase = flag.Bool(_const.AllowCrossDatabaseArg, false, "Allow to restore a backup into a database other than the one it is taken from.")
+	sourcesFilePath = flag.String(_const.SourcesFileArg, "", "JSON file with the sources to back up by a single `create`.")
+	parallelDumps = flag.Int(_const.ParallelDumpsArg, 2, "Number of the sources of `--sources-file` dumped at once.")
+	ydbDumpParallelism = flag.Int(_const.YdbDumpParallelismArg, 1, "Number of the top-level directories and tables of `--ydb-dump-path` dumped at once. Above 1, the consistency of the whole database is not preserved.")
+	imageGrowthStep = flag.String(_const.ImageGrowthStepArg, "1G", "Granularity of the growth of the image, e.g. 512M or 4G.")
+	imageMaxSize = flag.String(_const.ImageMaxSizeArg, "", "Maximum size of the image file, e.g. 500G. Unlimited by default.")
+	imageGrowthRemount = flag.Bool(_const.ImageGrowthRemountArg, false, "Extend the image by remounting it instead of resizing it while it is mounted.")
+	imageAllocation = flag.String(_const.ImageAllocationArg, string(device.AllocationPreallocated), "Allocation of the image file on the host: sparse, preallocated or fixed.")
+	imageInitialSize = flag.String(_const.ImageInitialSizeArg, "256M", "Size of the image file created on the first run.")
+	btrfsDataProfile = flag.String(_const.BtrfsDataProfileArg, "", "Data profile of the btrfs created on the first run, e.g. single or dup.")
+	btrfsMetadataProfile = flag.String(_const.BtrfsMetadataProfileArg, "", "Metadata profile of the btrfs created on the first run, e.g. single or dup.")
+	btrfsNodeSize = flag.String(_const.BtrfsNodeSizeArg, "", "Node size of the btrfs created on the first run, e.g. 16K.")
+	encrypt = flag.Bool(_const.EncryptArg, false, "Create the encrypted image with `init`.")
+	keyFile = flag.String(_const.KeyFileArg, "", "File with the key of the encrypted image. The key may also be passed in "+_const.KeyEnv+" or typed in the terminal.")
+	newKeyFile = flag.String(_const.NewKeyFileArg, "", "File with the new key for `rotate-key`. The key may also be passed in "+_const.NewKeyEnv+" or typed in the terminal.")
+	output = flag.String(_const.OutputArg, "", "Archive file `export` writes the backup to, `-` for stdout.")
+	flag.Var(&recipients, _const.RecipientArg, "Public key, or the file with the public keys, the exported archive is encrypted for. Repeatable.")
+	passphrase = flag.Bool(_const.PassphraseArg, false, "Encrypt the exported archive with a passphrase as well. The passphrase may also be passed in "+_const.PassphraseEnv+".")
+	passphraseFile = flag.String(_const.PassphraseFileArg, "", "File with the passphrase of the archive for `export` and `import`.")
+	plaintext = flag.Bool(_const.PlaintextArg, false, "Export the archive unencrypted.")
+	flag.Var(&identities, _const.IdentityArg, "File with the private keys `import` decrypts the archive with, or the file `keygen` creates. Repeatable.")
+	replicate = flag.Bool(_const.ReplicateArg, false, "Push the backups created by `create` to the bucket.")
+	s3Endpoint = flag.String(_const.S3EndpointArg, "", "URL of the S3-compatible storage the backups are replicated to.")
+	s3Bucket = flag.String(_const.S3BucketArg, "", "Bucket the backups are replicated to.")
+	s3Prefix = flag.String(_const.S3PrefixArg, "", "Prefix of the keys of the replicated backups in the bucket.")
+	s3Region = flag.String(_const.S3RegionArg, s3.DefaultRegion, "Region of the bucket.")
+	s3PathStyle = flag.Bool(_const.S3PathStyleArg, true, "Address the bucket in the path instead of the host name, as MinIO requires.")
+	s3PartSize = flag.String(_const.S3PartSizeArg, "64M", "Size of the parts of the multipart upload, at least 5M.")
+	backend = flag.String(_const.BackendArg, backendBtrfs, "Storage of the backups: btrfs, the image with deduplication, chunks, the content-addressed store which needs no root, or dir, the plain directories which need no root either.")
+	storePath = flag.String(_const.StorePathArg, "", "Directory of the chunk store with `--backend=chunks`, or of the plain directories with `--backend=dir`.")
+	dumpDirect = flag.Bool(_const.DumpDirectArg, false, "Dump the database straight into the subvolume of the backup instead of a temporary directory.")
+	verbose = flag.Bool(_const.VerboseArg, false, "Print the chain of causes of an error.")
 
 	flag.Bool(_const.YdbUseMetadataCredsArg, false, "YDB use the metadata service.")
 	flag.Bool(_const.YdbDumpSchemeOnly, false, "Dump only the details about the database schema objects, without dumping their data.")
@@ -67,30 +223,111 @@ func isArgFlagPassed(name string) bool {
 	return found
 }
 
-func parseAndValidateArgs() *cmd.Command {
+// tagsFlag collects the repeatable `--tag key=value` option.
+type tagsFlag map[string]string
+
+func (tags tagsFlag) String() string {
+	parts := make([]string, 0, len(tags))
+	for key, value := range tags {
+		parts = append(parts, key+"="+value)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (tags tagsFlag) Set(value string) error {
+	key, tagValue, found := strings.Cut(value, "=")
+	key = strings.TrimSpace(key)
+	if !found || key == "" {
+		return fmt.Errorf("tag `%s` must be in the key=value form", value)
+	}
+	tags[key] = strings.TrimSpace(tagValue)
+	return nil
+}
+
+func parseAndValidateArgs() (*cmd.Command, error) {
 	flag.Parse()
 
-	if strings.TrimSpace(*ydbEndpoint) == "" {
-		log.Panic("You need to specify YDB url passing the following parameter: \"--ydb-endpoint=<url>\"")
+	if len(flag.Args()) == 0 {
+		return nil, newUsageError("you need to pass a command")
+	}
+
+	// The options may also follow the command, e.g. `fsck --repair`
+	commandName := strings.TrimSpace(flag.Arg(0))
+	if err := flag.CommandLine.Parse(flag.Args()[1:]); err != nil {
+		return nil, newUsageError("%v", err)
 	}
-	if strings.TrimSpace(*ydbName) == "" {
-		log.Panic("You need to specify YDB database name passing the following parameter: \"--ydb-name=<name>\"")
+	commandArgs = flag.Args()
+	// The parsing stops at the first argument of the command, so the options after it would be ignored otherwise
+	for _, arg := range commandArgs {
+		if strings.HasPrefix(arg, "-") && arg != "-" {
+			return nil, newUsageError("the option `%s` must precede the arguments of `%s`", arg, commandName)
+		}
+	}
+	if *backupAt != "" && len(commandArgs) > 0 {
+		return nil, newUsageError("`--%s` cannot be combined with the backup `%s`", _const.BackupAtArg, commandArgs[0])
+	}
+
+	if *encrypt && commandName != "init" {
+		return nil, newUsageError("`--%s` is supported only by `init`", _const.EncryptArg)
+	}
+	if err := initImageParams(); err != nil {
+		return nil, err
+	}
+	if err := validateArchiveArgs(commandName); err != nil {
+		return nil, err
+	}
+	if err := validateRemoteArgs(commandName); err != nil {
+		return nil, err
+	}
+	if err := validateBackendArgs(commandName); err != nil {
+		return nil, err
+	}
+
+	if *ydbDumpParallelism < 1 {
+		return nil, newUsageError("`--%s` must be at least 1", _const.YdbDumpParallelismArg)
+	}
+	if *sourcesFilePath != "" {
+		if commandName != "cr" && commandName != "create" && commandName != "daemon" {
+			return nil, newUsageError("`--%s` is supported only by `create` and `daemon`", _const.SourcesFileArg)
+		}
+		if isArgFlagPassed(_const.SourceArg) {
+			return nil, newUsageError("`--%s` cannot be combined with `--%s`, set the names in the file",
+				_const.SourceArg, _const.SourcesFileArg)
+		}
+		if *parallelDumps < 1 {
+			return nil, newUsageError("`--%s` must be at least 1", _const.ParallelDumpsArg)
+		}
+		jobs, err := loadSourceJobs(*sourcesFilePath)
+		if err != nil {
+			return nil, err
+		}
+		sourceJobs = jobs
+	} else if commandName != "init" && commandName != "rotate-key" && commandName != "import" &&
+		commandName != "receive" && commandName != "keygen" && commandName != "pull" && commandName != "list-remote" {
+		if strings.TrimSpace(*ydbEndpoint) == "" {
+			return nil, newUsageError("you need to specify YDB url passing the following parameter: \"--ydb-endpoint=<url>\"")
+		}
+		if strings.TrimSpace(*ydbName) == "" {
+			return nil, newUsageError("you need to specify YDB database name passing the following parameter: \"--ydb-name=<name>\"")
+		}
+		source, err := cmd.NewSource(*sourceName, *ydbEndpoint, *ydbName)
+		if err != nil {
+			return nil, newUsageError("%v", err)
+		}
+		backupSource = source
 	}
 	if strings.TrimSpace(*compressionAlgorithm) != "" {
 		compressionAlgorithm := strings.ToLower(strings.TrimSpace(*compressionAlgorithm))
 		compressionObj, err := comp.CreateCompression(comp.Algorithm(compressionAlgorithm), *compressionLevel)
 		if err != nil {
-			log.Panicf("Failed to parse compression parameters: %s", err)
+			return nil, newUsageError("failed to parse compression parameters: %s", err)
 		}
 
 		compression = &compressionObj
 	}
-	if len(flag.Args()) == 0 {
-		log.Panic("You need to pass a command")
-	}
 
 	var command cmd.Command
-	switch strings.TrimSpace(flag.Arg(0)) {
+	switch commandName {
 	case "lss", "list-sizes":
 		command = cmd.ListAllBackupsSizes
 	case "ls", "list":
@@ -101,89 +338,170 @@ func parseAndValidateArgs() *cmd.Command {
 		break
 	case "rs", "restore":
 		command = cmd.RestoreFromBackup
+		if !isReferencePassed() {
+			return nil, newUsageError("you should specify backup: restore <reference>, restore --at <time> or restore --tag <key=value>")
+		}
 		break
+	case "prune":
+		command = cmd.PruneBackups
+	case "metrics":
+		command = cmd.ExportMetrics
+	case "verify":
+		command = cmd.VerifyBackups
+	case "compact":
+		command = cmd.CompactBackups
+	case "rm", "delete":
+		command = cmd.DeleteBackup
+		if len(commandArgs) == 0 && *backupAt == "" {
+			return nil, newUsageError("you should specify backup: delete <reference> or delete --at <time>")
+		}
+	case "doctor":
+		command = cmd.CheckEnvironment
+	case "fsck":
+		command = cmd.CheckConsistency
+	case "rebuild-meta":
+		command = cmd.RebuildMeta
+	case "pin", "unpin":
+		command = cmd.PinBackup
+		if !isReferencePassed() {
+			return nil, newUsageError("you should specify backup: %s <reference>", commandName)
+		}
+		*backupPin = commandName == "pin"
+	case "inspect":
+		command = cmd.InspectBackup
+		if !isReferencePassed() {
+			return nil, newUsageError("you should specify backup: inspect <reference>")
+		}
+	case "init":
+		command = cmd.InitRepository
+	case "rotate-key":
+		command = cmd.RotateKey
+	case "export", "send":
+		command = cmd.ExportBackup
+	case "import", "receive":
+		command = cmd.ImportBackup
+	case "keygen":
+		command = cmd.GenerateIdentity
+	case "push":
+		command = cmd.PushBackup
+	case "pull":
+		command = cmd.PullBackup
+	case "list-remote":
+		command = cmd.ListRemoteBackups
+	case "daemon":
+		command = cmd.RunDaemon
+		if err := parseDaemonSchedules(); err != nil {
+			return nil, err
+		}
 	default:
-		log.Panicf("Could not parse command")
+		return nil, newUsageError("unknown command `%s`", commandName)
 	}
 
-	return &command
+	return &command, nil
 }
 
-func main() {
-	command := parseAndValidateArgs()
+func parseDaemonSchedules() error {
+	for _, name := range daemonJobs {
+		expr := strings.TrimSpace(*daemonScheduleExprs[name])
+		if expr == "" {
+			continue
+		}
+		sched, err := schedule.Parse(expr)
+		if err != nil {
+			return newUsageError("failed to parse schedule of the `%s` job: %v", name, err)
+		}
+		daemonSchedules[name] = sched
+	}
+	if len(daemonSchedules) == 0 && *apiListen == "" {
+		return newUsageError("you need to schedule at least one job passing \"--schedule-<job>=<cron expression>\" " +
+			"or to enable the API passing \"--api-listen=<address>\"")
+	}
+	if *apiListen != "" && *apiTokenFile == "" {
+		return newUsageError("you need to specify the API token passing the following parameter: \"--api-token-file=<path>\"")
+	}
+	return nil
+}
 
-	// TODO: add "--help" option
+func main() {
+	if err := run(); err != nil {
+		reportError(os.Stderr, err, *verbose)
+		os.Exit(exitCode(err))
+	}
+}
 
-	backingFilePath := _const.AppBaseDataBackingFilePath
-	// Verify img file exists or create it in case of absence
-	backingFile, created, err := device.GetOrCreateBackingStoreFile(backingFilePath)
+// run returns instead of exiting, so that the deferred cleanups are always run.
+func run() error {
+	command, err := parseAndValidateArgs()
 	if err != nil {
-		log.Panicf("Cannot obtain backing file")
+		return err
 	}
-	if created {
-		if err := btrfs.MakeBtrfsFileSystem(backingFile.Path); err != nil {
-			log.Panicf("Failed to make Btrfs")
+
+	// TODO: add "--help" option
+
+	// The commands are cancelled on SIGINT/SIGTERM, so that the deferred cleanups below are always run
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := runCommand(ctx, command); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: %w", errInterrupted, err)
 		}
+		return err
 	}
+	return nil
+}
 
-	loopDev, err := device.SetupLoopDevice(backingFile)
-	if err != nil {
-		log.Panicf("Cannot create loop device. %v", err)
+func runCommand(ctx context.Context, command *cmd.Command) error {
+	switch *command {
+	case cmd.CheckEnvironment:
+		return runDoctor(ctx, command)
+	case cmd.InitRepository:
+		return runInit(ctx)
+	case cmd.RotateKey:
+		return runRotateKey(ctx)
+	case cmd.GenerateIdentity:
+		return runKeygen()
 	}
-	defer func(loopDevice *device.LoopDevice) {
-		err := device.DetachLoopDevice(loopDevice)
-		if err != nil {
-			log.Warnf("cannot detach the loop device.")
-		}
-	}(loopDev)
 
-	mountPoint, err := device.MountLoopDevice(loopDev, _const.AppDataMountPath, compression)
+	startedAt := time.Now()
+	repo, err := openRepository(ctx)
 	if err != nil {
-		log.Panicf("Cannot mount the backing file. %v", err)
-	}
-	defer func(mountPoint *device.MountPoint) {
-		err := device.Unmount(mountPoint)
-		if err != nil {
-			log.Warnf("cannot unmount the backing file.")
+		if operation, ok := notifiedOperations[*command]; ok {
+			notifyFailure(ctx, operation, startedAt, err)
 		}
-	}(mountPoint)
+		return err
+	}
+	defer repo.Close()
 
-	if err := utils.ClearTempDirectory(_const.AppTmpPath); err != nil {
-		log.Warnf("cannot clean temp directory %s", _const.AppTmpPath)
+	if err := utils.ClearTempDirectory(repo.TempPath()); err != nil {
+		log.WithContext(ctx).Warnf("cannot clean temp directory %s", repo.TempPath())
 	}
 
+	err = runRepositoryCommand(ctx, command, repo)
+	finishRun(ctx, repo, *command, err)
+	return err
+}
+
+// runRepositoryCommand runs the commands which work with the opened repository.
+func runRepositoryCommand(ctx context.Context, command *cmd.Command, repo repository.Repository) error {
 	switch *command {
 	case cmd.ListAllBackups:
-		err := command.ListBackups(mountPoint)
+		err := command.ListBackups(ctx, repo, *deleteOrphans, initSelector())
 		if err != nil {
-			log.Panicf("Cannot list backups: %v", err)
+			return fmt.Errorf("cannot list backups: %w", err)
 		}
 		break
 	case cmd.ListAllBackupsSizes:
-		err := command.ListBackupsSizes(mountPoint)
+		err := command.ListBackupsSizes(ctx, repo, *deleteOrphans, initSelector())
 		if err != nil {
-			log.Panicf("Cannot list backup sizes: %v", err)
+			return fmt.Errorf("cannot list backup sizes: %w", err)
 		}
 	case cmd.CreateIncrementalBackup:
-		ydbParams := initYdbParams()
-		dedupParams := &dedup.Params{BlockSize: *dedupBlockSize}
-		ydbDumpParams := &ydb.DumpParams{
-			Path:             *ydbDumpPath,
-			Exclude:          *ydbDumpExclude,
-			ConsistencyLevel: *ydbDumpConsistencyLevel,
-			AvoidCopy:        isArgFlagPassed(_const.YdbDumpAvoidCopy),
-			SchemeOnly:       isArgFlagPassed(_const.YdbDumpSchemeOnly),
-		}
-		if err := command.CreateIncrementalBackup(mountPoint, ydbParams, ydbDumpParams, compression, dedupParams); err != nil {
-			log.Panicf("Cannot perform incremental backup: %v", err)
+		if err := runCreate(ctx, repo); err != nil {
+			return fmt.Errorf("cannot perform incremental backup: %w", err)
 		}
 		break
 	case cmd.RestoreFromBackup:
-		if len(flag.Args()) <= 1 {
-			log.Panic("You should specify backup name: restore <name>")
-		}
-
-		sourcePath := flag.Arg(1)
 		ydbParams := initYdbParams()
 		restoreParams := &ydb.RestoreParams{
 			Path:    *ydbRestorePath,
@@ -191,10 +509,456 @@ func main() {
 			Indexes: *ydbRestoreIndexes,
 			DryRun:  isArgFlagPassed(_const.YdbRestoreDryRun),
 		}
-		if err := command.RestoreFromBackup(mountPoint, ydbParams, restoreParams, sourcePath); err != nil {
-			log.Panicf("Cannot restore from the backup: %v", err)
+		if err := command.RestoreFromBackup(ctx, repo, *deleteOrphans, ydbParams, restoreParams, commandReference(),
+			initReferenceSelector(), initRestoreTarget(), initHooks(), initNotifier()); err != nil {
+			return fmt.Errorf("cannot restore from the backup: %w", err)
 		}
 		break
+	case cmd.PruneBackups:
+		if err := runPrune(ctx, repo); err != nil {
+			return fmt.Errorf("cannot prune backups: %w", err)
+		}
+	case cmd.ExportMetrics:
+		if err := command.ExportMetrics(ctx, repo, *metricsTextfile, *metricsListen); err != nil {
+			return fmt.Errorf("cannot export metrics: %w", err)
+		}
+	case cmd.VerifyBackups:
+		if err := runVerify(ctx, repo); err != nil {
+			return fmt.Errorf("cannot verify backups: %w", err)
+		}
+	case cmd.CompactBackups:
+		if err := runCompact(ctx, repo); err != nil {
+			return fmt.Errorf("cannot compact backups: %w", err)
+		}
+	case cmd.DeleteBackup:
+		if err := command.DeleteBackup(ctx, repo, commandReference(), initReferenceSelector()); err != nil {
+			return fmt.Errorf("cannot delete the backup: %w", err)
+		}
+	case cmd.CheckConsistency:
+		fsckParams := &cmd.FsckParams{
+			Repair:        *fsckRepair,
+			IncompleteAge: *fsckIncompleteAge,
+			AssumeYes:     *assumeYes,
+			Input:         os.Stdin,
+		}
+		if err := command.Fsck(ctx, repo, fsckParams); err != nil {
+			return fmt.Errorf("fsck failed: %w", err)
+		}
+	case cmd.PinBackup:
+		if err := command.PinBackup(ctx, repo, commandReference(), initReferenceSelector(), *backupPin); err != nil {
+			return fmt.Errorf("cannot update the pin of the backup: %w", err)
+		}
+	case cmd.InspectBackup:
+		if err := command.InspectBackup(ctx, repo, commandReference(), initReferenceSelector()); err != nil {
+			return fmt.Errorf("cannot inspect the backup: %w", err)
+		}
+	case cmd.ExportBackup:
+		if err := runExport(ctx, command, repo); err != nil {
+			return fmt.Errorf("cannot export the backup: %w", err)
+		}
+	case cmd.ImportBackup:
+		if err := runImport(ctx, command, repo); err != nil {
+			return fmt.Errorf("cannot import the backup: %w", err)
+		}
+	case cmd.ListRemoteBackups:
+		if err := command.ListRemoteBackups(ctx, repo, remote); err != nil {
+			return fmt.Errorf("cannot list the replicated backups: %w", err)
+		}
+	case cmd.PushBackup:
+		if err := runPush(ctx, command, repo); err != nil {
+			return fmt.Errorf("cannot push the backup: %w", err)
+		}
+	case cmd.PullBackup:
+		if err := runPull(ctx, command, repo); err != nil {
+			return fmt.Errorf("cannot pull the backup: %w", err)
+		}
+	case cmd.RebuildMeta:
+		if err := command.RebuildMeta(ctx, repo); err != nil {
+			return fmt.Errorf("cannot rebuild the meta file: %w", err)
+		}
+	case cmd.RunDaemon:
+		if err := runDaemon(ctx, repo); err != nil {
+			return fmt.Errorf("daemon failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// initImageParams sets how the image is created on the first run and how it grows.
+func initImageParams() error {
+	growthStep, err := utils.ParseSize(*imageGrowthStep)
+	if err != nil || growthStep == 0 {
+		return newUsageError("`--%s` must be a positive size, e.g. 1G", _const.ImageGrowthStepArg)
+	}
+	allocation, err := device.ParseAllocation(*imageAllocation)
+	if err != nil {
+		return newUsageError("`--%s`: %v", _const.ImageAllocationArg, err)
+	}
+	imageGrowth = device.GrowthPolicy{Step: growthStep, Remount: *imageGrowthRemount, Allocation: allocation}
+	if *imageMaxSize != "" {
+		if imageGrowth.MaxSize, err = utils.ParseSize(*imageMaxSize); err != nil {
+			return newUsageError("`--%s`: %v", _const.ImageMaxSizeArg, err)
+		}
+	}
+
+	initialSize, err := utils.ParseSize(*imageInitialSize)
+	if err != nil || initialSize == 0 {
+		return newUsageError("`--%s` must be a positive size, e.g. 256M", _const.ImageInitialSizeArg)
+	}
+	if allocation == device.AllocationFixed {
+		// The fixed image is created at its final size
+		if imageGrowth.MaxSize == 0 {
+			return newUsageError("`--%s=%s` needs `--%s`", _const.ImageAllocationArg, allocation,
+				_const.ImageMaxSizeArg)
+		}
+		initialSize = imageGrowth.MaxSize
+	}
+	if imageGrowth.MaxSize > 0 && initialSize > imageGrowth.MaxSize {
+		return newUsageError("`--%s` exceeds `--%s`", _const.ImageInitialSizeArg, _const.ImageMaxSizeArg)
+	}
+	backingFileParams = &device.BackingFileParams{Size: initialSize, Allocation: allocation}
+
+	mkfsParams = &btrfs.MkfsParams{DataProfile: *btrfsDataProfile, MetadataProfile: *btrfsMetadataProfile}
+	if *btrfsNodeSize != "" {
+		if mkfsParams.NodeSize, err = utils.ParseSize(*btrfsNodeSize); err != nil {
+			return newUsageError("`--%s`: %v", _const.BtrfsNodeSizeArg, err)
+		}
+	}
+	return nil
+}
+
+// newImage returns the repository of the btrfs image, as it is configured by the command line.
+func newImage() *repository.Btrfs {
+	return &repository.Btrfs{
+		ImageParams: backingFileParams,
+		MkfsParams:  mkfsParams,
+		Compression: compression,
+		Growth:      imageGrowth,
+		Encrypt:     *encrypt,
+		Key:         keySource(),
+	}
+}
+
+func initDoctorOptions(mountPoint *device.MountPoint) *doctor.Options {
+	return &doctor.Options{MountPoint: mountPoint, InitialImageSize: backingFileParams.Size}
+}
+
+// runDoctor checks the image only if it already exists, so that `doctor` never creates it.
+func runDoctor(ctx context.Context, command *cmd.Command) error {
+	var mountPoint *device.MountPoint
+	if _, err := os.Stat(_const.AppBaseDataBackingFilePath); err == nil {
+		image := newImage()
+		if err := image.Open(ctx); err != nil {
+			log.WithContext(ctx).Warnf("The image is not checked: %v", err)
+		} else {
+			defer image.Close()
+			mountPoint = image.MountPoint()
+		}
+	}
+
+	if err := command.Doctor(ctx, initDoctorOptions(mountPoint)); err != nil {
+		return fmt.Errorf("doctor found problems: %w", err)
+	}
+	return nil
+}
+
+func runCreate(ctx context.Context, repo repository.Repository) error {
+	_, err := createBackup(ctx, repo, initLabels())
+	return err
+}
+
+// runScheduledCreate creates the backups in the daemon mode. The name and pinning are not applied to them,
+// since the name must be unique and the pinned backups would pile up.
+func runScheduledCreate(ctx context.Context, repo repository.Repository) error {
+	_, err := createBackup(ctx, repo, initScheduledLabels())
+	return err
+}
+
+func createBackup(ctx context.Context, repo repository.Repository, labels *cmd.BackupLabels) (string, error) {
+	command := cmd.CreateIncrementalBackup
+	dedupParams := &dedup.Params{BlockSize: *dedupBlockSize}
+	var path string
+	var created []string
+	var err error
+	// The checks of `doctor` are about the image and the tools it needs
+	if image, ok := repo.(*repository.Btrfs); ok && !*skipPreflight {
+		startedAt := time.Now()
+		if err = cmd.Preflight(ctx, initDoctorOptions(image.MountPoint())); err != nil {
+			notifyFailure(ctx, notifiedOperations[cmd.CreateIncrementalBackup], startedAt, err)
+		}
+	}
+	if err == nil && len(sourceJobs) > 0 {
+		var results []*cmd.SourceResult
+		results, err = command.CreateMultiSourceBackup(ctx, repo, *deleteOrphans, sourceJobs, *parallelDumps, compression,
+			dedupParams, labels, initHooks(), initNotifier())
+		path = formatSourceResults(results)
+		for _, result := range results {
+			if result.Err == nil {
+				created = append(created, result.Path)
+			}
+		}
+	} else if err == nil {
+		path, err = command.CreateIncrementalBackup(ctx, repo, *deleteOrphans, initYdbParams(), initYdbDumpParams(),
+			compression, dedupParams, backupSource, labels, initHooks(), initNotifier())
+		if err == nil {
+			created = append(created, path)
+		}
+	}
+	// The backups of the sources which succeeded are replicated even if the other sources failed
+	if *replicate && len(created) > 0 && ctx.Err() == nil {
+		if replicateErr := replicateBackups(ctx, repo, created); replicateErr != nil && err == nil {
+			err = replicateErr
+		} else if replicateErr != nil {
+			log.WithContext(ctx).Errorf("%v", replicateErr)
+		}
+	}
+	return path, err
+}
+
+func runPrune(ctx context.Context, repo repository.Repository) error {
+	command := cmd.PruneBackups
+	pruneParams := &cmd.PruneParams{KeepLast: *pruneKeepLast, KeepWithin: *pruneKeepWithin, Selector: initSelector()}
+	return command.PruneBackups(ctx, repo, *deleteOrphans, pruneParams, initNotifier())
+}
+
+func runVerify(ctx context.Context, repo repository.Repository) error {
+	command := cmd.VerifyBackups
+	return command.VerifyBackups(ctx, repo)
+}
+
+func runCompact(ctx context.Context, repo repository.Repository) error {
+	command := cmd.CompactBackups
+	return command.CompactBackups(ctx, repo, *deleteOrphans, &dedup.Params{BlockSize: *dedupBlockSize})
+}
+
+// runDaemon keeps the image mounted and runs the scheduled jobs until SIGINT or SIGTERM. The running job is
+// allowed to finish, unless the signal is sent once again.
+func runDaemon(ctx context.Context, repo repository.Repository) error {
+	jobsCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+	go func() {
+		<-ctx.Done()
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+
+		select {
+		case <-signals:
+			log.Warnf("Cancelling the running job")
+			cancelJobs()
+		case <-jobsCtx.Done():
+		}
+	}()
+
+	jobRunners := map[string]func(context.Context, repository.Repository) error{
+		"create":  runScheduledCreate,
+		"prune":   runPrune,
+		"verify":  runVerify,
+		"compact": runCompact,
+	}
+	jobCommands := map[string]cmd.Command{
+		"create":  cmd.CreateIncrementalBackup,
+		"prune":   cmd.PruneBackups,
+		"verify":  cmd.VerifyBackups,
+		"compact": cmd.CompactBackups,
+	}
+
+	d := &daemon.Daemon{Jitter: *daemonJitter, StatusAddr: *daemonStatusListen}
+	for _, name := range daemonJobs {
+		if sched, ok := daemonSchedules[name]; ok {
+			run, command := jobRunners[name], jobCommands[name]
+			d.Jobs = append(d.Jobs, &daemon.Job{Name: name, Schedule: sched, Run: func() error {
+				err := run(jobsCtx, repo)
+				finishRun(jobsCtx, repo, command, err)
+				return err
+			}})
+		}
+	}
+
+	if *apiListen == "" {
+		return d.Run(ctx)
+	}
+
+	token, err := os.ReadFile(*apiTokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read API token from `%s`: %w", *apiTokenFile, err)
+	}
+	server := &api.Server{
+		Addr:         *apiListen,
+		Token:        strings.TrimSpace(string(token)),
+		TLSCertFile:  *apiTLSCert,
+		TLSKeyFile:   *apiTLSKey,
+		Executor:     &apiExecutor{repo: repo},
+		RunExclusive: d.RunExclusive,
+		JobsCtx:      jobsCtx,
+	}
+
+	// Stop both of them when one fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	apiErr := make(chan error, 1)
+	go func() {
+		err := server.Run(ctx)
+		cancel()
+		apiErr <- err
+	}()
+
+	daemonErr := d.Run(ctx)
+	cancel()
+	if err := <-apiErr; err != nil {
+		return err
+	}
+	return daemonErr
+}
+
+// metricsCommands write the metrics textfile after their runs, so that the textfile collector sees the outcome.
+var metricsCommands = map[cmd.Command]bool{
+	cmd.CreateIncrementalBackup: true,
+	cmd.PruneBackups:            true,
+}
+
+// finishRun counts the failed run of a command or a job for the `failed_runs` metric, and then writes the metrics
+// textfile after the commands which update it.
+func finishRun(ctx context.Context, repo repository.Repository, command cmd.Command, err error) {
+	if err != nil {
+		if err := repo.Meta().RecordFailedRun(); err != nil {
+			log.WithContext(ctx).Warnf("cannot record the failed run: %v", err)
+		}
+	}
+	if metricsCommands[command] {
+		writeMetricsTextfile(ctx, repo)
+	}
+}
+
+func writeMetricsTextfile(ctx context.Context, repo repository.Repository) {
+	if *metricsTextfile == "" {
+		return
+	}
+	if err := cmd.WriteMetricsTextfile(ctx, repo, *metricsTextfile); err != nil {
+		log.WithContext(ctx).Warnf("cannot write metrics to `%s`: %v", *metricsTextfile, err)
+	}
+}
+
+// commandReference returns the backup passed to the command, e.g. `restore latest~2` or `restore --at <time>`.
+func commandReference() string {
+	if *backupAt != "" {
+		return "@" + *backupAt
+	}
+	if len(commandArgs) == 0 {
+		return ""
+	}
+	return commandArgs[0]
+}
+
+func isReferencePassed() bool {
+	return len(commandArgs) > 0 || *backupAt != "" || len(backupTags) > 0
+}
+
+// initSelector selects the backups of all the sources, unless `--source` is passed.
+func initSelector() *cmd.Selector {
+	selector := &cmd.Selector{Tags: backupTags, Latest: commandReference() == cmd.LatestReference}
+	if isArgFlagPassed(_const.SourceArg) {
+		selector.Source = backupSource.Name
+	}
+	return selector
+}
+
+// initReferenceSelector resolves the symbolic references, e.g. `latest`, among the backups of the current source.
+// There is no current source with `--sources-file`.
+func initReferenceSelector() *cmd.Selector {
+	selector := initSelector()
+	if backupSource != nil {
+		selector.Source = backupSource.Name
+	}
+	return selector
+}
+
+// initRestoreTarget is the source whose database the backup is restored into, the API of the daemon with
+// `--sources-file` finds it for every restore, see apiExecutor.RestoreBackup.
+func initRestoreTarget() *cmd.Source {
+	if *allowCrossDatabase {
+		return nil
+	}
+	return backupSource
+}
+
+func initLabels() *cmd.BackupLabels {
+	return &cmd.BackupLabels{
+		Label:  strings.TrimSpace(*backupName),
+		Tags:   backupTags,
+		Note:   *backupNote,
+		Pinned: *backupPin,
+	}
+}
+
+func initScheduledLabels() *cmd.BackupLabels {
+	return &cmd.BackupLabels{Tags: backupTags, Note: *backupNote}
+}
+
+func initHooks() *hooks.Hooks {
+	commands := map[hooks.Event]string{}
+	for event, command := range hookCommands {
+		if strings.TrimSpace(*command) != "" {
+			commands[event] = *command
+		}
+	}
+	return &hooks.Hooks{Commands: commands, Timeout: *hookTimeout}
+}
+
+// notifiedOperations are the commands which send the notifications, by the operation of their summaries.
+var notifiedOperations = map[cmd.Command]string{
+	cmd.CreateIncrementalBackup: "create",
+	cmd.RestoreFromBackup:       "restore",
+	cmd.PruneBackups:            "prune",
+}
+
+// notifyFailure sends the summary of the operation which has failed before the command itself has started, e.g. in
+// opening the repository or in the preflight checks. The command sends the summary of its own run otherwise.
+func notifyFailure(ctx context.Context, operation string, startedAt time.Time, err error) {
+	initNotifier().Notify(ctx, &notify.Summary{
+		Operation:       operation,
+		StartedAt:       startedAt,
+		DurationSeconds: time.Since(startedAt).Seconds(),
+		Error:           err.Error(),
+	})
+}
+
+func initNotifier() *notify.Notifier {
+	notifier := &notify.Notifier{OnFailureOnly: strings.TrimSpace(*notifyOn) == "failure"}
+	if *notifyWebhook != "" {
+		notifier.Sinks = append(notifier.Sinks, &notify.WebhookSink{URL: *notifyWebhook})
+	}
+	if *notifySmtpAddr != "" {
+		var recipients []string
+		for _, recipient := range strings.Split(*notifySmtpTo, ",") {
+			if strings.TrimSpace(recipient) != "" {
+				recipients = append(recipients, strings.TrimSpace(recipient))
+			}
+		}
+		notifier.Sinks = append(notifier.Sinks, &notify.EmailSink{
+			Addr:     *notifySmtpAddr,
+			From:     *notifySmtpFrom,
+			To:       recipients,
+			Username: *notifySmtpUser,
+			Password: os.Getenv(_const.SmtpPasswordEnv),
+		})
+	}
+	if *notifyCommand != "" {
+		notifier.Sinks = append(notifier.Sinks, &notify.CommandSink{Command: *notifyCommand})
+	}
+	return notifier
+}
+
+func initYdbDumpParams() *ydb.DumpParams {
+	return &ydb.DumpParams{
+		Path:             *ydbDumpPath,
+		Exclude:          *ydbDumpExclude,
+		ConsistencyLevel: *ydbDumpConsistencyLevel,
+		AvoidCopy:        isArgFlagPassed(_const.YdbDumpAvoidCopy),
+		SchemeOnly:       isArgFlagPassed(_const.YdbDumpSchemeOnly),
+		Parallelism:      *ydbDumpParallelism,
+		Direct:           *dumpDirect,
 	}
 }
 
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"ydb-backup-tool/internal/notify"
+)
+
+// runMainEnv makes the test binary run the tool itself, so that the tests can send it the signals.
+const runMainEnv = "YDB_BACKUP_TOOL_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// slowYdbScript stands for `ydb`: `tools dump` writes a part of the dump and hangs, until it is killed.
+const slowYdbScript = `#!/bin/sh
+out=""
+dump=""
+while [ $# -gt 0 ]; do
+  case "$1" in
+    dump) dump=1;;
+    -o) out="$2"; shift;;
+  esac
+  shift
+done
+[ -n "$dump" ] || exit 1
+mkdir -p "$out/table" && echo scheme > "$out/table/scheme.pb" && touch "$FAKE_YDB_STARTED"
+exec sleep 60
+`
+
+func TestCreateInterrupted(t *testing.T) {
+	for name, args := range map[string][]string{
+		"temporary directory": nil,
+		"direct":              {"--dump-direct"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			binDir := filepath.Join(root, "bin")
+			if err := os.Mkdir(binDir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(binDir, "ydb"), []byte(slowYdbScript), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			started := filepath.Join(root, "started")
+			store := filepath.Join(root, "store")
+
+			args = append([]string{"--backend=dir", "--store=" + store, "--ydb-endpoint=grpc://localhost:2136",
+				"--ydb-name=/local"}, args...)
+			tool := exec.Command(os.Args[0], append(args, "create")...)
+			tool.Env = append(os.Environ(), runMainEnv+"=1", "FAKE_YDB_STARTED="+started,
+				"PATH="+binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+			if err := tool.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer tool.Process.Kill()
+
+			for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+				if _, err := os.Stat(started); err == nil {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("the dump has not started")
+				}
+			}
+			if err := tool.Process.Signal(syscall.SIGINT); err != nil {
+				t.Fatal(err)
+			}
+
+			var exitErr *exec.ExitError
+			if err := tool.Wait(); !errors.As(err, &exitErr) || exitErr.ExitCode() != exitInterrupted {
+				t.Fatalf("expected the exit code %d, got %v", exitInterrupted, err)
+			}
+			temp, err := os.ReadDir(filepath.Join(store, "tmp"))
+			if err != nil || len(temp) != 0 {
+				t.Fatalf("the temporary dump is left behind: %v, %v", temp, err)
+			}
+			backups, err := filepath.Glob(filepath.Join(store, "backups", "*", "ydb_backup_*"))
+			if err != nil || len(backups) != 0 {
+				t.Fatalf("the partial backup is left behind: %v, %v", backups, err)
+			}
+		})
+	}
+}
+
+// The failure to open the repository happens before `create` itself, so it is notified about by main.
+func TestNotifyRepositoryOpenFailure(t *testing.T) {
+	summaries := make(chan notify.Summary, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var summary notify.Summary
+		if err := json.NewDecoder(r.Body).Decode(&summary); err == nil {
+			summaries <- summary
+		}
+	}))
+	defer server.Close()
+
+	// The store is a file, so its directories cannot be created
+	store := filepath.Join(t.TempDir(), "store")
+	if err := os.WriteFile(store, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tool := exec.Command(os.Args[0], "--backend=dir", "--store="+store, "--ydb-endpoint=grpc://localhost:2136",
+		"--ydb-name=/local", "--notify-webhook="+server.URL, "create")
+	tool.Env = append(os.Environ(), runMainEnv+"=1")
+	if output, err := tool.CombinedOutput(); err == nil {
+		t.Fatalf("the backup is created in the file: %s", output)
+	}
+
+	select {
+	case summary := <-summaries:
+		if summary.Operation != "create" || summary.Success || summary.Error == "" {
+			t.Fatalf("unexpected summary: %+v", summary)
+		}
+	default:
+		t.Fatal("the failure is not notified")
+	}
+}
+
+func TestOptionsAfterArguments(t *testing.T) {
+	tool := exec.Command(os.Args[0], "--backend=dir", "--store="+t.TempDir(), "--ydb-endpoint=grpc://localhost:2136",
+		"--ydb-name=/local", "restore", "ydb_backup_1", "--ydb-restore-path=/restored")
+	tool.Env = append(os.Environ(), runMainEnv+"=1")
+	output, err := tool.CombinedOutput()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitUsage {
+		t.Fatalf("expected the exit code %d, got %v: %s", exitUsage, err, output)
+	}
+	if !strings.Contains(string(output), "--ydb-restore-path=/restored") {
+		t.Fatalf("the ignored option is not reported: %s", output)
+	}
+}
+
+// TestFailedRunsMetric checks that the failed runs of all the commands are counted, and that `create` writes
+// the textfile after its failure is counted.
+func TestFailedRunsMetric(t *testing.T) {
+	root := t.TempDir()
+	binDir := filepath.Join(root, "bin")
+	if err := os.Mkdir(binDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(binDir, "ydb"), []byte("#!/bin/sh\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	textfile := filepath.Join(root, "ydb_backup.prom")
+	run := func(args ...string) {
+		args = append([]string{"--backend=dir", "--store=" + filepath.Join(root, "store"),
+			"--ydb-endpoint=grpc://localhost:2136", "--ydb-name=/local", "--metrics-textfile=" + textfile}, args...)
+		tool := exec.Command(os.Args[0], args...)
+		tool.Env = append(os.Environ(), runMainEnv+"=1",
+			"PATH="+binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+		if output, err := tool.CombinedOutput(); err == nil {
+			t.Fatalf("`%s` succeeded: %s", strings.Join(args, " "), output)
+		}
+	}
+	assertFailedRuns := func(expected string) {
+		content, err := os.ReadFile(textfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(content), "\nydb_backup_failed_runs "+expected+"\n") {
+			t.Fatalf("expected %s failed run(s):\n%s", expected, content)
+		}
+	}
+
+	run("create")
+	assertFailedRuns("1")
+	run("restore", "latest")
+	run("delete", "ydb_backup_1")
+	run("prune")
+	assertFailedRuns("4")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	dedup "ydb-backup-tool/internal/btrfs/deduplication/duperemove"
+	cmd "ydb-backup-tool/internal/command"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/repository"
+	"ydb-backup-tool/internal/s3"
+	"ydb-backup-tool/internal/utils"
+)
+
+// validateRemoteArgs checks the options of the bucket for the commands which replicate the backups.
+func validateRemoteArgs(commandName string) error {
+	if *replicate && commandName != "cr" && commandName != "create" && commandName != "daemon" {
+		return newUsageError("`--%s` is supported only by `create` and `daemon`", _const.ReplicateArg)
+	}
+	if !*replicate && commandName != "push" && commandName != "pull" && commandName != "list-remote" {
+		return nil
+	}
+
+	if strings.TrimSpace(*s3Endpoint) == "" || strings.TrimSpace(*s3Bucket) == "" {
+		return newUsageError("you need to specify the bucket passing \"--%s=<url>\" and \"--%s=<name>\"",
+			_const.S3EndpointArg, _const.S3BucketArg)
+	}
+	if os.Getenv(_const.S3AccessKeyEnv) == "" || os.Getenv(_const.S3SecretKeyEnv) == "" {
+		return newUsageError("you need to pass the credentials of the bucket in %s and %s", _const.S3AccessKeyEnv,
+			_const.S3SecretKeyEnv)
+	}
+	partSize, err := utils.ParseSize(*s3PartSize)
+	if err != nil || partSize < s3.MinPartSize {
+		return newUsageError("`--%s` must be a size of at least 5M", _const.S3PartSizeArg)
+	}
+	if commandName == "push" && !isReferencePassed() {
+		return newUsageError("you should specify backup: push <reference>")
+	}
+	if commandName == "pull" && len(commandArgs) == 0 {
+		return newUsageError("you should specify backup: pull <name>, pull <label> or pull <source>/<name>")
+	}
+
+	prefix := strings.Trim(strings.TrimSpace(*s3Prefix), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	remote = &cmd.Remote{
+		Client: &s3.Client{
+			Endpoint:  strings.TrimSpace(*s3Endpoint),
+			Region:    *s3Region,
+			Bucket:    strings.TrimSpace(*s3Bucket),
+			AccessKey: os.Getenv(_const.S3AccessKeyEnv),
+			SecretKey: os.Getenv(_const.S3SecretKeyEnv),
+			PathStyle: *s3PathStyle,
+			HTTP:      &http.Client{},
+		},
+		Prefix:   prefix,
+		PartSize: partSize,
+	}
+	return nil
+}
+
+func runPush(ctx context.Context, command *cmd.Command, repo repository.Repository) error {
+	encryption, err := initArchiveEncryption()
+	if err != nil {
+		return err
+	}
+	return command.PushBackup(ctx, repo, *deleteOrphans, commandReference(), initReferenceSelector(), remote, encryption)
+}
+
+func runPull(ctx context.Context, command *cmd.Command, repo repository.Repository) error {
+	decryption, err := initArchiveDecryption()
+	if err != nil {
+		return err
+	}
+	return command.PullBackup(ctx, repo, *deleteOrphans, commandArgs[0], remote, decryption, compression,
+		&dedup.Params{BlockSize: *dedupBlockSize})
+}
+
+// replicateBackups pushes the backups just created with `--replicate`.
+func replicateBackups(ctx context.Context, repo repository.Repository, paths []string) error {
+	encryption, err := initArchiveEncryption()
+	if err != nil {
+		return err
+	}
+	return cmd.ReplicateBackups(ctx, repo, paths, remote, encryption)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/device"
+	"ydb-backup-tool/internal/utils"
+)
+
+func keySource() *utils.SecretSource {
+	return &utils.SecretSource{File: *keyFile, Env: _const.KeyEnv, Prompt: "Key of the image"}
+}
+
+func newKeySource() *utils.SecretSource {
+	return &utils.SecretSource{File: *newKeyFile, Env: _const.NewKeyEnv, Prompt: "New key of the image"}
+}
+
+// runInit creates the image, encrypted with `--encrypt`. The other commands create the unencrypted image on the
+// first run, so `init` is needed only for the encrypted one or to create the image in advance.
+func runInit(ctx context.Context) error {
+	if err := newImage().Init(ctx); err != nil {
+		return err
+	}
+	if *encrypt {
+		fmt.Printf("Created the encrypted image `%s`. Keep the key safe, the backups cannot be read without it.\n",
+			_const.AppBaseDataBackingFilePath)
+	} else {
+		fmt.Printf("Created the image `%s`.\n", _const.AppBaseDataBackingFilePath)
+	}
+	return nil
+}
+
+// runRotateKey replaces the key of the encrypted image, the image may stay mounted meanwhile.
+func runRotateKey(ctx context.Context) error {
+	backingFile := &device.BackingFile{Path: _const.AppBaseDataBackingFilePath}
+	encrypted, err := device.IsEncrypted(backingFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("the image `%s` does not exist", backingFile.Path)
+	}
+	if err != nil {
+		return err
+	}
+	if !encrypted {
+		return fmt.Errorf("the image `%s` is not encrypted", backingFile.Path)
+	}
+
+	oldKey, err := device.LoadKey(keySource(), false)
+	if err != nil {
+		return err
+	}
+	newKey, err := device.LoadKey(newKeySource(), true)
+	if err != nil {
+		return err
+	}
+	if err := device.ChangeLuksKey(ctx, backingFile, oldKey, newKey); err != nil {
+		return err
+	}
+	fmt.Println("The key of the image is changed.")
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	cmd "ydb-backup-tool/internal/command"
+)
+
+// sourcesFile lists the databases backed up by a single `create --sources-file`. The options which are not set
+// for a source are taken from the command line.
+type sourcesFile struct {
+	Sources []sourceConfig `json:"sources"`
+}
+
+type sourceConfig struct {
+	Name             string `json:"name"`
+	Endpoint         string `json:"endpoint"`
+	Database         string `json:"database"`
+	YcTokenFile      string `json:"yc_token_file"`
+	IamTokenFile     string `json:"iam_token_file"`
+	SaKeyFile        string `json:"sa_key_file"`
+	Profile          string `json:"profile"`
+	UseMetadataCreds *bool  `json:"use_metadata_credentials"`
+	DumpPath         string `json:"dump_path"`
+	DumpExclude      string `json:"dump_exclude"`
+}
+
+func loadSourceJobs(path string) ([]*cmd.SourceJob, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, newUsageError("cannot read the sources file: %v", err)
+	}
+
+	var file sourcesFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, newUsageError("cannot parse the sources file `%s`: %v", path, err)
+	}
+	if len(file.Sources) == 0 {
+		return nil, newUsageError("the sources file `%s` has no sources", path)
+	}
+
+	var jobs []*cmd.SourceJob
+	names := map[string]bool{}
+	for i, config := range file.Sources {
+		ydbParams := initYdbParams()
+		overrideString(&ydbParams.Endpoint, config.Endpoint)
+		overrideString(&ydbParams.Name, config.Database)
+		overrideString(&ydbParams.YcTokenFile, config.YcTokenFile)
+		overrideString(&ydbParams.IamTokenFile, config.IamTokenFile)
+		overrideString(&ydbParams.SaKeyFile, config.SaKeyFile)
+		overrideString(&ydbParams.Profile, config.Profile)
+		if config.UseMetadataCreds != nil {
+			ydbParams.UseMetadataCreds = *config.UseMetadataCreds
+		}
+		if ydbParams.Endpoint == "" || ydbParams.Name == "" {
+			return nil, newUsageError("source #%d of `%s` needs the endpoint and the database", i+1, path)
+		}
+
+		dumpParams := initYdbDumpParams()
+		overrideString(&dumpParams.Path, config.DumpPath)
+		overrideString(&dumpParams.Exclude, config.DumpExclude)
+
+		source, err := cmd.NewSource(config.Name, ydbParams.Endpoint, ydbParams.Name)
+		if err != nil {
+			return nil, newUsageError("source #%d of `%s`: %v", i+1, path, err)
+		}
+		if names[source.Name] {
+			return nil, newUsageError("source `%s` is listed twice in `%s`", source.Name, path)
+		}
+		names[source.Name] = true
+
+		jobs = append(jobs, &cmd.SourceJob{Source: source, YdbParams: ydbParams, DumpParams: dumpParams})
+	}
+	return jobs, nil
+}
+
+func overrideString(value *string, override string) {
+	if override != "" {
+		*value = override
+	}
+}
+
+// formatSourceResults returns the names of the backups created by the multi-source run, separated by commas.
+func formatSourceResults(results []*cmd.SourceResult) string {
+	var created []string
+	for _, result := range results {
+		if result.Err == nil {
+			created = append(created, filepath.Base(result.Path))
+		}
+	}
+	return strings.Join(created, ",")
+}
@@ -0,0 +1,406 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"ydb-backup-tool/internal/command"
+)
+
+type RestoreRequest struct {
+	Path    string `json:"path"`
+	Data    *bool  `json:"data"`
+	Indexes *bool  `json:"indexes"`
+	DryRun  bool   `json:"dry_run"`
+}
+
+// Executor performs the operations requested through the API. The operations which return a result synchronously
+// must not modify the repository. The context of a job carries the job, so that the entries logged with it are
+// copied to the logs of the job. The backups are referenced as in the commands, the source resolves the symbolic
+// references among the backups of the source, see command.Selector.
+type Executor interface {
+	ListBackups(ctx context.Context, withSizes bool) ([]command.BackupInfo, error)
+	CreateBackup(ctx context.Context, logs io.Writer) (string, error)
+	RestoreBackup(ctx context.Context, reference string, source string, request *RestoreRequest, logs io.Writer) error
+	DeleteBackup(ctx context.Context, reference string, source string, logs io.Writer) error
+	VerifyBackups(ctx context.Context, logs io.Writer) error
+}
+
+// RunExclusive runs the job so that it never overlaps with the other jobs working with the repository.
+type RunExclusive func(name string, run func() error) error
+
+type Server struct {
+	Addr         string
+	Token        string
+	TLSCertFile  string
+	TLSKeyFile   string
+	Executor     Executor
+	RunExclusive RunExclusive
+	// JobsCtx is cancelled to interrupt the running jobs, they are allowed to finish when the server stops.
+	JobsCtx context.Context
+
+	jobs    *jobStore
+	running sync.WaitGroup
+	ctx     context.Context
+}
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+
+	// maxFinishedJobs is how many finished jobs are kept with their logs, the oldest ones are forgotten first
+	maxFinishedJobs = 100
+)
+
+type Job struct {
+	Id         string     `json:"id"`
+	Operation  string     `json:"operation"`
+	Backup     string     `json:"backup,omitempty"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type jobEntry struct {
+	mu   sync.Mutex
+	job  Job
+	logs *jobLog
+}
+
+// Run serves the API until the context is done and waits for the started jobs to finish. The jobs which are still
+// queued at that moment fail.
+func (s *Server) Run(ctx context.Context) error {
+	if s.Token == "" {
+		return errors.New("API token is not set")
+	}
+	s.ctx = ctx
+	s.jobs = newJobStore()
+
+	restoreLogHook := installLogHook()
+	defer restoreLogHook()
+
+	server := &http.Server{Addr: s.Addr, Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	errChan := make(chan error, 1)
+	go func() {
+		var err error
+		if s.TLSCertFile != "" {
+			err = server.ListenAndServeTLS(s.TLSCertFile, s.TLSKeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		errChan <- err
+	}()
+
+	var err error
+	select {
+	case err = <-errChan:
+		err = fmt.Errorf("API endpoint `%s` stopped: %w", s.Addr, err)
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// Log streams are long-living requests, so do not wait for them
+		if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil {
+			_ = server.Close()
+		}
+	}
+
+	s.running.Wait()
+	return err
+}
+
+func (s *Server) Handler() http.Handler {
+	if s.jobs == nil {
+		s.jobs = newJobStore()
+	}
+	if s.ctx == nil {
+		s.ctx = context.Background()
+	}
+	if s.JobsCtx == nil {
+		s.JobsCtx = context.Background()
+	}
+	if s.RunExclusive == nil {
+		var mu sync.Mutex
+		s.RunExclusive = func(name string, run func() error) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return run()
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/backups", s.handleBackups)
+	mux.HandleFunc("/v1/backups/", s.handleBackup)
+	mux.HandleFunc("/v1/verify", s.handleVerify)
+	mux.HandleFunc("/v1/jobs", s.handleJobs)
+	mux.HandleFunc("/v1/jobs/", s.handleJob)
+	return s.authenticate(mux)
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || s.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing bearer token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GET lists the backups, POST creates a new one.
+func (s *Server) handleBackups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		backups, err := s.Executor.ListBackups(r.Context(), r.URL.Query().Get("sizes") == "true")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, backups)
+	case http.MethodPost:
+		job := s.startJob("create", "", func(ctx context.Context, job *jobEntry) error {
+			name, err := s.Executor.CreateBackup(ctx, job.logs)
+			job.setBackup(name)
+			return err
+		})
+		writeJSON(w, http.StatusAccepted, job.snapshot())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	}
+}
+
+// DELETE /v1/backups/<name> deletes the backup, POST /v1/backups/<name>/restore restores from it. The name of
+// the backup of a source is escaped, e.g. `first%2Fydb_backup_1`, and `?source=` scopes the symbolic references.
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), "/v1/backups/"), "/"), "/")
+	name, err := url.PathUnescape(parts[0])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid backup name: %w", err))
+		return
+	}
+	if name == "" || strings.Contains(name, "..") {
+		writeError(w, http.StatusNotFound, errors.New("backup name is not specified"))
+		return
+	}
+	source := r.URL.Query().Get("source")
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		job := s.startJob("delete", name, func(ctx context.Context, job *jobEntry) error {
+			return s.Executor.DeleteBackup(ctx, name, source, job.logs)
+		})
+		writeJSON(w, http.StatusAccepted, job.snapshot())
+	case len(parts) == 2 && parts[1] == "restore" && r.Method == http.MethodPost:
+		var request RestoreRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse the request: %w", err))
+				return
+			}
+		}
+		job := s.startJob("restore", name, func(ctx context.Context, job *jobEntry) error {
+			return s.Executor.RestoreBackup(ctx, name, source, &request, job.logs)
+		})
+		writeJSON(w, http.StatusAccepted, job.snapshot())
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s %s is not supported", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	job := s.startJob("verify", "", func(ctx context.Context, job *jobEntry) error {
+		return s.Executor.VerifyBackups(ctx, job.logs)
+	})
+	writeJSON(w, http.StatusAccepted, job.snapshot())
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.jobs.list())
+}
+
+// GET /v1/jobs/<id> returns the status of the job, GET /v1/jobs/<id>/logs streams its logs.
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/jobs/"), "/"), "/")
+	job := s.jobs.get(parts[0])
+	if job == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job `%s` is not found", parts[0]))
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		writeJSON(w, http.StatusOK, job.snapshot())
+	case len(parts) == 2 && parts[1] == "logs":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		job.logs.stream(r.Context(), w, r.URL.Query().Get("follow") == "true")
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s is not supported", r.URL.Path))
+	}
+}
+
+func (s *Server) startJob(operation string, backup string,
+	run func(ctx context.Context, job *jobEntry) error) *jobEntry {
+	job := s.jobs.add(operation, backup)
+
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		defer job.logs.close()
+
+		err := s.RunExclusive(operation, func() error {
+			if s.ctx.Err() != nil {
+				return errors.New("the server is shutting down")
+			}
+			job.setStarted()
+			return run(withJob(s.JobsCtx, job), job)
+		})
+		job.setFinished(err)
+	}()
+
+	return job
+}
+
+func (entry *jobEntry) setBackup(name string) {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if name != "" {
+		entry.job.Backup = name
+	}
+}
+
+func (entry *jobEntry) setStarted() {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	now := time.Now()
+	entry.job.StartedAt = &now
+	entry.job.Status = JobRunning
+}
+
+func (entry *jobEntry) setFinished(err error) {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	now := time.Now()
+	entry.job.FinishedAt = &now
+	entry.job.Status = JobSucceeded
+	if err != nil {
+		entry.job.Status = JobFailed
+		entry.job.Error = err.Error()
+	}
+}
+
+func (entry *jobEntry) snapshot() Job {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	return entry.job
+}
+
+type jobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*jobEntry
+}
+
+func newJobStore() *jobStore {
+	return &jobStore{jobs: map[string]*jobEntry{}}
+}
+
+func (store *jobStore) add(operation string, backup string) *jobEntry {
+	idBytes := make([]byte, 8)
+	_, _ = rand.Read(idBytes)
+
+	entry := &jobEntry{
+		job: Job{
+			Id:        hex.EncodeToString(idBytes),
+			Operation: operation,
+			Backup:    backup,
+			Status:    JobQueued,
+			CreatedAt: time.Now(),
+		},
+		logs: newJobLog(),
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.jobs[entry.job.Id] = entry
+	store.evict()
+	return entry
+}
+
+// evict forgets the oldest finished jobs beyond maxFinishedJobs, the queued and running ones are always kept.
+func (store *jobStore) evict() {
+	var finished []Job
+	for _, entry := range store.jobs {
+		if job := entry.snapshot(); job.FinishedAt != nil {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].FinishedAt.Before(*finished[j].FinishedAt)
+	})
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(store.jobs, job.Id)
+	}
+}
+
+func (store *jobStore) get(id string) *jobEntry {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.jobs[id]
+}
+
+func (store *jobStore) list() []Job {
+	store.mu.Lock()
+	jobs := make([]*jobEntry, 0, len(store.jobs))
+	for _, job := range store.jobs {
+		jobs = append(jobs, job)
+	}
+	store.mu.Unlock()
+
+	result := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		result = append(result, job.snapshot())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Warnf("failed to write API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"ydb-backup-tool/internal/command"
+)
+
+const testToken = "secret"
+
+// fakeExecutor records the requests, the failing operations return errFake.
+type fakeExecutor struct {
+	mu       sync.Mutex
+	restored map[string]*RestoreRequest
+	deleted  []string
+	fail     bool
+}
+
+var errFake = errors.New("fake failure")
+
+func (e *fakeExecutor) ListBackups(ctx context.Context, withSizes bool) ([]command.BackupInfo, error) {
+	return []command.BackupInfo{{Name: "ydb_backup_1", Path: "/backups/ydb_backup_1"}}, nil
+}
+
+func (e *fakeExecutor) CreateBackup(ctx context.Context, logs io.Writer) (string, error) {
+	fmt.Fprintln(logs, "creating")
+	log.WithContext(ctx).Info("logged by the job")
+	log.Info("logged by the rest of the daemon")
+	if e.fail {
+		return "", errFake
+	}
+	return "ydb_backup_2", nil
+}
+
+func (e *fakeExecutor) RestoreBackup(ctx context.Context, reference string, source string, request *RestoreRequest,
+	logs io.Writer) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.restored[source+":"+reference] = request
+	return nil
+}
+
+func (e *fakeExecutor) DeleteBackup(ctx context.Context, reference string, source string, logs io.Writer) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.deleted = append(e.deleted, source+":"+reference)
+	return nil
+}
+
+func (e *fakeExecutor) VerifyBackups(ctx context.Context, logs io.Writer) error {
+	return nil
+}
+
+func newTestServer(t *testing.T) (*Server, *fakeExecutor, *httptest.Server) {
+	executor := &fakeExecutor{restored: map[string]*RestoreRequest{}}
+	server := &Server{Token: testToken, Executor: executor}
+	httpServer := httptest.NewServer(server.Handler())
+	t.Cleanup(httpServer.Close)
+	return server, executor, httpServer
+}
+
+func call(t *testing.T, httpServer *httptest.Server, method string, path string, body string,
+	result any) int {
+	request, err := http.NewRequest(method, httpServer.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer "+testToken)
+	response, err := httpServer.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if result != nil {
+		if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return response.StatusCode
+}
+
+func TestAuthenticate(t *testing.T) {
+	_, _, httpServer := newTestServer(t)
+	for name, authorization := range map[string]string{
+		"missing":        "",
+		"wrong":          "Bearer wrong",
+		"without scheme": testToken,
+		"other scheme":   "Basic " + testToken,
+	} {
+		request, err := http.NewRequest(http.MethodGet, httpServer.URL+"/v1/backups", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		response, err := httpServer.Client().Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s token: the status is %d", name, response.StatusCode)
+		}
+	}
+
+	var backups []command.BackupInfo
+	if status := call(t, httpServer, http.MethodGet, "/v1/backups", "", &backups); status != http.StatusOK ||
+		len(backups) != 1 {
+		t.Fatalf("the backups are not listed: %d, %+v", status, backups)
+	}
+}
+
+func TestCreateJob(t *testing.T) {
+	server, executor, httpServer := newTestServer(t)
+	t.Cleanup(installLogHook())
+	for _, fail := range []bool{false, true} {
+		executor.fail = fail
+		var job Job
+		if status := call(t, httpServer, http.MethodPost, "/v1/backups", "", &job); status != http.StatusAccepted {
+			t.Fatalf("the job is not accepted: %d", status)
+		}
+		server.running.Wait()
+
+		if status := call(t, httpServer, http.MethodGet, "/v1/jobs/"+job.Id, "", &job); status != http.StatusOK {
+			t.Fatalf("the job is not found: %d", status)
+		}
+		if fail && (job.Status != JobFailed || job.Error != errFake.Error()) {
+			t.Fatalf("the failed job: %+v", job)
+		}
+		if !fail && (job.Status != JobSucceeded || job.Backup != "ydb_backup_2") {
+			t.Fatalf("the succeeded job: %+v", job)
+		}
+
+		response, err := httpServer.Client().Do(newLogsRequest(t, httpServer, job.Id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil || !strings.HasPrefix(string(logs), "creating\n") ||
+			!strings.Contains(string(logs), "logged by the job") || strings.Contains(string(logs), "rest of the daemon") {
+			t.Fatalf("unexpected logs of the job: %q, %v", logs, err)
+		}
+	}
+
+	var jobs []Job
+	if call(t, httpServer, http.MethodGet, "/v1/jobs", "", &jobs); len(jobs) != 2 {
+		t.Fatalf("expected 2 jobs, got %+v", jobs)
+	}
+	if status := call(t, httpServer, http.MethodPost, "/v1/jobs", "", nil); status != http.StatusMethodNotAllowed {
+		t.Fatalf("the jobs are posted: %d", status)
+	}
+}
+
+func newLogsRequest(t *testing.T, httpServer *httptest.Server, id string) *http.Request {
+	request, err := http.NewRequest(http.MethodGet, httpServer.URL+"/v1/jobs/"+id+"/logs?follow=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer "+testToken)
+	return request
+}
+
+func TestRestoreAndDeleteJobs(t *testing.T) {
+	server, executor, httpServer := newTestServer(t)
+	if status := call(t, httpServer, http.MethodPost, "/v1/backups/ydb_backup_1/restore",
+		`{"path": "/restored", "data": false}`, nil); status != http.StatusAccepted {
+		t.Fatalf("the restore is not accepted: %d", status)
+	}
+	if status := call(t, httpServer, http.MethodPost, "/v1/backups/ydb_backup_1/restore", `{"path"`,
+		nil); status != http.StatusBadRequest {
+		t.Fatalf("the malformed restore request: %d", status)
+	}
+	if status := call(t, httpServer, http.MethodDelete, "/v1/backups/ydb_backup_1", "", nil); status !=
+		http.StatusAccepted {
+		t.Fatalf("the deletion is not accepted: %d", status)
+	}
+	if status := call(t, httpServer, http.MethodDelete, "/v1/backups/..", "", nil); status != http.StatusNotFound {
+		t.Fatalf("the deletion of `..`: %d", status)
+	}
+	if status := call(t, httpServer, http.MethodDelete, "/v1/backups/first%2Fydb_backup_2", "", nil); status !=
+		http.StatusAccepted {
+		t.Fatalf("the deletion of the backup of a source is not accepted: %d", status)
+	}
+	if status := call(t, httpServer, http.MethodPost, "/v1/backups/latest/restore?source=second", "",
+		nil); status != http.StatusAccepted {
+		t.Fatalf("the restore of the latest backup of a source is not accepted: %d", status)
+	}
+	server.running.Wait()
+
+	request := executor.restored[":ydb_backup_1"]
+	if request == nil || request.Path != "/restored" || request.Data == nil || *request.Data || request.Indexes != nil {
+		t.Fatalf("unexpected restore request: %+v", request)
+	}
+	if executor.restored["second:latest"] == nil {
+		t.Fatalf("the latest backup of `second` is not restored: %v", executor.restored)
+	}
+	sort.Strings(executor.deleted)
+	if strings.Join(executor.deleted, ",") != ":first/ydb_backup_2,:ydb_backup_1" {
+		t.Fatalf("unexpected deletions: %v", executor.deleted)
+	}
+}
+
+func TestJobsEvicted(t *testing.T) {
+	store := newJobStore()
+	running := store.add("create", "")
+	running.setStarted()
+	for i := 0; i < maxFinishedJobs+10; i++ {
+		store.add("verify", "").setFinished(nil)
+	}
+	last := store.add("verify", "")
+
+	jobs := store.list()
+	if len(jobs) != maxFinishedJobs+2 {
+		t.Fatalf("expected %d jobs, got %d", maxFinishedJobs+2, len(jobs))
+	}
+	if store.get(running.job.Id) == nil || store.get(last.job.Id) == nil {
+		t.Fatal("the unfinished jobs are evicted")
+	}
+}
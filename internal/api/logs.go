@@ -0,0 +1,121 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+)
+
+// jobLog keeps the whole output of a job and wakes up the followers on every write.
+type jobLog struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	closed  bool
+	changed chan struct{}
+}
+
+func newJobLog() *jobLog {
+	return &jobLog{changed: make(chan struct{})}
+}
+
+func (l *jobLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n, err := l.buf.Write(p)
+	l.notify()
+	return n, err
+}
+
+func (l *jobLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+	l.notify()
+}
+
+func (l *jobLog) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// stream writes the logs written so far. With `follow`, it keeps writing the new logs until the job is finished.
+func (l *jobLog) stream(ctx context.Context, w http.ResponseWriter, follow bool) {
+	flusher, _ := w.(http.Flusher)
+
+	var offset int
+	for {
+		l.mu.Lock()
+		chunk := append([]byte(nil), l.buf.Bytes()[offset:]...)
+		closed := l.closed
+		changed := l.changed
+		l.mu.Unlock()
+
+		if len(chunk) > 0 {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			offset += len(chunk)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if !follow || closed {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+// jobKey is the key of the job in the context of the job.
+type jobKey struct{}
+
+func withJob(ctx context.Context, job *jobEntry) context.Context {
+	return context.WithValue(ctx, jobKey{}, job)
+}
+
+// logHook copies the entries of the global logger logged with the context of a job to the logs of the job, the
+// entries of the rest of the daemon and of the other requests are not copied.
+type logHook struct{}
+
+func (h *logHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *logHook) Fire(entry *log.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+	job, ok := entry.Context.Value(jobKey{}).(*jobEntry)
+	if !ok {
+		return nil
+	}
+
+	line, err := (&log.TextFormatter{DisableColors: true, FullTimestamp: true}).Format(entry)
+	if err != nil {
+		return err
+	}
+	_, err = job.logs.Write(line)
+	return err
+}
+
+func installLogHook() func() {
+	logger := log.StandardLogger()
+	previous := make(log.LevelHooks)
+	for level, hooks := range logger.Hooks {
+		previous[level] = append(previous[level], hooks...)
+	}
+
+	logger.AddHook(&logHook{})
+	return func() {
+		logger.ReplaceHooks(previous)
+	}
+}
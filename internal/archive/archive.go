@@ -0,0 +1,190 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/utils"
+)
+
+// The archive is a gzipped tar of the files of the backup. Its first entry is the meta entry of the backup, named
+// like the sidecar, so that the archive can be imported without extracting it first.
+
+// Write archives the files of the backup in the directory with its meta entry. The directory is the backup itself,
+// unless the repository keeps the files elsewhere.
+func Write(ctx context.Context, w io.Writer, backup *meta.Backup, dir string) error {
+	gzipWriter, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err != nil {
+		return err
+	}
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	content, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tarWriter.WriteHeader(&tar.Header{Name: _const.BackupSidecarName, Mode: 0o644,
+		Size: int64(len(content)), ModTime: backup.StartedCreationAt, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(content); err != nil {
+		return err
+	}
+
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		// The meta entry is written above, the sidecar on the disk may be older. The manifest of the plain-directory
+		// backend is written again once the backup is imported
+		if relativePath == "." || relativePath == _const.BackupSidecarName ||
+			relativePath == _const.BackupStagingMarkerName || relativePath == _const.BackupManifestName {
+			return nil
+		}
+		return writeEntry(tarWriter, path, filepath.ToSlash(relativePath), entry)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive the backup `%s`: %w", backup.Path, err)
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+func writeEntry(tarWriter *tar.Writer, path string, name string, entry fs.DirEntry) error {
+	info, err := entry.Info()
+	if err != nil {
+		return err
+	}
+	var link string
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	} else if !info.IsDir() && !info.Mode().IsRegular() {
+		return fmt.Errorf("cannot archive `%s`, it is neither a file, a directory nor a symlink", path)
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(tarWriter, file)
+	return err
+}
+
+// Reader reads the archive written by Write.
+type Reader struct {
+	gzipReader *gzip.Reader
+	tarReader  *tar.Reader
+}
+
+// NewReader reads the meta entry of the backup from the archive, its path is the one on the exporting host.
+func NewReader(r io.Reader) (*Reader, *meta.Backup, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("the archive is not a backup archive: %w", err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	header, err := tarReader.Next()
+	if err != nil {
+		return nil, nil, fmt.Errorf("the archive is not a backup archive: %w", err)
+	}
+	if header.Name != _const.BackupSidecarName {
+		return nil, nil, errors.New("the archive does not start with the meta entry of the backup")
+	}
+	content, err := io.ReadAll(io.LimitReader(tarReader, 1024*1024))
+	if err != nil {
+		return nil, nil, err
+	}
+	var backup meta.Backup
+	if err := json.Unmarshal(content, &backup); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse the meta entry of the archive: %w", err)
+	}
+	return &Reader{gzipReader: gzipReader, tarReader: tarReader}, &backup, nil
+}
+
+// Extract writes the files of the backup into the existing directory, the archive is read to the end.
+func (reader *Reader) Extract(ctx context.Context, dir string) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		header, err := reader.tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			// The rest of the gzip stream is read to verify its checksum
+			if _, err := io.Copy(io.Discard, reader.gzipReader); err != nil {
+				return fmt.Errorf("failed to read the archive: %w", err)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the archive: %w", err)
+		}
+
+		// The parents are checked on the disk, a symlink extracted before must not lead the entry out of the backup
+		path, err := utils.JoinInside(dir, header.Name)
+		if err != nil {
+			return fmt.Errorf("the archive has the entry `%s` outside of the backup: %w", header.Name, err)
+		}
+		mode := fs.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, mode)
+		case tar.TypeSymlink:
+			err = os.Symlink(header.Linkname, path)
+		case tar.TypeReg:
+			err = extractFile(reader.tarReader, path, mode)
+		default:
+			err = fmt.Errorf("unsupported type of the entry `%s`", header.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract `%s`: %w", header.Name, err)
+		}
+	}
+}
+
+func extractFile(r io.Reader, path string, mode fs.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,133 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/meta"
+)
+
+// testEntry is an entry of the archive built by buildArchive, the content is that of the file or the target of
+// the symlink.
+type testEntry struct {
+	name     string
+	typeflag byte
+	content  string
+}
+
+// buildArchive writes the archive with the meta entry and the entries as they are, unlike Write, which only
+// archives the files of the backup.
+func buildArchive(t *testing.T, entries []testEntry) *bytes.Buffer {
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	entries = append([]testEntry{{name: _const.BackupSidecarName, typeflag: tar.TypeReg, content: "{}"}}, entries...)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Mode: 0o644}
+		switch entry.typeflag {
+		case tar.TypeReg:
+			header.Size = int64(len(entry.content))
+		case tar.TypeSymlink:
+			header.Linkname = entry.content
+		case tar.TypeDir:
+			header.Mode = 0o755
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if entry.typeflag == tar.TypeReg {
+			if _, err := tarWriter.Write([]byte(entry.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buffer
+}
+
+func TestWriteExtract(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "table"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "table", "data_00.csv"), []byte("id\n1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("data_00.csv", filepath.Join(dir, "table", "latest.csv")); err != nil {
+		t.Fatal(err)
+	}
+	backup := &meta.Backup{Path: "/backups/ydb_backup_1", Label: "first", Completed: true,
+		StartedCreationAt: time.Now()}
+
+	var buffer bytes.Buffer
+	if err := Write(context.Background(), &buffer, backup, dir); err != nil {
+		t.Fatal(err)
+	}
+	reader, read, err := NewReader(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Path != backup.Path || read.Label != backup.Label {
+		t.Fatalf("unexpected meta entry: %+v", read)
+	}
+	target := t.TempDir()
+	if err := reader.Extract(context.Background(), target); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(target, "table", "latest.csv"))
+	if err != nil || string(content) != "id\n1\n" {
+		t.Fatalf("the files are not extracted: %q, %v", content, err)
+	}
+}
+
+func TestExtractRejectsEntriesOutside(t *testing.T) {
+	tests := map[string][]testEntry{
+		"parent": {
+			{name: "../escaped", typeflag: tar.TypeReg, content: "escaped"},
+		},
+		"absolute": {
+			{name: "/escaped", typeflag: tar.TypeReg, content: "escaped"},
+		},
+		"file under symlink": {
+			{name: "link", typeflag: tar.TypeSymlink, content: ".."},
+			{name: "link/escaped", typeflag: tar.TypeReg, content: "escaped"},
+		},
+		"directory under symlink": {
+			{name: "table", typeflag: tar.TypeDir},
+			{name: "table/link", typeflag: tar.TypeSymlink, content: "/"},
+			{name: "table/link/escaped", typeflag: tar.TypeDir},
+		},
+	}
+	for name, entries := range tests {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			target := filepath.Join(parent, "backup")
+			if err := os.Mkdir(target, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			reader, _, err := NewReader(buildArchive(t, entries))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := reader.Extract(context.Background(), target); err == nil {
+				t.Fatal("the archive with the entry outside of the backup is extracted")
+			}
+			for _, path := range []string{filepath.Join(parent, "escaped"), "/escaped"} {
+				if _, err := os.Lstat(path); err == nil {
+					t.Fatalf("`%s` is written outside of the backup", path)
+				}
+			}
+		})
+	}
+}
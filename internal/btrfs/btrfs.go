@@ -1,6 +1,7 @@
 package btrfs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"golang.org/x/exp/slices"
@@ -11,6 +12,9 @@ import (
 	"ydb-backup-tool/internal/utils"
 )
 
+// ErrSubvolumeNotFound is returned when the operation requires an existing subvolume.
+var ErrSubvolumeNotFound = errors.New("subvolume does not exist")
+
 type Subvolume struct {
 	Path       string
 	Name       string
@@ -42,17 +46,17 @@ func NewSnapshot(path string) *Subvolume {
 	return NewSubvolume(path, true)
 }
 
-func GetFileSystemUsage(path string) (*FsUsage, error) {
+func GetFileSystemUsage(ctx context.Context, path string) (*FsUsage, error) {
 	// sudo btrfs filesystem usage -b -T /var/lib/ydb-backup-tool/mnt
 	btrfsPath, err := utils.GetBinary("btrfs")
 	if err != nil {
 		return nil, err
 	}
 
-	cmd := utils.BuildCommand(btrfsPath, "filesystem", "usage", "-b", "-T", path)
-	out, err := cmd.Output()
+	cmd := utils.BuildCommand(ctx, btrfsPath, "filesystem", "usage", "-b", "-T", path)
+	out, err := utils.OutputCommand(cmd)
 	if err != nil {
-		return nil, errors.New("cannot obtain btrfs usage statistics")
+		return nil, fmt.Errorf("cannot obtain btrfs usage statistics: %w", err)
 	}
 
 	metaMap := make(map[string]string)
@@ -91,42 +95,66 @@ func GetFileSystemUsage(path string) (*FsUsage, error) {
 	return &FsUsage{DeviceSize: devSize, DeviceAllocated: devAllocated, DeviceUnallocated: devUnallocated, Used: used, Free: free}, nil
 }
 
-func MakeBtrfsFileSystem(filePath string) error {
+// MkfsParams are the options of the filesystem fixed at its creation, the empty ones are left to `mkfs.btrfs`.
+type MkfsParams struct {
+	// DataProfile and MetadataProfile are the block group profiles, e.g. single or dup
+	DataProfile     string
+	MetadataProfile string
+	// NodeSize is the size of the metadata blocks in bytes, e.g. 16384
+	NodeSize int64
+}
+
+func MakeBtrfsFileSystem(ctx context.Context, filePath string, params *MkfsParams) error {
 	mkfsPath, err := utils.GetBinary("mkfs.btrfs")
 	if err != nil {
 		return err
 	}
-	mkfsCmd := utils.BuildCommand(mkfsPath, filePath)
-	if err := mkfsCmd.Run(); err != nil {
-		return fmt.Errorf("failed to initialize btrfs in the file `%s`", filePath)
+
+	var args []string
+	if params != nil {
+		if params.DataProfile != "" {
+			args = append(args, "--data", params.DataProfile)
+		}
+		if params.MetadataProfile != "" {
+			args = append(args, "--metadata", params.MetadataProfile)
+		}
+		if params.NodeSize != 0 {
+			args = append(args, "--nodesize", strconv.FormatInt(params.NodeSize, 10))
+		}
+	}
+	args = append(args, filePath)
+
+	mkfsCmd := utils.BuildCommand(ctx, mkfsPath, args...)
+	if err := utils.RunCommand(mkfsCmd); err != nil {
+		return fmt.Errorf("failed to initialize btrfs in the file `%s`: %w", filePath, err)
 	}
 
 	return nil
 }
 
 // CreateSubvolume /* It will not work with recursive subvolumes */
-func CreateSubvolume(path string) (*Subvolume, error) {
+func CreateSubvolume(ctx context.Context, path string) (*Subvolume, error) {
 	btrfsPath, err := utils.GetBinary("btrfs")
 	if err != nil {
 		return nil, err
 	}
 
-	btrfsCmd := utils.BuildCommand(btrfsPath, "subvolume", "create", path)
-	if err := btrfsCmd.Run(); err != nil {
-		return nil, fmt.Errorf("failed to create subvolume `%s`", path)
+	btrfsCmd := utils.BuildCommand(ctx, btrfsPath, "subvolume", "create", path)
+	if err := utils.RunCommand(btrfsCmd); err != nil {
+		return nil, fmt.Errorf("failed to create subvolume `%s`: %w", path, err)
 	}
 
 	return NewSubvolume(path, false), nil
 }
 
-func CreateSnapshot(subvolume *Subvolume, snapshotTargetPath string) (*Subvolume, error) {
-	subvolumeExists, err := verifySubvolumeExists(subvolume)
+func CreateSnapshot(ctx context.Context, subvolume *Subvolume, snapshotTargetPath string) (*Subvolume, error) {
+	subvolumeExists, err := verifySubvolumeExists(ctx, subvolume)
 
 	if err != nil {
-		return nil, errors.New("cannot verify that subvolume exists")
+		return nil, fmt.Errorf("cannot verify that subvolume exists: %w", err)
 	}
 	if !subvolumeExists {
-		return nil, fmt.Errorf("cannot find subvolume `%s`: %w", subvolume.Path, err)
+		return nil, fmt.Errorf("cannot find subvolume `%s`: %w", subvolume.Path, ErrSubvolumeNotFound)
 	}
 
 	btrfsPath, err := utils.GetBinary("btrfs")
@@ -134,9 +162,9 @@ func CreateSnapshot(subvolume *Subvolume, snapshotTargetPath string) (*Subvolume
 		return nil, err
 	}
 
-	btrfsCmd := utils.BuildCommand(btrfsPath, "subvolume", "snapshot", "-r", subvolume.Path, snapshotTargetPath)
-	if err := btrfsCmd.Run(); err != nil {
-		return nil, fmt.Errorf("cannot create snapshot %s", snapshotTargetPath)
+	btrfsCmd := utils.BuildCommand(ctx, btrfsPath, "subvolume", "snapshot", "-r", subvolume.Path, snapshotTargetPath)
+	if err := utils.RunCommand(btrfsCmd); err != nil {
+		return nil, fmt.Errorf("cannot create snapshot %s: %w", snapshotTargetPath, err)
 	}
 
 	return NewSnapshot(snapshotTargetPath), nil
@@ -145,21 +173,21 @@ func CreateSnapshot(subvolume *Subvolume, snapshotTargetPath string) (*Subvolume
 /*
 * Returns the list of subvolumes (including snapshots)
  */
-func GetSubvolumes(path string) ([]*Subvolume, error) {
+func GetSubvolumes(ctx context.Context, path string) ([]*Subvolume, error) {
 	btrfsPath, err := utils.GetBinary("btrfs")
 	if err != nil {
 		return nil, err
 	}
 
 	// Firstly, get snapshots
-	result, err := GetSnapshots(path)
+	result, err := GetSnapshots(ctx, path)
 	if err != nil {
 		return nil, err
 	}
-	btrfsCmd := utils.BuildCommand(btrfsPath, "subvolume", "list", "-o", path)
-	out, err := btrfsCmd.Output()
+	btrfsCmd := utils.BuildCommand(ctx, btrfsPath, "subvolume", "list", "-o", path)
+	out, err := utils.OutputCommand(btrfsCmd)
 	if err != nil {
-		return nil, errors.New("cannot get list of subvolumes")
+		return nil, fmt.Errorf("cannot get list of subvolumes: %w", err)
 	}
 
 	for _, subvolume := range strings.Split(string(out), "\n") {
@@ -177,16 +205,16 @@ func GetSubvolumes(path string) ([]*Subvolume, error) {
 	return result, nil
 }
 
-func GetSnapshots(path string) ([]*Subvolume, error) {
+func GetSnapshots(ctx context.Context, path string) ([]*Subvolume, error) {
 	btrfsPath, err := utils.GetBinary("btrfs")
 	if err != nil {
 		return nil, err
 	}
 
-	btrfsCmd := utils.BuildCommand(btrfsPath, "subvolume", "list", "-r", path)
-	out, err := btrfsCmd.Output()
+	btrfsCmd := utils.BuildCommand(ctx, btrfsPath, "subvolume", "list", "-r", path)
+	out, err := utils.OutputCommand(btrfsCmd)
 	if err != nil {
-		return nil, fmt.Errorf("cannot get list of snapshots")
+		return nil, fmt.Errorf("cannot get list of snapshots: %w", err)
 	}
 
 	result := []*Subvolume{}
@@ -200,11 +228,11 @@ func GetSnapshots(path string) ([]*Subvolume, error) {
 	return result, nil
 }
 
-func GetSnapshot(path string) (*Subvolume, error) {
+func GetSnapshot(ctx context.Context, path string) (*Subvolume, error) {
 	dir := filepath.Dir(path)
-	snapshots, err := GetSnapshots(dir)
+	snapshots, err := GetSnapshots(ctx, dir)
 	if err != nil {
-		return nil, errors.New("cannot get list of snapshots")
+		return nil, fmt.Errorf("cannot get list of snapshots: %w", err)
 	}
 
 	for _, snapshot := range snapshots {
@@ -216,13 +244,13 @@ func GetSnapshot(path string) (*Subvolume, error) {
 	return nil, nil
 }
 
-func GetSubvolume(path string) (*Subvolume, error) {
+func GetSubvolume(ctx context.Context, path string) (*Subvolume, error) {
 	// Extract dir
 	dir := filepath.Dir(path)
 
-	subvolumes, err := GetSubvolumes(dir)
+	subvolumes, err := GetSubvolumes(ctx, dir)
 	if err != nil {
-		return nil, errors.New("cannot get list of subvolumes")
+		return nil, fmt.Errorf("cannot get list of subvolumes: %w", err)
 	}
 
 	for _, subvolume := range subvolumes {
@@ -234,36 +262,36 @@ func GetSubvolume(path string) (*Subvolume, error) {
 	return nil, nil
 }
 
-func DeleteSubvolume(subvolume *Subvolume) error {
+func DeleteSubvolume(ctx context.Context, subvolume *Subvolume) error {
 	btrfsPath, err := utils.GetBinary("btrfs")
 	if err != nil {
 		return err
 	}
 
-	subvolumeExists, err := verifySubvolumeExists(subvolume)
+	subvolumeExists, err := verifySubvolumeExists(ctx, subvolume)
 	if err != nil {
-		return fmt.Errorf("failed to verify the existence of the following subvolume `%s`", subvolume.Path)
+		return fmt.Errorf("failed to verify the existence of the following subvolume `%s`: %w", subvolume.Path, err)
 	}
 	if !subvolumeExists {
-		return fmt.Errorf("subvolume %s does not exist", subvolume.Path)
+		return fmt.Errorf("cannot delete `%s`: %w", subvolume.Path, ErrSubvolumeNotFound)
 	}
 
-	btrfsCmd := utils.BuildCommand(btrfsPath, "subvolume", "delete", subvolume.Path)
-	if err := btrfsCmd.Run(); err != nil {
-		return fmt.Errorf("failed to delete the following subvolume `%s`", subvolume.Path)
+	btrfsCmd := utils.BuildCommand(ctx, btrfsPath, "subvolume", "delete", subvolume.Path)
+	if err := utils.RunCommand(btrfsCmd); err != nil {
+		return fmt.Errorf("failed to delete the following subvolume `%s`: %w", subvolume.Path, err)
 	}
 
 	return nil
 }
 
-func GetSubvolumesMeta(path string) (*[]SubvolumeMeta, error) {
-	subvolumes, err := GetSubvolumes(path)
+func GetSubvolumesMeta(ctx context.Context, path string) (*[]SubvolumeMeta, error) {
+	subvolumes, err := GetSubvolumes(ctx, path)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := quotaGroupEnable(path); err != nil {
-		return nil, fmt.Errorf("failed to enable quota group for the given path `%s`", path)
+	if err := quotaGroupEnable(ctx, path); err != nil {
+		return nil, fmt.Errorf("failed to enable quota group for the given path `%s`: %w", path, err)
 	}
 
 	btrfsPath, err := utils.GetBinary("btrfs")
@@ -274,10 +302,10 @@ func GetSubvolumesMeta(path string) (*[]SubvolumeMeta, error) {
 	var result []SubvolumeMeta
 
 	for _, subvolume := range subvolumes {
-		cmd := utils.BuildCommand(btrfsPath, "subvolume", "show", "-b", subvolume.Path)
-		out, err := cmd.Output()
+		cmd := utils.BuildCommand(ctx, btrfsPath, "subvolume", "show", "-b", subvolume.Path)
+		out, err := utils.OutputCommand(cmd)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get meta information about the following subvolume `%s`", subvolume.Path)
+			return nil, fmt.Errorf("failed to get meta information about the following subvolume `%s`: %w", subvolume.Path, err)
 		}
 
 		subvolumeMeta, err := extractSubvolumeMetaInfo(string(out), NewSubvolume(subvolume.Path, false))
@@ -290,16 +318,16 @@ func GetSubvolumesMeta(path string) (*[]SubvolumeMeta, error) {
 	return &result, nil
 }
 
-func DeleteSnapshot(subvolume *Subvolume) error {
+func DeleteSnapshot(ctx context.Context, subvolume *Subvolume) error {
 	if !subvolume.IsSnapshot {
 		panic("cannot delete snapshot, since subvolume provided")
 	}
 
-	return DeleteSubvolume(subvolume)
+	return DeleteSubvolume(ctx, subvolume)
 }
 
-func VerifySubvolumeExists(path string) (bool, error) {
-	subvolume, err := GetSubvolume(path)
+func VerifySubvolumeExists(ctx context.Context, path string) (bool, error) {
+	subvolume, err := GetSubvolume(ctx, path)
 	if err != nil {
 		return false, fmt.Errorf("cannot get list of subvolumes: %w", err)
 	}
@@ -310,39 +338,80 @@ func VerifySubvolumeExists(path string) (bool, error) {
 	return false, nil
 }
 
-func ResizeFileSystem(path string, newSize string) error {
+func ResizeFileSystem(ctx context.Context, path string, newSize string) error {
+	btrfsPath, err := utils.GetBinary("btrfs")
+	if err != nil {
+		return err
+	}
+
+	cmd := utils.BuildCommand(ctx, btrfsPath, "filesystem", "resize", newSize, path)
+	if err := utils.RunCommand(cmd); err != nil {
+		return fmt.Errorf("failed to resize btrfs %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Scrub reads all data and metadata of the filesystem and verifies checksums. It blocks until the scrub is over.
+func Scrub(ctx context.Context, path string) error {
+	btrfsPath, err := utils.GetBinary("btrfs")
+	if err != nil {
+		return err
+	}
+
+	cmd := utils.BuildCommand(ctx, btrfsPath, "scrub", "start", "-B", path)
+	out, err := utils.OutputCommand(cmd)
+	if err != nil {
+		return fmt.Errorf("scrub of `%s` failed: %w", path, err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		cuttingByDelimiter := strings.SplitN(line, ":", 2)
+		if len(cuttingByDelimiter) == 2 && strings.TrimSpace(strings.ToLower(cuttingByDelimiter[0])) == "error summary" {
+			summary := strings.TrimSpace(cuttingByDelimiter[1])
+			if summary != "no errors found" {
+				return fmt.Errorf("scrub of `%s` found errors: %s", path, summary)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Balance rewrites the data chunks which are filled less than `usage` percent to return the space to unallocated.
+func Balance(ctx context.Context, path string, usage uint64) error {
 	btrfsPath, err := utils.GetBinary("btrfs")
 	if err != nil {
 		return err
 	}
 
-	cmd := utils.BuildCommand(btrfsPath, "filesystem", "resize", newSize, path)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to resize btrfs %s", path)
+	cmd := utils.BuildCommand(ctx, btrfsPath, "balance", "start", fmt.Sprintf("-dusage=%d", usage), path)
+	if err := utils.RunCommand(cmd); err != nil {
+		return fmt.Errorf("failed to balance btrfs %s: %w", path, err)
 	}
 
 	return nil
 }
 
-func SetProperty(path string, key string, value string) error {
+func SetProperty(ctx context.Context, path string, key string, value string) error {
 	btrfsPath, err := utils.GetBinary("btrfs")
 	if err != nil {
 		return err
 	}
 
-	cmd := utils.BuildCommand(btrfsPath, "property", "set", path, key, value)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to set property %s = %s for the given path %s", key, value, path)
+	cmd := utils.BuildCommand(ctx, btrfsPath, "property", "set", path, key, value)
+	if err := utils.RunCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set property %s = %s for the given path %s: %w", key, value, path, err)
 	}
 	return nil
 }
 
-func verifySubvolumeExists(subvolume *Subvolume) (bool, error) {
+func verifySubvolumeExists(ctx context.Context, subvolume *Subvolume) (bool, error) {
 	dir := filepath.Dir(subvolume.Path)
 
-	subvolumes, err := GetSubvolumes(dir)
+	subvolumes, err := GetSubvolumes(ctx, dir)
 	if err != nil {
-		return false, errors.New("cannot get list of subvolumes")
+		return false, fmt.Errorf("cannot get list of subvolumes: %w", err)
 	}
 
 	for _, curSubvolume := range subvolumes {
@@ -354,15 +423,35 @@ func verifySubvolumeExists(subvolume *Subvolume) (bool, error) {
 	return false, nil
 }
 
-func quotaGroupEnable(path string) error {
+// QuotaEnabled reports whether quota groups are enabled on the filesystem, they are required to get the usage
+// of the subvolumes.
+func QuotaEnabled(ctx context.Context, path string) (bool, error) {
+	btrfsPath, err := utils.GetBinary("btrfs")
+	if err != nil {
+		return false, err
+	}
+
+	cmd := utils.BuildCommand(ctx, btrfsPath, "qgroup", "show", path)
+	if _, err := utils.OutputCommand(cmd); err != nil {
+		var cmdErr *utils.CommandError
+		if errors.As(err, &cmdErr) && strings.Contains(cmdErr.Stderr, "not enabled") {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get quota groups of %s: %w", path, err)
+	}
+
+	return true, nil
+}
+
+func quotaGroupEnable(ctx context.Context, path string) error {
 	btrfsPath, err := utils.GetBinary("btrfs")
 	if err != nil {
 		return err
 	}
 
-	btrfsCmd := utils.BuildCommand(btrfsPath, "quota", "enable", path)
-	if err := btrfsCmd.Run(); err != nil {
-		return fmt.Errorf("failed to enable quotas for the path %s", path)
+	btrfsCmd := utils.BuildCommand(ctx, btrfsPath, "quota", "enable", path)
+	if err := utils.RunCommand(btrfsCmd); err != nil {
+		return fmt.Errorf("failed to enable quotas for the path %s: %w", path, err)
 	}
 
 	return nil
@@ -1,6 +1,7 @@
 package compression
 
 import (
+	"context"
 	"fmt"
 	"ydb-backup-tool/internal/btrfs"
 )
@@ -58,8 +59,8 @@ func CreateCompression(algorithm Algorithm, compressionLevel uint64) (Compressio
 	}
 }
 
-func EnableCompression(path string, compression Compression) error {
-	if err := btrfs.SetProperty(path, "compression", string(compression.Algorithm())); err != nil {
+func EnableCompression(ctx context.Context, path string, compression Compression) error {
+	if err := btrfs.SetProperty(ctx, path, "compression", string(compression.Algorithm())); err != nil {
 		return fmt.Errorf("failed to enable compression for the given path `%s`: %s", path, err)
 	}
 
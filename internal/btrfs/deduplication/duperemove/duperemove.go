@@ -1,7 +1,7 @@
 package duperemove
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
@@ -12,23 +12,34 @@ import (
 
 type Params struct {
 	BlockSize uint64
+	// Hashfile keeps the hashes between the runs, the files of all the runs sharing it are deduplicated together.
+	// Default is `_const.AppHashfilePath`
+	Hashfile string
 }
 
-func DeduplicateDirectory(path string, params *Params) error {
+func DeduplicateDirectory(ctx context.Context, path string, params *Params) error {
+	return DeduplicatePaths(ctx, []string{path}, params)
+}
+
+// DeduplicatePaths deduplicates the files of all the directories together.
+func DeduplicatePaths(ctx context.Context, paths []string, params *Params) error {
 	duperemovePath, err := utils.GetBinary("duperemove")
 	if err != nil {
 		return err
 	}
 
-	duperemoveCmd := utils.BuildCommand(duperemovePath, "-dr", "-b", strconv.FormatUint(params.BlockSize, 10),
-		"--lookup-extents=yes", fmt.Sprintf("--hashfile=%s", _const.AppHashfilePath), path)
-
-	var errBuffer bytes.Buffer
-	duperemoveCmd.Stderr = &errBuffer
+	hashfile := params.Hashfile
+	if hashfile == "" {
+		hashfile = _const.AppHashfilePath
+	}
+	args := []string{"-dr", "-b", strconv.FormatUint(params.BlockSize, 10), "--lookup-extents=yes",
+		fmt.Sprintf("--hashfile=%s", hashfile)}
+	duperemoveCmd := utils.BuildCommand(ctx, duperemovePath, append(args, paths...)...)
 
-	if err := duperemoveCmd.Run(); err != nil {
-		if !strings.Contains(errBuffer.String(), "No dedupe candidates found") {
-			return errors.New("failed to perform data deduplication using `duperemove`")
+	if err := utils.RunCommand(duperemoveCmd); err != nil {
+		var cmdErr *utils.CommandError
+		if !errors.As(err, &cmdErr) || !strings.Contains(cmdErr.Stderr, "No dedupe candidates found") {
+			return fmt.Errorf("failed to perform data deduplication using `duperemove`: %w", err)
 		}
 	}
 
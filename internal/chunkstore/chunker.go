@@ -0,0 +1,123 @@
+package chunkstore
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// ChunkerParams bound the size of the chunks, the average size is a power of two.
+type ChunkerParams struct {
+	MinSize int `json:"min_size"`
+	AvgSize int `json:"avg_size"`
+	MaxSize int `json:"max_size"`
+}
+
+// DefaultChunkerParams suit the dumps of YDB: the data files are large and change in place, so the chunks are
+// large enough to keep the manifests small and the chunk files few.
+var DefaultChunkerParams = ChunkerParams{MinSize: 256 * 1024, AvgSize: 1024 * 1024, MaxSize: 4 * 1024 * 1024}
+
+func (params ChunkerParams) validate() error {
+	if params.MinSize <= 0 || params.AvgSize < params.MinSize || params.MaxSize < params.AvgSize {
+		return errors.New("the chunk sizes must be 0 < min <= avg <= max")
+	}
+	if params.AvgSize&(params.AvgSize-1) != 0 {
+		return errors.New("the average chunk size must be a power of two")
+	}
+	return nil
+}
+
+// gearTable maps the bytes to the random values of the gear hash. It must never change, otherwise the same data
+// would be cut differently and not deduplicated with the chunks already stored.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	// splitmix64 with a fixed seed
+	state := uint64(0x59_44_42_2d_63_64_63_31)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunker splits the stream into content-defined chunks: a chunk ends where the gear hash of the last bytes matches
+// the mask, so an insertion or a deletion only changes the chunks around it, and the data which is shifted is still
+// cut at the same places.
+type Chunker struct {
+	r      io.Reader
+	params ChunkerParams
+	mask   uint64
+	buf    []byte
+	start  int
+	end    int
+	eof    bool
+}
+
+func NewChunker(r io.Reader, params ChunkerParams) (*Chunker, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return &Chunker{
+		r:      r,
+		params: params,
+		mask:   uint64(params.AvgSize-1) << (64 - bits.Len(uint(params.AvgSize-1))),
+		buf:    make([]byte, 2*params.MaxSize),
+	}, nil
+}
+
+// Next returns the next chunk, which is valid until the next call, and io.EOF after the last one.
+func (chunker *Chunker) Next() ([]byte, error) {
+	if chunker.end-chunker.start < chunker.params.MaxSize && !chunker.eof {
+		if err := chunker.fill(); err != nil {
+			return nil, err
+		}
+	}
+	if chunker.start == chunker.end {
+		return nil, io.EOF
+	}
+
+	data := chunker.buf[chunker.start:chunker.end]
+	n := chunker.cut(data)
+	chunker.start += n
+	return data[:n], nil
+}
+
+// fill moves the rest of the buffer to its beginning and reads until the buffer is full or the stream ends.
+func (chunker *Chunker) fill() error {
+	copy(chunker.buf, chunker.buf[chunker.start:chunker.end])
+	chunker.end -= chunker.start
+	chunker.start = 0
+
+	n, err := io.ReadFull(chunker.r, chunker.buf[chunker.end:])
+	chunker.end += n
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		chunker.eof = true
+		return nil
+	}
+	return err
+}
+
+// cut returns the size of the chunk at the beginning of the data. The bytes before the minimal size are skipped,
+// since no chunk ends there anyway. The mask selects the high bits of the hash, which depend on the last 64 bytes,
+// while the low ones depend on the last few bytes only.
+func (chunker *Chunker) cut(data []byte) int {
+	if len(data) <= chunker.params.MinSize {
+		return len(data)
+	}
+	n := len(data)
+	if n > chunker.params.MaxSize {
+		n = chunker.params.MaxSize
+	}
+
+	var hash uint64
+	for i := chunker.params.MinSize; i < n; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&chunker.mask == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,71 @@
+package chunkstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var testChunkerParams = ChunkerParams{MinSize: 256, AvgSize: 1024, MaxSize: 4096}
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func splitChunks(t *testing.T, data []byte) [][]byte {
+	chunker, err := NewChunker(bytes.NewReader(data), testChunkerParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for {
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunkerBounds(t *testing.T) {
+	data := randomData(1, 256*1024)
+	chunks := splitChunks(t, data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("the chunks do not add up to the data")
+	}
+	for i, chunk := range chunks {
+		last := i == len(chunks)-1
+		if len(chunk) > testChunkerParams.MaxSize || (!last && len(chunk) < testChunkerParams.MinSize) {
+			t.Fatalf("chunk %d has the size %d out of the bounds", i, len(chunk))
+		}
+	}
+}
+
+func TestChunkerStableAfterInsertion(t *testing.T) {
+	data := randomData(2, 256*1024)
+	inserted := append(append(append([]byte(nil), data[:100_000]...), []byte("inserted bytes")...), data[100_000:]...)
+
+	original := map[[32]byte]bool{}
+	for _, chunk := range splitChunks(t, data) {
+		original[sha256.Sum256(chunk)] = true
+	}
+	chunks := splitChunks(t, inserted)
+	var changed int
+	for _, chunk := range chunks {
+		if !original[sha256.Sum256(chunk)] {
+			changed++
+		}
+	}
+	// Only the chunk with the insertion and maybe the next one are cut differently
+	if changed == 0 || changed > 2 {
+		t.Fatalf("%d of %d chunks have changed after the insertion", changed, len(chunks))
+	}
+}
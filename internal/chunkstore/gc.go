@@ -0,0 +1,180 @@
+package chunkstore
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+)
+
+// GCStats tell what the garbage collection deleted.
+type GCStats struct {
+	Chunks int
+	Freed  int64
+}
+
+// GC deletes the chunks which no manifest refers to, e.g. those of the deleted backups and of the backups which
+// failed before their manifests were written. It must run under the exclusive lock, see Lock.
+func (store *Store) GC(ctx context.Context) (*GCStats, error) {
+	manifests, err := store.Manifests()
+	if err != nil {
+		return nil, err
+	}
+	referenced := map[string]bool{}
+	for _, manifest := range manifests {
+		for _, file := range manifest.Files {
+			for _, chunk := range file.Chunks {
+				referenced[chunk.Hash] = true
+			}
+		}
+	}
+
+	stored, err := store.chunkHashes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the chunks: %w", err)
+	}
+	stats := &GCStats{}
+	for hash, size := range stored {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		if referenced[hash] {
+			continue
+		}
+		if err := os.Remove(store.chunkPath(hash)); err != nil {
+			return stats, fmt.Errorf("failed to delete the chunk %s: %w", hash, err)
+		}
+		stats.Chunks++
+		stats.Freed += size
+	}
+
+	if err := store.cleanTemp(); err != nil {
+		log.WithContext(ctx).Warnf("failed to clean the temporary directory of the store: %v", err)
+	}
+	return stats, nil
+}
+
+// cleanTemp deletes the files the crashed commands have left in the temporary directory: the chunks and
+// the manifests are written under the shared lock, so they are abandoned, and so are the temporary directories
+// nobody has locked.
+func (store *Store) cleanTemp() error {
+	entries, err := os.ReadDir(store.path(tmpDir))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := store.path(tmpDir, entry.Name())
+		if !entry.IsDir() {
+			if !strings.HasSuffix(entry.Name(), tempLockExtension) {
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		locked, unlock, err := tryLockFile(path + tempLockExtension)
+		if err != nil {
+			return err
+		}
+		if !locked {
+			continue
+		}
+		err = os.RemoveAll(path)
+		if err == nil {
+			err = os.Remove(path + tempLockExtension)
+		}
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify reads every chunk the manifests refer to and checks it against its hash. All the chunks are read, and
+// the error tells how many of them are missing or corrupted.
+func (store *Store) Verify(ctx context.Context) (int, error) {
+	manifests, err := store.Manifests()
+	if err != nil {
+		return 0, err
+	}
+	referenced := map[string]bool{}
+	for _, manifest := range manifests {
+		for hash := range manifest.chunkSet() {
+			referenced[hash] = true
+		}
+	}
+
+	var failed int
+	for hash := range referenced {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if _, err := store.readChunk(hash); err != nil {
+			log.WithContext(ctx).Errorf("%v", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return len(referenced), fmt.Errorf("%w: %d of %d chunk(s) cannot be read", ErrCorruptedChunk, failed,
+			len(referenced))
+	}
+	return len(referenced), nil
+}
+
+// Usage is the space taken by the chunks of the backup.
+type Usage struct {
+	// Referenced is the size of the files of the backup
+	Referenced int64
+	// Stored is the size of the chunk files of the backup, after compression
+	Stored int64
+	// Exclusive is the size of the chunk files no other backup refers to, which deleting the backup frees
+	Exclusive int64
+}
+
+// Usage returns the usage of each backup by its path.
+func (store *Store) Usage() (map[string]*Usage, error) {
+	manifests, err := store.Manifests()
+	if err != nil {
+		return nil, err
+	}
+	stored, err := store.chunkHashes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the chunks: %w", err)
+	}
+
+	references := map[string]int{}
+	for _, manifest := range manifests {
+		for hash := range manifest.chunkSet() {
+			references[hash]++
+		}
+	}
+
+	usage := map[string]*Usage{}
+	for _, manifest := range manifests {
+		backupUsage := &Usage{}
+		for _, file := range manifest.Files {
+			backupUsage.Referenced += file.Size
+		}
+		for hash := range manifest.chunkSet() {
+			backupUsage.Stored += stored[hash]
+			if references[hash] == 1 {
+				backupUsage.Exclusive += stored[hash]
+			}
+		}
+		usage[manifest.Backup.Path] = backupUsage
+	}
+	return usage, nil
+}
+
+func (manifest *Manifest) chunkSet() map[string]bool {
+	chunks := map[string]bool{}
+	for _, file := range manifest.Files {
+		for _, chunk := range file.Chunks {
+			chunks[chunk.Hash] = true
+		}
+	}
+	return chunks
+}
@@ -0,0 +1,48 @@
+package chunkstore
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// Lock locks the store until unlock is called: the commands share the lock, while the garbage collection takes
+// it exclusively, so that it never deletes the chunks of a backup being created. It waits for the lock.
+func (store *Store) Lock(exclusive bool) (unlock func(), err error) {
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	unlock, err = lockFile(store.path(lockName), how)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock the store: %w", err)
+	}
+	return unlock, nil
+}
+
+// tryLockFile locks the file exclusively unless another process has it locked, and then returns false.
+func tryLockFile(path string) (locked bool, unlock func(), err error) {
+	unlock, err = lockFile(path, unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	return true, unlock, nil
+}
+
+func lockFile(path string, how int) (unlock func(), err error) {
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, chunkFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(file.Fd()), how); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return func() {
+		_ = file.Close()
+	}, nil
+}
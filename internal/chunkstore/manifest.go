@@ -0,0 +1,293 @@
+package chunkstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/utils"
+)
+
+const manifestExtension = ".json"
+
+// Manifest is the backup in the store: its meta entry and the list of its files, each one as the list of its chunks.
+type Manifest struct {
+	Backup meta.Backup `json:"backup"`
+	Files  []File      `json:"files"`
+}
+
+// File is the file, the directory or the symlink of the backup, the path is relative to the root of the backup.
+type File struct {
+	Path   string      `json:"path"`
+	Mode   fs.FileMode `json:"mode"`
+	Size   int64       `json:"size,omitempty"`
+	Link   string      `json:"link,omitempty"`
+	Chunks []Chunk     `json:"chunks,omitempty"`
+}
+
+type Chunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// PutStats tell how much of the backup is new to the store.
+type PutStats struct {
+	Chunks    int
+	NewChunks int
+	// Written is the size of the new chunk files, after compression
+	Written int64
+}
+
+// The manifest of the backup is next to its directory, which keeps only the sidecar once the backup is stored.
+func (store *Store) manifestPath(backupPath string) string {
+	return backupPath + manifestExtension
+}
+
+// HasManifest reports whether the backup is stored.
+func (store *Store) HasManifest(backupPath string) (bool, error) {
+	_, err := os.Stat(store.manifestPath(backupPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Put stores the files of the directory and returns the manifest of the backup, which is not written yet,
+// see WriteManifest.
+func (store *Store) Put(ctx context.Context, dir string, backup meta.Backup) (*Manifest, *PutStats, error) {
+	manifest := &Manifest{Backup: backup}
+	stats := &PutStats{}
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		// The sidecar is updated after the backup is stored, so it is kept next to the manifest instead
+		if relativePath == "." || relativePath == _const.BackupSidecarName {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		file := File{Path: filepath.ToSlash(relativePath), Mode: info.Mode()}
+		switch {
+		case info.IsDir():
+		case info.Mode()&fs.ModeSymlink != 0:
+			if file.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if file.Chunks, err = store.putFile(ctx, path, stats); err != nil {
+				return fmt.Errorf("failed to store `%s`: %w", relativePath, err)
+			}
+			file.Size = info.Size()
+		default:
+			return fmt.Errorf("cannot store `%s`, it is neither a file, a directory nor a symlink", relativePath)
+		}
+		manifest.Files = append(manifest.Files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifest, stats, nil
+}
+
+func (store *Store) putFile(ctx context.Context, path string, stats *PutStats) ([]Chunk, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	chunker, err := NewChunker(file, store.config.Chunker)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []Chunk
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			return chunks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		hash, written, err := store.putChunk(data)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, Chunk{Hash: hash, Size: int64(len(data))})
+		stats.Chunks++
+		if written > 0 {
+			stats.NewChunks++
+			stats.Written += written
+		}
+	}
+}
+
+// WriteManifest adds the backup to the store. Its chunks must be stored by Put under the same lock, so that
+// the garbage collection does not delete them meanwhile.
+func (store *Store) WriteManifest(manifest *Manifest) error {
+	path := store.manifestPath(manifest.Backup.Path)
+	if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		return fmt.Errorf("failed to create directory of the manifest `%s`: %w", path, err)
+	}
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := store.writeFileAtomically(path, encoded); err != nil {
+		return fmt.Errorf("failed to write the manifest `%s`: %w", path, err)
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest of the backup by its path.
+func (store *Store) ReadManifest(backupPath string) (*Manifest, error) {
+	path := store.manifestPath(backupPath)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the manifest `%s`: %w", path, err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse the manifest `%s`: %w", path, err)
+	}
+	// The store may have been moved since the backup was created
+	manifest.Backup.Path = backupPath
+	return &manifest, nil
+}
+
+// DeleteManifest deletes the backup, its chunks are deleted by the garbage collection.
+func (store *Store) DeleteManifest(backupPath string) error {
+	if err := os.Remove(store.manifestPath(backupPath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete the manifest of the backup `%s`: %w", filepath.Base(backupPath), err)
+	}
+	return nil
+}
+
+// Manifests returns the manifests of all the backups in the store, oldest first.
+func (store *Store) Manifests() ([]*Manifest, error) {
+	backupPaths, err := store.BackupPaths()
+	if err != nil {
+		return nil, err
+	}
+	manifests := make([]*Manifest, 0, len(backupPaths))
+	for _, backupPath := range backupPaths {
+		manifest, err := store.ReadManifest(backupPath)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+	sort.SliceStable(manifests, func(i, j int) bool {
+		return manifests[i].Backup.StartedCreationAt.Before(manifests[j].Backup.StartedCreationAt)
+	})
+	return manifests, nil
+}
+
+// BackupPaths returns the paths of all the stored backups, without reading their manifests.
+func (store *Store) BackupPaths() ([]string, error) {
+	var backupPaths []string
+	err := filepath.WalkDir(store.path(backupsDir), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// The directories of the backups keep their sidecars, and their files until they are stored
+		if entry.IsDir() {
+			if strings.HasPrefix(entry.Name(), _const.BackupSubvolumePrefix) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), _const.BackupSubvolumePrefix) &&
+			strings.HasSuffix(entry.Name(), manifestExtension) {
+			backupPaths = append(backupPaths, strings.TrimSuffix(path, manifestExtension))
+		}
+		return nil
+	})
+	return backupPaths, err
+}
+
+// Extract writes the files of the backup into the directory, which must be empty. Every chunk is checked against
+// its hash.
+func (store *Store) Extract(ctx context.Context, manifest *Manifest, dir string) error {
+	for _, file := range manifest.Files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path, err := utils.JoinInside(dir, file.Path)
+		if err != nil {
+			return fmt.Errorf("the manifest has the file outside of the backup: %w", err)
+		}
+
+		switch {
+		case file.Mode.IsDir():
+			if err := os.MkdirAll(path, file.Mode.Perm()|0o700); err != nil {
+				return err
+			}
+		case file.Mode&fs.ModeSymlink != 0:
+			if err := os.Symlink(file.Link, path); err != nil {
+				return err
+			}
+		case file.Mode.IsRegular():
+			if err := store.extractFile(ctx, &file, path); err != nil {
+				return fmt.Errorf("failed to restore `%s`: %w", file.Path, err)
+			}
+		default:
+			return fmt.Errorf("the manifest has the file `%s` of the unsupported type", file.Path)
+		}
+	}
+	return nil
+}
+
+func (store *Store) extractFile(ctx context.Context, file *File, path string) error {
+	target, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, file.Mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, chunk := range file.Chunks {
+		if err := ctx.Err(); err != nil {
+			_ = target.Close()
+			return err
+		}
+		data, err := store.readChunk(chunk.Hash)
+		if err != nil {
+			_ = target.Close()
+			return err
+		}
+		if _, err := target.Write(data); err != nil {
+			_ = target.Close()
+			return err
+		}
+		size += int64(len(data))
+	}
+	if size != file.Size {
+		_ = target.Close()
+		return fmt.Errorf("the size of the file is %d instead of %d", size, file.Size)
+	}
+	return target.Close()
+}
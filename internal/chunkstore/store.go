@@ -0,0 +1,266 @@
+package chunkstore
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ErrCorruptedChunk is returned when the chunk cannot be decoded or does not match its hash.
+var ErrCorruptedChunk = errors.New("chunk is corrupted")
+
+// The layout of the store:
+//
+//	config.json                  the version and the chunker of the store
+//	chunks/<ab>/<sha256>         the chunks, named by the SHA-256 of their data and grouped by its first byte
+//	backups/<source>/<name>.json the manifests of the backups
+//	backups/<source>/<name>/     the directories of the backups, with only the sidecars once the backups are stored
+//	tmp/                         the dumps and the restored backups, and the chunks being written
+//	lock                         locked by the commands, exclusively by the garbage collection
+const (
+	configName    = "config.json"
+	chunksDir     = "chunks"
+	backupsDir    = "backups"
+	tmpDir        = "tmp"
+	lockName      = "lock"
+	storeVersion  = 1
+	dirPerm       = 0o700
+	chunkFilePerm = 0o600
+	// The temporary directories are locked by the files next to them, see TempDir
+	tempLockExtension = ".lock"
+)
+
+// The chunk file starts with the encoding of its data.
+const (
+	encodingRaw     byte = 0
+	encodingDeflate byte = 1
+)
+
+type config struct {
+	Version int           `json:"version"`
+	Chunker ChunkerParams `json:"chunker"`
+}
+
+// Store keeps the files of the backups as compressed chunks, each one stored once however many backups have it.
+type Store struct {
+	Path string
+	// Level is the level of DEFLATE the chunks are compressed with
+	Level  int
+	config config
+}
+
+// Open opens the store in the directory, creating it on the first run. No root is needed, only the permissions
+// on the directory.
+func Open(path string, level int) (*Store, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("invalid compression level %d of the chunks", level)
+	}
+	store := &Store{Path: path, Level: level}
+	for _, dir := range []string{store.Path, store.path(chunksDir), store.path(backupsDir), store.path(tmpDir)} {
+		if err := os.MkdirAll(dir, dirPerm); err != nil {
+			return nil, fmt.Errorf("failed to create directory `%s` of the store: %w", dir, err)
+		}
+	}
+
+	configPath := store.path(configName)
+	data, err := os.ReadFile(configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		store.config = config{Version: storeVersion, Chunker: DefaultChunkerParams}
+		encoded, err := json.MarshalIndent(store.config, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := store.writeFileAtomically(configPath, append(encoded, '\n')); err != nil {
+			return nil, fmt.Errorf("failed to create the config of the store: %w", err)
+		}
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the config of the store: %w", err)
+	}
+	if err := json.Unmarshal(data, &store.config); err != nil {
+		return nil, fmt.Errorf("failed to parse the config of the store `%s`: %w", configPath, err)
+	}
+	if store.config.Version != storeVersion {
+		return nil, fmt.Errorf("the store `%s` has the version %d, expected %d", store.Path, store.config.Version,
+			storeVersion)
+	}
+	if err := store.config.Chunker.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config of the store `%s`: %w", configPath, err)
+	}
+	return store, nil
+}
+
+func (store *Store) path(elem ...string) string {
+	return filepath.Join(append([]string{store.Path}, elem...)...)
+}
+
+// TempDir creates a directory for the dumps and the restored backups in the store, so that the files are never
+// copied across the file systems. It is locked until release, which deletes it, and the garbage collection
+// deletes the directories left unlocked by the crashed processes.
+func (store *Store) TempDir(pattern string) (dir string, release func(), err error) {
+	// The garbage collection would take the directory for an abandoned one until it is locked
+	unlockStore, err := store.Lock(false)
+	if err != nil {
+		return "", nil, err
+	}
+	defer unlockStore()
+
+	dir, err = os.MkdirTemp(store.path(tmpDir), pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	locked, unlock, err := tryLockFile(dir + tempLockExtension)
+	if err == nil && !locked {
+		err = fmt.Errorf("the temporary directory `%s` is locked already", dir)
+	}
+	if err != nil {
+		_ = os.Remove(dir)
+		return "", nil, err
+	}
+	return dir, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warnf("failed to delete the temporary directory `%s`: %v", dir, err)
+		}
+		_ = os.Remove(dir + tempLockExtension)
+		unlock()
+	}, nil
+}
+
+func (store *Store) chunkPath(hash string) string {
+	return store.path(chunksDir, hash[:2], hash)
+}
+
+// putChunk stores the chunk unless it is stored already, and returns its hash and the size of the new chunk
+// file, which is 0 for the chunk stored before.
+func (store *Store) putChunk(data []byte) (string, int64, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	path := store.chunkPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, 0, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", 0, err
+	}
+
+	encoded, err := store.encodeChunk(data)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		return "", 0, err
+	}
+	if err := store.writeFileAtomically(path, encoded); err != nil {
+		return "", 0, fmt.Errorf("failed to write the chunk %s: %w", hash, err)
+	}
+	return hash, int64(len(encoded)), nil
+}
+
+// encodeChunk compresses the chunk, the chunk which does not compress is kept as is.
+func (store *Store) encodeChunk(data []byte) ([]byte, error) {
+	var encoded bytes.Buffer
+	encoded.WriteByte(encodingDeflate)
+	writer, err := flate.NewWriter(&encoded, store.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if encoded.Len() > len(data) {
+		return append([]byte{encodingRaw}, data...), nil
+	}
+	return encoded.Bytes(), nil
+}
+
+// readChunk returns the data of the chunk, checked against its hash.
+func (store *Store) readChunk(hash string) ([]byte, error) {
+	encoded, err := os.ReadFile(store.chunkPath(hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the chunk %s: %w", hash, err)
+	}
+	if len(encoded) == 0 {
+		return nil, fmt.Errorf("%w: %s is empty", ErrCorruptedChunk, hash)
+	}
+
+	var data []byte
+	switch encoded[0] {
+	case encodingRaw:
+		data = encoded[1:]
+	case encodingDeflate:
+		data, err = io.ReadAll(flate.NewReader(bytes.NewReader(encoded[1:])))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrCorruptedChunk, hash, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s has the unknown encoding %d", ErrCorruptedChunk, hash, encoded[0])
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return nil, fmt.Errorf("%w: %s does not match its hash", ErrCorruptedChunk, hash)
+	}
+	return data, nil
+}
+
+// writeFileAtomically writes the file under a temporary name first, so that a crash never leaves a partial file
+// under the final name.
+func (store *Store) writeFileAtomically(path string, data []byte) (err error) {
+	file, err := os.CreateTemp(store.path(tmpDir), ".write_")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), chunkFilePerm); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// chunkHashes returns the hashes of the stored chunks.
+func (store *Store) chunkHashes() (map[string]int64, error) {
+	hashes := map[string]int64{}
+	err := filepath.WalkDir(store.path(chunksDir), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		hashes[entry.Name()] = info.Size()
+		return nil
+	})
+	return hashes, err
+}
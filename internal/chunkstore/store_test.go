@@ -0,0 +1,219 @@
+package chunkstore
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/meta"
+)
+
+// openTestStore opens the store with the small chunks, so that the test files are split into many of them.
+func openTestStore(t *testing.T) *Store {
+	path := t.TempDir()
+	encoded, err := json.Marshal(config{Version: storeVersion, Chunker: testChunkerParams})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, configName), encoded, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := Open(path, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// writeDump writes the files of a dump, the data file is random so that it does not compress.
+func writeDump(t *testing.T, seed int64) string {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "table"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"table/scheme.pb":        []byte("scheme"),
+		"table/data_00.csv":      randomData(seed, 64*1024),
+		"table/empty.csv":        nil,
+		_const.BackupSidecarName: []byte("{}"),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("data_00.csv", filepath.Join(dir, "table", "latest.csv")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func putBackup(t *testing.T, store *Store, dir string, name string) *Manifest {
+	backup := meta.Backup{Path: filepath.Join(store.Path, backupsDir, "test", name), Completed: true,
+		StartedCreationAt: time.Now()}
+	manifest, _, err := store.Put(context.Background(), dir, backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func TestPutExtract(t *testing.T) {
+	store := openTestStore(t)
+	dump := writeDump(t, 1)
+	manifest := putBackup(t, store, dump, "ydb_backup_1")
+
+	read, err := store.ReadManifest(manifest.Backup.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	if err := store.Extract(context.Background(), read, target); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"table/scheme.pb", "table/data_00.csv", "table/empty.csv"} {
+		expected, err := os.ReadFile(filepath.Join(dump, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := os.ReadFile(filepath.Join(target, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, actual) {
+			t.Errorf("`%s` differs after the round-trip", name)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(target, "table", "latest.csv")); err != nil || link != "data_00.csv" {
+		t.Errorf("the symlink is not restored: %q, %v", link, err)
+	}
+	if _, err := os.Stat(filepath.Join(target, _const.BackupSidecarName)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the sidecar is stored with the files: %v", err)
+	}
+}
+
+func TestPutDeduplicates(t *testing.T) {
+	store := openTestStore(t)
+	dump := writeDump(t, 1)
+	putBackup(t, store, dump, "ydb_backup_1")
+
+	_, stats, err := store.Put(context.Background(), dump, meta.Backup{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Chunks == 0 || stats.NewChunks != 0 || stats.Written != 0 {
+		t.Fatalf("the same files are stored again: %+v", stats)
+	}
+}
+
+func TestExtractDetectsCorruption(t *testing.T) {
+	store := openTestStore(t)
+	manifest := putBackup(t, store, writeDump(t, 1), "ydb_backup_1")
+
+	var hash string
+	for _, file := range manifest.Files {
+		if file.Path == "table/data_00.csv" {
+			hash = file.Chunks[0].Hash
+		}
+	}
+	if err := os.WriteFile(store.chunkPath(hash), append([]byte{encodingRaw}, "garbage"...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := store.Extract(context.Background(), manifest, t.TempDir())
+	if !errors.Is(err, ErrCorruptedChunk) {
+		t.Fatalf("expected the corrupted chunk to be detected, got %v", err)
+	}
+	if _, err := store.Verify(context.Background()); !errors.Is(err, ErrCorruptedChunk) {
+		t.Fatalf("expected verify to detect the corrupted chunk, got %v", err)
+	}
+}
+
+func TestGCKeepsReferencedChunks(t *testing.T) {
+	store := openTestStore(t)
+	kept := putBackup(t, store, writeDump(t, 1), "ydb_backup_1")
+	deleted := putBackup(t, store, writeDump(t, 2), "ydb_backup_2")
+	if err := store.DeleteManifest(deleted.Backup.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := store.GC(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unique := map[string]bool{}
+	for hash := range deleted.chunkSet() {
+		if !kept.chunkSet()[hash] {
+			unique[hash] = true
+		}
+	}
+	if stats.Chunks != len(unique) {
+		t.Errorf("deleted %d chunk(s), expected %d", stats.Chunks, len(unique))
+	}
+	if err := store.Extract(context.Background(), kept, t.TempDir()); err != nil {
+		t.Fatalf("the chunks of the kept backup are deleted: %v", err)
+	}
+	if count, err := store.Verify(context.Background()); err != nil || count != len(kept.chunkSet()) {
+		t.Fatalf("verified %d chunk(s) of %d: %v", count, len(kept.chunkSet()), err)
+	}
+}
+
+func TestGCKeepsLockedTempDirs(t *testing.T) {
+	store := openTestStore(t)
+	active, release, err := store.TempDir("run_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	abandoned, err := os.MkdirTemp(filepath.Join(store.Path, tmpDir), "run_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GC(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(active); err != nil {
+		t.Errorf("the locked temporary directory is deleted: %v", err)
+	}
+	if _, err := os.Stat(abandoned); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the abandoned temporary directory is left: %v", err)
+	}
+}
+
+func TestExtractRejectsEscapes(t *testing.T) {
+	store := openTestStore(t)
+	for name, files := range map[string][]File{
+		"dot-dot":  {{Path: "a/../../escaped", Mode: 0o644}},
+		"absolute": {{Path: "/tmp/escaped", Mode: 0o644}},
+		"symlink": {
+			{Path: "link", Mode: fs.ModeSymlink | 0o777, Link: ".."},
+			{Path: "link/escaped", Mode: 0o644},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "backup")
+			if err := os.Mkdir(dir, 0o700); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Extract(context.Background(), &Manifest{Files: files}, dir); err == nil {
+				t.Fatal("the file outside of the backup is extracted")
+			}
+			if _, err := os.Stat(filepath.Join(parent, "escaped")); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("the file is written outside of the backup: %v", err)
+			}
+		})
+	}
+}
@@ -1,25 +1,33 @@
 package command
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
-	"strings"
 	"text/tabwriter"
 	"time"
-	"ydb-backup-tool/internal/btrfs"
 	comp "ydb-backup-tool/internal/btrfs/compression"
 	"ydb-backup-tool/internal/btrfs/deduplication/duperemove"
 	_const "ydb-backup-tool/internal/const"
-	"ydb-backup-tool/internal/device"
+	"ydb-backup-tool/internal/hooks"
 	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/notify"
+	"ydb-backup-tool/internal/repository"
 	"ydb-backup-tool/internal/utils"
-	_math "ydb-backup-tool/internal/utils/math"
 	"ydb-backup-tool/internal/ydb"
 )
 
+// ErrBackupNotFound is returned when the requested backup does not exist.
+var ErrBackupNotFound = errors.New("backup is not found")
+
+// ErrMetaOutOfDate is returned when the meta file misses completed backups, e.g. after it was lost.
+var ErrMetaOutOfDate = errors.New("meta file is out of date")
+
 type Command int64
 
 const (
@@ -27,94 +35,108 @@ const (
 	ListAllBackupsSizes
 	CreateIncrementalBackup
 	RestoreFromBackup
+	PruneBackups
+	ExportMetrics
+	VerifyBackups
+	CompactBackups
+	RunDaemon
+	DeleteBackup
+	CheckEnvironment
+	CheckConsistency
+	RebuildMeta
+	PinBackup
+	InspectBackup
+	InitRepository
+	RotateKey
+	ExportBackup
+	ImportBackup
+	GenerateIdentity
+	PushBackup
+	PullBackup
+	ListRemoteBackups
 )
 
-func (command *Command) ListBackups(mountPoint *device.MountPoint) error {
-	if err := syncSubvolumesWithMeta(); err != nil {
+func (command *Command) ListBackups(ctx context.Context, repo repository.Repository, deleteOrphans bool,
+	selector *Selector) error {
+	if err := syncSubvolumesWithMeta(ctx, repo, deleteOrphans); err != nil {
 		return err
 	}
 
-	backupsSubvolume, err := getOrCreateBackupsSubvolume()
-	if err != nil {
-		return fmt.Errorf("failed to get subvolume with backups: %w", err)
-	}
-
-	if err := utils.Sync(); err != nil {
+	if err := utils.Sync(ctx); err != nil {
 		return err
 	}
 
-	metaBackups, err := meta.GetBackups()
+	metaBackups, err := repo.Meta().GetBackups()
 	if err != nil {
 		return fmt.Errorf("failed to get backups meta information: %w", err)
 	}
 
-	var atLeastOneBackupCompleted bool
-	for _, metaBackup := range *metaBackups {
-		if metaBackup.Completed == true {
-			atLeastOneBackupCompleted = true
-			break
+	selectedBackups := selectBackups(*metaBackups, selector)
+	if len(selectedBackups) == 0 {
+		if selector.Empty() {
+			fmt.Printf("Currently, there is no backups")
+		} else {
+			fmt.Printf("There is no backups matching %s\n", selector)
 		}
-	}
-
-	if !atLeastOneBackupCompleted {
-		fmt.Printf("Currently, there is no backups")
 	} else {
-		subvolumes, err := btrfs.GetSubvolumes(backupsSubvolume.Path)
+		subvolumes, err := getBackupSubvolumes(ctx, repo)
 		if err != nil {
-			return fmt.Errorf("cannot get list of subvolumes: %w", err)
+			return err
 		}
 
-		var subvolumesMap = map[string]*btrfs.Subvolume{}
+		var subvolumesMap = map[string]*repository.Backup{}
 		for _, subvolume := range subvolumes {
 			subvolumesMap[subvolume.Path] = subvolume
 		}
 
-		w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
-		fmt.Fprintln(w, "#\tName\t")
-		for i, metaBackup := range *metaBackups {
-			if val, ok := subvolumesMap[metaBackup.Path]; ok && metaBackup.Completed {
-				fmt.Fprintln(w, fmt.Sprintf("%d\t%s\t", i, val.Name))
+		sources, groups := groupBySource(selectedBackups)
+		for n, source := range sources {
+			if n > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("Source: %s\n", formatSource(source))
+
+			w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+			fmt.Fprintln(w, "#\tName\tLabel\tTags\tPinned\tNote\t")
+			for i, metaBackup := range groups[source] {
+				if val, ok := subvolumesMap[metaBackup.Path]; ok {
+					pinned := ""
+					if metaBackup.Pinned {
+						pinned = "yes"
+					}
+					fmt.Fprintln(w, fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t%s\t", i, val.Name, metaBackup.Label,
+						formatTags(metaBackup.Tags), pinned, metaBackup.Note))
+				}
 			}
-		}
 
-		if err := w.Flush(); err != nil {
-			return err
+			if err := w.Flush(); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func (command *Command) ListBackupsSizes(mountPoint *device.MountPoint) error {
-	if err := syncSubvolumesWithMeta(); err != nil {
+func (command *Command) ListBackupsSizes(ctx context.Context, repo repository.Repository, deleteOrphans bool,
+	selector *Selector) error {
+	if err := syncSubvolumesWithMeta(ctx, repo, deleteOrphans); err != nil {
 		return err
 	}
 
-	backupsSubvolume, err := getOrCreateBackupsSubvolume()
-	if err != nil {
-		return fmt.Errorf("failed to get subvolume with backups: %w", err)
-	}
-
-	if err := utils.Sync(); err != nil {
+	if err := utils.Sync(ctx); err != nil {
 		return err
 	}
 
-	metaBackups, err := meta.GetBackups()
+	metaBackups, err := repo.Meta().GetBackups()
 	if err != nil {
 		return fmt.Errorf("failed to get backups meta information: %w", err)
 	}
 
-	var atLeastOneBackupCompleted bool
-	for _, metaBackup := range *metaBackups {
-		if metaBackup.Completed == true {
-			atLeastOneBackupCompleted = true
-			break
-		}
-	}
-
-	if !atLeastOneBackupCompleted {
-		log.Printf("Currently, there is no backups\n")
+	selectedBackups := selectBackups(*metaBackups, selector)
+	if len(selectedBackups) == 0 {
+		log.WithContext(ctx).Printf("Currently, there is no backups\n")
 	} else {
-		metaSubvolumes, err := btrfs.GetSubvolumesMeta(backupsSubvolume.Path)
+		metaSubvolumes, err := getBackupSubvolumesMeta(ctx, repo)
 		if err != nil {
 			return fmt.Errorf("failed to get meta information about subvolumes: %w", err)
 		}
@@ -122,19 +144,19 @@ func (command *Command) ListBackupsSizes(mountPoint *device.MountPoint) error {
 		sort.Slice(*metaSubvolumes, func(i, j int) bool {
 			return (*metaSubvolumes)[i].Id < (*metaSubvolumes)[j].Id
 		})
-		metaSubvolumeMap := map[string]btrfs.SubvolumeMeta{}
+		metaSubvolumeMap := map[string]repository.BackupMeta{}
 		for _, metaSubvolume := range *metaSubvolumes {
 			metaSubvolumeMap[metaSubvolume.Base.Path] = metaSubvolume
 		}
 
 		w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
-		fmt.Fprintln(w, "Id\tBackup Name\tUsage referenced\tUsage exclusive\t")
-		for _, metaBackup := range *metaBackups {
-			if val, ok := metaSubvolumeMap[metaBackup.Path]; ok && metaBackup.Completed {
+		fmt.Fprintln(w, "Id\tSource\tBackup Name\tUsage referenced\tUsage exclusive\t")
+		for _, metaBackup := range selectedBackups {
+			if val, ok := metaSubvolumeMap[metaBackup.Path]; ok {
 				sizeReferencedKb := float64(val.SizeReferenced) / 1024
 				sizeExclusiveKb := float64(val.SizeExclusive) / 1024
-				fmt.Fprintln(w, fmt.Sprintf("%d\t%s\t%.2fKb\t%.2fKb\t",
-					val.Id, val.Base.Name, sizeReferencedKb, sizeExclusiveKb))
+				fmt.Fprintln(w, fmt.Sprintf("%d\t%s\t%s\t%.2fKb\t%.2fKb\t",
+					val.Id, formatSource(metaBackup.Source), val.Base.Name, sizeReferencedKb, sizeExclusiveKb))
 			}
 		}
 
@@ -147,166 +169,369 @@ func (command *Command) ListBackupsSizes(mountPoint *device.MountPoint) error {
 }
 
 func (command *Command) CreateIncrementalBackup(
-	mountPoint *device.MountPoint,
+	ctx context.Context,
+	repo repository.Repository,
+	deleteOrphans bool,
 	ydbParams *ydb.YdbParams,
 	dumpParams *ydb.DumpParams,
 	compression *comp.Compression,
-	dedupParams *duperemove.Params) error {
-	if err := syncSubvolumesWithMeta(); err != nil {
-		return err
+	dedupParams *duperemove.Params,
+	source *Source,
+	labels *BackupLabels,
+	backupHooks *hooks.Hooks,
+	notifier *notify.Notifier) (backupPath string, err error) {
+	startedAt := time.Now()
+	hookEnv := &hooks.Env{Operation: "create"}
+	defer func() {
+		if err != nil {
+			runFailureHook(ctx, backupHooks, hookEnv, startedAt, err)
+		}
+		notifier.Notify(ctx, newSummary(hookEnv, startedAt, err))
+	}()
+
+	if err := syncSubvolumesWithMeta(ctx, repo, deleteOrphans); err != nil {
+		return "", err
 	}
 
-	backupsSubvolume, err := getOrCreateBackupsSubvolume()
+	sourceSubvolume, err := getOrCreateSourceSubvolume(ctx, repo, source)
 	if err != nil {
-		return fmt.Errorf("failed to get subvolume with backups: %w", err)
+		return "", fmt.Errorf("failed to get subvolume of the source `%s`: %w", source.Name, err)
 	}
 
-	targetPath := backupsSubvolume.Path + "/ydb_backup_" + strconv.Itoa(int(time.Now().Unix()))
-	subvolume, err := createFullBackupSubvolume(mountPoint, ydbParams, dumpParams, compression, targetPath)
+	if err := validateLabels(repo.Meta(), labels); err != nil {
+		return "", err
+	}
+
+	targetPath := sourceSubvolume.Path + "/" + _const.BackupSubvolumePrefix + strconv.Itoa(int(time.Now().Unix()))
+	hookEnv.BackupPath = targetPath
+	if err := backupHooks.Run(ctx, hooks.PreCreate, hookEnv); err != nil {
+		return "", fmt.Errorf("backup is aborted by the hook: %w", err)
+	}
+
+	phases := map[string]float64{}
+	subvolume, dumpSize, err := createFullBackupSubvolume(ctx, repo, ydbParams, dumpParams, compression, source, targetPath,
+		phases)
 	if err != nil {
-		return fmt.Errorf("cannot perform full backup: %w", err)
+		return "", fmt.Errorf("cannot perform full backup: %w", err)
 	}
+	hookEnv.DumpSize = dumpSize
 
-	if err := duperemove.DeduplicateDirectory(backupsSubvolume.Path, dedupParams); err != nil {
-		return err
+	dedupStartedAt := time.Now()
+	// The backups of the other sources are different databases, so they are not deduplicated against
+	if err := repo.Dedup(ctx, []string{sourceSubvolume.Path},
+		sourceDedupParams(dedupParams, source.Name)); err != nil {
+		return "", err
+	}
+	phases["dedup"] = time.Since(dedupStartedAt).Seconds()
+
+	if err := recordBackup(ctx, repo.Meta(), targetPath, dumpSize, phases, labels); err != nil {
+		return "", err
+	}
+
+	if backupHooks.Has(hooks.PostCreate) || notifier.Enabled() {
+		fillBackupUsage(ctx, repo, hookEnv, sourceSubvolume.Path)
+	}
+	if backupHooks.Has(hooks.PostCreate) {
+		hookEnv.Duration = time.Since(startedAt)
+		if err := backupHooks.Run(ctx, hooks.PostCreate, hookEnv); err != nil {
+			return "", fmt.Errorf("backup `%s` is created, but the hook failed: %w", subvolume.Path, err)
+		}
 	}
 
 	fmt.Printf("Successfully performed incremental backup!\nPath: %s\n", subvolume.Path)
-	return nil
+	return subvolume.Path, nil
 }
 
-func (command *Command) RestoreFromBackup(mountPoint *device.MountPoint,
+func (command *Command) RestoreFromBackup(ctx context.Context, repo repository.Repository,
+	deleteOrphans bool,
 	ydbParams *ydb.YdbParams,
 	restoreParams *ydb.RestoreParams,
-	sourcePath string) error {
-	if err := syncSubvolumesWithMeta(); err != nil {
+	reference string,
+	selector *Selector,
+	target *Source,
+	backupHooks *hooks.Hooks,
+	notifier *notify.Notifier) (err error) {
+	startedAt := time.Now()
+	hookEnv := &hooks.Env{Operation: "restore"}
+	defer func() {
+		if err != nil {
+			runFailureHook(ctx, backupHooks, hookEnv, startedAt, err)
+		}
+		notifier.Notify(ctx, newSummary(hookEnv, startedAt, err))
+	}()
+
+	if err := syncSubvolumesWithMeta(ctx, repo, deleteOrphans); err != nil {
 		return err
 	}
 
-	finalSourcePath := strings.TrimSpace(sourcePath)
-	if !strings.HasPrefix(finalSourcePath, "/") {
-		finalSourcePath = "/" + finalSourcePath
+	backup, err := resolveBackup(repo.Meta(), reference, selector)
+	if err != nil {
+		return err
 	}
-	if !strings.HasPrefix(finalSourcePath, _const.AppBackupsPath) {
-		finalSourcePath = _const.AppBackupsPath + finalSourcePath
+	finalSourcePath := backup.Path
+	sourcePath := filepath.Base(finalSourcePath)
+	hookEnv.BackupPath = finalSourcePath
+	printResolved(reference, selector, backup)
+	if err := target.checkSameDatabase(backup); err != nil {
+		return err
 	}
 
-	subvolumeExists, err := btrfs.VerifySubvolumeExists(finalSourcePath)
+	subvolume, err := repo.GetBackup(ctx, finalSourcePath)
 	if err != nil {
-		return fmt.Errorf("cannot obtain info about backup from `%s`", sourcePath)
+		return fmt.Errorf("cannot obtain info about backup from `%s`: %w", sourcePath, err)
+	}
+	if subvolume == nil {
+		return fmt.Errorf("%w: `%s`", ErrBackupNotFound, sourcePath)
 	}
-	if !subvolumeExists {
-		return fmt.Errorf("cannot find backup `%s`", sourcePath)
+
+	if err := backupHooks.Run(ctx, hooks.PreRestore, hookEnv); err != nil {
+		return fmt.Errorf("restore is aborted by the hook: %w", err)
 	}
 
-	if err := ydb.Restore(ydbParams, restoreParams, finalSourcePath); err != nil {
+	dumpPath, release, err := repo.Checkout(ctx, subvolume)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := ydb.Restore(ctx, ydbParams, restoreParams, dumpPath); err != nil {
 		return fmt.Errorf("failed to restore from the backup `%s`: %w", sourcePath, err)
 	}
 
+	hookEnv.Duration = time.Since(startedAt)
+	if err := backupHooks.Run(ctx, hooks.PostRestore, hookEnv); err != nil {
+		return fmt.Errorf("restored from the backup `%s`, but the hook failed: %w", sourcePath, err)
+	}
+
 	fmt.Printf("Successfully restored from the backup `%s`!\n", sourcePath)
 
 	return nil
 }
 
-func createFullBackupSubvolume(
-	mountPoint *device.MountPoint,
+func runFailureHook(ctx context.Context, backupHooks *hooks.Hooks, hookEnv *hooks.Env, startedAt time.Time,
+	err error) {
+	hookEnv.Duration = time.Since(startedAt)
+	hookEnv.Err = err
+	if err := backupHooks.Run(ctx, hooks.OnFailure, hookEnv); err != nil {
+		log.WithContext(ctx).Warnf("`%s` hook failed: %v", hooks.OnFailure, err)
+	}
+}
+
+func newSummary(hookEnv *hooks.Env, startedAt time.Time, err error) *notify.Summary {
+	summary := &notify.Summary{
+		Operation:       hookEnv.Operation,
+		Success:         err == nil,
+		BackupPath:      hookEnv.BackupPath,
+		StartedAt:       startedAt,
+		DurationSeconds: time.Since(startedAt).Seconds(),
+		DumpSize:        hookEnv.DumpSize,
+		SizeExclusive:   hookEnv.SizeExclusive,
+		SizeReferenced:  hookEnv.SizeReferenced,
+	}
+	if hookEnv.BackupPath != "" {
+		summary.Backup = filepath.Base(hookEnv.BackupPath)
+	}
+	// Everything which is referenced, but not exclusive, is shared with the other backups
+	if hookEnv.SizeReferenced > hookEnv.SizeExclusive {
+		summary.DedupSavings = hookEnv.SizeReferenced - hookEnv.SizeExclusive
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	return summary
+}
+
+func fillBackupUsage(ctx context.Context, repo repository.Repository, hookEnv *hooks.Env, backupsPath string) {
+	metaSubvolumes, err := repo.BackupUsage(ctx, backupsPath)
+	if err != nil {
+		log.WithContext(ctx).Warnf("failed to get usage of the backup `%s`: %v", hookEnv.BackupPath, err)
+		return
+	}
+
+	for _, metaSubvolume := range metaSubvolumes {
+		if metaSubvolume.Base.Path == hookEnv.BackupPath {
+			hookEnv.SizeExclusive = metaSubvolume.SizeExclusive
+			hookEnv.SizeReferenced = metaSubvolume.SizeReferenced
+		}
+	}
+}
+
+func createFullBackupSubvolume(ctx context.Context, repo repository.Repository,
 	ydbParams *ydb.YdbParams,
 	dumpParams *ydb.DumpParams,
 	compression *comp.Compression,
-	targetPath string) (*btrfs.Subvolume, error) {
-	if err := utils.CreateDirectory(_const.AppTmpPath); err != nil {
-		return nil, fmt.Errorf("failed to create directory `%s`", _const.AppTmpPath)
+	source *Source,
+	targetPath string,
+	phases map[string]float64) (_ *repository.Backup, _ int64, err error) {
+	estimate := estimateBackupSpace(ctx, repo, ydbParams, dumpParams, source)
+	if err := prepareSpace(ctx, repo, estimate, phases); err != nil {
+		return nil, 0, err
 	}
 
-	tempBackupPath := _const.AppTmpPath + "/temp_backup_" + strconv.Itoa(int(time.Now().Unix()))
-	if err := utils.CreateDirectory(tempBackupPath); err != nil {
-		return nil, fmt.Errorf("failed to create a temporary directory for backup `%s`", tempBackupPath)
+	if err := repo.Meta().StartBackup(targetPath, source.Name, source.Endpoint, source.Database); err != nil {
+		return nil, 0, err
 	}
 	defer func() {
-		if err := utils.DeleteDirectory(tempBackupPath); err != nil {
-			log.Warnf("failed to delete temporary backup directory `%s`", tempBackupPath)
+		if err != nil {
+			abortBackup(ctx, repo, targetPath, err)
 		}
 	}()
+	recordDatabaseSize(ctx, repo.Meta(), targetPath, estimate)
 
-	if err := meta.StartBackup(targetPath); err != nil {
-		return nil, err
+	if dumpsDirectly(ctx, dumpParams, estimate) {
+		return dumpIntoSubvolume(ctx, repo, ydbParams, dumpParams, compression, targetPath, phases)
 	}
 
-	backup, err := ydb.Dump(ydbParams, dumpParams, tempBackupPath)
+	tempBackupPath, err := createTempBackupDirectory(repo)
 	if err != nil {
-		return nil, fmt.Errorf("error occurred during YDB backup process: %w", err)
+		return nil, 0, err
 	}
+	defer deleteTempBackupDirectory(ctx, tempBackupPath)
 
-	backupSize, err := utils.GetDirectorySize(backup.Path)
+	dumpPath, backupSize, err := dumpDatabase(ctx, ydbParams, dumpParams, tempBackupPath, phases)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get size of `%s`: %w", backup.Path, err)
+		return nil, 0, err
 	}
 
-	metaSize, err := btrfs.GetFileSystemUsage(mountPoint.Path)
+	subvolume, err := storeDump(ctx, repo, compression, dumpPath, backupSize, targetPath, phases)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get btrfs usage info: %w", err)
+		return nil, 0, err
 	}
+	return subvolume, backupSize, nil
+}
 
-	// Also, we should have 16Kib of free space to store subvolume metadata
-	btrfsFreeSpace := metaSize.Free - 16*1024
-	sizeDiff := btrfsFreeSpace - backupSize
-	if sizeDiff < 0 {
-		// Extend backing file size
-		extendBy := 2 * _math.Abs(sizeDiff)
+// createTempBackupDirectory creates a unique directory for the dump in the temporary directory of the repository,
+// which is outside the image, so that the image may be remounted while the database is being dumped.
+func createTempBackupDirectory(repo repository.Repository) (string, error) {
+	if err := utils.CreateDirectory(repo.TempPath()); err != nil {
+		return "", fmt.Errorf("failed to create directory `%s`: %w", repo.TempPath(), err)
+	}
 
-		if err := device.DetachLoopDevice(&mountPoint.LoopDev); err != nil {
-			return nil, fmt.Errorf("failed to detach loop device %s", mountPoint.LoopDev.Name)
-		}
-		if err := device.Unmount(mountPoint); err != nil {
-			return nil, fmt.Errorf("failed to unmount %s", mountPoint.Path)
-		}
-		if err := device.ExtendBackingStoreFileBy(&mountPoint.LoopDev.BackFile, _math.Abs(extendBy)); err != nil {
-			return nil, fmt.Errorf("failed to extend backing store file: %w", err)
-		}
+	tempBackupPath, err := os.MkdirTemp(repo.TempPath(), "temp_backup_")
+	if err != nil {
+		return "", fmt.Errorf("failed to create a temporary directory for backup: %w", err)
+	}
+	return tempBackupPath, nil
+}
 
-		newLoopDev, err := device.SetupLoopDevice(&mountPoint.LoopDev.BackFile)
-		if err != nil {
-			log.Panicf("Cannot create a new loop device. %v", err)
-		}
-		newMountPoint, err := device.MountLoopDevice(newLoopDev, mountPoint.Path, compression)
-		if err != nil {
-			return nil, fmt.Errorf("failed to mount %s", mountPoint.Path)
-		}
-		mountPoint = newMountPoint
-		if err := btrfs.ResizeFileSystem(mountPoint.Path, "max"); err != nil {
-			return nil, err
-		}
+func deleteTempBackupDirectory(ctx context.Context, tempBackupPath string) {
+	if err := utils.DeleteDirectory(tempBackupPath); err != nil {
+		log.WithContext(ctx).Warnf("failed to delete temporary backup directory `%s`", tempBackupPath)
 	}
+}
 
-	subvolume, err := btrfs.CreateSubvolume(targetPath)
+// dumpDatabase dumps the database into the temporary directory and returns the path and the size of the dump.
+func dumpDatabase(ctx context.Context,
+	ydbParams *ydb.YdbParams,
+	dumpParams *ydb.DumpParams,
+	tempBackupPath string,
+	phases map[string]float64) (string, int64, error) {
+	dumpStartedAt := time.Now()
+	backup, err := ydb.Dump(ctx, ydbParams, dumpParams, tempBackupPath)
+	if err != nil {
+		return "", 0, fmt.Errorf("error occurred during YDB backup process: %w", err)
+	}
+	phases["dump"] = time.Since(dumpStartedAt).Seconds()
+
+	backupSize, err := utils.GetDirectorySize(backup.Path)
 	if err != nil {
+		return "", 0, fmt.Errorf("failed to get size of `%s`: %w", backup.Path, err)
+	}
+	return backup.Path, backupSize, nil
+}
+
+// storeDump extends the image if the dump does not fit, e.g. when it exceeds the estimate, and moves the dump into
+// the new subvolume of the backup. The image may be remounted, so it must not be used by anything else meanwhile.
+func storeDump(ctx context.Context, repo repository.Repository,
+	compression *comp.Compression,
+	dumpPath string,
+	backupSize int64,
+	targetPath string,
+	phases map[string]float64) (*repository.Backup, error) {
+	resizeStartedAt := time.Now()
+	if err := repo.Reserve(ctx, backupSize, 0); err != nil {
 		return nil, err
 	}
-	if compression != nil {
-		if err := comp.EnableCompression(subvolume.Path, *compression); err != nil {
-			return nil, err
-		}
+	phases["resize"] += time.Since(resizeStartedAt).Seconds()
+
+	subvolume, err := repo.CreateBackup(ctx, targetPath, compression)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := utils.MoveFilesFromDirToDir(backup.Path, subvolume.Path); err != nil {
+	moveStartedAt := time.Now()
+	if err := utils.MoveFilesFromDirToDir(ctx, dumpPath, subvolume.Path); err != nil {
 		return nil, err
 	}
+	phases["move"] = time.Since(moveStartedAt).Seconds()
 
-	if err := meta.FinishBackup(targetPath); err != nil {
+	if err := repo.Meta().FinishBackup(targetPath); err != nil {
 		return nil, err
 	}
+	writeSidecar(ctx, repo.Meta(), targetPath)
 
 	return subvolume, nil
 }
 
-func getOrCreateBackupsSubvolume() (*btrfs.Subvolume, error) {
-	subvolume, err := btrfs.GetSubvolume(_const.AppBackupsPath)
+// recordBackup saves the statistics and the labels of the created backup.
+func recordBackup(ctx context.Context, store *meta.Store, targetPath string, dumpSize int64, phases map[string]float64,
+	labels *BackupLabels) error {
+	if err := store.RecordBackupStats(targetPath, dumpSize, phases); err != nil {
+		log.WithContext(ctx).Warnf("failed to record statistics of the backup `%s`: %v", targetPath, err)
+	}
+	if labels != nil {
+		if err := store.UpdateBackup(targetPath, func(backup *meta.Backup) {
+			backup.Label = labels.Label
+			backup.Tags = labels.Tags
+			backup.Note = labels.Note
+			backup.Pinned = labels.Pinned
+		}); err != nil {
+			return fmt.Errorf("backup `%s` is created, but its labels are not saved: %w", targetPath, err)
+		}
+	}
+	writeSidecar(ctx, store, targetPath)
+	return nil
+}
+
+// writeSidecar copies the meta entry into the subvolume. The backup is usable without it, so a failure is not fatal.
+func writeSidecar(ctx context.Context, store *meta.Store, path string) {
+	if err := store.WriteSidecar(path); err != nil {
+		log.WithContext(ctx).Warnf("failed to write the sidecar of the backup `%s`, `rebuild-meta` will rely on "+
+			"the creation time of the subvolume: %v", path, err)
+	}
+}
+
+// abortBackup deletes the partially created subvolume and marks the backup as aborted in the meta file.
+// It runs with its own context, since the context of the backup may already be cancelled.
+func abortBackup(ctx context.Context, repo repository.Repository, targetPath string, cause error) {
+	reason := cause.Error()
+	if ctx.Err() != nil {
+		reason = fmt.Sprintf("cancelled: %v", cause)
+	}
+	log.WithContext(ctx).Warnf("Aborting backup `%s`: %s", targetPath, reason)
+
+	cleanupCtx := context.Background()
+	subvolume, err := repo.GetBackup(cleanupCtx, targetPath)
+	if err != nil {
+		log.WithContext(ctx).Warnf("failed to check whether the partial backup `%s` exists: %v", targetPath, err)
+	} else if subvolume != nil {
+		if err := repo.DeleteBackup(cleanupCtx, subvolume); err != nil {
+			log.WithContext(ctx).Warnf("failed to delete the partial backup `%s`: %v", targetPath, err)
+		}
+	}
+
+	if err := repo.Meta().AbortBackup(targetPath, reason); err != nil {
+		log.WithContext(ctx).Warnf("failed to mark the backup `%s` as aborted: %v", targetPath, err)
+	}
+}
+
+func getOrCreateBackupsSubvolume(ctx context.Context, repo repository.Repository) (*repository.Backup, error) {
+	subvolume, err := repo.GetBackup(ctx, repo.BackupsPath())
 	if err != nil {
 		return nil, fmt.Errorf("cannot obtain info to verify that subvolume with backups exists: %w", err)
 	}
 
 	if subvolume == nil {
-		subvolume, err := btrfs.CreateSubvolume(_const.AppBackupsPath)
+		subvolume, err := repo.CreateBackup(ctx, repo.BackupsPath(), nil)
 		if err != nil {
 			return nil, err
 		}
@@ -316,19 +541,20 @@ func getOrCreateBackupsSubvolume() (*btrfs.Subvolume, error) {
 	return subvolume, nil
 }
 
-func syncSubvolumesWithMeta() error {
-	backupsSubvolume, err := getOrCreateBackupsSubvolume()
-	if err != nil {
-		return fmt.Errorf("failed to get subvolume with backups: %w", err)
-	}
-
-	subvolumes, err := btrfs.GetSubvolumes(backupsSubvolume.Path)
+// syncSubvolumesWithMeta checks the subvolumes against the meta file before a command. The subvolumes which are not
+// completed backups are deleted with deleteOrphans, otherwise they are only reported, and `fsck --repair` decides
+// what to do with them.
+func syncSubvolumesWithMeta(ctx context.Context, repo repository.Repository, deleteOrphans bool) error {
+	subvolumes, err := getBackupSubvolumes(ctx, repo)
 	if err != nil {
 		return err
 	}
 
-	metaBackups, err := meta.GetCompletedBackups()
+	metaBackups, err := repo.Meta().GetCompletedBackups()
 	if err != nil {
+		if errors.Is(err, meta.ErrCorrupted) {
+			return fmt.Errorf("run `rebuild-meta` to restore the meta file from the subvolumes: %w", err)
+		}
 		return err
 	}
 	metaBackupsPaths := utils.Map(*metaBackups, func(b meta.Backup) string { return b.Path })
@@ -337,13 +563,34 @@ func syncSubvolumesWithMeta() error {
 		metaBackupsSet[backupPath] = true
 	}
 
+	var orphans []*repository.Backup
 	for _, subvolume := range subvolumes {
 		if exists := metaBackupsSet[subvolume.Path]; !exists {
-			log.Warnf("Deleting non-completed backup or an unknown subvolume `%s`", subvolume.Name)
-
-			if err := btrfs.DeleteSubvolume(subvolume); err != nil {
-				return err
+			if !deleteOrphans {
+				log.WithContext(ctx).Warnf("Subvolume `%s` is not a completed backup, run `fsck` to check it", subvolume.Name)
+				continue
 			}
+			orphans = append(orphans, subvolume)
+		}
+	}
+
+	// A completed backup which is unknown to the meta file means that the meta file was lost or replaced,
+	// so nothing is deleted until it is rebuilt
+	for _, subvolume := range orphans {
+		sidecar, err := meta.ReadSidecar(subvolume.Path)
+		if err != nil {
+			return fmt.Errorf("refusing to delete subvolume `%s`: %w", subvolume.Name, err)
+		}
+		if sidecar != nil && sidecar.Completed {
+			return fmt.Errorf("%w: `%s` is a completed backup, run `rebuild-meta`", ErrMetaOutOfDate, subvolume.Name)
+		}
+	}
+
+	for _, subvolume := range orphans {
+		log.WithContext(ctx).Warnf("Deleting non-completed backup or an unknown subvolume `%s`", subvolume.Name)
+
+		if err := repo.DeleteBackup(ctx, subvolume); err != nil {
+			return err
 		}
 	}
 
@@ -0,0 +1,545 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"ydb-backup-tool/internal/btrfs/deduplication/duperemove"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/hooks"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/notify"
+	"ydb-backup-tool/internal/repository"
+	"ydb-backup-tool/internal/ydb"
+)
+
+// fakeYdbScript stands for `ydb`: `tools dump` writes a table into the output directory, and `tools restore` logs
+// the restored directory to $FAKE_YDB_LOG.
+const fakeYdbScript = `#!/bin/sh
+mode=""; out=""; in=""
+while [ $# -gt 0 ]; do
+  case "$1" in
+    dump|restore) mode="$1";;
+    -o) out="$2"; shift;;
+    -i) in="$2"; shift;;
+  esac
+  shift
+done
+case "$mode" in
+  dump)
+    mkdir -p "$out/table" && echo scheme > "$out/table/scheme.pb" &&
+      printf 'id,value\n1,one\n' > "$out/table/data_00.csv";;
+  restore)
+    test -f "$in/table/scheme.pb" && echo "$in" >> "$FAKE_YDB_LOG";;
+  *)
+    exit 1;;
+esac
+`
+
+// testEnv is the repository with its own meta file and the fake `ydb` on the PATH.
+type testEnv struct {
+	repo       repository.Repository
+	source     *Source
+	ydbParams  *ydb.YdbParams
+	dumpParams *ydb.DumpParams
+	restoreLog string
+}
+
+// newTestEnv opens the plain-directory repository.
+func newTestEnv(t *testing.T) *testEnv {
+	return newTestEnvWith(t, func(root string) repository.Repository {
+		return &repository.Dir{Root: root}
+	})
+}
+
+func newTestEnvWith(t *testing.T, newRepo func(root string) repository.Repository) *testEnv {
+	root := t.TempDir()
+	binDir := filepath.Join(root, "bin")
+	if err := os.Mkdir(binDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(binDir, "ydb"), []byte(fakeYdbScript), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	restoreLog := filepath.Join(root, "restore.log")
+	t.Setenv("FAKE_YDB_LOG", restoreLog)
+
+	storePath := filepath.Join(root, "store")
+	repo := newRepo(storePath)
+	if err := repo.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(repo.Close)
+
+	source, err := NewSource("test", "grpc://localhost:2136", "/local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testEnv{
+		repo:       repo,
+		source:     source,
+		ydbParams:  &ydb.YdbParams{Endpoint: source.Endpoint, Name: source.Database},
+		dumpParams: &ydb.DumpParams{Path: ".", ConsistencyLevel: "database", Parallelism: 1},
+		restoreLog: restoreLog,
+	}
+}
+
+func (env *testEnv) create(t *testing.T, labels *BackupLabels) string {
+	command := CreateIncrementalBackup
+	path, err := command.CreateIncrementalBackup(context.Background(), env.repo, false, env.ydbParams, env.dumpParams, nil,
+		&duperemove.Params{}, env.source, labels, &hooks.Hooks{}, &notify.Notifier{})
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	return path
+}
+
+// createSeveral creates the backups a second apart, since the names of the backups end with the creation time.
+func (env *testEnv) createSeveral(t *testing.T, count int) []string {
+	var paths []string
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+		}
+		paths = append(paths, env.create(t, nil))
+	}
+	return paths
+}
+
+func captureStdout(t *testing.T, run func() error) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	output := make(chan string)
+	go func() {
+		content, _ := io.ReadAll(reader)
+		output <- string(content)
+	}()
+
+	runErr := run()
+	os.Stdout = stdout
+	_ = writer.Close()
+	result := <-output
+	if runErr != nil {
+		t.Fatalf("the command failed: %v\n%s", runErr, result)
+	}
+	return result
+}
+
+func TestCreateBackup(t *testing.T) {
+	env := newTestEnv(t)
+	path := env.create(t, &BackupLabels{Label: "first", Tags: map[string]string{"env": "test"}})
+
+	if filepath.Dir(path) != filepath.Join(env.repo.BackupsPath(), "test") {
+		t.Fatalf("backup `%s` is not in the directory of its source", path)
+	}
+	if _, err := os.Stat(filepath.Join(path, "table", "data_00.csv")); err != nil {
+		t.Fatalf("the dump is not moved into the backup: %v", err)
+	}
+	backup, err := env.repo.Meta().GetBackup(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !backup.Completed || backup.Label != "first" || backup.Tags["env"] != "test" || backup.Source != "test" {
+		t.Fatalf("unexpected meta entry: %+v", backup)
+	}
+	sidecar, err := meta.ReadSidecar(path)
+	if err != nil || sidecar == nil || sidecar.Label != "first" {
+		t.Fatalf("the sidecar has no labels: %+v, %v", sidecar, err)
+	}
+	entries, err := os.ReadDir(env.repo.TempPath())
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("the temporary dump is left behind: %v, %v", entries, err)
+	}
+}
+
+// reservingRepo records the space reserved for the backups.
+type reservingRepo struct {
+	repository.Repository
+	reserved []int64
+}
+
+func (repo *reservingRepo) Reserve(ctx context.Context, required int64, tempSize int64) error {
+	repo.reserved = append(repo.reserved, required)
+	return repo.Repository.Reserve(ctx, required, tempSize)
+}
+
+func TestCreateDirectBackup(t *testing.T) {
+	env := newTestEnvWith(t, func(root string) repository.Repository {
+		return &reservingRepo{Repository: &repository.Dir{Root: root}}
+	})
+	repo := env.repo.(*reservingRepo)
+	env.dumpParams.Direct = true
+
+	// The fake database has no statistics, so the size of the first dump is not known in advance
+	first := env.create(t, nil)
+	backup, err := env.repo.Meta().GetBackup(first)
+	if err != nil || backup.DumpSize == 0 {
+		t.Fatalf("the first backup is not created: %+v, %v", backup, err)
+	}
+	if len(repo.reserved) != 1 || repo.reserved[0] != backup.DumpSize {
+		t.Fatalf("the space of the dump of unknown size is not reserved once it is over: %v", repo.reserved)
+	}
+
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	path := env.create(t, nil)
+	if len(repo.reserved) != 2 {
+		t.Fatalf("the estimated space is not reserved before the direct dump alone: %v", repo.reserved)
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "table", "data_00.csv")); err != nil {
+		t.Fatalf("the database is not dumped into the backup: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(path, _const.BackupStagingMarkerName)); !os.IsNotExist(err) {
+		t.Fatalf("the staging marker is left in the backup: %v", err)
+	}
+	backup, err = env.repo.Meta().GetBackup(path)
+	if err != nil || !backup.Completed {
+		t.Fatalf("the backup is not completed: %+v, %v", backup, err)
+	}
+}
+
+func TestListBackups(t *testing.T) {
+	env := newTestEnv(t)
+	paths := env.createSeveral(t, 2)
+
+	command := ListAllBackups
+	output := captureStdout(t, func() error {
+		return command.ListBackups(context.Background(), env.repo, false, &Selector{})
+	})
+	for _, path := range paths {
+		if !strings.Contains(output, filepath.Base(path)) {
+			t.Errorf("backup `%s` is not listed:\n%s", filepath.Base(path), output)
+		}
+	}
+
+	command = ListAllBackupsSizes
+	output = captureStdout(t, func() error {
+		return command.ListBackupsSizes(context.Background(), env.repo, false, &Selector{})
+	})
+	if !strings.Contains(output, filepath.Base(paths[1])) {
+		t.Errorf("the sizes of the backup `%s` are not listed:\n%s", filepath.Base(paths[1]), output)
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	env := newTestEnv(t)
+	paths := env.createSeveral(t, 3)
+	if err := env.repo.Meta().UpdateBackup(paths[0], func(backup *meta.Backup) {
+		backup.Pinned = true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	command := PruneBackups
+	captureStdout(t, func() error {
+		return command.PruneBackups(context.Background(), env.repo, false, &PruneParams{KeepLast: 1, Selector: &Selector{}},
+			&notify.Notifier{})
+	})
+
+	for i, expected := range []bool{true, false, true} {
+		_, err := os.Stat(paths[i])
+		if exists := err == nil; exists != expected {
+			t.Errorf("backup `%s` exists: %t, expected: %t", filepath.Base(paths[i]), exists, expected)
+		}
+	}
+	backups, err := env.repo.Meta().GetCompletedBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*backups) != 2 {
+		t.Fatalf("expected the pinned and the newest backups to be left, got %d", len(*backups))
+	}
+}
+
+func TestDeleteLatestBackupOfSource(t *testing.T) {
+	env := newTestEnv(t)
+	first := env.source
+	firstPaths := env.createSeveral(t, 2)
+	second, err := NewSource("second", "grpc://localhost:2136", "/second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.source = second
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	secondPath := env.create(t, nil)
+
+	command := DeleteBackup
+	if err := command.DeleteBackup(context.Background(), env.repo, LatestReference, nil); err == nil ||
+		!strings.Contains(err.Error(), "--source") {
+		t.Fatalf("`latest` is resolved across the sources: %v", err)
+	}
+	captureStdout(t, func() error {
+		return command.DeleteBackup(context.Background(), env.repo, LatestReference, &Selector{Source: first.Name})
+	})
+
+	backups, err := env.repo.Meta().GetBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, backup := range *backups {
+		left = append(left, backup.Path)
+	}
+	sort.Strings(left)
+	want := []string{firstPaths[0], secondPath}
+	sort.Strings(want)
+	if strings.Join(left, ",") != strings.Join(want, ",") {
+		t.Fatalf("the backups left are %v, want %v", left, want)
+	}
+}
+
+func TestRebuildMeta(t *testing.T) {
+	env := newTestEnv(t)
+	labeled := env.create(t, &BackupLabels{Label: "first", Tags: map[string]string{"env": "test"}})
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	withoutSidecar := env.create(t, nil)
+	if err := os.Remove(filepath.Join(withoutSidecar, _const.BackupSidecarName)); err != nil {
+		t.Fatal(err)
+	}
+	metaPath := env.repo.Meta().FilePath
+	if err := os.WriteFile(metaPath, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	command := RebuildMeta
+	output := captureStdout(t, func() error {
+		return command.RebuildMeta(context.Background(), env.repo)
+	})
+	if !strings.Contains(output, metaPath+".corrupted-") || !strings.Contains(output, "2 backup(s)") {
+		t.Fatalf("unexpected output of the rebuild:\n%s", output)
+	}
+
+	backup, err := env.repo.Meta().GetBackup(labeled)
+	if err != nil || !backup.Completed || backup.Label != "first" || backup.Tags["env"] != "test" {
+		t.Fatalf("the backup is not rebuilt from its sidecar: %+v, %v", backup, err)
+	}
+	backup, err = env.repo.Meta().GetBackup(withoutSidecar)
+	if err != nil || !backup.Completed || backup.Source != env.source.Name || backup.DumpSize == 0 {
+		t.Fatalf("the backup is not rebuilt from its dump: %+v, %v", backup, err)
+	}
+}
+
+// TestKeepOrphansOfOutdatedMeta checks that no subvolume is deleted as an orphan while the meta file is corrupted
+// or misses a completed backup.
+func TestKeepOrphansOfOutdatedMeta(t *testing.T) {
+	env := newTestEnv(t)
+	path := env.create(t, nil)
+	metaPath := env.repo.Meta().FilePath
+	content, err := os.ReadFile(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	command := ListAllBackups
+	if err := os.WriteFile(metaPath, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err = command.ListBackups(context.Background(), env.repo, true, &Selector{})
+	if !errors.Is(err, meta.ErrCorrupted) || !strings.Contains(err.Error(), "rebuild-meta") {
+		t.Fatalf("the orphans are looked for with the corrupted meta file: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("the backup is deleted with the corrupted meta file: %v", err)
+	}
+
+	if err := os.WriteFile(metaPath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.repo.Meta().DeleteBackup(path); err != nil {
+		t.Fatal(err)
+	}
+	err = command.ListBackups(context.Background(), env.repo, true, &Selector{})
+	if !errors.Is(err, ErrMetaOutOfDate) {
+		t.Fatalf("the completed backup missed by the meta file is an orphan: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("the completed backup missed by the meta file is deleted: %v", err)
+	}
+
+	// Without the sidecar, the subvolume is an orphan
+	if err := os.Remove(filepath.Join(path, _const.BackupSidecarName)); err != nil {
+		t.Fatal(err)
+	}
+	captureStdout(t, func() error {
+		return command.ListBackups(context.Background(), env.repo, true, &Selector{})
+	})
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("the orphan is not deleted: %v", err)
+	}
+}
+
+func TestMetricsTextfile(t *testing.T) {
+	env := newTestEnv(t)
+	path := env.create(t, nil)
+	if err := env.repo.Meta().RecordFailedRun(); err != nil {
+		t.Fatal(err)
+	}
+
+	textfile := filepath.Join(t.TempDir(), "ydb_backup.prom")
+	if err := WriteMetricsTextfile(context.Background(), env.repo, textfile); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(textfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"\nydb_backup_backups 1\n",
+		"\nydb_backup_failed_runs 1\n",
+		"\nydb_backup_referenced_bytes{backup=\"" + filepath.Base(path) + "\"} ",
+		"\nydb_backup_phase_duration_seconds{phase=\"dump\"} ",
+	} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("the textfile has no %q:\n%s", expected, content)
+		}
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	env := newTestEnv(t)
+	paths := env.createSeveral(t, 2)
+
+	command := RestoreFromBackup
+	restoreParams := &ydb.RestoreParams{Path: ".", Data: 1, Indexes: 1}
+	captureStdout(t, func() error {
+		return command.RestoreFromBackup(context.Background(), env.repo, false, env.ydbParams, restoreParams,
+			LatestReference+"~1", &Selector{Source: env.source.Name}, env.source, &hooks.Hooks{}, &notify.Notifier{})
+	})
+
+	restored, err := os.ReadFile(env.restoreLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(restored)) != paths[0] {
+		t.Fatalf("restored `%s` instead of `%s`", strings.TrimSpace(string(restored)), paths[0])
+	}
+
+	other, err := NewSource("other", "grpc://localhost:2136", "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = command.RestoreFromBackup(context.Background(), env.repo, false, env.ydbParams, restoreParams, LatestReference,
+		&Selector{Source: env.source.Name}, other, &hooks.Hooks{}, &notify.Notifier{})
+	if !errors.Is(err, ErrCrossDatabase) {
+		t.Fatalf("expected the cross-database restore to fail, got %v", err)
+	}
+}
+
+func TestChunkStoreBackups(t *testing.T) {
+	env := newTestEnvWith(t, func(root string) repository.Repository {
+		return &repository.Chunks{Dir: repository.Dir{Root: root}, Level: 6}
+	})
+	paths := env.createSeveral(t, 2)
+
+	entries, err := os.ReadDir(paths[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != _const.BackupSidecarName {
+		t.Fatalf("the files of the stored backup are left in its directory: %v", entries)
+	}
+	if _, err := os.Stat(paths[1] + ".json"); err != nil {
+		t.Fatalf("the manifest of the backup is not written: %v", err)
+	}
+
+	command := RestoreFromBackup
+	restoreParams := &ydb.RestoreParams{Path: ".", Data: 1, Indexes: 1}
+	captureStdout(t, func() error {
+		return command.RestoreFromBackup(context.Background(), env.repo, false, env.ydbParams, restoreParams,
+			LatestReference+"~1", &Selector{Source: env.source.Name}, env.source, &hooks.Hooks{}, &notify.Notifier{})
+	})
+	restored, err := os.ReadFile(env.restoreLog)
+	if err != nil {
+		t.Fatalf("the backup is not restored: %v", err)
+	}
+	if _, err := os.Stat(strings.TrimSpace(string(restored))); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the assembled backup is left behind: %v", err)
+	}
+
+	command = PruneBackups
+	captureStdout(t, func() error {
+		return command.PruneBackups(context.Background(), env.repo, false, &PruneParams{KeepLast: 1, Selector: &Selector{}},
+			&notify.Notifier{})
+	})
+	for _, path := range []string{paths[0], paths[0] + ".json"} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("`%s` of the pruned backup is left: %v", path, err)
+		}
+	}
+
+	command = VerifyBackups
+	captureStdout(t, func() error {
+		return command.VerifyBackups(context.Background(), env.repo)
+	})
+}
+
+// failingDedupRepo is the repository which cannot deduplicate the backups, it records the hashfiles of the dedups.
+type failingDedupRepo struct {
+	repository.Repository
+	hashfiles []string
+}
+
+func (repo *failingDedupRepo) Dedup(ctx context.Context, paths []string, params *duperemove.Params) error {
+	repo.hashfiles = append(repo.hashfiles, params.Hashfile)
+	return errors.New("dedup failed")
+}
+
+func TestCreateMultiSourceBackup(t *testing.T) {
+	env := newTestEnvWith(t, func(root string) repository.Repository {
+		return &failingDedupRepo{Repository: &repository.Dir{Root: root}}
+	})
+	dedupRepo := env.repo.(*failingDedupRepo)
+	var jobs []*SourceJob
+	for _, name := range []string{"first", "second"} {
+		source, err := NewSource(name, "grpc://localhost:2136", "/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, &SourceJob{Source: source, YdbParams: &ydb.YdbParams{Endpoint: source.Endpoint,
+			Name: source.Database}, DumpParams: env.dumpParams})
+	}
+
+	command := CreateIncrementalBackup
+	var results []*SourceResult
+	output := captureStdout(t, func() (err error) {
+		results, err = command.CreateMultiSourceBackup(context.Background(), env.repo, false, jobs, 2, nil,
+			&duperemove.Params{}, nil, &hooks.Hooks{}, &notify.Notifier{})
+		return err
+	})
+	for _, result := range results {
+		if result.Err != nil || result.Warning == "" {
+			t.Fatalf("the backup of `%s` is not created with the dedup warning: %v, %q", result.Source, result.Err,
+				result.Warning)
+		}
+		backup, err := env.repo.Meta().GetBackup(result.Path)
+		if err != nil || !backup.Completed {
+			t.Fatalf("the backup of `%s` is not completed: %+v, %v", result.Source, backup, err)
+		}
+	}
+	if strings.Contains(output, "FAIL") || !strings.Contains(output, "dedup failed") {
+		t.Fatalf("the dedup failure is not reported as a warning:\n%s", output)
+	}
+	if strings.Join(dedupRepo.hashfiles, ",") != _const.AppHashfilePath+".first,"+_const.AppHashfilePath+".second" {
+		t.Fatalf("the sources are not deduplicated with their own hashfiles: %v", dedupRepo.hashfiles)
+	}
+
+	job, err := FindSourceJob(env.repo, jobs, "second/"+filepath.Base(results[1].Path), nil)
+	if err != nil || job != jobs[1] {
+		t.Fatalf("the backup of `second` is resolved to %+v, %v", job, err)
+	}
+	job, err = FindSourceJob(env.repo, jobs, LatestReference, &Selector{Source: "first"})
+	if err != nil || job != jobs[0] {
+		t.Fatalf("the latest backup of `first` is resolved to %+v, %v", job, err)
+	}
+}
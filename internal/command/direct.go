@@ -0,0 +1,123 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"time"
+	comp "ydb-backup-tool/internal/btrfs/compression"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/repository"
+	"ydb-backup-tool/internal/utils"
+	"ydb-backup-tool/internal/ydb"
+)
+
+// dumpsDirectly reports whether the database is dumped right into the subvolume of the backup. Nothing is reserved
+// for the dump without the estimate, so it goes into the temporary directory then, and the image is extended for its
+// actual size once it is over, see storeDump.
+func dumpsDirectly(ctx context.Context, dumpParams *ydb.DumpParams, estimate *SpaceEstimate) bool {
+	if !dumpParams.Direct {
+		return false
+	}
+	if estimate == nil {
+		log.WithContext(ctx).Warnf("The size of the dump is unknown, so it is dumped into the temporary directory " +
+			"rather than right into the backup")
+		return false
+	}
+	return true
+}
+
+// dumpIntoSubvolume creates the subvolume of the backup and dumps the database into it. The subvolume keeps the
+// staging marker until the meta entry is completed, see finishDirectDump, so that a partial dump left by a crash
+// is never taken for a backup.
+func dumpIntoSubvolume(ctx context.Context, repo repository.Repository,
+	ydbParams *ydb.YdbParams,
+	dumpParams *ydb.DumpParams,
+	compression *comp.Compression,
+	targetPath string,
+	phases map[string]float64) (*repository.Backup, int64, error) {
+	subvolume, err := createStagedSubvolume(ctx, repo, compression, targetPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	dumpSize, err := dumpIntoStagedSubvolume(ctx, ydbParams, dumpParams, subvolume, phases)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := finishDirectDump(ctx, repo.Meta(), targetPath); err != nil {
+		return nil, 0, err
+	}
+	return subvolume, dumpSize, nil
+}
+
+// createStagedSubvolume creates the subvolume of the backup with the staging marker in it.
+func createStagedSubvolume(ctx context.Context, repo repository.Repository, compression *comp.Compression,
+	targetPath string) (*repository.Backup, error) {
+	subvolume, err := repo.CreateBackup(ctx, targetPath, compression)
+	if err != nil {
+		return nil, err
+	}
+	markerPath := filepath.Join(subvolume.Path, _const.BackupStagingMarkerName)
+	if err := os.WriteFile(markerPath, []byte(time.Now().Format(time.RFC3339)+"\n"), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to create the staging marker `%s`: %w", markerPath, err)
+	}
+	return subvolume, nil
+}
+
+// dumpIntoStagedSubvolume dumps the database into the subvolume and returns the size of the dump.
+func dumpIntoStagedSubvolume(ctx context.Context,
+	ydbParams *ydb.YdbParams,
+	dumpParams *ydb.DumpParams,
+	subvolume *repository.Backup,
+	phases map[string]float64) (int64, error) {
+	// `ydb tools dump` needs a directory of its own, the marker must stay out of the dump
+	stagingPath := filepath.Join(subvolume.Path, _const.BackupStagingDumpName)
+	dumpPath, dumpSize, err := dumpDatabase(ctx, ydbParams, dumpParams, stagingPath, phases)
+	if err != nil {
+		return 0, err
+	}
+
+	// Both directories are in the same subvolume, so the files are only renamed
+	moveStartedAt := time.Now()
+	if err := utils.MoveFilesFromDirToDir(ctx, dumpPath, subvolume.Path); err != nil {
+		return 0, err
+	}
+	if err := os.Remove(stagingPath); err != nil {
+		return 0, fmt.Errorf("failed to delete the staging directory `%s`: %w", stagingPath, err)
+	}
+	phases["move"] = time.Since(moveStartedAt).Seconds()
+	return dumpSize, nil
+}
+
+// finishDirectDump completes the meta entry and only then deletes the staging marker.
+func finishDirectDump(ctx context.Context, store *meta.Store, targetPath string) error {
+	if err := store.FinishBackup(targetPath); err != nil {
+		return err
+	}
+	writeSidecar(ctx, store, targetPath)
+
+	markerPath := filepath.Join(targetPath, _const.BackupStagingMarkerName)
+	if err := os.Remove(markerPath); err != nil {
+		log.WithContext(ctx).Warnf("failed to delete the staging marker `%s`, the backup is completed: %v", markerPath, err)
+	}
+	return nil
+}
+
+// isStaged reports whether the subvolume holds a dump which is possibly incomplete. The dump is trusted anyway
+// when its sidecar says that the backup is completed, since the marker is deleted after the sidecar is written.
+func isStaged(path string, sidecar *meta.Backup) (bool, error) {
+	if sidecar != nil && sidecar.Completed {
+		return false, nil
+	}
+	_, err := os.Stat(filepath.Join(path, _const.BackupStagingMarkerName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,43 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"text/tabwriter"
+	"ydb-backup-tool/internal/doctor"
+)
+
+// Doctor prints the result of each check. The mount point of the options is nil when the image could not be mounted.
+func (command *Command) Doctor(ctx context.Context, options *doctor.Options) error {
+	results := doctor.Run(ctx, options)
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 2, ' ', 0)
+	for _, result := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", result.Status, result.Check, result.Message)
+		if result.Remediation != "" {
+			fmt.Fprintf(w, "\t\t-> %s\t\n", result.Remediation)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return doctor.Failed(results)
+}
+
+// Preflight runs the checks of `doctor` before a backup and fails if any of them fails. Only the problems are logged.
+func Preflight(ctx context.Context, options *doctor.Options) error {
+	results := doctor.Run(ctx, options)
+	for _, result := range results {
+		switch result.Status {
+		case doctor.StatusWarn:
+			log.WithContext(ctx).Warnf("Preflight: %s: %s", result.Check, result.Message)
+		case doctor.StatusFail:
+			log.WithContext(ctx).Errorf("Preflight: %s: %s. Remediation: %s", result.Check, result.Message, result.Remediation)
+		}
+	}
+
+	return doctor.Failed(results)
+}
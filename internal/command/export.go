@@ -0,0 +1,330 @@
+package command
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"ydb-backup-tool/internal/archive"
+	comp "ydb-backup-tool/internal/btrfs/compression"
+	"ydb-backup-tool/internal/btrfs/deduplication/duperemove"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/envelope"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/repository"
+	"ydb-backup-tool/internal/utils"
+)
+
+// StdStream is the name of the output or the input meaning the standard output or input.
+const StdStream = "-"
+
+// ArchiveEncryption lists who can decrypt the exported archive: the owners of the identities of the recipients
+// and whoever knows the passphrase. Without it the archive is not encrypted.
+type ArchiveEncryption struct {
+	Recipients []*envelope.Recipient
+	Passphrase []byte
+}
+
+// ArchiveDecryption is what the imported archive is decrypted with. The passphrase is only asked for when none
+// of the identities is a recipient of the archive.
+type ArchiveDecryption struct {
+	Identities []*envelope.Identity
+	Passphrase func() ([]byte, error)
+}
+
+// ExportBackup writes the backup resolved from the reference as an archive to the output, either a file or the
+// standard output. The archive is written to a temporary file first, so that a partial archive is never left
+// under the final name.
+func (command *Command) ExportBackup(ctx context.Context, repo repository.Repository, deleteOrphans bool,
+	reference string, selector *Selector, output string, encryption *ArchiveEncryption) error {
+	if err := syncSubvolumesWithMeta(ctx, repo, deleteOrphans); err != nil {
+		return err
+	}
+
+	backup, err := resolveBackup(repo.Meta(), reference, selector)
+	if err != nil {
+		return err
+	}
+	// The archive itself may go to the standard output
+	fprintResolved(os.Stderr, reference, selector, backup)
+	if !backup.Completed {
+		return fmt.Errorf("backup `%s` is not completed", filepath.Base(backup.Path))
+	}
+
+	subvolume, err := repo.GetBackup(ctx, backup.Path)
+	if err != nil {
+		return fmt.Errorf("cannot obtain info about backup `%s`: %w", filepath.Base(backup.Path), err)
+	}
+	if subvolume == nil {
+		return fmt.Errorf("%w: `%s`", ErrBackupNotFound, filepath.Base(backup.Path))
+	}
+	dir, release, err := repo.Checkout(ctx, subvolume)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	session, err := encryption.newSession()
+	if err != nil {
+		return err
+	}
+	if output == StdStream {
+		if err := writeArchive(ctx, os.Stdout, backup, dir, session); err != nil {
+			return fmt.Errorf("failed to export the backup `%s`: %w", filepath.Base(backup.Path), err)
+		}
+		fmt.Fprintf(os.Stderr, "Successfully exported the backup `%s`!\n", filepath.Base(backup.Path))
+		return nil
+	}
+
+	partialPath := output + ".partial"
+	file, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create the archive `%s`: %w", partialPath, err)
+	}
+	err = writeArchive(ctx, file, backup, dir, session)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partialPath, output)
+	}
+	if err != nil {
+		if removeErr := os.Remove(partialPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			log.WithContext(ctx).Warnf("failed to delete the partial archive `%s`: %v", partialPath, removeErr)
+		}
+		return fmt.Errorf("failed to export the backup `%s`: %w", filepath.Base(backup.Path), err)
+	}
+
+	fmt.Printf("Successfully exported the backup `%s`!\nArchive: %s\n", filepath.Base(backup.Path), output)
+	return nil
+}
+
+// newSession returns the session of the encrypted archive, or nil for the archive which is not encrypted.
+func (encryption *ArchiveEncryption) newSession() (*envelope.Session, error) {
+	if encryption == nil {
+		return nil, nil
+	}
+	return envelope.NewSession(encryption.Recipients, encryption.Passphrase)
+}
+
+func writeArchive(ctx context.Context, w io.Writer, backup *meta.Backup, dir string,
+	session *envelope.Session) error {
+	bufferedWriter := bufio.NewWriterSize(w, 1024*1024)
+	if session == nil {
+		if err := archive.Write(ctx, bufferedWriter, backup, dir); err != nil {
+			return err
+		}
+		return bufferedWriter.Flush()
+	}
+
+	encryptedWriter, err := session.NewWriter(bufferedWriter)
+	if err != nil {
+		return err
+	}
+	if err := archive.Write(ctx, encryptedWriter, backup, dir); err != nil {
+		return err
+	}
+	if err := encryptedWriter.Close(); err != nil {
+		return err
+	}
+	return bufferedWriter.Flush()
+}
+
+// ImportBackup adds the backup from the archive written by ExportBackup, the encrypted archive is decrypted
+// transparently. The backup keeps its name, source and labels, and is deduplicated with the other backups
+// of its source.
+func (command *Command) ImportBackup(ctx context.Context, repo repository.Repository, deleteOrphans bool,
+	input string, decryption *ArchiveDecryption, compression *comp.Compression, dedupParams *duperemove.Params) error {
+	if err := syncSubvolumesWithMeta(ctx, repo, deleteOrphans); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if input != StdStream {
+		file, err := os.Open(input)
+		if err != nil {
+			return fmt.Errorf("failed to open the archive: %w", err)
+		}
+		defer file.Close()
+		r = file
+	}
+
+	targetPath, err := importArchive(ctx, repo, r, decryption, compression, dedupParams)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Successfully imported the backup!\nPath: %s\n", targetPath)
+	return nil
+}
+
+// importArchive adds the backup from the archive and returns its path. The archive is read to the end, so that
+// a wrapping reader can verify it as a whole before the backup is added.
+func importArchive(ctx context.Context, repo repository.Repository, r io.Reader, decryption *ArchiveDecryption,
+	compression *comp.Compression, dedupParams *duperemove.Params) (targetPath string, err error) {
+	rawReader := bufio.NewReaderSize(r, 1024*1024)
+	r, err = decryptArchive(rawReader, decryption)
+	if err != nil {
+		return "", err
+	}
+
+	archiveReader, backup, err := archive.NewReader(r)
+	if err != nil {
+		return "", err
+	}
+	targetPath, err = importTarget(ctx, repo, backup)
+	if err != nil {
+		return "", err
+	}
+
+	if err := repo.Reserve(ctx, backup.DumpSize, 0); err != nil {
+		return "", err
+	}
+	subvolume, err := createStagedSubvolume(ctx, repo, compression, targetPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create the subvolume of the backup: %w", err)
+	}
+	var imported bool
+	defer func() {
+		if err != nil && !imported {
+			deleteImportedSubvolume(ctx, repo, targetPath)
+		}
+	}()
+
+	if err := archiveReader.Extract(ctx, subvolume.Path); err != nil {
+		return "", err
+	}
+	// The end of the encrypted archive is authenticated as well, so that a truncated archive is never imported
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return "", fmt.Errorf("failed to read the archive: %w", err)
+	}
+	if trailing, err := io.Copy(io.Discard, rawReader); err != nil {
+		return "", fmt.Errorf("failed to read the archive: %w", err)
+	} else if trailing > 0 {
+		return "", fmt.Errorf("the archive has %d unexpected bytes after its end", trailing)
+	}
+
+	backup.Path = targetPath
+	backup.Completed = true
+	if err := repo.Meta().AdoptBackupEntry(*backup); err != nil {
+		return "", err
+	}
+	imported = true
+	writeSidecar(ctx, repo.Meta(), targetPath)
+	markerPath := filepath.Join(targetPath, _const.BackupStagingMarkerName)
+	if err := os.Remove(markerPath); err != nil {
+		log.WithContext(ctx).Warnf("failed to delete the staging marker `%s`, the backup is imported: %v", markerPath, err)
+	}
+
+	if err := dedupImported(ctx, repo, backup, dedupParams); err != nil {
+		return targetPath, fmt.Errorf("backup `%s` is imported, but not deduplicated: %w", filepath.Base(targetPath),
+			err)
+	}
+	return targetPath, nil
+}
+
+// decryptArchive returns the archive as is unless it is encrypted.
+func decryptArchive(r *bufio.Reader, decryption *ArchiveDecryption) (io.Reader, error) {
+	encrypted, err := envelope.IsEncrypted(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the archive: %w", err)
+	}
+	if !encrypted {
+		return r, nil
+	}
+
+	header, encodedHeader, err := envelope.ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	decryptedReader, err := envelope.NewReader(r, header, encodedHeader, decryption.Identities, decryption.Passphrase)
+	if errors.Is(err, envelope.ErrNoIdentity) {
+		recipients := strings.Join(header.Fingerprints(), ", ")
+		if recipients == "" {
+			recipients = "none"
+		}
+		return nil, fmt.Errorf("%w, the archive is encrypted for the recipients %s, passphrase: %t", err,
+			recipients, header.HasPassphrase())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the archive: %w", err)
+	}
+	return decryptedReader, nil
+}
+
+// importTarget returns the path of the subvolume the backup from the archive is imported to. The meta entry comes
+// from another host, so its name and source are checked before they are made into a path.
+func importTarget(ctx context.Context, repo repository.Repository, backup *meta.Backup) (string, error) {
+	name := filepath.Base(backup.Path)
+	if !labelRegexp.MatchString(name) || !strings.HasPrefix(name, _const.BackupSubvolumePrefix) {
+		return "", fmt.Errorf("the archive has the backup with the invalid name `%s`", name)
+	}
+	if !backup.Completed {
+		return "", fmt.Errorf("the archive has the backup `%s` which is not completed", name)
+	}
+
+	parentPath := repo.BackupsPath()
+	if backup.Source != "" {
+		source, err := NewSource(backup.Source, backup.Endpoint, backup.Database)
+		if err != nil {
+			return "", err
+		}
+		sourceSubvolume, err := getOrCreateSourceSubvolume(ctx, repo, source)
+		if err != nil {
+			return "", fmt.Errorf("failed to get subvolume of the source `%s`: %w", source.Name, err)
+		}
+		parentPath = sourceSubvolume.Path
+	} else if _, err := getOrCreateBackupsSubvolume(ctx, repo); err != nil {
+		return "", fmt.Errorf("failed to get subvolume with backups: %w", err)
+	}
+
+	targetPath := parentPath + "/" + name
+	metaBackups, err := repo.Meta().GetBackups()
+	if err != nil {
+		return "", fmt.Errorf("failed to get backups meta information: %w", err)
+	}
+	for _, existing := range *metaBackups {
+		if existing.Path == targetPath {
+			return "", fmt.Errorf("backup `%s` already exists", name)
+		}
+	}
+	if err := validateLabels(repo.Meta(), &BackupLabels{Label: backup.Label}); err != nil {
+		return "", err
+	}
+	return targetPath, nil
+}
+
+// dedupImported deduplicates the imported backup with the other backups of its source, as on `create`.
+func dedupImported(ctx context.Context, repo repository.Repository, backup *meta.Backup,
+	dedupParams *duperemove.Params) error {
+	if backup.Source != "" {
+		return repo.Dedup(ctx, []string{filepath.Dir(backup.Path)}, sourceDedupParams(dedupParams, backup.Source))
+	}
+
+	metaBackups, err := repo.Meta().GetCompletedBackups()
+	if err != nil {
+		return err
+	}
+	legacyBackups := utils.Map(utils.Filter(*metaBackups, func(b meta.Backup) bool {
+		return b.Source == "" && filepath.Dir(b.Path) == repo.BackupsPath()
+	}), func(b meta.Backup) string {
+		return b.Path
+	})
+	return repo.Dedup(ctx, legacyBackups, dedupParams)
+}
+
+// deleteImportedSubvolume deletes the partially imported backup. It runs with its own context, since the context
+// of the import may already be cancelled.
+func deleteImportedSubvolume(ctx context.Context, repo repository.Repository, targetPath string) {
+	cleanupCtx := context.Background()
+	if err := repo.DeleteBackup(cleanupCtx, repository.NewBackup(targetPath)); err != nil {
+		log.WithContext(ctx).Warnf("failed to delete the partially imported backup `%s`: %v", targetPath, err)
+	}
+}
@@ -0,0 +1,237 @@
+package command
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/repository"
+	"ydb-backup-tool/internal/utils"
+)
+
+// ErrInconsistent is returned by `fsck` when problems are found and not repaired.
+var ErrInconsistent = errors.New("backups are inconsistent with the meta file")
+
+type FsckParams struct {
+	Repair bool
+	// The backups which are not completed for longer than this are considered abandoned
+	IncompleteAge time.Duration
+	// Adopt the orphaned subvolumes without asking
+	AssumeYes bool
+	Input     io.Reader
+}
+
+type fsckProblem string
+
+const (
+	problemOrphan     fsckProblem = "orphaned subvolume"
+	problemMissing    fsckProblem = "missing subvolume"
+	problemIncomplete fsckProblem = "incomplete backup"
+	problemAborted    fsckProblem = "leftover of aborted backup"
+)
+
+type fsckIssue struct {
+	problem   fsckProblem
+	path      string
+	details   string
+	subvolume *repository.BackupMeta
+}
+
+// Fsck reports the subvolumes without meta entries, the completed meta entries without subvolumes and the backups
+// which are not completed for longer than `IncompleteAge`. With `Repair` the orphans are adopted, the entries
+// without subvolumes are removed and the abandoned backups are deleted.
+func (command *Command) Fsck(ctx context.Context, repo repository.Repository, params *FsckParams) error {
+	issues, err := findInconsistencies(ctx, repo, params.IncompleteAge)
+	if err != nil {
+		return err
+	}
+
+	if len(issues) == 0 {
+		fmt.Println("No problems found.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 2, ' ', 0)
+	fmt.Fprintln(w, "Problem\tBackup\tDetails\t")
+	for _, issue := range issues {
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", issue.problem, filepath.Base(issue.path), issue.details)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if !params.Repair {
+		return fmt.Errorf("%w: %d problem(s) found, run `fsck` with `--repair` to fix them", ErrInconsistent,
+			len(issues))
+	}
+
+	input := bufio.NewReader(params.Input)
+	var unresolved int
+	for _, issue := range issues {
+		repaired, err := repairIssue(ctx, repo, issue, params, input)
+		if err != nil {
+			return fmt.Errorf("failed to repair %s `%s`: %w", issue.problem, issue.path, err)
+		}
+		if !repaired {
+			unresolved++
+		}
+	}
+
+	if unresolved > 0 {
+		return fmt.Errorf("%w: %d problem(s) are left", ErrInconsistent, unresolved)
+	}
+	fmt.Printf("Repaired %d problem(s).\n", len(issues))
+	return nil
+}
+
+func findInconsistencies(ctx context.Context, repo repository.Repository,
+	incompleteAge time.Duration) ([]fsckIssue, error) {
+	metaBackups, err := repo.Meta().GetBackups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backups meta information: %w", err)
+	}
+
+	subvolumes := map[string]*repository.BackupMeta{}
+	metaSubvolumes, err := getBackupSubvolumesMeta(ctx, repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get meta information about subvolumes: %w", err)
+	}
+	for i := range *metaSubvolumes {
+		subvolumes[(*metaSubvolumes)[i].Base.Path] = &(*metaSubvolumes)[i]
+	}
+
+	var issues []fsckIssue
+	known := map[string]bool{}
+	for _, backup := range *metaBackups {
+		known[backup.Path] = true
+		subvolume := subvolumes[backup.Path]
+
+		switch {
+		case backup.Completed && subvolume == nil:
+			issues = append(issues, fsckIssue{problem: problemMissing, path: backup.Path,
+				details: "the backup is completed in the meta file, but its subvolume does not exist"})
+		case backup.Aborted && subvolume != nil:
+			issues = append(issues, fsckIssue{problem: problemAborted, path: backup.Path, subvolume: subvolume,
+				details: fmt.Sprintf("aborted: %s", backup.AbortReason)})
+		case !backup.Completed && !backup.Aborted && time.Since(backup.StartedCreationAt) > incompleteAge:
+			issues = append(issues, fsckIssue{problem: problemIncomplete, path: backup.Path, subvolume: subvolume,
+				details: fmt.Sprintf("started at %s and never finished",
+					backup.StartedCreationAt.Format(time.RFC3339))})
+		}
+	}
+
+	for _, subvolume := range *metaSubvolumes {
+		if !known[subvolume.Base.Path] {
+			issues = append(issues, fsckIssue{problem: problemOrphan, path: subvolume.Base.Path,
+				subvolume: subvolumes[subvolume.Base.Path],
+				details:   fmt.Sprintf("created at %s, not in the meta file", subvolume.CreatedAt.Format(time.RFC3339))})
+		}
+	}
+
+	return issues, nil
+}
+
+func repairIssue(ctx context.Context, repo repository.Repository, issue fsckIssue, params *FsckParams,
+	input *bufio.Reader) (bool, error) {
+	switch issue.problem {
+	case problemMissing:
+		log.WithContext(ctx).Infof("Removing `%s` from the meta file", issue.path)
+		return true, repo.Meta().DeleteBackup(issue.path)
+	case problemAborted:
+		log.WithContext(ctx).Infof("Deleting the leftover subvolume of the aborted backup `%s`", issue.path)
+		return true, repo.DeleteBackup(ctx, &issue.subvolume.Base)
+	case problemIncomplete:
+		log.WithContext(ctx).Infof("Deleting the abandoned backup `%s`", issue.path)
+		if issue.subvolume != nil {
+			if err := repo.DeleteBackup(ctx, &issue.subvolume.Base); err != nil {
+				return false, err
+			}
+		}
+		return true, repo.Meta().AbortBackup(issue.path, "abandoned, found by fsck")
+	case problemOrphan:
+		return adoptOrphan(ctx, repo.Meta(), issue, params, input)
+	}
+	return false, nil
+}
+
+// adoptOrphan adds the subvolume to the meta file as a completed backup if its sidecar says so or it looks like
+// a YDB dump. The files of the completed backup may be kept elsewhere by the repository, e.g. in the chunk store.
+func adoptOrphan(ctx context.Context, store *meta.Store, issue fsckIssue, params *FsckParams,
+	input *bufio.Reader) (bool, error) {
+	// The sidecar keeps the original meta entry, e.g. when the meta file was lost
+	sidecar, err := meta.ReadSidecar(issue.path)
+	if err != nil {
+		log.WithContext(ctx).Warnf("Ignoring the sidecar of `%s`: %v", issue.path, err)
+		sidecar = nil
+	}
+	staged, err := isStaged(issue.path, sidecar)
+	if err != nil {
+		return false, err
+	}
+	if staged {
+		log.WithContext(ctx).Warnf("Subvolume `%s` holds an incomplete dump, it is left as is", issue.path)
+		return false, nil
+	}
+	if sidecar == nil || !sidecar.Completed {
+		isDump, err := looksLikeDump(issue.path)
+		if err != nil {
+			return false, err
+		}
+		if !isDump {
+			log.WithContext(ctx).Warnf("Subvolume `%s` does not contain a YDB dump, it is left as is", issue.path)
+			return false, nil
+		}
+	}
+
+	if !params.AssumeYes {
+		fmt.Printf("Adopt `%s` created at %s as a completed backup? [y/N] ", issue.subvolume.Base.Name,
+			issue.subvolume.CreatedAt.Format(time.RFC3339))
+		answer, err := input.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return false, err
+		}
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return false, nil
+		}
+	}
+
+	if sidecar != nil && sidecar.Completed {
+		log.WithContext(ctx).Infof("Adopting `%s` from its sidecar", issue.path)
+		return true, store.AdoptBackupEntry(*sidecar)
+	}
+
+	dumpSize, err := utils.GetDirectorySize(issue.path)
+	if err != nil {
+		return false, err
+	}
+	log.WithContext(ctx).Infof("Adopting `%s` as a backup created at %s", issue.path,
+		issue.subvolume.CreatedAt.Format(time.RFC3339))
+	return true, store.AdoptBackup(issue.path, issue.subvolume.CreatedAt, dumpSize)
+}
+
+// looksLikeDump checks that the directory contains the scheme of at least one table, as `ydb tools dump` writes.
+func looksLikeDump(path string) (bool, error) {
+	errFound := errors.New("found")
+	err := filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && entry.Name() == "scheme.pb" {
+			return errFound
+		}
+		return nil
+	})
+	if errors.Is(err, errFound) {
+		return true, nil
+	}
+	return false, err
+}
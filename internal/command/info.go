@@ -0,0 +1,70 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+	"ydb-backup-tool/internal/repository"
+)
+
+type BackupInfo struct {
+	Name           string            `json:"name"`
+	Path           string            `json:"path"`
+	StartedAt      time.Time         `json:"started_at"`
+	FinishedAt     *time.Time        `json:"finished_at,omitempty"`
+	DumpSize       int64             `json:"dump_size,omitempty"`
+	SizeReferenced uint64            `json:"size_referenced,omitempty"`
+	SizeExclusive  uint64            `json:"size_exclusive,omitempty"`
+	Label          string            `json:"label,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+	Note           string            `json:"note,omitempty"`
+	Pinned         bool              `json:"pinned,omitempty"`
+	Source         string            `json:"source,omitempty"`
+}
+
+// GetBackupsInfo returns the completed backups, oldest first. Unlike `list`, it never deletes the unknown
+// subvolumes, so it is safe to call while a backup is being created.
+func GetBackupsInfo(ctx context.Context, repo repository.Repository, withSizes bool) ([]BackupInfo, error) {
+	metaBackups, err := repo.Meta().GetCompletedBackups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backups meta information: %w", err)
+	}
+
+	metaSubvolumeMap := map[string]repository.BackupMeta{}
+	if withSizes && len(*metaBackups) > 0 {
+		metaSubvolumes, err := getBackupSubvolumesMeta(ctx, repo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get meta information about subvolumes: %w", err)
+		}
+		for _, metaSubvolume := range *metaSubvolumes {
+			metaSubvolumeMap[metaSubvolume.Base.Path] = metaSubvolume
+		}
+	}
+
+	result := make([]BackupInfo, 0, len(*metaBackups))
+	for _, metaBackup := range *metaBackups {
+		info := BackupInfo{
+			Name:       repository.NewBackup(metaBackup.Path).Name,
+			Path:       metaBackup.Path,
+			StartedAt:  metaBackup.StartedCreationAt,
+			FinishedAt: metaBackup.FinishedCreationAt,
+			DumpSize:   metaBackup.DumpSize,
+			Label:      metaBackup.Label,
+			Tags:       metaBackup.Tags,
+			Note:       metaBackup.Note,
+			Pinned:     metaBackup.Pinned,
+			Source:     metaBackup.Source,
+		}
+		if val, ok := metaSubvolumeMap[metaBackup.Path]; ok {
+			info.SizeReferenced = val.SizeReferenced
+			info.SizeExclusive = val.SizeExclusive
+		}
+		result = append(result, info)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartedAt.Before(result[j].StartedAt)
+	})
+	return result, nil
+}
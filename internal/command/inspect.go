@@ -0,0 +1,60 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+	"ydb-backup-tool/internal/repository"
+)
+
+// InspectBackup prints the meta information and the disk usage of the backup resolved from the reference.
+func (command *Command) InspectBackup(ctx context.Context, repo repository.Repository, reference string,
+	selector *Selector) error {
+	backup, err := resolveBackup(repo.Meta(), reference, selector)
+	if err != nil {
+		return err
+	}
+	printResolved(reference, selector, backup)
+
+	metaSubvolumes, err := getBackupSubvolumesMeta(ctx, repo)
+	if err != nil {
+		return fmt.Errorf("failed to get meta information about subvolumes: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", filepath.Base(backup.Path))
+	fmt.Fprintf(w, "Path:\t%s\n", backup.Path)
+	fmt.Fprintf(w, "Source:\t%s\n", formatSource(backup.Source))
+	if backup.Database != "" {
+		fmt.Fprintf(w, "Database:\t%s at %s\n", backup.Database, backup.Endpoint)
+	}
+	fmt.Fprintf(w, "Label:\t%s\n", backup.Label)
+	fmt.Fprintf(w, "Tags:\t%s\n", formatTags(backup.Tags))
+	fmt.Fprintf(w, "Note:\t%s\n", backup.Note)
+	fmt.Fprintf(w, "Pinned:\t%t\n", backup.Pinned)
+	fmt.Fprintf(w, "Started at:\t%s\n", backup.StartedCreationAt.Format(time.RFC3339))
+	if backup.FinishedCreationAt != nil {
+		fmt.Fprintf(w, "Finished at:\t%s\n", backup.FinishedCreationAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "Dump size:\t%.2fKb\n", float64(backup.DumpSize)/1024)
+	for _, subvolume := range *metaSubvolumes {
+		if subvolume.Base.Path == backup.Path {
+			fmt.Fprintf(w, "Usage referenced:\t%.2fKb\n", float64(subvolume.SizeReferenced)/1024)
+			fmt.Fprintf(w, "Usage exclusive:\t%.2fKb\n", float64(subvolume.SizeExclusive)/1024)
+		}
+	}
+
+	phases := make([]string, 0, len(backup.Phases))
+	for phase := range backup.Phases {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	for _, phase := range phases {
+		fmt.Fprintf(w, "Phase %s:\t%.1fs\n", phase, backup.Phases[phase])
+	}
+	return w.Flush()
+}
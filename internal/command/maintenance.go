@@ -0,0 +1,90 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"ydb-backup-tool/internal/btrfs/deduplication/duperemove"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/repository"
+)
+
+// VerifyBackups checks that the completed backups exist, and that the repository reads back intact, e.g. scrubs
+// the image.
+func (command *Command) VerifyBackups(ctx context.Context, repo repository.Repository) error {
+	metaBackups, err := repo.Meta().GetCompletedBackups()
+	if err != nil {
+		return fmt.Errorf("failed to get backups meta information: %w", err)
+	}
+
+	subvolumes, err := getBackupSubvolumes(ctx, repo)
+	if err != nil {
+		return err
+	}
+	subvolumesSet := map[string]bool{}
+	for _, subvolume := range subvolumes {
+		subvolumesSet[subvolume.Path] = true
+	}
+
+	var missing int
+	for _, metaBackup := range *metaBackups {
+		if !subvolumesSet[metaBackup.Path] {
+			log.WithContext(ctx).Errorf("Backup `%s` is completed in the meta file, but its subvolume is missing",
+				metaBackup.Path)
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d backup(s) are missing", missing)
+	}
+
+	if err := repo.Verify(ctx); err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully verified %d backup(s)!\n", len(*metaBackups))
+	return nil
+}
+
+// CompactBackups deduplicates the backups of each source, and then compacts the repository, e.g. balances the image.
+func (command *Command) CompactBackups(ctx context.Context, repo repository.Repository, deleteOrphans bool,
+	dedupParams *duperemove.Params) error {
+	if err := syncSubvolumesWithMeta(ctx, repo, deleteOrphans); err != nil {
+		return err
+	}
+
+	backupsSubvolume, err := getOrCreateBackupsSubvolume(ctx, repo)
+	if err != nil {
+		return fmt.Errorf("failed to get subvolume with backups: %w", err)
+	}
+
+	// Each source is deduplicated separately, as on `create`
+	subvolumes, err := repo.ListBackups(ctx, backupsSubvolume.Path)
+	if err != nil {
+		return fmt.Errorf("cannot get list of subvolumes: %w", err)
+	}
+	var legacyBackups []string
+	for _, subvolume := range subvolumes {
+		if strings.HasPrefix(subvolume.Name, _const.BackupSubvolumePrefix) {
+			legacyBackups = append(legacyBackups, subvolume.Path)
+			continue
+		}
+		if err := repo.Dedup(ctx, []string{subvolume.Path},
+			sourceDedupParams(dedupParams, subvolume.Name)); err != nil {
+			return err
+		}
+	}
+	// The backups created before the sources were introduced are right in the subvolume with backups
+	if len(legacyBackups) > 0 {
+		if err := repo.Dedup(ctx, legacyBackups, dedupParams); err != nil {
+			return err
+		}
+	}
+	if err := repo.Compact(ctx); err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully compacted backups!\n")
+	return nil
+}
@@ -0,0 +1,129 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/metrics"
+	"ydb-backup-tool/internal/repository"
+)
+
+const metricsPrefix = "ydb_backup_"
+
+func (command *Command) ExportMetrics(
+	ctx context.Context,
+	repo repository.Repository,
+	textfilePath string,
+	listenAddr string) error {
+	collector := func() (*metrics.Registry, error) {
+		return collectMetrics(ctx, repo)
+	}
+
+	if listenAddr != "" {
+		fmt.Printf("Serving metrics on http://%s/metrics\n", listenAddr)
+		return metrics.Serve(ctx, listenAddr, collector)
+	}
+
+	registry, err := collector()
+	if err != nil {
+		return err
+	}
+	if textfilePath != "" {
+		return metrics.WriteTextfile(registry, textfilePath)
+	}
+
+	_, err = registry.WriteTo(os.Stdout)
+	return err
+}
+
+// WriteMetricsTextfile is called after `create` and `prune` so that the textfile collector sees the outcome of the run.
+func WriteMetricsTextfile(ctx context.Context, repo repository.Repository, textfilePath string) error {
+	registry, err := collectMetrics(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	return metrics.WriteTextfile(registry, textfilePath)
+}
+
+func collectMetrics(ctx context.Context, repo repository.Repository) (*metrics.Registry, error) {
+	registry := metrics.NewRegistry()
+
+	metaBackups, err := repo.Meta().GetCompletedBackups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backups meta information: %w", err)
+	}
+
+	var lastBackup *meta.Backup
+	for i, backup := range *metaBackups {
+		if backup.FinishedCreationAt == nil {
+			continue
+		}
+		if lastBackup == nil || backup.FinishedCreationAt.After(*lastBackup.FinishedCreationAt) {
+			lastBackup = &(*metaBackups)[i]
+		}
+	}
+
+	registry.Set(metricsPrefix+"backups", "Number of completed backups.", float64(len(*metaBackups)))
+	if lastBackup != nil {
+		registry.Set(metricsPrefix+"last_success_timestamp_seconds",
+			"Unix time when the last successful backup was finished.",
+			float64(lastBackup.FinishedCreationAt.Unix()))
+		registry.Set(metricsPrefix+"dump_bytes", "Size of the YDB dump of the last successful backup.",
+			float64(lastBackup.DumpSize))
+		for phase, seconds := range lastBackup.Phases {
+			registry.Set(metricsPrefix+"phase_duration_seconds",
+				"Duration of each phase of the last successful backup.", seconds, "phase", phase)
+		}
+	}
+
+	stats, err := repo.Meta().GetStats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get statistics from the meta file: %w", err)
+	}
+	registry.Set(metricsPrefix+"failed_runs",
+		"Number of failed runs of the commands, e.g. create, restore, prune and the jobs of the daemon.",
+		float64(stats.FailedRuns))
+
+	completedPaths := map[string]bool{}
+	for _, backup := range *metaBackups {
+		completedPaths[backup.Path] = true
+	}
+
+	var referencedTotal uint64
+	if len(completedPaths) > 0 {
+		metaSubvolumes, err := getBackupSubvolumesMeta(ctx, repo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get meta information about subvolumes: %w", err)
+		}
+		for _, metaSubvolume := range *metaSubvolumes {
+			if !completedPaths[metaSubvolume.Base.Path] {
+				continue
+			}
+			referencedTotal += metaSubvolume.SizeReferenced
+			registry.Set(metricsPrefix+"exclusive_bytes", "Space used exclusively by the backup.",
+				float64(metaSubvolume.SizeExclusive), "backup", metaSubvolume.Base.Name)
+			registry.Set(metricsPrefix+"referenced_bytes", "Space referenced by the backup.",
+				float64(metaSubvolume.SizeReferenced), "backup", metaSubvolume.Base.Name)
+		}
+	}
+
+	fsUsage, err := repo.Usage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	registry.Set(metricsPrefix+"filesystem_free_bytes", "Estimated free space of the backups filesystem.",
+		float64(fsUsage.Free))
+	registry.Set(metricsPrefix+"filesystem_used_bytes", "Used space of the backups filesystem.",
+		float64(fsUsage.Used))
+
+	dedupRatio := 1.0
+	if fsUsage.Used > 0 && referencedTotal > 0 {
+		dedupRatio = float64(referencedTotal) / float64(fsUsage.Used)
+	}
+	registry.Set(metricsPrefix+"dedup_ratio",
+		"Ratio of the data referenced by all backups to the space used on the filesystem.", dedupRatio)
+
+	return registry, nil
+}
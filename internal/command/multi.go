@@ -0,0 +1,323 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+	comp "ydb-backup-tool/internal/btrfs/compression"
+	"ydb-backup-tool/internal/btrfs/deduplication/duperemove"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/hooks"
+	"ydb-backup-tool/internal/notify"
+	"ydb-backup-tool/internal/repository"
+	"ydb-backup-tool/internal/ydb"
+)
+
+// ErrPartialFailure is returned by the multi-source run when some of the sources are backed up and some are not.
+var ErrPartialFailure = errors.New("some of the sources failed")
+
+// SourceJob is a source of the multi-source run with its own connection and dump parameters.
+type SourceJob struct {
+	Source     *Source
+	YdbParams  *ydb.YdbParams
+	DumpParams *ydb.DumpParams
+}
+
+// FindSourceJob returns the job of the source of the backup resolved from the reference among the backups of
+// the selector, so that the backup is restored into the database of its own source.
+func FindSourceJob(repo repository.Repository, jobs []*SourceJob, reference string,
+	selector *Selector) (*SourceJob, error) {
+	backup, err := resolveBackup(repo.Meta(), reference, selector)
+	if err != nil {
+		return nil, err
+	}
+	if backup.Source == "" {
+		return nil, fmt.Errorf("backup `%s` has no source, its database is unknown", filepath.Base(backup.Path))
+	}
+	for _, job := range jobs {
+		if job.Source.Name == backup.Source {
+			return job, nil
+		}
+	}
+	return nil, fmt.Errorf("the source `%s` of the backup `%s` is not listed", backup.Source,
+		filepath.Base(backup.Path))
+}
+
+// SourceResult is the outcome of the backup of a single source.
+type SourceResult struct {
+	Source   string
+	Path     string
+	DumpSize int64
+	Duration time.Duration
+	Err      error
+	// Warning tells what went wrong after the backup was created, e.g. the dedup failed
+	Warning string
+
+	job       *SourceJob
+	startedAt time.Time
+	estimate  *SpaceEstimate
+	phases    map[string]float64
+	hookEnv   *hooks.Env
+}
+
+// CreateMultiSourceBackup backs up several sources in one run. Up to `parallelism` databases are dumped at once,
+// while the dumps are moved into the image one at a time, since the image may be remounted to extend it. The new
+// backups are deduplicated after all the dumps are over, each with the hashfile of its source, and a failed dedup
+// leaves them created. The error wraps ErrPartialFailure when only some of the sources fail.
+func (command *Command) CreateMultiSourceBackup(
+	ctx context.Context,
+	repo repository.Repository,
+	deleteOrphans bool,
+	jobs []*SourceJob,
+	parallelism int,
+	compression *comp.Compression,
+	dedupParams *duperemove.Params,
+	labels *BackupLabels,
+	backupHooks *hooks.Hooks,
+	notifier *notify.Notifier) ([]*SourceResult, error) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	if labels != nil && labels.Label != "" && len(jobs) > 1 {
+		return nil, errors.New("the backups of several sources cannot have the same name")
+	}
+
+	if err := syncSubvolumesWithMeta(ctx, repo, deleteOrphans); err != nil {
+		return nil, err
+	}
+	if err := validateLabels(repo.Meta(), labels); err != nil {
+		return nil, err
+	}
+
+	// The dumps run at once, so the image is extended for all of them before the first one starts
+	var total *SpaceEstimate
+	estimates := make([]*SpaceEstimate, len(jobs))
+	for i, job := range jobs {
+		estimates[i] = estimateBackupSpace(ctx, repo, job.YdbParams, job.DumpParams, job.Source)
+		if estimates[i] != nil {
+			if total == nil {
+				total = &SpaceEstimate{}
+			}
+			total.add(estimates[i])
+		}
+	}
+	if err := prepareSpace(ctx, repo, total, map[string]float64{}); err != nil {
+		return nil, err
+	}
+
+	results := make([]*SourceResult, len(jobs))
+	// Everything but the dumps is serialized: the meta file is rewritten as a whole, and the image may be remounted
+	var storeLock sync.Mutex
+	workers := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		result := &SourceResult{Source: job.Source.Name, job: job, startedAt: time.Now(), estimate: estimates[i],
+			phases: map[string]float64{}, hookEnv: &hooks.Env{Operation: "create"}}
+		results[i] = result
+
+		wg.Add(1)
+		go func(job *SourceJob, result *SourceResult) {
+			defer wg.Done()
+			workers <- struct{}{}
+			released := false
+			release := func() {
+				if !released {
+					released = true
+					<-workers
+				}
+			}
+			defer release()
+
+			result.Path, result.DumpSize, result.Err = createSourceBackup(ctx, repo, job, compression, backupHooks,
+				result, &storeLock, release)
+		}(job, result)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if result.Err == nil {
+			dedupSourceBackup(ctx, repo, result, dedupParams)
+			result.Err = finishSourceBackup(ctx, repo, result, labels, backupHooks, notifier.Enabled())
+		}
+		result.Duration = time.Since(result.startedAt)
+		if result.Err != nil {
+			runFailureHook(ctx, backupHooks, result.hookEnv, result.startedAt, result.Err)
+		}
+		notifier.Notify(ctx, newSummary(result.hookEnv, result.startedAt, result.Err))
+	}
+
+	if err := printSourceResults(results); err != nil {
+		return results, err
+	}
+
+	var failed int
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	switch {
+	case failed == len(results) && failed > 0:
+		return results, fmt.Errorf("all %d source(s) failed, the first error: %w", failed, results[0].Err)
+	case failed > 0:
+		return results, fmt.Errorf("%w: %d of %d source(s)", ErrPartialFailure, failed, len(results))
+	}
+	return results, nil
+}
+
+// createSourceBackup dumps the source and moves the dump into a new backup, the worker is released once the dump
+// is over.
+func createSourceBackup(ctx context.Context, repo repository.Repository,
+	job *SourceJob,
+	compression *comp.Compression,
+	backupHooks *hooks.Hooks,
+	result *SourceResult,
+	storeLock *sync.Mutex,
+	releaseWorker func()) (_ string, _ int64, err error) {
+	storeLock.Lock()
+	targetPath, err := startSourceBackup(ctx, repo, job.Source)
+	if err == nil {
+		recordDatabaseSize(ctx, repo.Meta(), targetPath, result.estimate)
+	}
+	storeLock.Unlock()
+	if err != nil {
+		return "", 0, err
+	}
+	result.hookEnv.BackupPath = targetPath
+	defer func() {
+		if err != nil {
+			storeLock.Lock()
+			abortBackup(ctx, repo, targetPath, err)
+			storeLock.Unlock()
+		}
+	}()
+
+	if err := backupHooks.Run(ctx, hooks.PreCreate, result.hookEnv); err != nil {
+		return "", 0, fmt.Errorf("backup is aborted by the hook: %w", err)
+	}
+
+	log.WithContext(ctx).Infof("Dumping the source `%s`", job.Source.Name)
+	if dumpsDirectly(ctx, job.DumpParams, result.estimate) {
+		return dumpSourceIntoSubvolume(ctx, repo, job, compression, targetPath, result, storeLock, releaseWorker)
+	}
+
+	tempBackupPath, err := createTempBackupDirectory(repo)
+	if err != nil {
+		return "", 0, err
+	}
+	defer deleteTempBackupDirectory(ctx, tempBackupPath)
+
+	dumpPath, dumpSize, err := dumpDatabase(ctx, job.YdbParams, job.DumpParams, tempBackupPath, result.phases)
+	releaseWorker()
+	if err != nil {
+		return "", 0, err
+	}
+	result.hookEnv.DumpSize = dumpSize
+
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	if _, err := storeDump(ctx, repo, compression, dumpPath, dumpSize, targetPath, result.phases); err != nil {
+		return "", 0, err
+	}
+	return targetPath, dumpSize, nil
+}
+
+// dumpSourceIntoSubvolume is dumpIntoSubvolume of the multi-source run, the image is not remounted in this mode,
+// so only the meta file is guarded by the lock.
+func dumpSourceIntoSubvolume(ctx context.Context, repo repository.Repository,
+	job *SourceJob,
+	compression *comp.Compression,
+	targetPath string,
+	result *SourceResult,
+	storeLock *sync.Mutex,
+	releaseWorker func()) (string, int64, error) {
+	subvolume, err := createStagedSubvolume(ctx, repo, compression, targetPath)
+	if err != nil {
+		return "", 0, err
+	}
+	dumpSize, err := dumpIntoStagedSubvolume(ctx, job.YdbParams, job.DumpParams, subvolume, result.phases)
+	releaseWorker()
+	if err != nil {
+		return "", 0, err
+	}
+	result.hookEnv.DumpSize = dumpSize
+
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	if err := finishDirectDump(ctx, repo.Meta(), targetPath); err != nil {
+		return "", 0, err
+	}
+	return targetPath, dumpSize, nil
+}
+
+func startSourceBackup(ctx context.Context, repo repository.Repository, source *Source) (string, error) {
+	sourceSubvolume, err := getOrCreateSourceSubvolume(ctx, repo, source)
+	if err != nil {
+		return "", fmt.Errorf("failed to get subvolume of the source `%s`: %w", source.Name, err)
+	}
+
+	targetPath := sourceSubvolume.Path + "/" + _const.BackupSubvolumePrefix + strconv.Itoa(int(time.Now().Unix()))
+	if err := repo.Meta().StartBackup(targetPath, source.Name, source.Endpoint, source.Database); err != nil {
+		return "", err
+	}
+	return targetPath, nil
+}
+
+// dedupSourceBackup deduplicates the new backup with the backups of its source, with the hashfile of the source
+// like `create` does. A failed dedup leaves the backup created and is reported as the warning of the source.
+func dedupSourceBackup(ctx context.Context, repo repository.Repository, result *SourceResult,
+	dedupParams *duperemove.Params) {
+	startedAt := time.Now()
+	err := repo.Dedup(ctx, []string{result.job.Source.path(repo)}, sourceDedupParams(dedupParams, result.Source))
+	result.phases["dedup"] = time.Since(startedAt).Seconds()
+	if err != nil {
+		log.WithContext(ctx).Warnf("failed to deduplicate the new backup of `%s`, it is kept as it is: %v",
+			result.Source, err)
+		result.Warning = fmt.Sprintf("not deduplicated: %v", err)
+	}
+}
+
+// finishSourceBackup records the new backup of the source, like `create` does after the dedup.
+func finishSourceBackup(ctx context.Context, repo repository.Repository,
+	result *SourceResult,
+	labels *BackupLabels,
+	backupHooks *hooks.Hooks,
+	withUsage bool) error {
+	sourcePath := result.job.Source.path(repo)
+
+	if err := recordBackup(ctx, repo.Meta(), result.Path, result.DumpSize, result.phases, labels); err != nil {
+		return err
+	}
+
+	if backupHooks.Has(hooks.PostCreate) || withUsage {
+		fillBackupUsage(ctx, repo, result.hookEnv, sourcePath)
+	}
+	if backupHooks.Has(hooks.PostCreate) {
+		result.hookEnv.Duration = time.Since(result.startedAt)
+		if err := backupHooks.Run(ctx, hooks.PostCreate, result.hookEnv); err != nil {
+			return fmt.Errorf("backup `%s` is created, but the hook failed: %w", result.Path, err)
+		}
+	}
+	return nil
+}
+
+func printSourceResults(results []*SourceResult) error {
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 2, ' ', 0)
+	fmt.Fprintln(w, "Source\tStatus\tBackup\tDuration\tError\t")
+	for _, result := range results {
+		status, backup, message := "OK", filepath.Base(result.Path), result.Warning
+		if result.Err != nil {
+			status, backup, message = "FAIL", "-", result.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t\n", result.Source, status, backup,
+			result.Duration.Round(time.Second), message)
+	}
+	return w.Flush()
+}
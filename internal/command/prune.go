@@ -0,0 +1,225 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"sort"
+	"time"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/notify"
+	"ydb-backup-tool/internal/repository"
+)
+
+type PruneParams struct {
+	KeepLast   uint64
+	KeepWithin time.Duration
+	// Only the selected backups are pruned, the retention policy is applied to them separately. The policy is applied
+	// to each source separately as well
+	Selector *Selector
+}
+
+func (command *Command) PruneBackups(
+	ctx context.Context,
+	repo repository.Repository,
+	deleteOrphans bool,
+	pruneParams *PruneParams,
+	notifier *notify.Notifier) (err error) {
+	startedAt := time.Now()
+	var deleted []string
+	defer func() {
+		summary := &notify.Summary{
+			Operation:       "prune",
+			Success:         err == nil,
+			StartedAt:       startedAt,
+			DurationSeconds: time.Since(startedAt).Seconds(),
+			Deleted:         deleted,
+		}
+		if err != nil {
+			summary.Error = err.Error()
+		}
+		notifier.Notify(ctx, summary)
+	}()
+
+	if pruneParams.KeepLast == 0 && pruneParams.KeepWithin == 0 {
+		return errors.New("retention policy is not specified, pass `--keep-last` and/or `--keep-within`")
+	}
+
+	if err := syncSubvolumesWithMeta(ctx, repo, deleteOrphans); err != nil {
+		return err
+	}
+
+	metaBackups, err := repo.Meta().GetCompletedBackups()
+	if err != nil {
+		return fmt.Errorf("failed to get backups meta information: %w", err)
+	}
+
+	backups, expired := expiredBackups(*metaBackups, pruneParams, time.Now())
+	for _, backup := range expired {
+		log.WithContext(ctx).Infof("Deleting backup `%s` of the source `%s` according to the retention policy", backup.Path,
+			formatSource(backup.Source))
+		if err := deleteBackup(ctx, repo, backup.Path); err != nil {
+			return err
+		}
+		deleted = append(deleted, filepath.Base(backup.Path))
+	}
+	if len(deleted) > 0 {
+		if err := repo.Reclaim(ctx); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Pruned %d backup(s), %d left.\n", len(deleted), len(backups)-len(deleted))
+	return nil
+}
+
+// expiredBackups applies the retention policy to the selected backups. It returns the backups the policy applies
+// to and those of them to delete.
+func expiredBackups(metaBackups []meta.Backup, pruneParams *PruneParams, now time.Time) ([]meta.Backup,
+	[]meta.Backup) {
+	// The pinned backups are neither deleted nor counted by the retention policy
+	var backups []meta.Backup
+	for _, backup := range selectBackups(metaBackups, pruneParams.Selector) {
+		if !backup.Pinned {
+			backups = append(backups, backup)
+		}
+	}
+
+	// Each source has its own retention, e.g. `--keep-last` keeps that many backups of every source
+	var expired []meta.Backup
+	sources, groups := groupBySource(backups)
+	for _, source := range sources {
+		sourceBackups := groups[source]
+		// The newest backups go first
+		sort.Slice(sourceBackups, func(i, j int) bool {
+			return sourceBackups[i].StartedCreationAt.After(sourceBackups[j].StartedCreationAt)
+		})
+
+		for i, backup := range sourceBackups {
+			if uint64(i) < pruneParams.KeepLast {
+				continue
+			}
+			if pruneParams.KeepWithin > 0 && now.Sub(backup.StartedCreationAt) <= pruneParams.KeepWithin {
+				continue
+			}
+			expired = append(expired, backup)
+		}
+	}
+	return backups, expired
+}
+
+// DeleteBackup deletes the backup by its name or label, or by a symbolic reference, e.g. `latest~2`, which is
+// resolved among the backups of the selector.
+func (command *Command) DeleteBackup(ctx context.Context, repo repository.Repository, reference string,
+	selector *Selector) error {
+	found, err := lookupBackup(repo.Meta(), reference, selector)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(found.Path)
+	if found.Pinned {
+		return fmt.Errorf("backup `%s` is pinned, unpin it first", name)
+	}
+
+	if err := deleteBackup(ctx, repo, found.Path); err != nil {
+		return err
+	}
+	if err := repo.Reclaim(ctx); err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully deleted the backup `%s`!\n", name)
+	return nil
+}
+
+// lookupBackup resolves the reference like resolveBackup, but the name or label may also be of a backup which is
+// not completed. A symbolic reference must not pick the backup of whichever source happens to be the newest, so
+// the source is required once the backups of several sources match it.
+func lookupBackup(store *meta.Store, reference string, selector *Selector) (*meta.Backup, error) {
+	if isSymbolicReference(reference) {
+		if selector == nil || selector.Source == "" {
+			if err := requireSingleSource(store, reference, selector); err != nil {
+				return nil, err
+			}
+		}
+		backup, err := resolveBackup(store, reference, selector)
+		if err != nil {
+			return nil, err
+		}
+		printResolved(reference, selector, backup)
+		return backup, nil
+	}
+
+	metaBackups, err := store.GetBackups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backups meta information: %w", err)
+	}
+	backup, err := findByName(*metaBackups, reference)
+	if err != nil {
+		return nil, err
+	}
+	printResolved(reference, nil, backup)
+	return backup, nil
+}
+
+func requireSingleSource(store *meta.Store, reference string, selector *Selector) error {
+	metaBackups, err := store.GetCompletedBackups()
+	if err != nil {
+		return fmt.Errorf("failed to get backups meta information: %w", err)
+	}
+	var tags map[string]string
+	if selector != nil {
+		tags = selector.Tags
+	}
+	sources, _ := groupBySource(selectBackups(*metaBackups, &Selector{Tags: tags}))
+	if len(sources) > 1 {
+		return fmt.Errorf("the backups of %d sources match `%s`, pass `--%s`", len(sources), reference,
+			_const.SourceArg)
+	}
+	return nil
+}
+
+// PinBackup pins or unpins the backup, pinned backups are never deleted by `prune`.
+func (command *Command) PinBackup(ctx context.Context, repo repository.Repository, reference string,
+	selector *Selector, pinned bool) error {
+	backup, err := resolveBackup(repo.Meta(), reference, selector)
+	if err != nil {
+		return err
+	}
+	printResolved(reference, selector, backup)
+
+	if err := repo.Meta().UpdateBackup(backup.Path, func(backup *meta.Backup) {
+		backup.Pinned = pinned
+	}); err != nil {
+		return err
+	}
+	writeSidecar(ctx, repo.Meta(), backup.Path)
+
+	if pinned {
+		fmt.Printf("Pinned the backup `%s`\n", filepath.Base(backup.Path))
+	} else {
+		fmt.Printf("Unpinned the backup `%s`\n", filepath.Base(backup.Path))
+	}
+	return nil
+}
+
+func deleteBackup(ctx context.Context, repo repository.Repository, path string) error {
+	subvolume, err := repo.GetBackup(ctx, path)
+	if err != nil {
+		return fmt.Errorf("cannot obtain info about backup `%s`: %w", path, err)
+	}
+	if subvolume != nil {
+		if err := repo.DeleteBackup(ctx, subvolume); err != nil {
+			return err
+		}
+	}
+
+	if err := repo.Meta().DeleteBackup(path); err != nil {
+		return fmt.Errorf("failed to delete backup `%s` from the meta file: %w", path, err)
+	}
+
+	return nil
+}
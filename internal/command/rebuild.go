@@ -0,0 +1,93 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"text/tabwriter"
+	"time"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/repository"
+	"ydb-backup-tool/internal/utils"
+)
+
+// RebuildMeta regenerates the backups of the meta file from the subvolumes. The entries are taken from the sidecars,
+// the subvolumes without sidecars which contain a YDB dump are added as completed at their creation time.
+func (command *Command) RebuildMeta(ctx context.Context, repo repository.Repository) error {
+	metaSubvolumes, err := getBackupSubvolumesMeta(ctx, repo)
+	if err != nil {
+		return fmt.Errorf("failed to get meta information about subvolumes: %w", err)
+	}
+
+	var backups []meta.Backup
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 2, ' ', 0)
+	fmt.Fprintln(w, "Backup\tCreated at\tSource\t")
+	for _, subvolume := range *metaSubvolumes {
+		backup, source, err := recoverBackup(ctx, repo.Meta(), &subvolume)
+		if err != nil {
+			return err
+		}
+		if backup == nil {
+			log.WithContext(ctx).Warnf("Subvolume `%s` has no sidecar and does not contain a YDB dump, it is skipped",
+				subvolume.Base.Name)
+			continue
+		}
+		backups = append(backups, *backup)
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", subvolume.Base.Name, backup.StartedCreationAt.Format(time.RFC3339), source)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	corruptedCopyPath, err := repo.Meta().Rebuild(backups)
+	if err != nil {
+		return fmt.Errorf("failed to rebuild the meta file: %w", err)
+	}
+	if corruptedCopyPath != "" {
+		fmt.Printf("The corrupted meta file is saved to `%s`.\n", corruptedCopyPath)
+	}
+
+	fmt.Printf("Rebuilt the meta file with %d backup(s).\n", len(backups))
+	return nil
+}
+
+func recoverBackup(ctx context.Context, store *meta.Store, subvolume *repository.BackupMeta) (*meta.Backup, string,
+	error) {
+	sidecar, err := meta.ReadSidecar(subvolume.Base.Path)
+	if err != nil {
+		log.WithContext(ctx).Warnf("Ignoring the sidecar of `%s`: %v", subvolume.Base.Name, err)
+	} else if sidecar != nil {
+		return sidecar, "sidecar", nil
+	}
+	staged, err := isStaged(subvolume.Base.Path, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if staged {
+		log.WithContext(ctx).Warnf("Skipping `%s`, its dump is not completed", subvolume.Base.Name)
+		return nil, "", nil
+	}
+
+	isDump, err := looksLikeDump(subvolume.Base.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	if !isDump {
+		return nil, "", nil
+	}
+
+	dumpSize, err := utils.GetDirectorySize(subvolume.Base.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	finishedAt := subvolume.CreatedAt
+	return &meta.Backup{
+		Completed:          true,
+		Path:               subvolume.Base.Path,
+		StartedCreationAt:  subvolume.CreatedAt,
+		FinishedCreationAt: &finishedAt,
+		DumpSize:           dumpSize,
+		Source:             store.SourceOfPath(subvolume.Base.Path),
+	}, "creation time", nil
+}
@@ -0,0 +1,516 @@
+package command
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	comp "ydb-backup-tool/internal/btrfs/compression"
+	"ydb-backup-tool/internal/btrfs/deduplication/duperemove"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/envelope"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/repository"
+	"ydb-backup-tool/internal/s3"
+	"ydb-backup-tool/internal/utils"
+)
+
+const (
+	archiveExtension  = ".archive"
+	manifestExtension = ".json"
+
+	archiveContentType  = "application/octet-stream"
+	manifestContentType = "application/json"
+
+	// DefaultPartSize keeps the archives up to 640GiB within the limit of the parts of the multipart upload
+	DefaultPartSize = 64 * 1024 * 1024
+
+	maxDownloadAttempts = 4
+)
+
+// Remote is the bucket the backups are replicated to. Each backup is uploaded as its archive, see ExportBackup,
+// and the manifest next to it, `<prefix><source>/<name>.archive` and `.json`.
+type Remote struct {
+	Client   *s3.Client
+	Prefix   string
+	PartSize int64
+}
+
+// location identifies the catalog of the remote in the meta file.
+func (remote *Remote) location() string {
+	endpoint := strings.TrimSuffix(remote.Client.Endpoint, "/")
+	return endpoint + "/" + remote.Client.Bucket + "/" + remote.Prefix
+}
+
+func (remote *Remote) key(source string, name string, extension string) string {
+	if source == "" {
+		return remote.Prefix + name + extension
+	}
+	return remote.Prefix + source + "/" + name + extension
+}
+
+func (remote *Remote) url(key string) string {
+	return "s3://" + remote.Client.Bucket + "/" + key
+}
+
+// uploadState is kept while the archive is uploaded, so that an interrupted upload is resumed by the next push
+// of the backup. It is kept in the image, since the session has the key of the archive.
+type uploadState struct {
+	Key      string            `json:"key"`
+	UploadID string            `json:"upload_id"`
+	PartSize int64             `json:"part_size"`
+	Session  *envelope.Session `json:"session,omitempty"`
+}
+
+func uploadStatePath(key string) string {
+	return filepath.Join(_const.AppUploadsPath, strings.ReplaceAll(key, "/", "_")+".json")
+}
+
+// PushBackup replicates the backup resolved from the reference to the remote. The backup which is replicated
+// already is skipped.
+func (command *Command) PushBackup(ctx context.Context, repo repository.Repository, deleteOrphans bool,
+	reference string, selector *Selector, remote *Remote, encryption *ArchiveEncryption) error {
+	if err := syncSubvolumesWithMeta(ctx, repo, deleteOrphans); err != nil {
+		return err
+	}
+
+	backup, err := resolveBackup(repo.Meta(), reference, selector)
+	if err != nil {
+		return err
+	}
+	printResolved(reference, selector, backup)
+	return pushBackup(ctx, repo.Meta(), backup, remote, encryption)
+}
+
+// ReplicateBackups pushes the backups just created, see PushBackup.
+func ReplicateBackups(ctx context.Context, repo repository.Repository, paths []string, remote *Remote,
+	encryption *ArchiveEncryption) error {
+	for _, path := range paths {
+		backup, err := repo.Meta().GetBackup(path)
+		if err != nil {
+			return err
+		}
+		if err := pushBackup(ctx, repo.Meta(), backup, remote, encryption); err != nil {
+			return fmt.Errorf("backup `%s` is created, but not replicated: %w", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
+
+func pushBackup(ctx context.Context, store *meta.Store, backup *meta.Backup, remote *Remote,
+	encryption *ArchiveEncryption) error {
+	name := filepath.Base(backup.Path)
+	if !backup.Completed {
+		return fmt.Errorf("backup `%s` is not completed", name)
+	}
+	archiveKey := remote.key(backup.Source, name, archiveExtension)
+	manifestKey := remote.key(backup.Source, name, manifestExtension)
+
+	existing, err := getManifest(ctx, remote, manifestKey)
+	if err != nil && !errors.Is(err, s3.ErrNotFound) {
+		return err
+	}
+	if existing != nil {
+		fmt.Printf("The backup `%s` is replicated already: %s\n", name, remote.url(existing.Key))
+		return store.RecordRemoteBackup(remote.location(), *existing)
+	}
+
+	state, parts, err := startUpload(ctx, remote, archiveKey, encryption)
+	if err != nil {
+		return err
+	}
+	remoteBackup, err := uploadArchive(ctx, remote, backup, state, parts)
+	if err != nil {
+		return fmt.Errorf("failed to push the backup `%s`, the next push resumes the upload: %w", name, err)
+	}
+
+	manifest, err := json.MarshalIndent(remoteBackup, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := remote.Client.PutObject(ctx, manifestKey, manifest, manifestContentType); err != nil {
+		return err
+	}
+	if err := os.Remove(uploadStatePath(archiveKey)); err != nil {
+		log.WithContext(ctx).Warnf("failed to delete the state of the completed upload `%s`: %v", archiveKey, err)
+	}
+	if err := store.RecordRemoteBackup(remote.location(), *remoteBackup); err != nil {
+		return fmt.Errorf("backup `%s` is pushed, but not recorded in the meta file: %w", name, err)
+	}
+
+	fmt.Printf("Successfully pushed the backup `%s`!\nObject: %s\n", name, remote.url(archiveKey))
+	return nil
+}
+
+// startUpload resumes the upload of the archive if its state is left by the previous push with the same options,
+// otherwise it starts a new upload. The parts uploaded so far are returned by number.
+func startUpload(ctx context.Context, remote *Remote, key string,
+	encryption *ArchiveEncryption) (*uploadState, map[int]s3.Part, error) {
+	state, err := readUploadState(key)
+	if err != nil {
+		log.WithContext(ctx).Warnf("failed to read the state of the upload `%s`, starting it anew: %v", key, err)
+	}
+	if state != nil && state.PartSize == remote.PartSize && sameEncryption(state.Session, encryption) {
+		uploaded, err := remote.Client.ListParts(ctx, key, state.UploadID)
+		if err == nil {
+			parts := map[int]s3.Part{}
+			for _, part := range uploaded {
+				parts[part.Number] = part
+			}
+			log.WithContext(ctx).Infof("Resuming the upload of `%s`, %d part(s) are uploaded already", key, len(parts))
+			return state, parts, nil
+		}
+		if !errors.Is(err, s3.ErrNotFound) {
+			return nil, nil, err
+		}
+	} else if state != nil {
+		log.WithContext(ctx).Infof("The options of the upload of `%s` have changed, starting it anew", key)
+		if err := remote.Client.AbortMultipartUpload(ctx, key, state.UploadID); err != nil &&
+			!errors.Is(err, s3.ErrNotFound) {
+			log.WithContext(ctx).Warnf("failed to abort the previous upload: %v", err)
+		}
+	}
+
+	session, err := encryption.newSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	uploadID, err := remote.Client.CreateMultipartUpload(ctx, key, archiveContentType)
+	if err != nil {
+		return nil, nil, err
+	}
+	state = &uploadState{Key: key, UploadID: uploadID, PartSize: remote.PartSize, Session: session}
+	if err := writeUploadState(state); err != nil {
+		return nil, nil, err
+	}
+	return state, map[int]s3.Part{}, nil
+}
+
+func sameEncryption(session *envelope.Session, encryption *ArchiveEncryption) bool {
+	if session == nil || encryption == nil {
+		return session == nil && encryption == nil
+	}
+	return session.Accepts(encryption.Recipients, encryption.Passphrase)
+}
+
+// uploadArchive streams the archive in parts. The archive of the same backup in the same session is the same,
+// so the part which is uploaded already with the same MD5 is skipped.
+func uploadArchive(ctx context.Context, remote *Remote, backup *meta.Backup, state *uploadState,
+	uploaded map[int]s3.Part) (*meta.RemoteBackup, error) {
+	pipeReader, pipeWriter := io.Pipe()
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		_ = pipeWriter.CloseWithError(writeArchive(ctx, pipeWriter, backup, backup.Path, state.Session))
+	}()
+	defer func() {
+		_ = pipeReader.CloseWithError(errors.New("the upload is stopped"))
+		<-writeDone
+	}()
+
+	checksum := sha256.New()
+	reader := io.TeeReader(pipeReader, checksum)
+	buffer := make([]byte, state.PartSize)
+	var parts []s3.Part
+	var size int64
+	var reused int
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(reader, buffer)
+		if n > 0 {
+			if number > s3.MaxParts {
+				return nil, fmt.Errorf("the archive needs more than %d parts, increase the part size", s3.MaxParts)
+			}
+			part, reuse, err := uploadPart(ctx, remote, state, number, buffer[:n], uploaded)
+			if err != nil {
+				return nil, err
+			}
+			if reuse {
+				reused++
+			}
+			parts = append(parts, *part)
+			size += int64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if reused > 0 {
+		log.WithContext(ctx).Infof("%d of %d part(s) of `%s` are uploaded before", reused, len(parts), state.Key)
+	}
+
+	etag, err := remote.Client.CompleteMultipartUpload(ctx, state.Key, state.UploadID, parts)
+	if err != nil {
+		return nil, err
+	}
+	object, err := remote.Client.HeadObject(ctx, state.Key)
+	if err != nil {
+		return nil, err
+	}
+	if object.Size != size {
+		return nil, fmt.Errorf("the uploaded archive `%s` has %d bytes instead of %d", state.Key, object.Size, size)
+	}
+	// The parts are checked by the storage against their MD5, and the ETags are not always the MD5 anyway
+	if object.ETag != etag {
+		log.WithContext(ctx).Warnf("The uploaded archive `%s` has ETag %s instead of %s", state.Key, object.ETag, etag)
+	}
+
+	remoteBackup := &meta.RemoteBackup{
+		Name:              filepath.Base(backup.Path),
+		Source:            backup.Source,
+		Label:             backup.Label,
+		Tags:              backup.Tags,
+		StartedCreationAt: backup.StartedCreationAt,
+		DumpSize:          backup.DumpSize,
+		Key:               state.Key,
+		Size:              size,
+		SHA256:            hex.EncodeToString(checksum.Sum(nil)),
+		ETag:              etag,
+		Encrypted:         state.Session != nil,
+		PushedAt:          time.Now(),
+	}
+	if state.Session != nil {
+		remoteBackup.Recipients = state.Session.Header.Fingerprints()
+		remoteBackup.Passphrase = state.Session.Header.HasPassphrase()
+	}
+	return remoteBackup, nil
+}
+
+func uploadPart(ctx context.Context, remote *Remote, state *uploadState, number int, data []byte,
+	uploaded map[int]s3.Part) (*s3.Part, bool, error) {
+	if part, ok := uploaded[number]; ok && part.Size == int64(len(data)) {
+		sum := md5.Sum(data)
+		if part.ETag == hex.EncodeToString(sum[:]) {
+			return &part, true, nil
+		}
+	}
+	part, err := remote.Client.UploadPart(ctx, state.Key, state.UploadID, number, data)
+	return part, false, err
+}
+
+func readUploadState(key string) (*uploadState, error) {
+	content, err := os.ReadFile(uploadStatePath(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, err
+	}
+	if state.Key != key {
+		return nil, fmt.Errorf("the state is of the upload `%s`", state.Key)
+	}
+	return &state, nil
+}
+
+func writeUploadState(state *uploadState) error {
+	if err := os.MkdirAll(_const.AppUploadsPath, 0o700); err != nil {
+		return fmt.Errorf("failed to create the directory `%s`: %w", _const.AppUploadsPath, err)
+	}
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	path := uploadStatePath(state.Key)
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		return fmt.Errorf("failed to save the state of the upload `%s`: %w", path, err)
+	}
+	return nil
+}
+
+func getManifest(ctx context.Context, remote *Remote, key string) (*meta.RemoteBackup, error) {
+	body, err := remote.Client.GetObject(ctx, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	content, err := io.ReadAll(io.LimitReader(body, 1024*1024))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download `%s`: %w", key, err)
+	}
+	var manifest meta.RemoteBackup
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse the manifest `%s`: %w", key, err)
+	}
+	return &manifest, nil
+}
+
+// syncRemoteCatalog lists the manifests in the remote and mirrors them in the meta file.
+func syncRemoteCatalog(ctx context.Context, store *meta.Store, remote *Remote) ([]meta.RemoteBackup, error) {
+	objects, err := remote.Client.ListObjects(ctx, remote.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	var backups []meta.RemoteBackup
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, manifestExtension) {
+			continue
+		}
+		manifest, err := getManifest(ctx, remote, object.Key)
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, *manifest)
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].StartedCreationAt.Before(backups[j].StartedCreationAt)
+	})
+
+	if err := store.SetRemoteCatalog(remote.location(), backups); err != nil {
+		return nil, err
+	}
+	return backups, nil
+}
+
+// ListRemoteBackups prints the catalog of the remote after mirroring it in the meta file.
+func (command *Command) ListRemoteBackups(ctx context.Context, repo repository.Repository, remote *Remote) error {
+	backups, err := syncRemoteCatalog(ctx, repo.Meta(), remote)
+	if err != nil {
+		return fmt.Errorf("failed to get the catalog of %s: %w", remote.location(), err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 2, ' ', 0)
+	fmt.Fprintln(w, "Source\tName\tLabel\tCreated at\tSize\tEncrypted")
+	for _, backup := range backups {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\n", formatSource(backup.Source), backup.Name, backup.Label,
+			backup.StartedCreationAt.Format(time.RFC3339), utils.FormatSize(backup.Size), backup.Encrypted)
+	}
+	return w.Flush()
+}
+
+// PullBackup downloads the backup from the remote and imports it, see ImportBackup. The reference is the name or
+// the label of the backup, or `<source>/<name>`.
+func (command *Command) PullBackup(ctx context.Context, repo repository.Repository, deleteOrphans bool,
+	reference string, remote *Remote, decryption *ArchiveDecryption, compression *comp.Compression,
+	dedupParams *duperemove.Params) error {
+	if err := syncSubvolumesWithMeta(ctx, repo, deleteOrphans); err != nil {
+		return err
+	}
+
+	backups, err := syncRemoteCatalog(ctx, repo.Meta(), remote)
+	if err != nil {
+		return fmt.Errorf("failed to get the catalog of %s: %w", remote.location(), err)
+	}
+	remoteBackup, err := findRemoteBackup(backups, reference)
+	if err != nil {
+		return err
+	}
+
+	r := &objectReader{ctx: ctx, client: remote.Client, key: remoteBackup.Key, expected: remoteBackup,
+		checksum: sha256.New()}
+	defer r.Close()
+	targetPath, err := importArchive(ctx, repo, r, decryption, compression, dedupParams)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully pulled the backup `%s`!\nPath: %s\n", remoteBackup.Name, targetPath)
+	return nil
+}
+
+func findRemoteBackup(backups []meta.RemoteBackup, reference string) (*meta.RemoteBackup, error) {
+	var found []meta.RemoteBackup
+	for _, backup := range backups {
+		if backup.Name == reference || (backup.Label != "" && backup.Label == reference) ||
+			(backup.Source != "" && backup.Source+"/"+backup.Name == reference) {
+			found = append(found, backup)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("%w in the remote: `%s`", ErrBackupNotFound, reference)
+	case 1:
+		return &found[0], nil
+	default:
+		return nil, fmt.Errorf("`%s` matches %d backups in the remote, use `<source>/<name>`", reference, len(found))
+	}
+}
+
+// objectReader downloads the archive, resuming the download from the offset reached when the connection breaks.
+// The archive is checked against the size and the checksum of the catalog when it is read to the end.
+type objectReader struct {
+	ctx      context.Context
+	client   *s3.Client
+	key      string
+	expected *meta.RemoteBackup
+	checksum hash.Hash
+
+	body     io.ReadCloser
+	offset   int64
+	attempts int
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	for {
+		if r.body == nil {
+			body, err := r.client.GetObject(r.ctx, r.key, r.offset)
+			if err != nil {
+				return 0, err
+			}
+			r.body = body
+		}
+
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		r.checksum.Write(p[:n])
+		if n > 0 {
+			// Only the attempts in a row without any progress are limited
+			r.attempts = 0
+		}
+		if errors.Is(err, io.EOF) && r.offset >= r.expected.Size {
+			return n, r.verify()
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		_ = r.body.Close()
+		r.body = nil
+		r.attempts++
+		if r.ctx.Err() != nil || r.attempts >= maxDownloadAttempts {
+			return 0, fmt.Errorf("failed to download `%s`: %w", r.key, err)
+		}
+		log.WithContext(r.ctx).Warnf("Download of `%s` is interrupted at %d bytes, resuming it: %v", r.key, r.offset, err)
+	}
+}
+
+func (r *objectReader) verify() error {
+	if r.offset != r.expected.Size {
+		return fmt.Errorf("the archive `%s` has %d bytes instead of %d", r.key, r.offset, r.expected.Size)
+	}
+	if checksum := hex.EncodeToString(r.checksum.Sum(nil)); checksum != r.expected.SHA256 {
+		return fmt.Errorf("the checksum of the archive `%s` is %s instead of %s", r.key, checksum,
+			r.expected.SHA256)
+	}
+	return io.EOF
+}
+
+func (r *objectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
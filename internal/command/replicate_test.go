@@ -0,0 +1,123 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/s3"
+	"ydb-backup-tool/internal/s3/s3test"
+)
+
+func newTestRemote(server *s3test.Server, partSize int64) *Remote {
+	client := &s3.Client{Endpoint: server.URL, Region: s3.DefaultRegion, Bucket: s3test.Bucket, AccessKey: "access",
+		SecretKey: "secret", PathStyle: true, HTTP: server.Client()}
+	return &Remote{Client: client, Prefix: "backups/", PartSize: partSize}
+}
+
+// newTestBackup returns the backup with the incompressible data, so that its archive takes a few parts.
+func newTestBackup(t *testing.T) *meta.Backup {
+	dir := t.TempDir()
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := os.WriteFile(filepath.Join(dir, "data_00.csv"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return &meta.Backup{Path: dir, Completed: true, StartedCreationAt: time.Unix(1700000000, 0)}
+}
+
+func TestUploadArchiveResume(t *testing.T) {
+	server := s3test.NewServer()
+	defer server.Close()
+	remote := newTestRemote(server, 1024)
+	backup := newTestBackup(t)
+	ctx := context.Background()
+
+	var archive bytes.Buffer
+	if err := writeArchive(ctx, &archive, backup, backup.Path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if archive.Len() <= 3*1024 {
+		t.Fatalf("the archive has %d bytes only", archive.Len())
+	}
+
+	key := remote.key("", "ydb_backup_1", ".tar.gz")
+	uploadID, err := remote.Client.CreateMultipartUpload(ctx, key, "application/gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &uploadState{Key: key, UploadID: uploadID, PartSize: remote.PartSize}
+	server.FailPart = 3
+	if _, err := uploadArchive(ctx, remote, backup, state, nil); err == nil {
+		t.Fatal("the upload with the failed part is completed")
+	}
+
+	server.FailPart = 0
+	parts, err := remote.Client.ListParts(ctx, key, uploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded := map[int]s3.Part{}
+	for _, part := range parts {
+		uploaded[part.Number] = part
+	}
+	remoteBackup, err := uploadArchive(ctx, remote, backup, state, uploaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server.PartUploads[1] != 1 || server.PartUploads[2] != 1 || server.PartUploads[3] != 1 {
+		t.Fatalf("the parts uploaded before are uploaded again: %v", server.PartUploads)
+	}
+	if !bytes.Equal(server.Object(key), archive.Bytes()) {
+		t.Fatal("the uploaded archive differs")
+	}
+	checksum := sha256.Sum256(archive.Bytes())
+	if remoteBackup.Size != int64(archive.Len()) || remoteBackup.SHA256 != hex.EncodeToString(checksum[:]) {
+		t.Fatalf("unexpected remote backup: %+v", remoteBackup)
+	}
+}
+
+func TestObjectReaderResume(t *testing.T) {
+	server := s3test.NewServer()
+	defer server.Close()
+	remote := newTestRemote(server, s3.MinPartSize)
+	ctx := context.Background()
+
+	object := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(object)
+	if err := remote.Client.PutObject(ctx, "archive", object, "application/gzip"); err != nil {
+		t.Fatal(err)
+	}
+	checksum := sha256.Sum256(object)
+	expected := &meta.RemoteBackup{Key: "archive", Size: int64(len(object)), SHA256: hex.EncodeToString(checksum[:])}
+
+	// The download breaks more times than the attempts, but every attempt makes progress
+	server.TruncateAfter = 100
+	server.TruncateTimes = 2 * maxDownloadAttempts
+	r := &objectReader{ctx: ctx, client: remote.Client, key: "archive", expected: expected, checksum: sha256.New()}
+	defer r.Close()
+	downloaded, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, object) {
+		t.Fatal("the downloaded object differs")
+	}
+
+	// The checksum is verified when the download is resumed
+	expected.SHA256 = hex.EncodeToString(make([]byte, sha256.Size))
+	server.TruncateTimes = 2
+	r = &objectReader{ctx: ctx, client: remote.Client, key: "archive", expected: expected, checksum: sha256.New()}
+	defer r.Close()
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatal("the object with the wrong checksum is downloaded")
+	}
+}
@@ -0,0 +1,288 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"ydb-backup-tool/internal/meta"
+)
+
+// LatestReference selects the newest of the backups matching the selector.
+const LatestReference = "latest"
+
+// Selector narrows the backups down to those of the source having all the tags. With `Latest` only the newest
+// of them is selected.
+type Selector struct {
+	Source string
+	Tags   map[string]string
+	Latest bool
+}
+
+// BackupLabels are set on a new backup.
+type BackupLabels struct {
+	Label  string
+	Tags   map[string]string
+	Note   string
+	Pinned bool
+}
+
+var labelRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func (selector *Selector) Empty() bool {
+	return selector == nil || (selector.Source == "" && len(selector.Tags) == 0 && !selector.Latest)
+}
+
+func (selector *Selector) matches(backup *meta.Backup) bool {
+	if selector == nil {
+		return true
+	}
+	if selector.Source != "" && backup.Source != selector.Source {
+		return false
+	}
+	for key, value := range selector.Tags {
+		if actual, ok := backup.Tags[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// selectBackups returns the completed backups matching the selector, oldest first.
+func selectBackups(backups []meta.Backup, selector *Selector) []meta.Backup {
+	var result []meta.Backup
+	for i := range backups {
+		if backups[i].Completed && selector.matches(&backups[i]) {
+			result = append(result, backups[i])
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].StartedCreationAt.Before(result[j].StartedCreationAt)
+	})
+
+	if selector != nil && selector.Latest && len(result) > 0 {
+		return result[len(result)-1:]
+	}
+	return result
+}
+
+// Prefixes of the symbolic references, e.g. `latest~2`, `@2024-05-01T03:00` and `tag:pre-release`.
+const (
+	latestOffsetPrefix  = LatestReference + "~"
+	timeReferencePrefix = "@"
+	tagReferencePrefix  = "tag:"
+)
+
+// referenceTimeLayouts are accepted by `@<time>`, the time without a zone is local.
+var referenceTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// resolveBackup finds the completed backup by the reference:
+//   - the name, path or label of the backup;
+//   - `latest`, or `latest~N` for the N-th backup before the newest one;
+//   - `@<time>`, the newest backup started at or before the time;
+//   - `tag:<key>` or `tag:<key>=<value>`, the newest backup having the tag.
+//
+// Only the backups having the tags of the selector are considered. The symbolic references are resolved among
+// the backups of the source of the selector and the backups without a source. Without a reference the selector must
+// match exactly one backup.
+func resolveBackup(store *meta.Store, reference string, selector *Selector) (*meta.Backup, error) {
+	metaBackups, err := store.GetCompletedBackups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backups meta information: %w", err)
+	}
+
+	var tags map[string]string
+	var source string
+	if selector != nil {
+		tags = selector.Tags
+		source = selector.Source
+	}
+	// `Latest` is applied by the reference itself, and the names are unique across the sources
+	tagged := selectBackups(*metaBackups, &Selector{Tags: tags})
+	var candidates []meta.Backup
+	for _, backup := range tagged {
+		if source == "" || backup.Source == "" || backup.Source == source {
+			candidates = append(candidates, backup)
+		}
+	}
+	reference = strings.TrimSpace(reference)
+
+	switch {
+	case reference == "":
+		switch {
+		case len(candidates) == 0:
+			return nil, fmt.Errorf("%w: no backup matches %s", ErrBackupNotFound, selector)
+		case len(candidates) > 1 && (selector == nil || !selector.Latest):
+			return nil, fmt.Errorf("%d backups match %s, pass `%s` or the name of the backup", len(candidates),
+				selector, LatestReference)
+		}
+		return &candidates[len(candidates)-1], nil
+	case reference == LatestReference:
+		return nthNewest(candidates, 0, reference)
+	case strings.HasPrefix(reference, latestOffsetPrefix):
+		offset, err := strconv.Atoi(strings.TrimPrefix(reference, latestOffsetPrefix))
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid reference `%s`, expected `%sN` with N >= 0", reference,
+				latestOffsetPrefix)
+		}
+		return nthNewest(candidates, offset, reference)
+	case strings.HasPrefix(reference, timeReferencePrefix):
+		at, err := parseReferenceTime(strings.TrimPrefix(reference, timeReferencePrefix))
+		if err != nil {
+			return nil, err
+		}
+		for i := len(candidates) - 1; i >= 0; i-- {
+			if !candidates[i].StartedCreationAt.After(at) {
+				return &candidates[i], nil
+			}
+		}
+		return nil, fmt.Errorf("%w: no backup was created at or before %s", ErrBackupNotFound,
+			at.Format(time.RFC3339))
+	case strings.HasPrefix(reference, tagReferencePrefix):
+		key, value, withValue := strings.Cut(strings.TrimPrefix(reference, tagReferencePrefix), "=")
+		for i := len(candidates) - 1; i >= 0; i-- {
+			if actual, ok := candidates[i].Tags[key]; ok && (!withValue || actual == value) {
+				return &candidates[i], nil
+			}
+		}
+		return nil, fmt.Errorf("%w: no backup has the tag `%s`", ErrBackupNotFound,
+			strings.TrimPrefix(reference, tagReferencePrefix))
+	}
+
+	return findByName(tagged, reference)
+}
+
+// findByName finds the backup by its name, `<source>/<name>`, path or label.
+func findByName(backups []meta.Backup, reference string) (*meta.Backup, error) {
+	reference = strings.TrimSpace(reference)
+	var found []*meta.Backup
+	for i := range backups {
+		if matchesName(&backups[i], reference) {
+			found = append(found, &backups[i])
+		}
+	}
+
+	switch {
+	case len(found) == 0:
+		return nil, fmt.Errorf("%w: `%s`", ErrBackupNotFound, reference)
+	case len(found) > 1:
+		return nil, fmt.Errorf("backup `%s` exists in several sources, pass it as `<source>/%s`", reference,
+			reference)
+	}
+	return found[0], nil
+}
+
+func matchesName(backup *meta.Backup, reference string) bool {
+	return backup.Path == reference || backup.Label == reference || filepath.Base(backup.Path) == reference ||
+		backup.Source != "" && backup.Source+"/"+filepath.Base(backup.Path) == reference
+}
+
+// isSymbolicReference reports whether the reference is resolved among the completed backups only, unlike the name.
+func isSymbolicReference(reference string) bool {
+	reference = strings.TrimSpace(reference)
+	return reference == "" || reference == LatestReference || strings.HasPrefix(reference, latestOffsetPrefix) ||
+		strings.HasPrefix(reference, timeReferencePrefix) || strings.HasPrefix(reference, tagReferencePrefix)
+}
+
+// printResolved tells which backup the reference was resolved to, unless it is the name of the backup already.
+func printResolved(reference string, selector *Selector, backup *meta.Backup) {
+	fprintResolved(os.Stdout, reference, selector, backup)
+}
+
+func fprintResolved(w io.Writer, reference string, selector *Selector, backup *meta.Backup) {
+	name := filepath.Base(backup.Path)
+	if reference == "" {
+		fmt.Fprintf(w, "Resolved %s to the backup `%s`\n", selector, name)
+	} else if name != reference && backup.Path != reference {
+		fmt.Fprintf(w, "Resolved `%s` to the backup `%s`\n", reference, name)
+	}
+}
+
+// nthNewest returns the backup which is `offset` backups older than the newest one.
+func nthNewest(backups []meta.Backup, offset int, reference string) (*meta.Backup, error) {
+	if offset >= len(backups) {
+		return nil, fmt.Errorf("%w: `%s`, there are only %d backup(s)", ErrBackupNotFound, reference, len(backups))
+	}
+	return &backups[len(backups)-1-offset], nil
+}
+
+func parseReferenceTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range referenceTimeLayouts {
+		if at, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return at, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time `%s`, expected e.g. 2024-05-01T03:00 or %s", value, time.RFC3339)
+}
+
+func (selector *Selector) String() string {
+	if selector.Empty() {
+		return "all backups"
+	}
+
+	var parts []string
+	if selector.Source != "" {
+		parts = append(parts, fmt.Sprintf("source %s", selector.Source))
+	}
+	if selector.Latest {
+		parts = append(parts, LatestReference)
+	}
+	keys := make([]string, 0, len(selector.Tags))
+	for key := range selector.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("tag %s=%s", key, selector.Tags[key]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// validateLabels checks that the label is well-formed and is not used by another backup.
+func validateLabels(store *meta.Store, labels *BackupLabels) error {
+	if labels == nil || labels.Label == "" {
+		return nil
+	}
+	if !labelRegexp.MatchString(labels.Label) || labels.Label == LatestReference {
+		return fmt.Errorf("invalid backup name `%s`, use letters, digits, `.`, `_` and `-`", labels.Label)
+	}
+
+	metaBackups, err := store.GetBackups()
+	if err != nil {
+		return fmt.Errorf("failed to get backups meta information: %w", err)
+	}
+	for _, backup := range *metaBackups {
+		if backup.Label == labels.Label || filepath.Base(backup.Path) == labels.Label {
+			return fmt.Errorf("backup name `%s` is already used by `%s`", labels.Label, filepath.Base(backup.Path))
+		}
+	}
+	return nil
+}
+
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+"="+tags[key])
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,153 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"ydb-backup-tool/internal/btrfs/deduplication/duperemove"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/repository"
+)
+
+// ErrCrossDatabase is returned when the backup is restored into a database other than the one it is taken from.
+var ErrCrossDatabase = errors.New("backup is taken from a different database")
+
+var sourceNameReplacer = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// Source is the database the backups are taken from. The backups of each source are kept in a separate subvolume,
+// and are deduplicated and pruned separately from the other sources.
+type Source struct {
+	Name     string
+	Endpoint string
+	Database string
+}
+
+// NewSource returns the source of the database. Without a name, it is derived from the endpoint and the database,
+// e.g. `ydb.example.net-2135_ru-central1_b1g_etn`.
+func NewSource(name string, endpoint string, database string) (*Source, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		host := endpoint
+		if _, afterScheme, found := strings.Cut(host, "://"); found {
+			host = afterScheme
+		}
+		name = strings.Trim(sourceNameReplacer.ReplaceAllString(host, "-"), "-") + "_" +
+			strings.Trim(sourceNameReplacer.ReplaceAllString(database, "_"), "_")
+		name = strings.Trim(name, "_")
+	}
+
+	if !labelRegexp.MatchString(name) || strings.HasPrefix(name, _const.BackupSubvolumePrefix) {
+		return nil, fmt.Errorf("invalid source name `%s`, use letters, digits, `.`, `_` and `-`, "+
+			"and do not start it with `%s`", name, _const.BackupSubvolumePrefix)
+	}
+	return &Source{Name: name, Endpoint: strings.TrimSpace(endpoint), Database: strings.TrimSpace(database)}, nil
+}
+
+func (source *Source) path(repo repository.Repository) string {
+	return repo.BackupsPath() + "/" + source.Name
+}
+
+// checkSameDatabase refuses to restore the backup into a database other than its own. The backups without
+// a source are not checked, since their database is unknown.
+func (source *Source) checkSameDatabase(backup *meta.Backup) error {
+	if source == nil || backup.Source == "" || backup.Database == "" {
+		return nil
+	}
+	if backup.Endpoint == source.Endpoint && backup.Database == source.Database {
+		return nil
+	}
+	return fmt.Errorf("%w: the backup of `%s` at `%s` cannot be restored into `%s` at `%s`, pass "+
+		"`--allow-cross-database` to do it anyway", ErrCrossDatabase, backup.Database, backup.Endpoint,
+		source.Database, source.Endpoint)
+}
+
+// sourceDedupParams gives each source its own hashfile, otherwise duperemove would deduplicate the files of all
+// the sources in the hashfile together.
+func sourceDedupParams(params *duperemove.Params, source string) *duperemove.Params {
+	sourceParams := *params
+	sourceParams.Hashfile = _const.AppHashfilePath + "." + source
+	return &sourceParams
+}
+
+func getOrCreateSourceSubvolume(ctx context.Context, repo repository.Repository,
+	source *Source) (*repository.Backup, error) {
+	if _, err := getOrCreateBackupsSubvolume(ctx, repo); err != nil {
+		return nil, fmt.Errorf("failed to get subvolume with backups: %w", err)
+	}
+
+	subvolume, err := repo.GetBackup(ctx, source.path(repo))
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain info to verify that subvolume of the source `%s` exists: %w",
+			source.Name, err)
+	}
+	if subvolume == nil {
+		return repo.CreateBackup(ctx, source.path(repo), nil)
+	}
+	return subvolume, nil
+}
+
+// getBackupSubvolumes returns the subvolumes of the backups of all sources, including the backups created before
+// the sources were introduced, which are right in the subvolume with backups.
+func getBackupSubvolumes(ctx context.Context, repo repository.Repository) ([]*repository.Backup, error) {
+	backupsSubvolume, err := getOrCreateBackupsSubvolume(ctx, repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subvolume with backups: %w", err)
+	}
+
+	return repository.ListAllBackups(ctx, repo, backupsSubvolume.Path)
+}
+
+// getBackupSubvolumesMeta is getBackupSubvolumes with the creation time and the usage of the subvolumes.
+func getBackupSubvolumesMeta(ctx context.Context, repo repository.Repository) (*[]repository.BackupMeta, error) {
+	backupsSubvolume, err := getOrCreateBackupsSubvolume(ctx, repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subvolume with backups: %w", err)
+	}
+
+	metaSubvolumes, err := repo.BackupUsage(ctx, backupsSubvolume.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []repository.BackupMeta
+	for _, metaSubvolume := range metaSubvolumes {
+		if strings.HasPrefix(metaSubvolume.Base.Name, _const.BackupSubvolumePrefix) {
+			result = append(result, metaSubvolume)
+			continue
+		}
+
+		sourceSubvolumes, err := repo.BackupUsage(ctx, metaSubvolume.Base.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get meta information about subvolumes of the source `%s`: %w",
+				metaSubvolume.Base.Name, err)
+		}
+		result = append(result, sourceSubvolumes...)
+	}
+	return &result, nil
+}
+
+// groupBySource splits the backups by their sources, keeping the order of the backups. The sources are sorted
+// by name, the backups without a source go first.
+func groupBySource(backups []meta.Backup) ([]string, map[string][]meta.Backup) {
+	groups := map[string][]meta.Backup{}
+	var sources []string
+	for _, backup := range backups {
+		if _, ok := groups[backup.Source]; !ok {
+			sources = append(sources, backup.Source)
+		}
+		groups[backup.Source] = append(groups[backup.Source], backup)
+	}
+	sort.Strings(sources)
+	return sources, groups
+}
+
+func formatSource(name string) string {
+	if name == "" {
+		return "(no source)"
+	}
+	return name
+}
@@ -0,0 +1,149 @@
+package command
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"time"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/repository"
+	"ydb-backup-tool/internal/utils"
+	"ydb-backup-tool/internal/ydb"
+)
+
+// SpaceEstimate is the space the backup is expected to take before the database is dumped.
+type SpaceEstimate struct {
+	// DatabaseSize is the size of the data by the statistics of the database, zero if they are not available
+	DatabaseSize int64
+	// DumpSize is the expected size of the dump on the host
+	DumpSize int64
+	// TempDumpSize is the part of DumpSize dumped into the temporary directory, zero for the direct dumps
+	TempDumpSize int64
+	// ImageSize is the expected space taken by the dump in the image before it is deduplicated
+	ImageSize int64
+	// RetainedSize is the expected space left to the backup once it is deduplicated
+	RetainedSize int64
+}
+
+func (estimate *SpaceEstimate) add(other *SpaceEstimate) {
+	estimate.DatabaseSize += other.DatabaseSize
+	estimate.DumpSize += other.DumpSize
+	estimate.TempDumpSize += other.TempDumpSize
+	estimate.ImageSize += other.ImageSize
+	estimate.RetainedSize += other.RetainedSize
+}
+
+// estimateBackupSpace predicts the space of the next backup of the source. The size of the dump follows the
+// statistics of the database, scaled by the dump-to-statistics ratio of the previous backup, and the space in the
+// image follows the referenced and exclusive usage of the previous backup relative to its dump. Nil is returned when
+// there is neither the statistics nor a previous backup to rely on.
+func estimateBackupSpace(ctx context.Context, repo repository.Repository, ydbParams *ydb.YdbParams,
+	dumpParams *ydb.DumpParams, source *Source) *SpaceEstimate {
+	databaseSize, err := ydb.DataSize(ctx, ydbParams, dumpParams)
+	if err != nil {
+		log.WithContext(ctx).Warnf("The size of the dump is estimated without the statistics of the database: %v", err)
+	}
+	previous := previousSourceBackup(ctx, repo.Meta(), source)
+
+	estimate := &SpaceEstimate{DatabaseSize: databaseSize}
+	switch {
+	case previous != nil && previous.DatabaseSize > 0 && databaseSize > 0:
+		estimate.DumpSize = int64(float64(databaseSize) * float64(previous.DumpSize) / float64(previous.DatabaseSize))
+	case previous != nil && previous.DumpSize > databaseSize:
+		estimate.DumpSize = previous.DumpSize
+	case databaseSize > 0:
+		estimate.DumpSize = databaseSize
+	default:
+		return nil
+	}
+
+	// Without the usage of the previous backup, the dump is assumed to be neither compressed nor deduplicated
+	referencedRatio, exclusiveRatio := 1.0, 1.0
+	if previous != nil {
+		if usage := backupUsage(ctx, repo, source, previous.Path); usage != nil && previous.DumpSize > 0 {
+			referencedRatio = ratio(usage.SizeReferenced, previous.DumpSize)
+			exclusiveRatio = ratio(usage.SizeExclusive, previous.DumpSize)
+		}
+	}
+	if !dumpParams.Direct {
+		estimate.TempDumpSize = estimate.DumpSize
+	}
+	estimate.ImageSize = int64(float64(estimate.DumpSize) * referencedRatio)
+	estimate.RetainedSize = int64(float64(estimate.DumpSize) * exclusiveRatio)
+
+	log.WithContext(ctx).Infof("Estimated the backup of `%s`: dump %s, %s in the image before dedup, %s after it",
+		source.Name, utils.FormatSize(estimate.DumpSize), utils.FormatSize(estimate.ImageSize),
+		utils.FormatSize(estimate.RetainedSize))
+	return estimate
+}
+
+// previousSourceBackup returns the newest completed backup of the source with the known size of the dump.
+func previousSourceBackup(ctx context.Context, store *meta.Store, source *Source) *meta.Backup {
+	backups, err := store.GetCompletedBackups()
+	if err != nil {
+		log.WithContext(ctx).Warnf("The previous backup is not used for the estimate: %v", err)
+		return nil
+	}
+
+	var previous *meta.Backup
+	for i, backup := range *backups {
+		if backup.Source != source.Name || backup.DumpSize == 0 {
+			continue
+		}
+		if previous == nil || backup.StartedCreationAt.After(previous.StartedCreationAt) {
+			previous = &(*backups)[i]
+		}
+	}
+	return previous
+}
+
+func backupUsage(ctx context.Context, repo repository.Repository, source *Source, path string) *repository.BackupMeta {
+	metaSubvolumes, err := repo.BackupUsage(ctx, source.path(repo))
+	if err != nil {
+		log.WithContext(ctx).Warnf("The usage of the previous backup is not used for the estimate: %v", err)
+		return nil
+	}
+	for _, metaSubvolume := range metaSubvolumes {
+		if metaSubvolume.Base.Path == path {
+			return &metaSubvolume
+		}
+	}
+	return nil
+}
+
+// ratio returns the share of the dump which takes the space, it never exceeds 1, since the compression and the dedup
+// never take more space than the dump itself.
+func ratio(usage uint64, dumpSize int64) float64 {
+	value := float64(usage) / float64(dumpSize)
+	if value > 1 {
+		return 1
+	}
+	return value
+}
+
+// prepareSpace extends the image for the estimated backup before the database is dumped, and fails early with
+// device.ErrInsufficientSpace if the host cannot fit the image or the temporary dump.
+func prepareSpace(ctx context.Context, repo repository.Repository, estimate *SpaceEstimate,
+	phases map[string]float64) error {
+	if estimate == nil {
+		return nil
+	}
+
+	resizeStartedAt := time.Now()
+	if err := repo.Reserve(ctx, estimate.ImageSize, estimate.TempDumpSize); err != nil {
+		return err
+	}
+	phases["resize"] += time.Since(resizeStartedAt).Seconds()
+	return nil
+}
+
+// recordDatabaseSize keeps the statistics of the database in the meta entry for the estimate of the next backup.
+func recordDatabaseSize(ctx context.Context, store *meta.Store, targetPath string, estimate *SpaceEstimate) {
+	if estimate == nil || estimate.DatabaseSize == 0 {
+		return
+	}
+	if err := store.UpdateBackup(targetPath, func(backup *meta.Backup) {
+		backup.DatabaseSize = estimate.DatabaseSize
+	}); err != nil {
+		log.WithContext(ctx).Warnf("failed to record the size of the database for the backup `%s`: %v", targetPath, err)
+	}
+}
@@ -19,11 +19,91 @@ const YdbRestorePath = "ydb-restore-path"
 const YdbRestoreData = "ydb-restore-data"
 const YdbRestoreIndexes = "ydb-restore-indexes"
 const YdbRestoreDryRun = "ydb-restore-dry-run"
+const PruneKeepLastArg = "keep-last"
+const PruneKeepWithinArg = "keep-within"
+const MetricsTextfileArg = "metrics-textfile"
+const MetricsListenArg = "listen"
+const HookArgPrefix = "hook-"
+const HookTimeoutArg = "hook-timeout"
+const NotifyWebhookArg = "notify-webhook"
+const NotifySmtpAddrArg = "notify-smtp"
+const NotifySmtpFromArg = "notify-smtp-from"
+const NotifySmtpToArg = "notify-smtp-to"
+const NotifySmtpUserArg = "notify-smtp-user"
+const NotifyCommandArg = "notify-command"
+const NotifyOnArg = "notify-on"
+const ScheduleArgPrefix = "schedule-"
+const JitterArg = "jitter"
+const StatusListenArg = "status-listen"
+const ApiListenArg = "api-listen"
+const ApiTokenFileArg = "api-token-file"
+const ApiTLSCertArg = "api-tls-cert"
+const ApiTLSKeyArg = "api-tls-key"
+const VerboseArg = "verbose"
+const SkipPreflightArg = "skip-preflight"
+const FsckRepairArg = "repair"
+const FsckIncompleteAgeArg = "incomplete-older-than"
+const AssumeYesArg = "yes"
+const DeleteOrphansArg = "delete-orphans"
+const BackupNameArg = "name"
+const BackupTagArg = "tag"
+const BackupNoteArg = "note"
+const BackupPinArg = "pin"
+const BackupAtArg = "at"
+const SourceArg = "source"
+const AllowCrossDatabaseArg = "allow-cross-database"
+const SourcesFileArg = "sources-file"
+const ParallelDumpsArg = "parallel-dumps"
+const YdbDumpParallelismArg = "ydb-dump-parallelism"
+const DumpDirectArg = "dump-direct"
+const ImageGrowthStepArg = "image-growth-step"
+const ImageMaxSizeArg = "image-max-size"
+const ImageGrowthRemountArg = "image-growth-remount"
+const ImageAllocationArg = "image-allocation"
+const ImageInitialSizeArg = "image-initial-size"
+const BtrfsDataProfileArg = "btrfs-data-profile"
+const BtrfsMetadataProfileArg = "btrfs-metadata-profile"
+const BtrfsNodeSizeArg = "btrfs-nodesize"
+const EncryptArg = "encrypt"
+const KeyFileArg = "key-file"
+const NewKeyFileArg = "new-key-file"
+const OutputArg = "output"
+const RecipientArg = "recipient"
+const PassphraseArg = "passphrase"
+const PassphraseFileArg = "passphrase-file"
+const PlaintextArg = "plaintext"
+const IdentityArg = "identity"
+const ReplicateArg = "replicate"
+const S3EndpointArg = "s3-endpoint"
+const S3BucketArg = "s3-bucket"
+const S3PrefixArg = "s3-prefix"
+const S3RegionArg = "s3-region"
+const S3PathStyleArg = "s3-path-style"
+const S3PartSizeArg = "s3-part-size"
+const BackendArg = "backend"
+const StorePathArg = "store"
+
+const SmtpPasswordEnv = "YDB_BACKUP_TOOL_SMTP_PASSWORD"
+const KeyEnv = "YDB_BACKUP_TOOL_KEY"
+const NewKeyEnv = "YDB_BACKUP_TOOL_NEW_KEY"
+const PassphraseEnv = "YDB_BACKUP_TOOL_PASSPHRASE"
+const S3AccessKeyEnv = "AWS_ACCESS_KEY_ID"
+const S3SecretKeyEnv = "AWS_SECRET_ACCESS_KEY"
 
 const AppDataPath = "/var/lib/ydb-backup-tool"
 const AppTmpPath = AppDataPath + "/tmp"
 const AppMetaPath = AppDataPath + "/meta.json"
 const AppHashfilePath = AppDataPath + "/hashfile"
+const BackupSidecarName = ".ydb-backup-meta.json"
+const BackupStagingMarkerName = ".ydb-backup-staging"
+const BackupStagingDumpName = ".ydb-backup-dump"
+const BackupManifestName = ".ydb-backup-manifest.json"
 const AppBaseDataBackingFilePath = AppDataPath + "/data.img"
 const AppDataMountPath = AppDataPath + "/mnt"
+const LuksMapperPrefix = "ydb-backup-tool-"
 const AppBackupsPath = AppDataMountPath + "/backups"
+const AppUploadsPath = AppDataMountPath + "/uploads"
+
+// BackupSubvolumePrefix starts the names of the backup subvolumes, the other subvolumes under `AppBackupsPath`
+// keep the backups of the sources
+const BackupSubvolumePrefix = "ydb_backup_"
@@ -0,0 +1,235 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+	"ydb-backup-tool/internal/schedule"
+)
+
+const defaultHistorySize = 50
+
+type Job struct {
+	Name     string
+	Schedule *schedule.Schedule
+	Run      func() error
+}
+
+type Outcome struct {
+	Job        string    `json:"job"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Success    bool      `json:"success"`
+	Skipped    bool      `json:"skipped,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type jobStatus struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	NextRun  time.Time `json:"next_run"`
+}
+
+type status struct {
+	Running string      `json:"running,omitempty"`
+	Jobs    []jobStatus `json:"jobs"`
+	History []Outcome   `json:"history"`
+}
+
+// Daemon runs the jobs according to their schedules. Jobs never overlap: the activation of a job is skipped while
+// another one is still running.
+type Daemon struct {
+	Jobs        []*Job
+	Jitter      time.Duration
+	StatusAddr  string
+	HistorySize int
+
+	jobMu   sync.Mutex
+	mu      sync.Mutex
+	running string
+	nextRun map[string]time.Time
+	history []Outcome
+}
+
+// Run blocks until the context is done and the running job, if any, is finished.
+func (d *Daemon) Run(ctx context.Context) error {
+	d.mu.Lock()
+	if d.nextRun == nil {
+		d.nextRun = map[string]time.Time{}
+	}
+	d.mu.Unlock()
+
+	var server *http.Server
+	serverErr := make(chan error, 1)
+	if d.StatusAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/status", d.handleStatus)
+		server = &http.Server{Addr: d.StatusAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serverErr <- err
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for _, job := range d.Jobs {
+		wg.Add(1)
+		go func(job *Job) {
+			defer wg.Done()
+			d.loop(ctx, job)
+		}(job)
+		log.Infof("Scheduled `%s` job with `%s`", job.Name, job.Schedule)
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-serverErr:
+		err = fmt.Errorf("status endpoint `%s` stopped: %w", d.StatusAddr, err)
+	}
+
+	log.Infof("Stopping the daemon, waiting for the running job to finish")
+	wg.Wait()
+
+	if server != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
+
+func (d *Daemon) loop(ctx context.Context, job *Job) {
+	for {
+		next := job.Schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Warnf("Job `%s` will never run with `%s`", job.Name, job.Schedule)
+			return
+		}
+		if d.Jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(d.Jitter))))
+		}
+		d.setNextRun(job.Name, next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		d.runJob(job)
+	}
+}
+
+func (d *Daemon) runJob(job *Job) {
+	if !d.jobMu.TryLock() {
+		now := time.Now()
+		outcome := Outcome{Job: job.Name, StartedAt: now, FinishedAt: now, Skipped: true}
+		outcome.Error = fmt.Sprintf("job `%s` is still running", d.getRunning())
+		log.Warnf("Skipping `%s` job: %s", job.Name, outcome.Error)
+		d.record(outcome)
+		return
+	}
+	defer d.jobMu.Unlock()
+
+	_ = d.runLocked(job.Name, job.Run)
+}
+
+// RunExclusive waits until no other job is running and runs `run` as the job `name`. It is used for the jobs which
+// are not scheduled, but requested, e.g. through the API.
+func (d *Daemon) RunExclusive(name string, run func() error) error {
+	d.jobMu.Lock()
+	defer d.jobMu.Unlock()
+
+	return d.runLocked(name, run)
+}
+
+func (d *Daemon) runLocked(name string, run func() error) error {
+	outcome := Outcome{Job: name, StartedAt: time.Now()}
+	d.setRunning(name)
+	defer d.setRunning("")
+
+	log.Infof("Running `%s` job", name)
+	err := runRecovered(run)
+	outcome.FinishedAt = time.Now()
+	outcome.Success = err == nil
+	if err != nil {
+		outcome.Error = err.Error()
+		log.Errorf("Job `%s` failed: %v", name, err)
+	} else {
+		log.Infof("Job `%s` finished in %s", name, outcome.FinishedAt.Sub(outcome.StartedAt))
+	}
+	d.record(outcome)
+	return err
+}
+
+// runRecovered keeps the daemon alive when a job panics.
+func runRecovered(run func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return run()
+}
+
+func (d *Daemon) record(outcome Outcome) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	historySize := d.HistorySize
+	if historySize <= 0 {
+		historySize = defaultHistorySize
+	}
+	d.history = append(d.history, outcome)
+	if len(d.history) > historySize {
+		d.history = d.history[len(d.history)-historySize:]
+	}
+}
+
+func (d *Daemon) setNextRun(name string, next time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextRun[name] = next
+}
+
+func (d *Daemon) setRunning(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.running = name
+}
+
+func (d *Daemon) getRunning() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.running
+}
+
+func (d *Daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	st := status{Running: d.running, History: make([]Outcome, 0, len(d.history))}
+	for _, job := range d.Jobs {
+		st.Jobs = append(st.Jobs, jobStatus{Name: job.Name, Schedule: job.Schedule.String(), NextRun: d.nextRun[job.Name]})
+	}
+	// The most recent outcomes go first
+	for i := len(d.history) - 1; i >= 0; i-- {
+		st.History = append(st.History, d.history[i])
+	}
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		log.Warnf("failed to write status response: %v", err)
+	}
+}
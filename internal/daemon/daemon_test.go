@@ -0,0 +1,68 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"ydb-backup-tool/internal/schedule"
+)
+
+// TestSkipWhileRunning checks that a trigger is skipped, not queued, while another job is running.
+func TestSkipWhileRunning(t *testing.T) {
+	every, err := schedule.Parse("* * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	skippedRuns := 0
+	skipped := &Job{Name: "prune", Schedule: every, Run: func() error {
+		skippedRuns++
+		return nil
+	}}
+	d := &Daemon{Jobs: []*Job{skipped}, nextRun: map[string]time.Time{}}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- d.RunExclusive("create", func() error {
+			close(started)
+			<-release
+			return errors.New("dump failed")
+		})
+	}()
+	<-started
+	d.runJob(skipped)
+	close(release)
+	if err := <-done; err == nil {
+		t.Fatal("the error of the job is not returned")
+	}
+
+	d.runJob(skipped)
+	if skippedRuns != 1 {
+		t.Fatalf("the job ran %d times, want once after the running job", skippedRuns)
+	}
+
+	recorder := httptest.NewRecorder()
+	d.handleStatus(recorder, httptest.NewRequest("GET", "/status", nil))
+	var st status
+	if err := json.NewDecoder(recorder.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Jobs) != 1 || st.Jobs[0].Name != "prune" || st.Jobs[0].Schedule != "* * * * *" || st.Running != "" {
+		t.Fatalf("unexpected status: %+v", st)
+	}
+	// The most recent outcomes go first
+	if len(st.History) != 3 {
+		t.Fatalf("unexpected history: %+v", st.History)
+	}
+	if last := st.History[0]; last.Job != "prune" || !last.Success || last.Skipped {
+		t.Fatalf("the job is not run after the running job: %+v", last)
+	}
+	if failed := st.History[1]; failed.Job != "create" || failed.Success || failed.Error != "dump failed" {
+		t.Fatalf("the failed job: %+v", failed)
+	}
+	if first := st.History[2]; first.Job != "prune" || !first.Skipped || first.Error != "job `create` is still running" {
+		t.Fatalf("the job is not skipped while another one is running: %+v", first)
+	}
+}
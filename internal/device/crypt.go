@@ -0,0 +1,156 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/utils"
+)
+
+// ErrKeyRequired is returned when the image is encrypted, but no key is passed.
+var ErrKeyRequired = errors.New("the image is encrypted, a key is required")
+
+// luksMagic starts the header of both LUKS1 and LUKS2 containers.
+var luksMagic = []byte{'L', 'U', 'K', 'S', 0xba, 0xbe}
+
+// Key unlocks the encrypted image. It is passed to `cryptsetup` through a pipe, so it never appears in the command
+// line or on the disk.
+type Key struct {
+	secret []byte
+}
+
+// LoadKey returns the key from the source, see utils.SecretSource.
+func LoadKey(source *utils.SecretSource, isNew bool) (*Key, error) {
+	secret, err := source.Load(isNew)
+	if errors.Is(err, utils.ErrNotTerminal) {
+		return nil, fmt.Errorf("%w, pass a key file or set `%s`", ErrKeyRequired, source.Env)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Key{secret: secret}, nil
+}
+
+// CryptDevice is the opened LUKS container, btrfs is mounted from its mapping.
+type CryptDevice struct {
+	Name string
+	Path string
+	// The key is kept to resize the container while it is open
+	key *Key
+}
+
+// IsEncrypted checks the header of the backing file for the LUKS magic.
+func IsEncrypted(backingFile *BackingFile) (bool, error) {
+	file, err := os.Open(backingFile.Path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, len(luksMagic))
+	if _, err := io.ReadFull(file, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read the header of `%s`: %w", backingFile.Path, err)
+	}
+	return bytes.Equal(header, luksMagic), nil
+}
+
+// FormatLuks creates the LUKS2 container on the loop device, the data of the device is lost.
+func FormatLuks(ctx context.Context, loopDevice *LoopDevice, key *Key) error {
+	if err := runCryptsetup(ctx, key, "luksFormat", "--type", "luks2", "--batch-mode", "--key-file", "-",
+		loopDevice.Name); err != nil {
+		return fmt.Errorf("cannot create the LUKS container on %s: %w", loopDevice.Name, err)
+	}
+	return nil
+}
+
+// OpenLuks maps the LUKS container of the loop device to `/dev/mapper/<name>`, the name is derived from the backing
+// file, see luksMapperName.
+func OpenLuks(ctx context.Context, loopDevice *LoopDevice, key *Key) (*CryptDevice, error) {
+	name := luksMapperName(loopDevice.BackFile.Path)
+	if err := runCryptsetup(ctx, key, "open", "--type", "luks", "--key-file", "-", loopDevice.Name,
+		name); err != nil {
+		return nil, fmt.Errorf("cannot open the LUKS container on %s: %w", loopDevice.Name, err)
+	}
+	return &CryptDevice{Name: name, Path: filepath.Join("/dev/mapper", name), key: key}, nil
+}
+
+// luksMapperName returns the name of the mapping of the image, unique for its path, so that several images,
+// e.g. of several instances of the tool or of the tests, can be open at once.
+func luksMapperName(backingFilePath string) string {
+	if absolutePath, err := filepath.Abs(backingFilePath); err == nil {
+		backingFilePath = absolutePath
+	}
+	hash := sha256.Sum256([]byte(backingFilePath))
+	return _const.LuksMapperPrefix + hex.EncodeToString(hash[:8])
+}
+
+// ReopenLuks opens the container of the closed device on the loop device with the same key.
+func ReopenLuks(ctx context.Context, loopDevice *LoopDevice, crypt *CryptDevice) (*CryptDevice, error) {
+	return OpenLuks(ctx, loopDevice, crypt.key)
+}
+
+func CloseLuks(ctx context.Context, crypt *CryptDevice) error {
+	if err := runCryptsetup(ctx, nil, "close", crypt.Name); err != nil {
+		return fmt.Errorf("cannot close the LUKS container %s: %w", crypt.Name, err)
+	}
+	return nil
+}
+
+// ResizeLuks makes the open container pick up the new size of the loop device.
+func ResizeLuks(ctx context.Context, crypt *CryptDevice) error {
+	if err := runCryptsetup(ctx, crypt.key, "resize", "--key-file", "-", crypt.Name); err != nil {
+		return fmt.Errorf("cannot resize the LUKS container %s: %w", crypt.Name, err)
+	}
+	return nil
+}
+
+// ChangeLuksKey replaces the key of the container in the backing file. The new key is passed through another pipe,
+// which `cryptsetup` reads as the file descriptor 3.
+func ChangeLuksKey(ctx context.Context, backingFile *BackingFile, oldKey *Key, newKey *Key) error {
+	cryptsetupPath, err := utils.GetBinary("cryptsetup")
+	if err != nil {
+		return err
+	}
+
+	newKeyReader, newKeyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer newKeyReader.Close()
+	go func() {
+		_, _ = newKeyWriter.Write(newKey.secret)
+		_ = newKeyWriter.Close()
+	}()
+
+	cmd := utils.BuildCommand(ctx, cryptsetupPath, "luksChangeKey", "--batch-mode", "--key-file", "-",
+		backingFile.Path, "/dev/fd/3")
+	cmd.Stdin = bytes.NewReader(oldKey.secret)
+	cmd.ExtraFiles = []*os.File{newKeyReader}
+	if err := utils.RunCommand(cmd); err != nil {
+		return fmt.Errorf("cannot change the key of `%s`, check the current key: %w", backingFile.Path, err)
+	}
+	return nil
+}
+
+func runCryptsetup(ctx context.Context, key *Key, args ...string) error {
+	cryptsetupPath, err := utils.GetBinary("cryptsetup")
+	if err != nil {
+		return err
+	}
+
+	cmd := utils.BuildCommand(ctx, cryptsetupPath, args...)
+	if key != nil {
+		cmd.Stdin = bytes.NewReader(key.secret)
+	}
+	return utils.RunCommand(cmd)
+}
@@ -0,0 +1,126 @@
+package device
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	_const "ydb-backup-tool/internal/const"
+)
+
+// fakeCryptsetupScript stands for `cryptsetup`: it logs the arguments, the key read from stdin and the new key
+// read from the file descriptor 3, if it is passed.
+const fakeCryptsetupScript = `#!/bin/sh
+echo "$@" > "$FAKE_CRYPTSETUP_DIR/args"
+cat > "$FAKE_CRYPTSETUP_DIR/key"
+for arg in "$@"; do
+  if [ "$arg" = /dev/fd/3 ]; then
+    cat <&3 > "$FAKE_CRYPTSETUP_DIR/new-key"
+  fi
+done
+`
+
+// fakeCryptsetup puts the fake `cryptsetup` on the PATH and returns the directory of its logs.
+func fakeCryptsetup(t *testing.T) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "cryptsetup"), []byte(fakeCryptsetupScript), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("FAKE_CRYPTSETUP_DIR", dir)
+	return dir
+}
+
+func readLog(t *testing.T, dir string, name string) string {
+	content, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func TestIsEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"luks":  append(append([]byte{}, luksMagic...), make([]byte, 1024)...),
+		"plain": make([]byte, 1024),
+		"short": luksMagic[:3],
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		encrypted, err := IsEncrypted(&BackingFile{Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypted != (name == "luks") {
+			t.Errorf("`%s` is encrypted: %t", name, encrypted)
+		}
+	}
+}
+
+func TestLuksMapperName(t *testing.T) {
+	dir := t.TempDir()
+	name := luksMapperName(filepath.Join(dir, "data.img"))
+	if !strings.HasPrefix(name, _const.LuksMapperPrefix) || strings.ContainsAny(name, "/ ") {
+		t.Fatalf("unexpected mapper name `%s`", name)
+	}
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relativePath, err := filepath.Rel(workingDir, filepath.Join(dir, "data.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relative := luksMapperName(relativePath); relative != name {
+		t.Fatalf("the relative path of the image is mapped to `%s` instead of `%s`", relative, name)
+	}
+	if other := luksMapperName(filepath.Join(dir, "other.img")); other == name {
+		t.Fatalf("both images are mapped to `%s`", name)
+	}
+}
+
+func TestOpenLuks(t *testing.T) {
+	logs := fakeCryptsetup(t)
+	loopDevice := &LoopDevice{Name: "/dev/loop7", BackFile: BackingFile{Path: "/var/lib/data.img"}}
+	crypt, err := OpenLuks(context.Background(), loopDevice, &Key{secret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := luksMapperName(loopDevice.BackFile.Path)
+	if crypt.Name != name || crypt.Path != "/dev/mapper/"+name {
+		t.Fatalf("unexpected device: %+v", crypt)
+	}
+	args := readLog(t, logs, "args")
+	if args != "open --type luks --key-file - /dev/loop7 "+name {
+		t.Fatalf("unexpected arguments: %s", args)
+	}
+	if key := readLog(t, logs, "key"); key != "secret" {
+		t.Fatalf("the key is passed as `%s`", key)
+	}
+}
+
+func TestChangeLuksKey(t *testing.T) {
+	logs := fakeCryptsetup(t)
+	err := ChangeLuksKey(context.Background(), &BackingFile{Path: "/var/lib/data.img"}, &Key{secret: []byte("old")},
+		&Key{secret: []byte("new")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := readLog(t, logs, "args")
+	if strings.Contains(args, "old") || strings.Contains(args, "new") {
+		t.Fatalf("the keys are passed in the arguments: %s", args)
+	}
+	if key := readLog(t, logs, "key"); key != "old" {
+		t.Fatalf("the current key is passed as `%s`", key)
+	}
+	if key := readLog(t, logs, "new-key"); key != "new" {
+		t.Fatalf("the new key is passed as `%s`", key)
+	}
+}
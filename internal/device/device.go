@@ -1,16 +1,52 @@
 package device
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 	comp "ydb-backup-tool/internal/btrfs/compression"
 	_const "ydb-backup-tool/internal/const"
 	"ydb-backup-tool/internal/utils"
 )
 
+// ErrInsufficientSpace is returned when the host filesystem cannot fit the backing file.
+var ErrInsufficientSpace = errors.New("insufficient space on the host filesystem")
+
+// InitialBackingFileSize is the size of the image file created on the first run.
+const InitialBackingFileSize = 256 * 1024 * 1024
+
+// Allocation is the strategy of allocating the blocks of the image file on the host.
+type Allocation string
+
+const (
+	// AllocationSparse allocates the blocks of the image only when btrfs writes them
+	AllocationSparse Allocation = "sparse"
+	// AllocationPreallocated allocates the blocks of the image as soon as the file is created or extended
+	AllocationPreallocated Allocation = "preallocated"
+	// AllocationFixed preallocates the image of the maximum size at once and never extends it
+	AllocationFixed Allocation = "fixed"
+)
+
+func ParseAllocation(value string) (Allocation, error) {
+	switch allocation := Allocation(strings.ToLower(value)); allocation {
+	case AllocationSparse, AllocationPreallocated, AllocationFixed:
+		return allocation, nil
+	default:
+		return "", fmt.Errorf("unknown allocation `%s`, available: sparse, preallocated and fixed", value)
+	}
+}
+
+// BackingFileParams describes the image file created on the first run.
+type BackingFileParams struct {
+	Size       int64
+	Allocation Allocation
+}
+
 type BackingFile struct {
 	Path string
 }
@@ -42,25 +78,27 @@ type LoopDevice struct {
 type MountPoint struct {
 	Path    string
 	LoopDev LoopDevice
+	// Crypt is the LUKS container between the loop device and btrfs, nil for the unencrypted image
+	Crypt *CryptDevice
 }
 
-func Unmount(mountPoint *MountPoint) error {
+func Unmount(ctx context.Context, mountPoint *MountPoint) error {
 	umountPath, err := utils.GetBinary("umount")
 	if err != nil {
 		return err
 	}
 
-	umountCmd := utils.BuildCommand(umountPath, mountPoint.Path)
-	if err := umountCmd.Run(); err != nil {
-		return fmt.Errorf("cannot unmount the image file")
+	umountCmd := utils.BuildCommand(ctx, umountPath, mountPoint.Path)
+	if err := utils.RunCommand(umountCmd); err != nil {
+		return fmt.Errorf("cannot unmount the image file: %w", err)
 	}
 
 	return nil
 }
 
-func GetOrCreateBackingStoreFile(filePath string) (*BackingFile, bool, error) {
+func GetOrCreateBackingStoreFile(filePath string, params *BackingFileParams) (*BackingFile, bool, error) {
 	if _, err := os.Stat(filePath); err != nil {
-		if err := createBackingStoreFile(filePath); err != nil {
+		if err := createBackingStoreFile(filePath, params); err != nil {
 			return nil, false, err
 		}
 		return &BackingFile{filePath}, true, nil
@@ -68,21 +106,21 @@ func GetOrCreateBackingStoreFile(filePath string) (*BackingFile, bool, error) {
 	return &BackingFile{filePath}, false, nil
 }
 
-func SetupLoopDevice(backingFile *BackingFile) (*LoopDevice, error) {
+func SetupLoopDevice(ctx context.Context, backingFile *BackingFile) (*LoopDevice, error) {
 	losetupPath, err := utils.GetBinary("losetup")
 	if err != nil {
 		return nil, err
 	}
 
-	losetupCmd := utils.BuildCommand(losetupPath, "-fP", backingFile.Path)
-	if err := losetupCmd.Run(); err != nil {
-		return nil, fmt.Errorf("cannot create loop device with backing file = %s", backingFile.Path)
+	losetupCmd := utils.BuildCommand(ctx, losetupPath, "-fP", backingFile.Path)
+	if err := utils.RunCommand(losetupCmd); err != nil {
+		return nil, fmt.Errorf("cannot create loop device with backing file = %s: %w", backingFile.Path, err)
 	}
 
-	losetupDevicesCmd := utils.BuildCommand(losetupPath, "--json")
-	out, err := losetupDevicesCmd.Output()
+	losetupDevicesCmd := utils.BuildCommand(ctx, losetupPath, "--json")
+	out, err := utils.OutputCommand(losetupDevicesCmd)
 	if err != nil {
-		return nil, errors.New("cannot get list of loopback devices")
+		return nil, fmt.Errorf("cannot get list of loopback devices: %w", err)
 	}
 
 	var loopDevicesJson loopDevicesJson
@@ -112,46 +150,64 @@ func SetupLoopDevice(backingFile *BackingFile) (*LoopDevice, error) {
 	}, nil
 }
 
-func DetachLoopDevice(device *LoopDevice) error {
+func DetachLoopDevice(ctx context.Context, device *LoopDevice) error {
 	losetupPath, err := utils.GetBinary("losetup")
 	if err != nil {
 		return err
 	}
 
-	cmd := utils.BuildCommand(losetupPath, "-d", device.Name)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("cannot detach loop device %s", device.Name)
+	cmd := utils.BuildCommand(ctx, losetupPath, "-d", device.Name)
+	if err := utils.RunCommand(cmd); err != nil {
+		return fmt.Errorf("cannot detach loop device %s: %w", device.Name, err)
 	}
 
 	return nil
 }
 
-func MountLoopDevice(loopDevice *LoopDevice, mountTargetPath string, compression *comp.Compression) (*MountPoint, error) {
-	if err := utils.CreateDirectory(mountTargetPath); err != nil {
+func MountLoopDevice(ctx context.Context, loopDevice *LoopDevice, mountTargetPath string, compression *comp.Compression) (*MountPoint, error) {
+	if err := mountDevice(ctx, loopDevice.Name, mountTargetPath, compression); err != nil {
+		return nil, err
+	}
+	return &MountPoint{Path: mountTargetPath, LoopDev: *loopDevice}, nil
+}
+
+// MountCryptDevice mounts btrfs from the open LUKS container of the loop device.
+func MountCryptDevice(ctx context.Context, loopDevice *LoopDevice, crypt *CryptDevice, mountTargetPath string,
+	compression *comp.Compression) (*MountPoint, error) {
+	if err := mountDevice(ctx, crypt.Path, mountTargetPath, compression); err != nil {
 		return nil, err
 	}
+	return &MountPoint{Path: mountTargetPath, LoopDev: *loopDevice, Crypt: crypt}, nil
+}
+
+func mountDevice(ctx context.Context, devicePath string, mountTargetPath string, compression *comp.Compression) error {
+	if err := utils.CreateDirectory(mountTargetPath); err != nil {
+		return err
+	}
 
 	mountPath, err := utils.GetBinary("mount")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	var args []string
 	if compression != nil {
 		args = append(args, "-o", fmt.Sprintf("compress=%s:%d", (*compression).Algorithm(), (*compression).CompressionLevel()))
 	}
-	args = append(args, loopDevice.Name, mountTargetPath)
+	args = append(args, devicePath, mountTargetPath)
 
-	mountCmd := utils.BuildCommand(mountPath, args...)
+	mountCmd := utils.BuildCommand(ctx, mountPath, args...)
 
-	if err := mountCmd.Run(); err != nil {
-		return nil, fmt.Errorf("cannot mount loopdevice to folder %s", mountTargetPath)
+	if err := utils.RunCommand(mountCmd); err != nil {
+		return fmt.Errorf("cannot mount %s to folder %s: %w", devicePath, mountTargetPath, err)
 	}
 
-	return &MountPoint{Path: mountTargetPath, LoopDev: *loopDevice}, nil
+	return nil
 }
 
-func ExtendBackingStoreFileBy(backingFile *BackingFile, size int64) error {
+// ExtendBackingStoreFileBy extends the file by `size` bytes, rounded up to a megabyte. The file may stay attached
+// to the loop device, see RefreshLoopDeviceCapacity.
+func ExtendBackingStoreFileBy(backingFile *BackingFile, size int64, allocation Allocation) error {
 	currentSize, err := utils.GetFileSize(backingFile.Path)
 	if err != nil {
 		return fmt.Errorf("failed to get the file size of %s", backingFile.Path)
@@ -160,48 +216,132 @@ func ExtendBackingStoreFileBy(backingFile *BackingFile, size int64) error {
 	if size < 0 {
 		return fmt.Errorf("not allowed to shrink the backing file %s", backingFile.Path)
 	}
+	if size == 0 {
+		return nil
+	}
 
-	if size > 0 {
-		// Bytes to MB
-		targetSizeInMb := size / (1024 * 1024)
-		if size%(1024*1024) != 0 {
-			targetSizeInMb += 1
-		}
-		// Bytes to MB
-		targetSizeInMb += currentSize / (1024 * 1024)
-		if currentSize%(1024*1024) != 0 {
-			targetSizeInMb += 1
-		}
+	const megabyte = 1024 * 1024
+	targetSize := (currentSize + size + megabyte - 1) / megabyte * megabyte
+	if err := CheckFreeSpace(filepath.Dir(backingFile.Path), targetSize-currentSize); err != nil {
+		return err
+	}
+	if err := growFile(backingFile.Path, currentSize, targetSize, allocation); err != nil {
+		return fmt.Errorf("failed to extend backing file %s to %d bytes: %w", backingFile.Path, targetSize, err)
+	}
+	return nil
+}
 
-		dd, err := utils.GetBinary("dd")
-		if err != nil {
-			return err
-		}
+// RefreshLoopDeviceCapacity makes the loop device pick up the new size of its backing file while it is in use.
+func RefreshLoopDeviceCapacity(ctx context.Context, device *LoopDevice) error {
+	losetupPath, err := utils.GetBinary("losetup")
+	if err != nil {
+		return err
+	}
 
-		cmd := utils.BuildCommand(dd, "if=/dev/zero", "bs=1M", fmt.Sprintf("seek=%d", targetSizeInMb),
-			"count=0", fmt.Sprintf("of=%s", backingFile.Path))
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to extend backing file %s size to %dMB", backingFile.Path, size)
-		}
+	cmd := utils.BuildCommand(ctx, losetupPath, "-c", device.Name)
+	if err := utils.RunCommand(cmd); err != nil {
+		return fmt.Errorf("cannot refresh the capacity of loop device %s: %w", device.Name, err)
 	}
 
 	return nil
 }
 
-func createBackingStoreFile(filePath string) error {
+func createBackingStoreFile(filePath string, params *BackingFileParams) error {
 	// Create directory for app data in case it doesn't exist
 	if err := utils.CreateDirectory(_const.AppDataPath); err != nil {
 		return err
 	}
 
-	ddPath, err := utils.GetBinary("dd")
-	if err != nil {
+	if err := CheckFreeSpace(_const.AppDataPath, params.Size); err != nil {
 		return err
 	}
-	ddCmd := utils.BuildCommand(ddPath, "if=/dev/zero", "of="+filePath, "bs=1M", "count=256")
-	if err := ddCmd.Run(); err != nil {
-		return fmt.Errorf("failed to create img file `%s`", filePath)
+
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create img file `%s`: %w", filePath, err)
+	}
+	if err := allocateFile(file, 0, params.Size, params.Allocation); err != nil {
+		_ = file.Close()
+		_ = os.Remove(filePath)
+		return fmt.Errorf("failed to allocate img file `%s`: %w", filePath, err)
 	}
+	return file.Close()
+}
+
+// AvailableSpace returns the number of bytes available to unprivileged users on the filesystem holding `dir`.
+func AvailableSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("failed to get free space of `%s`: %w", dir, err)
+	}
+	return int64(stat.Bavail) * stat.Bsize, nil
+}
 
+// CheckFreeSpace fails with ErrInsufficientSpace if less than `required` bytes are available in `dir`.
+func CheckFreeSpace(dir string, required int64) error {
+	available, err := AvailableSpace(dir)
+	if err != nil {
+		return err
+	}
+	if available < required {
+		return fmt.Errorf("%w: `%s` has %d bytes available, %d bytes required", ErrInsufficientSpace, dir,
+			available, required)
+	}
 	return nil
 }
+
+// GrowthPolicy decides how much the image is extended when it cannot fit the next dump.
+type GrowthPolicy struct {
+	// Step is the granularity of the growth, the image is extended by a multiple of it
+	Step int64
+	// MaxSize limits the size of the image file, zero means no limit
+	MaxSize int64
+	// Allocation of the blocks of the extension, the fixed image is never extended
+	Allocation Allocation
+	// Remount extends the image by remounting it, instead of refreshing the capacity of the loop device
+	// while the image is mounted
+	Remount bool
+}
+
+// DefaultGrowthStep is the step of the growth unless it is configured.
+const DefaultGrowthStep = 1024 * 1024 * 1024
+
+// Extension returns the number of bytes to extend the image of `currentSize` by, so that `deficit` more bytes fit
+// into it. It fails with ErrInsufficientSpace if the image would exceed the maximum size.
+func (policy *GrowthPolicy) Extension(currentSize int64, deficit int64) (int64, error) {
+	if deficit <= 0 {
+		return 0, nil
+	}
+
+	if policy.Allocation == AllocationFixed {
+		return 0, fmt.Errorf("%w: the image needs %s more, but it has a fixed size", ErrInsufficientSpace,
+			utils.FormatSize(deficit))
+	}
+
+	step := policy.Step
+	if step <= 0 {
+		step = DefaultGrowthStep
+	}
+	extension := (deficit + step - 1) / step * step
+	if policy.MaxSize > 0 && currentSize+extension > policy.MaxSize {
+		// The last step may be partial, as long as the deficit still fits under the maximum
+		if currentSize+deficit > policy.MaxSize {
+			return 0, fmt.Errorf("%w: the image needs %s more, it would exceed the maximum size of %s",
+				ErrInsufficientSpace, utils.FormatSize(deficit), utils.FormatSize(policy.MaxSize))
+		}
+		extension = policy.MaxSize - currentSize
+	}
+	return extension, nil
+}
+
+// SameFilesystem reports whether both paths are on the same filesystem.
+func SameFilesystem(first string, second string) (bool, error) {
+	var firstStat, secondStat syscall.Stat_t
+	if err := syscall.Stat(first, &firstStat); err != nil {
+		return false, fmt.Errorf("failed to stat `%s`: %w", first, err)
+	}
+	if err := syscall.Stat(second, &secondStat); err != nil {
+		return false, fmt.Errorf("failed to stat `%s`: %w", second, err)
+	}
+	return firstStat.Dev == secondStat.Dev, nil
+}
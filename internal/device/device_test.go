@@ -0,0 +1,40 @@
+package device
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGrowthPolicyExtension(t *testing.T) {
+	const mb = 1024 * 1024
+	tests := []struct {
+		name        string
+		policy      GrowthPolicy
+		currentSize int64
+		deficit     int64
+		expected    int64
+		expectErr   error
+	}{
+		{name: "no deficit", policy: GrowthPolicy{Step: 64 * mb}, currentSize: 256 * mb},
+		{name: "rounded up to the step", policy: GrowthPolicy{Step: 64 * mb}, currentSize: 256 * mb,
+			deficit: 65 * mb, expected: 128 * mb},
+		{name: "default step", currentSize: 256 * mb, deficit: 1, expected: DefaultGrowthStep},
+		{name: "partial last step", policy: GrowthPolicy{Step: 64 * mb, MaxSize: 300 * mb}, currentSize: 256 * mb,
+			deficit: 10 * mb, expected: 44 * mb},
+		{name: "above the maximum", policy: GrowthPolicy{Step: 64 * mb, MaxSize: 300 * mb}, currentSize: 256 * mb,
+			deficit: 45 * mb, expectErr: ErrInsufficientSpace},
+		{name: "fixed", policy: GrowthPolicy{Step: 64 * mb, Allocation: AllocationFixed}, currentSize: 256 * mb,
+			deficit: 1, expectErr: ErrInsufficientSpace},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			extension, err := test.policy.Extension(test.currentSize, test.deficit)
+			if !errors.Is(err, test.expectErr) {
+				t.Fatalf("expected %v, got %v", test.expectErr, err)
+			}
+			if extension != test.expected {
+				t.Fatalf("extension: %d, expected: %d", extension, test.expected)
+			}
+		})
+	}
+}
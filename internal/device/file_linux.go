@@ -0,0 +1,37 @@
+package device
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// growFile extends the file from `currentSize` to `targetSize` according to the allocation.
+func growFile(path string, currentSize int64, targetSize int64, allocation Allocation) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return allocateFile(file, currentSize, targetSize, allocation)
+}
+
+// allocateFile extends the file to `targetSize`. Unless the allocation is sparse, the blocks from `offset` on are
+// allocated, so that the host cannot run out of space under the mounted image. The file is extended sparsely on
+// the filesystems without fallocate.
+func allocateFile(file *os.File, offset int64, targetSize int64, allocation Allocation) error {
+	var err error
+	if allocation == AllocationSparse {
+		err = file.Truncate(targetSize)
+	} else {
+		err = unix.Fallocate(int(file.Fd()), 0, offset, targetSize-offset)
+		if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+			err = file.Truncate(targetSize)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package device
+
+import "os"
+
+func growFile(path string, currentSize int64, targetSize int64, allocation Allocation) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return allocateFile(file, currentSize, targetSize, allocation)
+}
+
+// allocateFile extends the file sparsely, fallocate is specific to Linux.
+func allocateFile(file *os.File, offset int64, targetSize int64, allocation Allocation) error {
+	if err := file.Truncate(targetSize); err != nil {
+		return err
+	}
+	return file.Sync()
+}
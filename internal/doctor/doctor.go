@@ -0,0 +1,414 @@
+package doctor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"ydb-backup-tool/internal/btrfs"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/device"
+	"ydb-backup-tool/internal/repository"
+	"ydb-backup-tool/internal/utils"
+)
+
+type Status string
+
+const (
+	StatusOK   Status = "OK"
+	StatusWarn Status = "WARN"
+	StatusFail Status = "FAIL"
+)
+
+// ErrChecksFailed is returned when at least one of the checks has failed.
+var ErrChecksFailed = errors.New("preflight checks failed")
+
+type Result struct {
+	Check       string
+	Status      Status
+	Message     string
+	Remediation string
+}
+
+type tool struct {
+	name    string
+	binary  string
+	args    []string
+	minimum string
+	// Where to get the tool, if it is not in the package repositories
+	source string
+}
+
+// The minimum versions are documented in the README
+var tools = []tool{
+	{"btrfs-progs", "btrfs", []string{"--version"}, "5.4.1", ""},
+	{"duperemove", "duperemove", []string{"--version"}, "0.11.1", ""},
+	{"YDB CLI", "ydb", []string{"version"}, "2.4.0", "https://ydb.tech/docs/en/reference/ydb-cli/install"},
+}
+
+// The tools from util-linux and coreutils, which have no documented minimum
+var systemBinaries = []string{"mkfs.btrfs", "losetup", "mount", "umount", "sync"}
+
+const capSysAdmin = 21
+
+var versionRegexp = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// Options are what the checks know of the image.
+type Options struct {
+	// MountPoint is nil when the image is not mounted, then the checks of the image are skipped
+	MountPoint *device.MountPoint
+	// InitialImageSize is the size of the image created on the first run, device.InitialBackingFileSize if zero
+	InitialImageSize int64
+}
+
+// Run performs all checks.
+func Run(ctx context.Context, options *Options) []Result {
+	mountPoint := options.MountPoint
+	var results []Result
+	for _, t := range tools {
+		results = append(results, checkTool(ctx, t))
+	}
+	results = append(results, checkSystemBinaries(imageEncrypted(mountPoint)))
+	results = append(results, checkPrivileges())
+	results = append(results, checkLoopModule())
+	results = append(results, checkFreeSpace(options.InitialImageSize))
+	results = append(results, checkMeta(ctx, mountPoint))
+	results = append(results, checkQuota(ctx, mountPoint))
+	return results
+}
+
+// Failed returns ErrChecksFailed if any of the results is FAIL.
+func Failed(results []Result) error {
+	var failed []string
+	for _, result := range results {
+		if result.Status == StatusFail {
+			failed = append(failed, result.Check)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%w: %s", ErrChecksFailed, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func checkTool(ctx context.Context, t tool) Result {
+	result := Result{Check: t.name}
+
+	binaryPath, err := utils.GetBinary(t.binary)
+	if err != nil {
+		result.Status = StatusFail
+		result.Message = fmt.Sprintf("`%s` is not found in $PATH", t.binary)
+		result.Remediation = fmt.Sprintf("install %s %s or higher", t.name, t.minimum)
+		if t.source != "" {
+			result.Remediation += ", see " + t.source
+		}
+		return result
+	}
+
+	cmd := utils.BuildCommand(ctx, binaryPath, t.args...)
+	// Some versions print the version to stderr
+	cmd.Stderr = nil
+	out, err := cmd.CombinedOutput()
+	version := versionRegexp.FindString(string(out))
+	if err != nil || version == "" {
+		result.Status = StatusWarn
+		result.Message = fmt.Sprintf("cannot determine the version of `%s`", binaryPath)
+		result.Remediation = fmt.Sprintf("make sure that %s %s or higher is installed", t.name, t.minimum)
+		return result
+	}
+
+	if compareVersions(version, t.minimum) < 0 {
+		result.Status = StatusFail
+		result.Message = fmt.Sprintf("version %s is older than %s", version, t.minimum)
+		result.Remediation = fmt.Sprintf("upgrade %s to %s or higher", t.name, t.minimum)
+		return result
+	}
+
+	result.Status = StatusOK
+	result.Message = fmt.Sprintf("version %s", version)
+	return result
+}
+
+// checkSystemBinaries requires `cryptsetup` as well when the image is encrypted.
+func checkSystemBinaries(encrypted bool) Result {
+	result := Result{Check: "system tools"}
+
+	binaries := systemBinaries
+	if encrypted {
+		binaries = append(binaries[:len(binaries):len(binaries)], "cryptsetup")
+	}
+	var missing []string
+	for _, binary := range binaries {
+		if _, err := utils.GetBinary(binary); err != nil {
+			missing = append(missing, binary)
+		}
+	}
+	if len(missing) > 0 {
+		result.Status = StatusFail
+		result.Message = fmt.Sprintf("not found in $PATH: %s", strings.Join(missing, ", "))
+		result.Remediation = "install util-linux, coreutils and btrfs-progs"
+		if encrypted {
+			result.Remediation += ", and cryptsetup for the encrypted image"
+		}
+		return result
+	}
+
+	result.Status = StatusOK
+	result.Message = strings.Join(binaries, ", ")
+	return result
+}
+
+// imageEncrypted checks the header of the image unless it is mounted, since the image which cannot be opened
+// without `cryptsetup` is not mounted.
+func imageEncrypted(mountPoint *device.MountPoint) bool {
+	if mountPoint != nil {
+		return mountPoint.Crypt != nil
+	}
+	encrypted, err := device.IsEncrypted(&device.BackingFile{Path: _const.AppBaseDataBackingFilePath})
+	return err == nil && encrypted
+}
+
+func checkPrivileges() Result {
+	result := Result{Check: "privileges"}
+
+	if os.Geteuid() == 0 {
+		result.Status = StatusOK
+		result.Message = "running as root"
+		return result
+	}
+
+	capabilities, err := effectiveCapabilities()
+	if err == nil && capabilities&(1<<capSysAdmin) != 0 {
+		result.Status = StatusOK
+		result.Message = "CAP_SYS_ADMIN is effective"
+		return result
+	}
+
+	result.Status = StatusFail
+	result.Message = "neither root nor CAP_SYS_ADMIN, mounting and managing subvolumes will fail"
+	result.Remediation = "run the tool as root, e.g. with sudo"
+	return result
+}
+
+func effectiveCapabilities() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), "CapEff:"); found {
+			return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+	return 0, errors.New("CapEff is not found in /proc/self/status")
+}
+
+func checkLoopModule() Result {
+	result := Result{Check: "loop devices"}
+
+	// The module may be built into the kernel, then it is not listed in /proc/modules, but the control device exists
+	for _, path := range []string{"/dev/loop-control", "/sys/module/loop"} {
+		if _, err := os.Stat(path); err == nil {
+			result.Status = StatusOK
+			result.Message = fmt.Sprintf("`%s` exists", path)
+			return result
+		}
+	}
+
+	result.Status = StatusFail
+	result.Message = "the loop module is not loaded"
+	result.Remediation = "load it with `modprobe loop`"
+	return result
+}
+
+func checkFreeSpace(initialImageSize int64) Result {
+	result := Result{Check: "host free space"}
+	if initialImageSize == 0 {
+		initialImageSize = device.InitialBackingFileSize
+	}
+
+	// The data directory is created on the first run, so check the closest existing parent
+	dir := _const.AppDataPath
+	for {
+		if _, err := os.Stat(dir); err == nil || dir == "/" {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	available, err := device.AvailableSpace(dir)
+	if err != nil {
+		result.Status = StatusWarn
+		result.Message = err.Error()
+		return result
+	}
+
+	imageSize, err := utils.GetFileSize(_const.AppBaseDataBackingFilePath)
+	if err != nil {
+		imageSize = 0
+	}
+
+	result.Message = fmt.Sprintf("%s available in `%s`, the image takes %s", utils.FormatSize(available), dir,
+		utils.FormatSize(imageSize))
+	switch {
+	case available < initialImageSize:
+		result.Status = StatusFail
+		result.Remediation = fmt.Sprintf("free at least %s in `%s`", utils.FormatSize(initialImageSize), dir)
+	case available < imageSize:
+		// The image is extended by the size of the new dump, which is usually close to the size of the previous one
+		result.Status = StatusWarn
+		result.Remediation = fmt.Sprintf("the image may not fit the next backup, free some space in `%s` "+
+			"or prune old backups", dir)
+	default:
+		result.Status = StatusOK
+	}
+	return result
+}
+
+func checkMeta(ctx context.Context, mountPoint *device.MountPoint) Result {
+	result := Result{Check: "meta file"}
+
+	// The image is mounted already, if at all, so its subvolumes are listed without opening it
+	image := &repository.Btrfs{}
+	store := image.Meta()
+	if _, err := os.Stat(store.FilePath); os.IsNotExist(err) {
+		result.Status = StatusOK
+		result.Message = "there is no meta file yet, it is created by the first backup"
+		return result
+	}
+
+	backups, err := store.GetBackups()
+	if err != nil {
+		result.Status = StatusFail
+		result.Message = err.Error()
+		result.Remediation = "run `rebuild-meta` to restore it from the subvolumes"
+		return result
+	}
+
+	var problems []string
+	seen := map[string]bool{}
+	completed := map[string]bool{}
+	for _, backup := range *backups {
+		if seen[backup.Path] {
+			problems = append(problems, fmt.Sprintf("`%s` is listed twice", backup.Path))
+		}
+		seen[backup.Path] = true
+		if backup.Completed {
+			completed[backup.Path] = true
+			if backup.FinishedCreationAt == nil {
+				problems = append(problems, fmt.Sprintf("`%s` is completed, but has no finish time", backup.Path))
+			}
+		}
+	}
+
+	if mountPoint == nil {
+		if len(problems) > 0 {
+			result.Status = StatusWarn
+			result.Message = strings.Join(problems, "; ")
+			return result
+		}
+		result.Status = StatusOK
+		result.Message = fmt.Sprintf("%d backup(s), the subvolumes are not checked since the image is not mounted",
+			len(*backups))
+		return result
+	}
+
+	var subvolumes []*repository.Backup
+	backupsExist, err := btrfs.VerifySubvolumeExists(ctx, image.BackupsPath())
+	if err == nil && backupsExist {
+		subvolumes, err = repository.ListAllBackups(ctx, image, image.BackupsPath())
+	}
+	if err != nil {
+		result.Status = StatusWarn
+		result.Message = fmt.Sprintf("cannot list the subvolumes: %v", err)
+		return result
+	}
+	subvolumePaths := map[string]bool{}
+	for _, subvolume := range subvolumes {
+		subvolumePaths[subvolume.Path] = true
+		if !completed[subvolume.Path] {
+			problems = append(problems, fmt.Sprintf("subvolume `%s` is not a completed backup", subvolume.Name))
+		}
+	}
+
+	var missing []string
+	for path := range completed {
+		if !subvolumePaths[path] {
+			missing = append(missing, filepath.Base(path))
+		}
+	}
+	if len(missing) > 0 {
+		result.Status = StatusFail
+		result.Message = fmt.Sprintf("completed backup(s) without subvolumes: %s", strings.Join(missing, ", "))
+		result.Remediation = "run `fsck --repair` to remove them from the meta file"
+		return result
+	}
+	if len(problems) > 0 {
+		result.Status = StatusWarn
+		result.Message = strings.Join(problems, "; ")
+		result.Remediation = "run `fsck --repair`"
+		return result
+	}
+
+	result.Status = StatusOK
+	result.Message = fmt.Sprintf("%d backup(s) match the subvolumes", len(completed))
+	return result
+}
+
+func checkQuota(ctx context.Context, mountPoint *device.MountPoint) Result {
+	result := Result{Check: "quota groups"}
+
+	if mountPoint == nil {
+		result.Status = StatusWarn
+		result.Message = "not checked since the image is not mounted"
+		return result
+	}
+
+	enabled, err := btrfs.QuotaEnabled(ctx, mountPoint.Path)
+	if err != nil {
+		result.Status = StatusWarn
+		result.Message = err.Error()
+		return result
+	}
+	if !enabled {
+		result.Status = StatusWarn
+		result.Message = "quota groups are disabled, the usage of the backups is unknown until `list-sizes`"
+		result.Remediation = fmt.Sprintf("enable them with `btrfs quota enable %s`", mountPoint.Path)
+		return result
+	}
+
+	result.Status = StatusOK
+	result.Message = "enabled"
+	return result
+}
+
+// compareVersions compares dotted versions, the missing components are zeros.
+func compareVersions(a string, b string) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aValue, bValue int
+		if i < len(aParts) {
+			aValue, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bValue, _ = strconv.Atoi(bParts[i])
+		}
+		if aValue != bValue {
+			if aValue < bValue {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
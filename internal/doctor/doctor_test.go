@@ -0,0 +1,62 @@
+package doctor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeBinaries puts the empty executables on the PATH instead of the tools.
+func fakeBinaries(t *testing.T, names ...string) {
+	dir := t.TempDir()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+}
+
+func TestCheckSystemBinaries(t *testing.T) {
+	fakeBinaries(t, systemBinaries...)
+	if result := checkSystemBinaries(false); result.Status != StatusOK {
+		t.Fatalf("the system tools are not found: %+v", result)
+	}
+	result := checkSystemBinaries(true)
+	if result.Status != StatusFail || !strings.Contains(result.Message, "cryptsetup") {
+		t.Fatalf("the encrypted image does not require cryptsetup: %+v", result)
+	}
+
+	fakeBinaries(t, append(systemBinaries, "cryptsetup")...)
+	if result := checkSystemBinaries(true); result.Status != StatusOK {
+		t.Fatalf("the system tools are not found: %+v", result)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"5.4.1", "5.4.1", 0},
+		{"5.4", "5.4.0", 0},
+		{"5.10", "5.4.1", 1},
+		{"0.9", "0.11.1", -1},
+	}
+	for _, test := range tests {
+		if actual := compareVersions(test.a, test.b); actual != test.expected {
+			t.Errorf("compareVersions(%s, %s) = %d, expected %d", test.a, test.b, actual, test.expected)
+		}
+	}
+}
+
+func TestCheckFreeSpaceInitialImageSize(t *testing.T) {
+	// No host has an exabyte free for the image
+	if result := checkFreeSpace(1 << 60); result.Status != StatusFail {
+		t.Fatalf("the image larger than the free space passes: %+v", result)
+	}
+	if result := checkFreeSpace(1); result.Status == StatusFail {
+		t.Fatalf("the tiny image does not fit: %+v", result)
+	}
+}
@@ -0,0 +1,490 @@
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The encrypted stream is the magic line, the length of the header as uint32, the JSON header and the chunks of
+// the payload. Each chunk is prefixed by its length as uint32 with the top bit set for the last chunk, and sealed
+// with AES-256-GCM under the nonce made of the random prefix, the counter of the chunk and the flag of the last
+// chunk, so that the chunks can be neither reordered nor dropped. The hash of the header is the additional data of
+// every chunk, so that the header cannot be altered either. The key of the payload is random, it is wrapped for
+// each recipient and for the passphrase.
+
+// ErrNoIdentity is returned when none of the identities nor the passphrase decrypts the archive.
+var ErrNoIdentity = errors.New("no identity matches the recipients of the archive")
+
+const (
+	magic = "ydb-backup-tool encrypted archive v1\n"
+
+	typeX25519     = "x25519"
+	typePassphrase = "passphrase"
+
+	chunkSize            = 64 * 1024
+	lastChunkFlag        = 1 << 31
+	noncePrefixSize      = 7
+	maxHeaderSize        = 1024 * 1024
+	passphraseSaltSize   = 16
+	passphraseIterations = 600000
+)
+
+// Header describes how the key of the payload is wrapped, it is stored unencrypted.
+type Header struct {
+	Stanzas     []Stanza `json:"recipients"`
+	ChunkSize   int      `json:"chunk_size"`
+	NoncePrefix []byte   `json:"nonce_prefix"`
+}
+
+// Stanza is the key of the payload wrapped for a single recipient or for the passphrase.
+type Stanza struct {
+	Type string `json:"type"`
+	// Fingerprint of the recipient, see Recipient.Fingerprint
+	Fingerprint  string `json:"fingerprint,omitempty"`
+	EphemeralKey []byte `json:"ephemeral_key,omitempty"`
+	Salt         []byte `json:"salt,omitempty"`
+	Iterations   int    `json:"iterations,omitempty"`
+	WrappedKey   []byte `json:"wrapped_key"`
+}
+
+// Fingerprints returns the fingerprints of the recipients of the archive.
+func (header *Header) Fingerprints() []string {
+	var fingerprints []string
+	for _, stanza := range header.Stanzas {
+		if stanza.Type == typeX25519 {
+			fingerprints = append(fingerprints, stanza.Fingerprint)
+		}
+	}
+	return fingerprints
+}
+
+// HasPassphrase reports whether the archive can be decrypted with the passphrase.
+func (header *Header) HasPassphrase() bool {
+	for _, stanza := range header.Stanzas {
+		if stanza.Type == typePassphrase {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEncrypted reports whether the stream starts with the magic of the encrypted archive, the stream is not consumed.
+func IsEncrypted(r *bufio.Reader) (bool, error) {
+	prefix, err := r.Peek(len(magic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	return string(prefix) == magic, nil
+}
+
+type writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	ad      []byte
+	counter uint32
+	buffer  []byte
+	closed  bool
+}
+
+// NewWriter returns the writer which encrypts the payload to the recipients and the passphrase, at least one of
+// them is required. Close must be called to write the last chunk, it does not close `w`.
+func NewWriter(w io.Writer, recipients []*Recipient, passphrase []byte) (io.WriteCloser, error) {
+	session, err := NewSession(recipients, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return session.NewWriter(w)
+}
+
+// Session is the header and the key of the payload of an archive. The same payload written in the same session
+// gives the same archive, e.g. to resume its upload. The key decrypts the archive, so the session must be kept
+// as safe as the payload itself.
+type Session struct {
+	Header  Header `json:"header"`
+	FileKey []byte `json:"file_key"`
+}
+
+// NewSession wraps a random key of the payload for the recipients and the passphrase, at least one of them
+// is required.
+func NewSession(recipients []*Recipient, passphrase []byte) (*Session, error) {
+	if len(recipients) == 0 && len(passphrase) == 0 {
+		return nil, errors.New("the archive needs a recipient or a passphrase")
+	}
+
+	fileKey := make([]byte, 32)
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+
+	session := &Session{Header: Header{ChunkSize: chunkSize, NoncePrefix: noncePrefix}, FileKey: fileKey}
+	for _, recipient := range recipients {
+		stanza, err := wrapForRecipient(fileKey, recipient)
+		if err != nil {
+			return nil, err
+		}
+		session.Header.Stanzas = append(session.Header.Stanzas, *stanza)
+	}
+	if len(passphrase) > 0 {
+		stanza, err := wrapForPassphrase(fileKey, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		session.Header.Stanzas = append(session.Header.Stanzas, *stanza)
+	}
+	return session, nil
+}
+
+// Accepts reports whether the archive of the session is encrypted for exactly the recipients and the passphrase,
+// e.g. to tell whether the upload can be resumed after the options have changed.
+func (session *Session) Accepts(recipients []*Recipient, passphrase []byte) bool {
+	fingerprints := map[string]bool{}
+	for _, recipient := range recipients {
+		fingerprints[recipient.Fingerprint()] = true
+	}
+	sessionFingerprints := session.Header.Fingerprints()
+	if len(sessionFingerprints) != len(fingerprints) || session.Header.HasPassphrase() != (len(passphrase) > 0) {
+		return false
+	}
+	for _, fingerprint := range sessionFingerprints {
+		if !fingerprints[fingerprint] {
+			return false
+		}
+	}
+	if len(passphrase) == 0 {
+		return true
+	}
+	fileKey, err := unwrapFileKey(&session.Header, nil, func() ([]byte, error) {
+		return passphrase, nil
+	})
+	return err == nil && bytes.Equal(fileKey, session.FileKey)
+}
+
+// NewWriter returns the writer which encrypts the payload in the session, see the package-level NewWriter.
+func (session *Session) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	header := session.Header
+	if header.ChunkSize != chunkSize || len(header.NoncePrefix) != noncePrefixSize || len(session.FileKey) != 32 {
+		return nil, errors.New("the session of the archive is malformed")
+	}
+	encodedHeader, err := encodeHeader(&header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(encodedHeader); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(deriveKey(session.FileKey, header.NoncePrefix, "payload"))
+	if err != nil {
+		return nil, err
+	}
+	headerHash := sha256.Sum256(encodedHeader)
+	return &writer{w: w, aead: aead, nonce: header.NoncePrefix, ad: headerHash[:],
+		buffer: make([]byte, 0, chunkSize)}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to the closed archive")
+	}
+	written := 0
+	for len(p) > 0 {
+		// The full chunk is kept until more data comes, since only the last chunk is flagged
+		if len(w.buffer) == chunkSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buffer[len(w.buffer):chunkSize], p)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+func (w *writer) flush(last bool) error {
+	nonce, err := chunkNonce(w.nonce, w.counter, last)
+	if err != nil {
+		return err
+	}
+	sealed := w.aead.Seal(nil, nonce, w.buffer, w.ad)
+
+	length := uint32(len(sealed))
+	if last {
+		length |= lastChunkFlag
+	}
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], length)
+	if _, err := w.w.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(sealed); err != nil {
+		return err
+	}
+
+	w.counter++
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+type reader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	ad      []byte
+	counter uint32
+	chunk   []byte
+	last    bool
+	maxSize int
+}
+
+// ReadHeader reads the header of the encrypted stream.
+func ReadHeader(r io.Reader) (*Header, []byte, error) {
+	prefix := make([]byte, len(magic)+4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, nil, fmt.Errorf("failed to read the header of the archive: %w", err)
+	}
+	if string(prefix[:len(magic)]) != magic {
+		return nil, nil, errors.New("the archive is not encrypted by this tool")
+	}
+	size := binary.BigEndian.Uint32(prefix[len(magic):])
+	if size > maxHeaderSize {
+		return nil, nil, fmt.Errorf("the header of the archive is too large: %d bytes", size)
+	}
+
+	content := make([]byte, size)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, nil, fmt.Errorf("failed to read the header of the archive: %w", err)
+	}
+	var header Header
+	if err := json.Unmarshal(content, &header); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse the header of the archive: %w", err)
+	}
+	if header.ChunkSize <= 0 || header.ChunkSize > 16*chunkSize || len(header.NoncePrefix) != noncePrefixSize {
+		return nil, nil, errors.New("the header of the archive is malformed")
+	}
+	return &header, append(prefix, content...), nil
+}
+
+// NewReader returns the reader of the payload of the stream after the header, the key of the payload is unwrapped
+// with one of the identities or with the passphrase, which is asked for only when no identity matches.
+func NewReader(r io.Reader, header *Header, encodedHeader []byte, identities []*Identity,
+	passphrase func() ([]byte, error)) (io.Reader, error) {
+	fileKey, err := unwrapFileKey(header, identities, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(deriveKey(fileKey, header.NoncePrefix, "payload"))
+	if err != nil {
+		return nil, err
+	}
+	headerHash := sha256.Sum256(encodedHeader)
+	return &reader{r: r, aead: aead, nonce: header.NoncePrefix, ad: headerHash[:],
+		maxSize: header.ChunkSize + aead.Overhead()}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (r *reader) next() error {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r.r, prefix[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errors.New("the archive is truncated")
+		}
+		return err
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	last := length&lastChunkFlag != 0
+	length &^= lastChunkFlag
+	if int(length) > r.maxSize {
+		return errors.New("the archive is malformed: the chunk is too large")
+	}
+
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errors.New("the archive is truncated")
+		}
+		return err
+	}
+	nonce, err := chunkNonce(r.nonce, r.counter, last)
+	if err != nil {
+		return err
+	}
+	chunk, err := r.aead.Open(sealed[:0], nonce, sealed, r.ad)
+	if err != nil {
+		return fmt.Errorf("the archive is corrupted or altered at chunk %d", r.counter)
+	}
+
+	r.counter++
+	r.chunk = chunk
+	r.last = last
+	if last {
+		// Nothing may follow the last chunk
+		var extra [1]byte
+		if _, err := io.ReadFull(r.r, extra[:]); err == nil {
+			return errors.New("the archive has data after the last chunk")
+		}
+	}
+	return nil
+}
+
+func encodeHeader(header *Header) ([]byte, error) {
+	content, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	var encoded bytes.Buffer
+	encoded.WriteString(magic)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(content)))
+	encoded.Write(size[:])
+	encoded.Write(content)
+	return encoded.Bytes(), nil
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) ([]byte, error) {
+	if counter == 1<<32-1 {
+		return nil, errors.New("the archive has too many chunks")
+	}
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The wrapping keys are used only once, so the nonce is always zero
+var zeroNonce = make([]byte, 12)
+
+func wrapForRecipient(fileKey []byte, recipient *Recipient) (*Stanza, error) {
+	ephemeral, err := recipient.key.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient.key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(x25519WrapKey(shared, ephemeral.PublicKey().Bytes(), recipient.key.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	return &Stanza{Type: typeX25519, Fingerprint: recipient.Fingerprint(),
+		EphemeralKey: ephemeral.PublicKey().Bytes(), WrappedKey: aead.Seal(nil, zeroNonce, fileKey, nil)}, nil
+}
+
+// x25519WrapKey binds the wrapping key to both public keys, like the KEM of HPKE does.
+func x25519WrapKey(shared []byte, ephemeralKey []byte, recipientKey []byte) []byte {
+	salt := make([]byte, 0, len(ephemeralKey)+len(recipientKey))
+	salt = append(salt, ephemeralKey...)
+	salt = append(salt, recipientKey...)
+	return deriveKey(shared, salt, typeX25519)
+}
+
+func wrapForPassphrase(fileKey []byte, passphrase []byte) (*Stanza, error) {
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(derivePassphraseKey(passphrase, salt, passphraseIterations))
+	if err != nil {
+		return nil, err
+	}
+	return &Stanza{Type: typePassphrase, Salt: salt, Iterations: passphraseIterations,
+		WrappedKey: aead.Seal(nil, zeroNonce, fileKey, nil)}, nil
+}
+
+func unwrapFileKey(header *Header, identities []*Identity, passphrase func() ([]byte, error)) ([]byte, error) {
+	for _, identity := range identities {
+		recipient := identity.Recipient()
+		for _, stanza := range header.Stanzas {
+			if stanza.Type != typeX25519 || stanza.Fingerprint != recipient.Fingerprint() {
+				continue
+			}
+			ephemeral, err := identity.key.Curve().NewPublicKey(stanza.EphemeralKey)
+			if err != nil {
+				return nil, fmt.Errorf("the archive is malformed: %w", err)
+			}
+			shared, err := identity.key.ECDH(ephemeral)
+			if err != nil {
+				return nil, err
+			}
+			aead, err := newAEAD(x25519WrapKey(shared, stanza.EphemeralKey, recipient.key.Bytes()))
+			if err != nil {
+				return nil, err
+			}
+			if fileKey, err := aead.Open(nil, zeroNonce, stanza.WrappedKey, nil); err == nil {
+				return fileKey, nil
+			}
+		}
+	}
+
+	if !header.HasPassphrase() || passphrase == nil {
+		return nil, ErrNoIdentity
+	}
+	secret, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+	for _, stanza := range header.Stanzas {
+		if stanza.Type != typePassphrase {
+			continue
+		}
+		if stanza.Iterations <= 0 || stanza.Iterations > 100*passphraseIterations {
+			return nil, errors.New("the archive is malformed: invalid number of iterations")
+		}
+		aead, err := newAEAD(derivePassphraseKey(secret, stanza.Salt, stanza.Iterations))
+		if err != nil {
+			return nil, err
+		}
+		if fileKey, err := aead.Open(nil, zeroNonce, stanza.WrappedKey, nil); err == nil {
+			return fileKey, nil
+		}
+	}
+	return nil, errors.New("the passphrase does not decrypt the archive")
+}
@@ -0,0 +1,179 @@
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// The archives written before must still be decrypted, so the keys are checked against the known vectors.
+func TestDeriveKey(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	// RFC 5869, test case 1, the first 32 bytes
+	expected := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf"
+	if key := hex.EncodeToString(deriveKey(secret, salt, string(info))); key != expected {
+		t.Fatalf("HKDF: %s, expected: %s", key, expected)
+	}
+
+	// The inputs of RFC 6070 with HMAC-SHA256
+	expected = "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"
+	if key := hex.EncodeToString(derivePassphraseKey([]byte("password"), []byte("salt"), 4096)); key != expected {
+		t.Fatalf("PBKDF2: %s, expected: %s", key, expected)
+	}
+}
+
+// encrypt returns the payload, which takes a few chunks, and the stream encrypted for the identity.
+func encrypt(t *testing.T, identity *Identity) ([]byte, []byte) {
+	payload := make([]byte, 3*chunkSize+100)
+	rand.New(rand.NewSource(1)).Read(payload)
+
+	var buffer bytes.Buffer
+	w, err := NewWriter(&buffer, []*Recipient{identity.Recipient()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return payload, buffer.Bytes()
+}
+
+func decrypt(stream []byte, identities []*Identity, passphrase func() ([]byte, error)) ([]byte, error) {
+	r := bufio.NewReader(bytes.NewReader(stream))
+	encrypted, err := IsEncrypted(r)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		return nil, errors.New("the stream is not recognized as encrypted")
+	}
+	header, encodedHeader, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := NewReader(r, header, encodedHeader, identities, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(decrypted)
+}
+
+func generateIdentity(t *testing.T) *Identity {
+	identity, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func TestRoundTrip(t *testing.T) {
+	identity := generateIdentity(t)
+	payload, stream := encrypt(t, identity)
+	decrypted, err := decrypt(stream, []*Identity{identity}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, payload) {
+		t.Fatal("the decrypted payload differs")
+	}
+}
+
+func TestPassphraseRoundTrip(t *testing.T) {
+	var buffer bytes.Buffer
+	w, err := NewWriter(&buffer, nil, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := decrypt(buffer.Bytes(), nil, func() ([]byte, error) { return []byte("secret"), nil })
+	if err != nil || string(decrypted) != "payload" {
+		t.Fatalf("the payload is not decrypted with the passphrase: %q, %v", decrypted, err)
+	}
+	if _, err := decrypt(buffer.Bytes(), nil, func() ([]byte, error) { return []byte("wrong"), nil }); err == nil {
+		t.Fatal("the payload is decrypted with the wrong passphrase")
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	_, stream := encrypt(t, generateIdentity(t))
+	_, err := decrypt(stream, []*Identity{generateIdentity(t)}, nil)
+	if !errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("expected %v, got %v", ErrNoIdentity, err)
+	}
+}
+
+func TestTruncatedStream(t *testing.T) {
+	identity := generateIdentity(t)
+	payload, stream := encrypt(t, identity)
+	chunks := splitChunks(t, stream)
+
+	// Cut at the end of a chunk, inside a chunk and inside the length of a chunk
+	for _, size := range []int{chunks[2].offset, chunks[2].offset + 100, chunks[2].offset + 2} {
+		decrypted, err := decrypt(stream[:size], []*Identity{identity}, nil)
+		if err == nil || !strings.Contains(err.Error(), "truncated") {
+			t.Fatalf("the stream truncated to %d bytes: %v", size, err)
+		}
+		if !bytes.HasPrefix(payload, decrypted) {
+			t.Fatal("the decrypted part of the truncated stream differs")
+		}
+	}
+}
+
+func TestReorderedChunks(t *testing.T) {
+	identity := generateIdentity(t)
+	_, stream := encrypt(t, identity)
+	chunks := splitChunks(t, stream)
+
+	first, second := chunks[0], chunks[1]
+	if first.size != second.size {
+		t.Fatal("the chunks to swap differ in size")
+	}
+	reordered := append([]byte(nil), stream...)
+	copy(reordered[first.offset:], stream[second.offset:second.offset+second.size])
+	copy(reordered[second.offset:], stream[first.offset:first.offset+first.size])
+
+	if _, err := decrypt(reordered, []*Identity{identity}, nil); err == nil ||
+		!strings.Contains(err.Error(), "chunk 0") {
+		t.Fatalf("the reordered chunks are decrypted: %v", err)
+	}
+}
+
+type chunk struct {
+	offset int
+	size   int
+}
+
+// splitChunks returns the chunks of the stream after the header, with their lengths.
+func splitChunks(t *testing.T, stream []byte) []chunk {
+	_, encodedHeader, err := ReadHeader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []chunk
+	for offset := len(encodedHeader); offset < len(stream); {
+		length := int(binary.BigEndian.Uint32(stream[offset:]) &^ lastChunkFlag)
+		chunks = append(chunks, chunk{offset: offset, size: 4 + length})
+		offset += 4 + length
+	}
+	if len(chunks) < 3 {
+		t.Fatalf("the stream has %d chunk(s) only", len(chunks))
+	}
+	return chunks
+}
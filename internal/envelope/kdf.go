@@ -0,0 +1,26 @@
+package envelope
+
+import (
+	"crypto/sha256"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+	"io"
+)
+
+// The keys are 32 bytes long, for AES-256-GCM.
+const keySize = 32
+
+// deriveKey derives the key from the secret with HKDF-SHA256, RFC 5869.
+func deriveKey(secret []byte, salt []byte, info string) []byte {
+	key := make([]byte, keySize)
+	// The reader fails only when more than 255 blocks are read
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// derivePassphraseKey derives the key from the passphrase with PBKDF2-HMAC-SHA256, RFC 8018.
+func derivePassphraseKey(passphrase []byte, salt []byte, iterations int) []byte {
+	return pbkdf2.Key(passphrase, salt, iterations, keySize, sha256.New)
+}
@@ -0,0 +1,140 @@
+package envelope
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	publicKeyPrefix = "ydbpub:"
+	secretKeyPrefix = "ydbsec:"
+)
+
+// Recipient is the X25519 public key the archive is encrypted to.
+type Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// Identity is the X25519 private key which decrypts the archives encrypted to its recipient.
+type Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// GenerateIdentity creates a new random identity.
+func GenerateIdentity() (*Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{key: key}, nil
+}
+
+func (identity *Identity) Recipient() *Recipient {
+	return &Recipient{key: identity.key.PublicKey()}
+}
+
+func (identity *Identity) String() string {
+	return secretKeyPrefix + base64.RawURLEncoding.EncodeToString(identity.key.Bytes())
+}
+
+func (recipient *Recipient) String() string {
+	return publicKeyPrefix + base64.RawURLEncoding.EncodeToString(recipient.key.Bytes())
+}
+
+// Fingerprint identifies the recipient in the header of the archive without revealing the key itself.
+func (recipient *Recipient) Fingerprint() string {
+	sum := sha256.Sum256(recipient.key.Bytes())
+	return hex.EncodeToString(sum[:8])
+}
+
+// ParseRecipient parses the public key, or reads the public keys from the file if the value is not a key.
+func ParseRecipient(value string) ([]*Recipient, error) {
+	if strings.HasPrefix(value, publicKeyPrefix) {
+		recipient, err := parseRecipientKey(value)
+		if err != nil {
+			return nil, err
+		}
+		return []*Recipient{recipient}, nil
+	}
+
+	lines, err := readKeyLines(value)
+	if err != nil {
+		return nil, fmt.Errorf("`%s` is neither a public key nor a readable file: %w", value, err)
+	}
+	var recipients []*Recipient
+	for _, line := range lines {
+		recipient, err := parseRecipientKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", value, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+func parseRecipientKey(value string) (*Recipient, error) {
+	if !strings.HasPrefix(value, publicKeyPrefix) {
+		return nil, fmt.Errorf("a public key must start with `%s`", publicKeyPrefix)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, publicKeyPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("malformed public key: %w", err)
+	}
+	key, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("malformed public key: %w", err)
+	}
+	return &Recipient{key: key}, nil
+}
+
+// ReadIdentities reads the private keys from the file, one per line, the empty lines and comments are skipped.
+func ReadIdentities(path string) ([]*Identity, error) {
+	lines, err := readKeyLines(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the identity file: %w", err)
+	}
+	var identities []*Identity
+	for _, line := range lines {
+		if !strings.HasPrefix(line, secretKeyPrefix) {
+			return nil, fmt.Errorf("%s: a private key must start with `%s`", path, secretKeyPrefix)
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(line, secretKeyPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("%s: malformed private key: %w", path, err)
+		}
+		key, err := ecdh.X25519().NewPrivateKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: malformed private key: %w", path, err)
+		}
+		identities = append(identities, &Identity{key: key})
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("%s has no private keys", path)
+	}
+	return identities, nil
+}
+
+func readKeyLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,144 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+	"ydb-backup-tool/internal/utils"
+)
+
+type Event string
+
+const (
+	PreCreate   Event = "pre-create"
+	PostCreate  Event = "post-create"
+	OnFailure   Event = "on-failure"
+	PreRestore  Event = "pre-restore"
+	PostRestore Event = "post-restore"
+)
+
+var Events = []Event{PreCreate, PostCreate, OnFailure, PreRestore, PostRestore}
+
+const DefaultTimeout = 10 * time.Minute
+
+// Hooks maps an event to an executable or a shell command which is run when the event happens.
+type Hooks struct {
+	Commands map[Event]string
+	Timeout  time.Duration
+}
+
+// Env describes the operation for the hook. It is passed to the hook as `YDB_BACKUP_*` environment variables.
+type Env struct {
+	Operation      string
+	BackupPath     string
+	DumpSize       int64
+	SizeExclusive  uint64
+	SizeReferenced uint64
+	Duration       time.Duration
+	Err            error
+}
+
+type HookError struct {
+	Event    Event
+	ExitCode int
+	TimedOut bool
+}
+
+func (e *HookError) Error() string {
+	if e.TimedOut {
+		return fmt.Sprintf("hook `%s` timed out", e.Event)
+	}
+	return fmt.Sprintf("hook `%s` exited with code %d", e.Event, e.ExitCode)
+}
+
+func (h *Hooks) Has(event Event) bool {
+	return h != nil && h.Commands[event] != ""
+}
+
+// Run executes the hook of the event. A non-zero exit code or a timeout is returned as *HookError. The hook is killed
+// when the context is done as well, e.g. when the operation is cancelled.
+func (h *Hooks) Run(ctx context.Context, event Event, env *Env) error {
+	if !h.Has(event) {
+		return nil
+	}
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	hookCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd, err := buildHookCommand(hookCtx, h.Commands[event])
+	if err != nil {
+		return err
+	}
+	cmd.Env = append(os.Environ(), env.toEnviron(event)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Hooks are usually shell scripts, so kill the whole process group and not only the shell
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+
+	log.WithContext(ctx).Infof("Running `%s` hook", event)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("hook `%s` is interrupted: %w", event, ctx.Err())
+		}
+		if errors.Is(hookCtx.Err(), context.DeadlineExceeded) {
+			return &HookError{Event: event, TimedOut: true}
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return &HookError{Event: event, ExitCode: exitErr.ExitCode()}
+		}
+		return fmt.Errorf("failed to run hook `%s`: %w", event, err)
+	}
+
+	return nil
+}
+
+// buildHookCommand runs executable files directly and everything else with `sh -c`.
+func buildHookCommand(ctx context.Context, hook string) (*exec.Cmd, error) {
+	if fi, err := os.Stat(hook); err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+		return exec.CommandContext(ctx, hook), nil
+	}
+
+	shPath, err := utils.GetBinary("sh")
+	if err != nil {
+		return nil, err
+	}
+	return exec.CommandContext(ctx, shPath, "-c", hook), nil
+}
+
+func (env *Env) toEnviron(event Event) []string {
+	var name string
+	if env.BackupPath != "" {
+		name = filepath.Base(env.BackupPath)
+	}
+
+	environ := []string{
+		"YDB_BACKUP_HOOK=" + string(event),
+		"YDB_BACKUP_OPERATION=" + env.Operation,
+		"YDB_BACKUP_PATH=" + env.BackupPath,
+		"YDB_BACKUP_NAME=" + name,
+		"YDB_BACKUP_DUMP_SIZE=" + strconv.FormatInt(env.DumpSize, 10),
+		"YDB_BACKUP_SIZE_EXCLUSIVE=" + strconv.FormatUint(env.SizeExclusive, 10),
+		"YDB_BACKUP_SIZE_REFERENCED=" + strconv.FormatUint(env.SizeReferenced, 10),
+		"YDB_BACKUP_DURATION_SECONDS=" + strconv.FormatFloat(env.Duration.Seconds(), 'f', 3, 64),
+	}
+	if env.Err != nil {
+		environ = append(environ, "YDB_BACKUP_ERROR="+env.Err.Error())
+	}
+	return environ
+}
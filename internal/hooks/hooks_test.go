@@ -0,0 +1,110 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runHook(ctx context.Context, command string, timeout time.Duration, env *Env) error {
+	hooks := &Hooks{Commands: map[Event]string{PreCreate: command}, Timeout: timeout}
+	return hooks.Run(ctx, PreCreate, env)
+}
+
+func TestRunExitCode(t *testing.T) {
+	if err := runHook(context.Background(), "exit 0", 0, &Env{}); err != nil {
+		t.Fatalf("the succeeded hook failed: %v", err)
+	}
+
+	var hookErr *HookError
+	err := runHook(context.Background(), "exit 3", 0, &Env{})
+	if !errors.As(err, &hookErr) || hookErr.ExitCode != 3 || hookErr.TimedOut {
+		t.Fatalf("the exit code of the hook is not returned: %v", err)
+	}
+}
+
+func TestRunNoHook(t *testing.T) {
+	var hooks *Hooks
+	if err := hooks.Run(context.Background(), PreCreate, &Env{}); err != nil {
+		t.Fatalf("the missing hook failed: %v", err)
+	}
+}
+
+func TestRunEnv(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "env")
+	env := &Env{Operation: "create", BackupPath: "/backups/test/ydb_backup_1", DumpSize: 42,
+		Duration: 1500 * time.Millisecond, Err: errors.New("dump failed")}
+	command := `echo "$YDB_BACKUP_HOOK $YDB_BACKUP_OPERATION $YDB_BACKUP_NAME $YDB_BACKUP_DUMP_SIZE ` +
+		`$YDB_BACKUP_DURATION_SECONDS $YDB_BACKUP_ERROR" > ` + output
+	if err := runHook(context.Background(), command, 0, env); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "pre-create create ydb_backup_1 42 1.500 dump failed\n"; string(content) != expected {
+		t.Fatalf("the hook got %q, want %q", content, expected)
+	}
+}
+
+// TestRunTimeout checks that the hook is killed along with the processes it has started.
+func TestRunTimeout(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	startedAt := time.Now()
+	err := runHook(context.Background(), "sleep 30 & echo $! > "+pidFile+"; wait", 200*time.Millisecond, &Env{})
+
+	var hookErr *HookError
+	if !errors.As(err, &hookErr) || !hookErr.TimedOut {
+		t.Fatalf("the timeout of the hook is not returned: %v", err)
+	}
+	if elapsed := time.Since(startedAt); elapsed > 5*time.Second {
+		t.Fatalf("the hook is killed in %s", elapsed)
+	}
+	assertKilled(t, pidFile)
+}
+
+func TestRunCancelled(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := runHook(ctx, "sleep 30 & echo $! > "+pidFile+"; wait", 0, &Env{})
+
+	var hookErr *HookError
+	if errors.As(err, &hookErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("the hook is not interrupted with the operation: %v", err)
+	}
+	assertKilled(t, pidFile)
+}
+
+// assertKilled waits for the process started by the hook to die. The process is reparented once the shell is killed,
+// so it may be left as a zombie if nothing reaps it.
+func assertKilled(t *testing.T, pidFile string) {
+	content, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		if err != nil {
+			return
+		}
+		// The state follows the name of the command in parentheses
+		if fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:])); fields[0] == "Z" {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("the process %d started by the hook is still running", pid)
+}
@@ -3,35 +3,73 @@ package meta
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"os"
+	"path/filepath"
 	"time"
-	_const "ydb-backup-tool/internal/const"
 	"ydb-backup-tool/internal/utils"
 )
 
+// ErrCorrupted is returned when the meta file cannot be parsed.
+var ErrCorrupted = errors.New("meta file is corrupted")
+
+// Store is the meta file of a repository. BackupsPath is the directory with the backups of all sources, the sources
+// of the backups are told by the paths relative to it.
+type Store struct {
+	FilePath    string
+	BackupsPath string
+}
+
 type BtrfsNode struct {
 	Backups []Backup `json:"backups"`
 }
 
 type Backup struct {
-	Completed          bool       `json:"completed"`
-	Path               string     `json:"path"`
-	StartedCreationAt  time.Time  `json:"started_creation_at"`
-	FinishedCreationAt *time.Time `json:"finished_creation_at"`
+	Completed          bool               `json:"completed"`
+	Aborted            bool               `json:"aborted,omitempty"`
+	AbortReason        string             `json:"abort_reason,omitempty"`
+	Path               string             `json:"path"`
+	StartedCreationAt  time.Time          `json:"started_creation_at"`
+	FinishedCreationAt *time.Time         `json:"finished_creation_at"`
+	DumpSize           int64              `json:"dump_size,omitempty"`
+	Phases             map[string]float64 `json:"phases,omitempty"`
+	// DatabaseSize is the size of the data by the statistics of the database when the backup was started, it relates
+	// the size of the next dump to the statistics
+	DatabaseSize int64 `json:"database_size,omitempty"`
+	// Label is a user-defined name of the backup, e.g. pre-migration-v42
+	Label string            `json:"label,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	Note  string            `json:"note,omitempty"`
+	// Pinned backups are never deleted by the retention policy
+	Pinned bool `json:"pinned,omitempty"`
+	// Source is the name of the database the backup is taken from. It is empty for the backups created before
+	// the sources were introduced, they are kept right in the subvolume with backups
+	Source   string `json:"source,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	Database string `json:"database,omitempty"`
+}
+
+// StatsNode keeps the counters which outlive a single run of the tool.
+type StatsNode struct {
+	FailedRuns   uint64     `json:"failed_runs"`
+	LastFailedAt *time.Time `json:"last_failed_at,omitempty"`
 }
 
 type metaFileStructure struct {
-	Btrfs BtrfsNode `json:"btrfs"`
+	Btrfs  BtrfsNode   `json:"btrfs"`
+	Stats  StatsNode   `json:"stats"`
+	Remote *RemoteNode `json:"remote,omitempty"`
 }
 
-func StartBackup(path string) error {
-	btrfsNode, err := GetBtrfsNode()
-	if err != err {
+func (store *Store) StartBackup(path string, source string, endpoint string, database string) error {
+	metaStruct, err := store.getMetaFileStructure()
+	if err != nil {
 		return fmt.Errorf("failed to get current backups meta info: %w", err)
 	}
+	btrfsNode := &metaStruct.Btrfs
 
 	for _, backup := range btrfsNode.Backups {
 		if backup.Path == path {
@@ -43,20 +81,24 @@ func StartBackup(path string) error {
 		Completed:         false,
 		Path:              path,
 		StartedCreationAt: time.Now(),
+		Source:            source,
+		Endpoint:          endpoint,
+		Database:          database,
 	})
 
-	if err := saveStateToFile(&metaFileStructure{Btrfs: *btrfsNode}); err != nil {
+	if err := store.saveStateToFile(metaStruct); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func FinishBackup(path string) error {
-	btrfsNode, err := GetBtrfsNode()
-	if err != err {
+func (store *Store) FinishBackup(path string) error {
+	metaStruct, err := store.getMetaFileStructure()
+	if err != nil {
 		return fmt.Errorf("failed to get current backups meta info: %w", err)
 	}
+	btrfsNode := &metaStruct.Btrfs
 
 	for i := range btrfsNode.Backups {
 		if btrfsNode.Backups[i].Path == path {
@@ -66,36 +108,180 @@ func FinishBackup(path string) error {
 		}
 	}
 
-	if err := saveStateToFile(&metaFileStructure{Btrfs: *btrfsNode}); err != nil {
+	if err := store.saveStateToFile(metaStruct); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func GetBtrfsNode() (*BtrfsNode, error) {
-	f, err := getOrCreateMetaFile(os.O_RDONLY, os.ModeType)
+// AdoptBackup adds a completed backup which was created outside the tool or whose meta entry was lost.
+func (store *Store) AdoptBackup(path string, createdAt time.Time, dumpSize int64) error {
+	finishedAt := createdAt
+	return store.AdoptBackupEntry(Backup{
+		Completed:          true,
+		Path:               path,
+		StartedCreationAt:  createdAt,
+		FinishedCreationAt: &finishedAt,
+		DumpSize:           dumpSize,
+		Source:             store.SourceOfPath(path),
+	})
+}
+
+// SourceOfPath returns the source of the backup by the subvolume it is kept in, the endpoint and the database
+// are unknown then.
+func (store *Store) SourceOfPath(path string) string {
+	dir := filepath.Dir(path)
+	if dir == store.BackupsPath || filepath.Dir(dir) != store.BackupsPath {
+		return ""
+	}
+	return filepath.Base(dir)
+}
+
+// AdoptBackupEntry adds the entry as is, e.g. restored from the sidecar of the backup.
+func (store *Store) AdoptBackupEntry(backup Backup) error {
+	metaStruct, err := store.getMetaFileStructure()
+	if err != nil {
+		return fmt.Errorf("failed to get current backups meta info: %w", err)
+	}
+
+	for _, existing := range metaStruct.Btrfs.Backups {
+		if existing.Path == backup.Path {
+			return fmt.Errorf("cannot adopt backup %s since it already exists in the meta file", backup.Path)
+		}
+	}
+
+	metaStruct.Btrfs.Backups = append(metaStruct.Btrfs.Backups, backup)
+	return store.saveStateToFile(metaStruct)
+}
+
+// AbortBackup marks the backup which has not been completed as aborted, so it is never considered for restore.
+func (store *Store) AbortBackup(path string, reason string) error {
+	metaStruct, err := store.getMetaFileStructure()
+	if err != nil {
+		return fmt.Errorf("failed to get current backups meta info: %w", err)
+	}
+
+	for i := range metaStruct.Btrfs.Backups {
+		if metaStruct.Btrfs.Backups[i].Path == path && !metaStruct.Btrfs.Backups[i].Completed {
+			metaStruct.Btrfs.Backups[i].Aborted = true
+			metaStruct.Btrfs.Backups[i].AbortReason = reason
+		}
+	}
+
+	return store.saveStateToFile(metaStruct)
+}
+
+// RecordBackupStats stores the size of the dump and the duration of each phase (in seconds) of the backup.
+func (store *Store) RecordBackupStats(path string, dumpSize int64, phases map[string]float64) error {
+	metaStruct, err := store.getMetaFileStructure()
+	if err != nil {
+		return fmt.Errorf("failed to get current backups meta info: %w", err)
+	}
+
+	for i := range metaStruct.Btrfs.Backups {
+		if metaStruct.Btrfs.Backups[i].Path == path {
+			metaStruct.Btrfs.Backups[i].DumpSize = dumpSize
+			metaStruct.Btrfs.Backups[i].Phases = phases
+		}
+	}
+
+	return store.saveStateToFile(metaStruct)
+}
+
+// UpdateBackup applies `update` to the meta entry of the backup.
+func (store *Store) UpdateBackup(path string, update func(backup *Backup)) error {
+	metaStruct, err := store.getMetaFileStructure()
+	if err != nil {
+		return fmt.Errorf("failed to get current backups meta info: %w", err)
+	}
+
+	var found bool
+	for i := range metaStruct.Btrfs.Backups {
+		if metaStruct.Btrfs.Backups[i].Path == path {
+			update(&metaStruct.Btrfs.Backups[i])
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("backup `%s` is not found in the meta file", path)
+	}
+
+	return store.saveStateToFile(metaStruct)
+}
+
+func (store *Store) DeleteBackup(path string) error {
+	metaStruct, err := store.getMetaFileStructure()
+	if err != nil {
+		return fmt.Errorf("failed to get current backups meta info: %w", err)
+	}
+
+	metaStruct.Btrfs.Backups = utils.Filter(metaStruct.Btrfs.Backups, func(b Backup) bool {
+		return b.Path != path
+	})
+
+	return store.saveStateToFile(metaStruct)
+}
+
+func (store *Store) RecordFailedRun() error {
+	metaStruct, err := store.getMetaFileStructure()
+	if err != nil {
+		return fmt.Errorf("failed to get current backups meta info: %w", err)
+	}
+
+	now := time.Now()
+	metaStruct.Stats.FailedRuns++
+	metaStruct.Stats.LastFailedAt = &now
+
+	return store.saveStateToFile(metaStruct)
+}
+
+func (store *Store) GetStats() (*StatsNode, error) {
+	metaStruct, err := store.getMetaFileStructure()
+	if err != nil {
+		return nil, err
+	}
+
+	return &metaStruct.Stats, nil
+}
+
+func (store *Store) GetBtrfsNode() (*BtrfsNode, error) {
+	metaStruct, err := store.getMetaFileStructure()
 	if err != nil {
 		return nil, err
 	}
 
+	return &metaStruct.Btrfs, nil
+}
+
+func (store *Store) getMetaFileStructure() (*metaFileStructure, error) {
+	f, err := store.getOrCreateMetaFile(os.O_RDONLY, os.ModeType)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		if err := f.Close(); err != nil {
+			log.Warnf("failed to close descriptor of the file %s", f.Name())
+		}
+	}(f)
+
 	r := bufio.NewReader(f)
 	buff, err := io.ReadAll(r)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read from the meta file `%s`: %w", _const.AppMetaPath, err)
+		return nil, fmt.Errorf("failed to read from the meta file `%s`: %w", store.FilePath, err)
 	}
 
 	var metaFileStruct metaFileStructure
 	if err := json.Unmarshal(buff, &metaFileStruct); err != nil {
-		return nil, fmt.Errorf("failed to parse JSON object from the meta file `%s`: %w", _const.AppMetaPath,
+		return nil, fmt.Errorf("%w: failed to parse JSON object from `%s`: %w", ErrCorrupted, store.FilePath,
 			err)
 	}
 
-	return &metaFileStruct.Btrfs, nil
+	return &metaFileStruct, nil
 }
 
-func GetCompletedBackups() (*[]Backup, error) {
-	backups, err := GetBackups()
+func (store *Store) GetCompletedBackups() (*[]Backup, error) {
+	backups, err := store.GetBackups()
 	if err != nil {
 		return nil, err
 	}
@@ -106,8 +292,8 @@ func GetCompletedBackups() (*[]Backup, error) {
 	return &completedBackups, nil
 }
 
-func GetBackups() (*[]Backup, error) {
-	btrfsNode, err := GetBtrfsNode()
+func (store *Store) GetBackups() (*[]Backup, error) {
+	btrfsNode, err := store.GetBtrfsNode()
 	if err != nil {
 		return nil, err
 	}
@@ -115,50 +301,34 @@ func GetBackups() (*[]Backup, error) {
 	return &btrfsNode.Backups, nil
 }
 
-func getOrCreateMetaFile(flag int, perm os.FileMode) (*os.File, error) {
-	if _, err := os.Stat(_const.AppMetaPath); os.IsNotExist(err) {
-		if err := createMetaFile(); err != nil {
+func (store *Store) getOrCreateMetaFile(flag int, perm os.FileMode) (*os.File, error) {
+	if _, err := os.Stat(store.FilePath); os.IsNotExist(err) {
+		if err := store.createMetaFile(); err != nil {
 			return nil, fmt.Errorf("failed to create meta file: %w", err)
 		}
 	}
 
-	return os.OpenFile(_const.AppMetaPath, flag, perm)
+	return os.OpenFile(store.FilePath, flag, perm)
 }
 
-func createMetaFile() error {
-	if err := utils.CreateFile(_const.AppMetaPath); err != nil {
-		return fmt.Errorf("failed to create file `%s` for meta storage: %w", _const.AppMetaPath, err)
+func (store *Store) createMetaFile() error {
+	if err := utils.CreateFile(store.FilePath); err != nil {
+		return fmt.Errorf("failed to create file `%s` for meta storage: %w", store.FilePath, err)
 	}
 
-	if err := saveStateToFile(&metaFileStructure{}); err != nil {
+	if err := store.saveStateToFile(&metaFileStructure{}); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func saveStateToFile(metaFileStructure *metaFileStructure) error {
-	f, err := os.OpenFile(_const.AppMetaPath, os.O_CREATE|os.O_WRONLY, os.ModeExclusive)
+// saveStateToFile replaces the meta file atomically, so that it is never left half-written.
+func (store *Store) saveStateToFile(metaFileStructure *metaFileStructure) error {
+	jsonByte, err := json.Marshal(metaFileStructure)
 	if err != nil {
 		return err
 	}
-	defer func(f *os.File) {
-		if err := f.Close(); err != nil {
-			log.Warnf("failed to close descriptor of the file %s", f.Name())
-		}
-	}(f)
 
-	jsonByte, _ := json.Marshal(metaFileStructure)
-	w := bufio.NewWriterSize(f, len(jsonByte))
-	if _, err = w.Write(jsonByte); err != nil {
-		return err
-	}
-	if err := w.Flush(); err != nil {
-		return err
-	}
-	if err := f.Sync(); err != nil {
-		return err
-	}
-
-	return nil
+	return writeFileAtomically(store.FilePath, jsonByte)
 }
@@ -0,0 +1,121 @@
+package meta
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *Store {
+	root := t.TempDir()
+	return &Store{FilePath: filepath.Join(root, "meta.json"), BackupsPath: filepath.Join(root, "backups")}
+}
+
+// createBackup records the completed backup with its subvolume and its sidecar.
+func createBackup(t *testing.T, store *Store, source string, name string) string {
+	path := filepath.Join(store.BackupsPath, source, name)
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StartBackup(path, source, "grpc://localhost:2136", "/"+source); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.FinishBackup(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateBackup(path, func(backup *Backup) {
+		backup.Label = name + "-label"
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteSidecar(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSidecar(t *testing.T) {
+	store := newTestStore(t)
+	path := createBackup(t, store, "first", "ydb_backup_1")
+
+	// The subvolume is received on another host under another path
+	moved := filepath.Join(t.TempDir(), "ydb_backup_1")
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal(err)
+	}
+	sidecar, err := ReadSidecar(moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sidecar == nil || !sidecar.Completed || sidecar.Path != moved || sidecar.Source != "first" ||
+		sidecar.Label != "ydb_backup_1-label" {
+		t.Fatalf("unexpected sidecar: %+v", sidecar)
+	}
+
+	if sidecar, err := ReadSidecar(t.TempDir()); sidecar != nil || err != nil {
+		t.Fatalf("the missing sidecar is read: %+v, %v", sidecar, err)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	store := newTestStore(t)
+	paths := []string{createBackup(t, store, "first", "ydb_backup_2"), createBackup(t, store, "second", "ydb_backup_1")}
+	if err := store.RecordFailedRun(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sidecars []Backup
+	for _, path := range paths {
+		sidecar, err := ReadSidecar(path)
+		if err != nil || sidecar == nil {
+			t.Fatalf("the sidecar of `%s` is not read: %v", path, err)
+		}
+		sidecars = append(sidecars, *sidecar)
+	}
+	// The backup of `second` is started first
+	sidecars[1].StartedCreationAt = sidecars[0].StartedCreationAt.Add(-time.Minute)
+
+	corruptedCopyPath, err := store.Rebuild(sidecars)
+	if err != nil || corruptedCopyPath != "" {
+		t.Fatalf("the readable meta file is not rebuilt in place: %q, %v", corruptedCopyPath, err)
+	}
+	backups, err := store.GetCompletedBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*backups) != 2 || (*backups)[0].Path != paths[1] || (*backups)[1].Label != "ydb_backup_2-label" {
+		t.Fatalf("the backups are not rebuilt in the order of their creation: %+v", *backups)
+	}
+	if stats, err := store.GetStats(); err != nil || stats.FailedRuns != 1 {
+		t.Fatalf("the statistics are not kept: %+v, %v", stats, err)
+	}
+}
+
+func TestRebuildCorrupted(t *testing.T) {
+	store := newTestStore(t)
+	path := createBackup(t, store, "first", "ydb_backup_1")
+	if err := os.WriteFile(store.FilePath, []byte(`{"btrfs": {"backups": [`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetBackups(); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("the corrupted meta file is read: %v", err)
+	}
+
+	sidecar, err := ReadSidecar(path)
+	if err != nil || sidecar == nil {
+		t.Fatalf("the sidecar is not read: %v", err)
+	}
+	corruptedCopyPath, err := store.Rebuild([]Backup{*sidecar})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(corruptedCopyPath); err != nil || string(content) != `{"btrfs": {"backups": [` {
+		t.Fatalf("the corrupted meta file is not saved aside: %q, %v", content, err)
+	}
+	backup, err := store.GetBackup(path)
+	if err != nil || !backup.Completed || backup.Label != "ydb_backup_1-label" {
+		t.Fatalf("the backup is not rebuilt from the sidecar: %+v, %v", backup, err)
+	}
+}
@@ -0,0 +1,76 @@
+package meta
+
+import (
+	"fmt"
+	"time"
+	"ydb-backup-tool/internal/utils"
+)
+
+// RemoteNode mirrors the catalog of the backups replicated to the object storage.
+type RemoteNode struct {
+	// Location is the URL of the bucket with the prefix the catalog is taken from
+	Location string         `json:"location"`
+	SyncedAt *time.Time     `json:"synced_at,omitempty"`
+	Backups  []RemoteBackup `json:"backups"`
+}
+
+// RemoteBackup is the backup replicated to the object storage. It is also uploaded next to the archive, so that
+// the catalog can be restored from the bucket alone.
+type RemoteBackup struct {
+	Name              string            `json:"name"`
+	Source            string            `json:"source,omitempty"`
+	Label             string            `json:"label,omitempty"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	StartedCreationAt time.Time         `json:"started_creation_at"`
+	DumpSize          int64             `json:"dump_size,omitempty"`
+	// Key is the key of the archive in the bucket
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	ETag   string `json:"etag"`
+	// Recipients are the fingerprints of the recipients of the encrypted archive
+	Recipients []string  `json:"recipients,omitempty"`
+	Passphrase bool      `json:"passphrase,omitempty"`
+	Encrypted  bool      `json:"encrypted"`
+	PushedAt   time.Time `json:"pushed_at"`
+}
+
+// GetRemoteNode returns the catalog of the location, which is empty if the catalog of another location is mirrored.
+func (store *Store) GetRemoteNode(location string) (*RemoteNode, error) {
+	metaStruct, err := store.getMetaFileStructure()
+	if err != nil {
+		return nil, err
+	}
+	if metaStruct.Remote == nil || metaStruct.Remote.Location != location {
+		return &RemoteNode{Location: location}, nil
+	}
+	return metaStruct.Remote, nil
+}
+
+// SetRemoteCatalog replaces the mirrored catalog with the one just listed from the location.
+func (store *Store) SetRemoteCatalog(location string, backups []RemoteBackup) error {
+	metaStruct, err := store.getMetaFileStructure()
+	if err != nil {
+		return fmt.Errorf("failed to get current backups meta info: %w", err)
+	}
+
+	now := time.Now()
+	metaStruct.Remote = &RemoteNode{Location: location, SyncedAt: &now, Backups: backups}
+	return store.saveStateToFile(metaStruct)
+}
+
+// RecordRemoteBackup adds the backup just replicated to the location to the mirrored catalog.
+func (store *Store) RecordRemoteBackup(location string, backup RemoteBackup) error {
+	metaStruct, err := store.getMetaFileStructure()
+	if err != nil {
+		return fmt.Errorf("failed to get current backups meta info: %w", err)
+	}
+
+	if metaStruct.Remote == nil || metaStruct.Remote.Location != location {
+		metaStruct.Remote = &RemoteNode{Location: location}
+	}
+	metaStruct.Remote.Backups = append(utils.Filter(metaStruct.Remote.Backups, func(existing RemoteBackup) bool {
+		return existing.Key != backup.Key
+	}), backup)
+	return store.saveStateToFile(metaStruct)
+}
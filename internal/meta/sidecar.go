@@ -0,0 +1,117 @@
+package meta
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	_const "ydb-backup-tool/internal/const"
+)
+
+// The sidecar is a copy of the meta entry of the backup stored inside its subvolume, so that the meta file can be
+// rebuilt from the subvolumes if it is lost.
+
+// WriteSidecar stores the current meta entry of the backup inside its subvolume.
+func (store *Store) WriteSidecar(path string) error {
+	backup, err := store.GetBackup(path)
+	if err != nil {
+		return err
+	}
+	return WriteSidecarEntry(backup)
+}
+
+// WriteSidecarEntry stores the meta entry inside the subvolume at its path, e.g. the one kept by the backup elsewhere.
+func WriteSidecarEntry(backup *Backup) error {
+	content, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	sidecarPath := filepath.Join(backup.Path, _const.BackupSidecarName)
+	if err := writeFileAtomically(sidecarPath, content); err != nil {
+		return fmt.Errorf("failed to write the sidecar `%s`: %w", sidecarPath, err)
+	}
+	return nil
+}
+
+// ReadSidecar returns the meta entry stored inside the subvolume, or nil if there is none.
+func ReadSidecar(path string) (*Backup, error) {
+	sidecarPath := filepath.Join(path, _const.BackupSidecarName)
+	content, err := os.ReadFile(sidecarPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the sidecar `%s`: %w", sidecarPath, err)
+	}
+
+	var backup Backup
+	if err := json.Unmarshal(content, &backup); err != nil {
+		return nil, fmt.Errorf("failed to parse the sidecar `%s`: %w", sidecarPath, err)
+	}
+	// The subvolume may have been moved or received from another host
+	backup.Path = path
+	return &backup, nil
+}
+
+// Rebuild replaces the backups in the meta file. The statistics are kept if the meta file can be parsed,
+// otherwise it is saved aside, and the path of the copy is returned.
+func (store *Store) Rebuild(backups []Backup) (string, error) {
+	metaStruct, err := store.getMetaFileStructure()
+	var corruptedCopyPath string
+	if err != nil {
+		if !errors.Is(err, ErrCorrupted) {
+			return "", err
+		}
+		corruptedCopyPath = fmt.Sprintf("%s.corrupted-%d", store.FilePath, time.Now().Unix())
+		if err := os.Rename(store.FilePath, corruptedCopyPath); err != nil {
+			return "", fmt.Errorf("failed to save the corrupted meta file aside: %w", err)
+		}
+		metaStruct = &metaFileStructure{}
+	}
+
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].StartedCreationAt.Before(backups[j].StartedCreationAt)
+	})
+	metaStruct.Btrfs.Backups = backups
+
+	return corruptedCopyPath, store.saveStateToFile(metaStruct)
+}
+
+func (store *Store) GetBackup(path string) (*Backup, error) {
+	backups, err := store.GetBackups()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, backup := range *backups {
+		if backup.Path == path {
+			return &backup, nil
+		}
+	}
+	return nil, fmt.Errorf("backup `%s` is not found in the meta file", path)
+}
+
+func writeFileAtomically(path string, content []byte) error {
+	tempPath := path + ".tmp"
+	f, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, path)
+}
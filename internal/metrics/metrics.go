@@ -0,0 +1,180 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+type Gauge struct {
+	Name    string
+	Help    string
+	Samples []Sample
+}
+
+// Registry is a set of gauges rendered in the Prometheus text exposition format.
+type Registry struct {
+	gauges map[string]*Gauge
+}
+
+type Collector func() (*Registry, error)
+
+func NewRegistry() *Registry {
+	return &Registry{gauges: map[string]*Gauge{}}
+}
+
+// Set adds a sample to the gauge `name`. Labels are passed as key-value pairs.
+func (r *Registry) Set(name string, help string, value float64, labels ...string) {
+	gauge, ok := r.gauges[name]
+	if !ok {
+		gauge = &Gauge{Name: name, Help: help}
+		r.gauges[name] = gauge
+	}
+
+	labelsMap := map[string]string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		labelsMap[labels[i]] = labels[i+1]
+	}
+	gauge.Samples = append(gauge.Samples, Sample{Labels: labelsMap, Value: value})
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	names := make([]string, 0, len(r.gauges))
+	for name := range r.gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		gauge := r.gauges[name]
+		sb.WriteString(fmt.Sprintf("# HELP %s %s\n", gauge.Name, escapeHelp(gauge.Help)))
+		sb.WriteString(fmt.Sprintf("# TYPE %s gauge\n", gauge.Name))
+		for _, sample := range gauge.Samples {
+			sb.WriteString(gauge.Name)
+			sb.WriteString(formatLabels(sample.Labels))
+			sb.WriteString(" ")
+			sb.WriteString(strconv.FormatFloat(sample.Value, 'g', -1, 64))
+			sb.WriteString("\n")
+		}
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+// WriteTextfile atomically replaces the file for the node_exporter textfile collector.
+func WriteTextfile(registry *Registry, path string) error {
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create metrics file `%s`: %w", tmpPath, err)
+	}
+
+	w := bufio.NewWriter(f)
+	if _, err := registry.WriteTo(w); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write metrics to `%s`: %w", tmpPath, err)
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to move metrics file to `%s`: %w", path, err)
+	}
+
+	return nil
+}
+
+// Serve exposes the metrics returned by the collector on `/metrics` until the context is done.
+func Serve(ctx context.Context, addr string, collector Collector) error {
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		// Every scrape runs the btrfs binaries, so do not let them overlap
+		mu.Lock()
+		defer mu.Unlock()
+
+		registry, err := collector()
+		if err != nil {
+			log.Warnf("failed to collect metrics: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if _, err := registry.WriteTo(w); err != nil {
+			log.Warnf("failed to write metrics response: %v", err)
+		}
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errChan:
+		return fmt.Errorf("metrics endpoint `%s` stopped: %w", addr, err)
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", key, escapeLabelValue(labels[key])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+func escapeHelp(help string) string {
+	help = strings.ReplaceAll(help, `\`, `\\`)
+	return strings.ReplaceAll(help, "\n", `\n`)
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	registry := NewRegistry()
+	registry.Set("ydb_backup_referenced_bytes", "Space referenced by the backup.", 2048, "backup", `ydb_backup_2`)
+	registry.Set("ydb_backup_referenced_bytes", "Space referenced by the backup.", 1024, "backup", "a\"b\\c\nd")
+	registry.Set("ydb_backup_dedup_ratio", "Ratio of the data\nreferenced by all backups.", 1.5)
+
+	var sb strings.Builder
+	if _, err := registry.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP ydb_backup_dedup_ratio Ratio of the data\nreferenced by all backups.
+# TYPE ydb_backup_dedup_ratio gauge
+ydb_backup_dedup_ratio 1.5
+# HELP ydb_backup_referenced_bytes Space referenced by the backup.
+# TYPE ydb_backup_referenced_bytes gauge
+ydb_backup_referenced_bytes{backup="ydb_backup_2"} 2048
+ydb_backup_referenced_bytes{backup="a\"b\\c\nd"} 1024
+`
+	if sb.String() != expected {
+		t.Fatalf("unexpected metrics:\n%s\nwant:\n%s", sb.String(), expected)
+	}
+}
+
+func TestWriteTextfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ydb_backup.prom")
+	if err := os.WriteFile(path, []byte("stale\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := NewRegistry()
+	registry.Set("ydb_backup_failed_runs", "Number of failed runs.", 3)
+	if err := WriteTextfile(registry, path); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(content), "\nydb_backup_failed_runs 3\n") || strings.Contains(string(content), "stale") {
+		t.Fatalf("the textfile is not replaced: %q", content)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o644 {
+		t.Fatalf("the textfile is not readable by the collector: %v", info.Mode())
+	}
+	// The collector reads only the *.prom files, the temporary one must not be left
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("unexpected files next to the textfile: %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,206 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"ydb-backup-tool/internal/utils"
+)
+
+const defaultTimeout = 30 * time.Second
+
+// Summary describes the outcome of a single run of `create`, `restore` or `prune`.
+type Summary struct {
+	Operation       string    `json:"operation"`
+	Success         bool      `json:"success"`
+	Host            string    `json:"host"`
+	Backup          string    `json:"backup,omitempty"`
+	BackupPath      string    `json:"backup_path,omitempty"`
+	StartedAt       time.Time `json:"started_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	DumpSize        int64     `json:"dump_size,omitempty"`
+	SizeExclusive   uint64    `json:"size_exclusive,omitempty"`
+	SizeReferenced  uint64    `json:"size_referenced,omitempty"`
+	DedupSavings    uint64    `json:"dedup_savings,omitempty"`
+	Deleted         []string  `json:"deleted,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+type Sink interface {
+	Name() string
+	Notify(summary *Summary) error
+}
+
+type Notifier struct {
+	Sinks         []Sink
+	OnFailureOnly bool
+}
+
+func (n *Notifier) Enabled() bool {
+	return n != nil && len(n.Sinks) > 0
+}
+
+// Notify sends the summary to every sink. A failed sink never fails the operation itself.
+func (n *Notifier) Notify(ctx context.Context, summary *Summary) {
+	if !n.Enabled() || (n.OnFailureOnly && summary.Success) {
+		return
+	}
+
+	if summary.Host == "" {
+		summary.Host, _ = os.Hostname()
+	}
+	for _, sink := range n.Sinks {
+		if err := sink.Notify(summary); err != nil {
+			log.WithContext(ctx).Warnf("failed to send notification via %s: %v", sink.Name(), err)
+		}
+	}
+}
+
+func (s *Summary) Subject() string {
+	status := "succeeded"
+	if !s.Success {
+		status = "FAILED"
+	}
+	subject := fmt.Sprintf("[ydb-backup-tool] %s %s on %s", s.Operation, status, s.Host)
+	if s.Backup != "" {
+		subject += ": " + s.Backup
+	}
+	return subject
+}
+
+func (s *Summary) Text() string {
+	var sb strings.Builder
+	sb.WriteString(s.Subject() + "\n\n")
+	if s.Backup != "" {
+		sb.WriteString(fmt.Sprintf("Backup: %s\n", s.BackupPath))
+	}
+	sb.WriteString(fmt.Sprintf("Started at: %s\n", s.StartedAt.Format(time.RFC3339)))
+	sb.WriteString(fmt.Sprintf("Duration: %.1fs\n", s.DurationSeconds))
+	if s.DumpSize > 0 {
+		sb.WriteString(fmt.Sprintf("Dump size: %d bytes\n", s.DumpSize))
+	}
+	if s.SizeReferenced > 0 {
+		sb.WriteString(fmt.Sprintf("Usage referenced: %d bytes\n", s.SizeReferenced))
+		sb.WriteString(fmt.Sprintf("Usage exclusive: %d bytes\n", s.SizeExclusive))
+		sb.WriteString(fmt.Sprintf("Deduplication savings: %d bytes\n", s.DedupSavings))
+	}
+	if len(s.Deleted) > 0 {
+		sb.WriteString(fmt.Sprintf("Deleted: %s\n", strings.Join(s.Deleted, ", ")))
+	}
+	if s.Error != "" {
+		sb.WriteString(fmt.Sprintf("Error: %s\n", s.Error))
+	}
+	return sb.String()
+}
+
+// WebhookSink posts the summary as JSON.
+type WebhookSink struct {
+	URL     string
+	Timeout time.Duration
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *WebhookSink) Notify(summary *Summary) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: timeoutOrDefault(s.Timeout)}
+	resp, err := client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post to `%s`: %w", s.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook `%s` responded with %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// EmailSink sends the summary as a plain text email. STARTTLS is used when the server supports it.
+type EmailSink struct {
+	Addr     string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+func (s *EmailSink) Name() string {
+	return "email"
+}
+
+func (s *EmailSink) Notify(summary *Summary) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := strings.Split(s.Addr, ":")[0]
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	var msg strings.Builder
+	msg.WriteString("From: " + s.From + "\r\n")
+	msg.WriteString("To: " + strings.Join(s.To, ", ") + "\r\n")
+	msg.WriteString("Subject: " + summary.Subject() + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(summary.Text(), "\n", "\r\n"))
+
+	if err := smtp.SendMail(s.Addr, auth, s.From, s.To, []byte(msg.String())); err != nil {
+		return fmt.Errorf("failed to send email via `%s`: %w", s.Addr, err)
+	}
+	return nil
+}
+
+// CommandSink runs a local shell command with the JSON summary on stdin.
+type CommandSink struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (s *CommandSink) Name() string {
+	return "command"
+}
+
+func (s *CommandSink) Notify(summary *Summary) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	shPath, err := utils.GetBinary("sh")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutOrDefault(s.Timeout))
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, shPath, "-c", s.Command)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("notification command failed: %w", err)
+	}
+	return nil
+}
+
+func timeoutOrDefault(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return defaultTimeout
+	}
+	return timeout
+}
@@ -0,0 +1,156 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSummary(success bool) *Summary {
+	summary := &Summary{Operation: "create", Success: success, Host: "host", Backup: "ydb_backup_1",
+		BackupPath: "/backups/ydb_backup_1", StartedAt: time.Unix(1700000000, 0), DurationSeconds: 1.5}
+	if !success {
+		summary.Error = "dump failed"
+	}
+	return summary
+}
+
+func TestWebhookSink(t *testing.T) {
+	received := make(chan Summary, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var summary Summary
+		if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&summary) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- summary
+	}))
+	defer server.Close()
+
+	if err := (&WebhookSink{URL: server.URL}).Notify(newTestSummary(false)); err != nil {
+		t.Fatal(err)
+	}
+	summary := <-received
+	if summary.Success || summary.Error != "dump failed" || summary.Backup != "ydb_backup_1" {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	if err := (&WebhookSink{URL: failing.URL}).Notify(newTestSummary(true)); err == nil {
+		t.Fatal("the failed webhook is not reported")
+	}
+}
+
+// serveSMTP accepts a single message, with the bare minimum of the protocol smtp.SendMail needs, and sends
+// the envelope and the data of the message to the channel.
+func serveSMTP(listener net.Listener, messages chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		_, _ = conn.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 localhost ESMTP")
+	var message strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM"), strings.HasPrefix(command, "RCPT TO"):
+			message.WriteString(strings.TrimSpace(line) + "\n")
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 Go ahead")
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				message.WriteString(line)
+			}
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			messages <- message.String()
+			return
+		default:
+			reply("502 Not implemented")
+		}
+	}
+}
+
+func TestEmailSink(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	messages := make(chan string, 1)
+	go serveSMTP(listener, messages)
+
+	sink := &EmailSink{Addr: listener.Addr().String(), From: "backup@example.com",
+		To: []string{"ops@example.com", "dba@example.com"}}
+	if err := sink.Notify(newTestSummary(false)); err != nil {
+		t.Fatal(err)
+	}
+	message := <-messages
+	for _, expected := range []string{
+		"MAIL FROM:<backup@example.com>",
+		"RCPT TO:<ops@example.com>",
+		"RCPT TO:<dba@example.com>",
+		"Subject: [ydb-backup-tool] create FAILED on host: ydb_backup_1\r\n",
+		"Error: dump failed\r\n",
+	} {
+		if !strings.Contains(message, expected) {
+			t.Fatalf("the message has no %q:\n%s", expected, message)
+		}
+	}
+}
+
+type recordingSink struct {
+	summaries []*Summary
+}
+
+func (s *recordingSink) Name() string {
+	return "recording"
+}
+
+func (s *recordingSink) Notify(summary *Summary) error {
+	s.summaries = append(s.summaries, summary)
+	return nil
+}
+
+func TestNotifyOnFailureOnly(t *testing.T) {
+	sink := &recordingSink{}
+	notifier := &Notifier{Sinks: []Sink{sink, &WebhookSink{URL: "http://127.0.0.1:1"}}, OnFailureOnly: true}
+	notifier.Notify(context.Background(), newTestSummary(true))
+	notifier.Notify(context.Background(), newTestSummary(false))
+	if len(sink.summaries) != 1 || sink.summaries[0].Success {
+		t.Fatalf("expected the failure only, got %+v", sink.summaries)
+	}
+
+	// The nil notifier sends nothing
+	var disabled *Notifier
+	disabled.Notify(context.Background(), newTestSummary(false))
+}
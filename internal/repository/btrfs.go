@@ -0,0 +1,292 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"ydb-backup-tool/internal/btrfs"
+	comp "ydb-backup-tool/internal/btrfs/compression"
+	"ydb-backup-tool/internal/btrfs/deduplication/duperemove"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/device"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/utils"
+)
+
+// Chunks filled less than this are rewritten by Compact
+const compactBalanceUsage = 50
+
+// Btrfs keeps the backups as the subvolumes of the btrfs image, which is mounted through a loop device, and opened
+// as a LUKS container if it is encrypted. It needs root.
+type Btrfs struct {
+	ImageParams *device.BackingFileParams
+	MkfsParams  *btrfs.MkfsParams
+	// Compression is the mount option of the image
+	Compression *comp.Compression
+	Growth      device.GrowthPolicy
+	// Encrypt makes Init create the encrypted image
+	Encrypt bool
+	// Key is where the key of the encrypted image is read from
+	Key *utils.SecretSource
+
+	mountPoint *device.MountPoint
+}
+
+// MountPoint is nil until the image is opened. It is updated in place when the image is remounted.
+func (image *Btrfs) MountPoint() *device.MountPoint {
+	return image.mountPoint
+}
+
+func (image *Btrfs) BackupsPath() string {
+	return _const.AppBackupsPath
+}
+
+func (image *Btrfs) Meta() *meta.Store {
+	return &meta.Store{FilePath: _const.AppMetaPath, BackupsPath: image.BackupsPath()}
+}
+
+// TempPath is outside the image, so that the image may be remounted while the database is being dumped.
+func (image *Btrfs) TempPath() string {
+	return _const.AppTmpPath
+}
+
+// Init creates the image, encrypted with Encrypt. A half-initialized image is deleted, since it would be taken
+// for a ready one by the next run.
+func (image *Btrfs) Init(ctx context.Context) (err error) {
+	backingFilePath := _const.AppBaseDataBackingFilePath
+	if _, err := os.Stat(backingFilePath); err == nil {
+		return fmt.Errorf("the image `%s` already exists", backingFilePath)
+	}
+
+	var key *device.Key
+	if image.Encrypt {
+		if key, err = device.LoadKey(image.Key, true); err != nil {
+			return err
+		}
+	}
+
+	backingFile, _, err := device.GetOrCreateBackingStoreFile(backingFilePath, image.ImageParams)
+	if err != nil {
+		return fmt.Errorf("cannot create backing file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			if removeErr := os.Remove(backingFile.Path); removeErr != nil {
+				log.WithContext(ctx).Warnf("cannot delete the incomplete image `%s`: %v", backingFile.Path, removeErr)
+			}
+		}
+	}()
+
+	if !image.Encrypt {
+		if err := btrfs.MakeBtrfsFileSystem(ctx, backingFile.Path, image.MkfsParams); err != nil {
+			return fmt.Errorf("failed to make btrfs: %w", err)
+		}
+		return nil
+	}
+
+	loopDev, err := device.SetupLoopDevice(ctx, backingFile)
+	if err != nil {
+		return fmt.Errorf("cannot create loop device: %w", err)
+	}
+	defer detachLoopDevice(loopDev)
+
+	if err := device.FormatLuks(ctx, loopDev, key); err != nil {
+		return err
+	}
+	crypt, err := device.OpenLuks(ctx, loopDev, key)
+	if err != nil {
+		return err
+	}
+	defer closeCryptDevice(crypt)
+
+	if err := btrfs.MakeBtrfsFileSystem(ctx, crypt.Path, image.MkfsParams); err != nil {
+		return fmt.Errorf("failed to make btrfs: %w", err)
+	}
+	return nil
+}
+
+// Open mounts the image with backups, creating it on the first run.
+func (image *Btrfs) Open(ctx context.Context) error {
+	backingFilePath := _const.AppBaseDataBackingFilePath
+	// Verify img file exists or create it in case of absence
+	backingFile, created, err := device.GetOrCreateBackingStoreFile(backingFilePath, image.ImageParams)
+	if err != nil {
+		return fmt.Errorf("cannot obtain backing file: %w", err)
+	}
+	if created {
+		if err := btrfs.MakeBtrfsFileSystem(ctx, backingFile.Path, image.MkfsParams); err != nil {
+			return fmt.Errorf("failed to make btrfs: %w", err)
+		}
+	}
+
+	loopDev, err := device.SetupLoopDevice(ctx, backingFile)
+	if err != nil {
+		return fmt.Errorf("cannot create loop device: %w", err)
+	}
+
+	encrypted, err := device.IsEncrypted(backingFile)
+	if err != nil {
+		detachLoopDevice(loopDev)
+		return err
+	}
+	if encrypted {
+		mountPoint, err := image.mountEncrypted(ctx, loopDev)
+		if err != nil {
+			detachLoopDevice(loopDev)
+			return err
+		}
+		image.mountPoint = mountPoint
+		return nil
+	}
+
+	mountPoint, err := device.MountLoopDevice(ctx, loopDev, _const.AppDataMountPath, image.Compression)
+	if err != nil {
+		detachLoopDevice(loopDev)
+		return fmt.Errorf("cannot mount the backing file: %w", err)
+	}
+	image.mountPoint = mountPoint
+	return nil
+}
+
+func (image *Btrfs) mountEncrypted(ctx context.Context, loopDev *device.LoopDevice) (*device.MountPoint, error) {
+	key, err := device.LoadKey(image.Key, false)
+	if err != nil {
+		return nil, err
+	}
+	crypt, err := device.OpenLuks(ctx, loopDev, key)
+	if err != nil {
+		return nil, err
+	}
+	mountPoint, err := device.MountCryptDevice(ctx, loopDev, crypt, _const.AppDataMountPath, image.Compression)
+	if err != nil {
+		closeCryptDevice(crypt)
+		return nil, fmt.Errorf("cannot mount the encrypted image: %w", err)
+	}
+	return mountPoint, nil
+}
+
+// Close unmounts the image and releases its devices.
+func (image *Btrfs) Close() {
+	if image.mountPoint == nil {
+		return
+	}
+	mountPoint := image.mountPoint
+	image.mountPoint = nil
+
+	if err := device.Unmount(context.Background(), mountPoint); err != nil {
+		log.Warnf("cannot unmount the backing file.")
+	}
+	if mountPoint.Crypt != nil {
+		closeCryptDevice(mountPoint.Crypt)
+	}
+	// The loop device may have been replaced while the backing file was being extended
+	detachLoopDevice(&mountPoint.LoopDev)
+}
+
+func closeCryptDevice(crypt *device.CryptDevice) {
+	if err := device.CloseLuks(context.Background(), crypt); err != nil {
+		log.Warnf("cannot close the LUKS container: %v", err)
+	}
+}
+
+func detachLoopDevice(loopDevice *device.LoopDevice) {
+	if err := device.DetachLoopDevice(context.Background(), loopDevice); err != nil {
+		log.Warnf("cannot detach the loop device.")
+	}
+}
+
+// CreateBackup creates the subvolume of the backup, the compression is set as its property.
+func (image *Btrfs) CreateBackup(ctx context.Context, path string, compression *comp.Compression) (*Backup, error) {
+	subvolume, err := btrfs.CreateSubvolume(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if compression != nil {
+		if err := comp.EnableCompression(ctx, subvolume.Path, *compression); err != nil {
+			return nil, err
+		}
+	}
+	return fromSubvolume(subvolume), nil
+}
+
+func (image *Btrfs) GetBackup(ctx context.Context, path string) (*Backup, error) {
+	subvolume, err := btrfs.GetSubvolume(ctx, path)
+	if err != nil || subvolume == nil {
+		return nil, err
+	}
+	return fromSubvolume(subvolume), nil
+}
+
+func (image *Btrfs) ListBackups(ctx context.Context, dir string) ([]*Backup, error) {
+	subvolumes, err := btrfs.GetSubvolumes(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]*Backup, 0, len(subvolumes))
+	for _, subvolume := range subvolumes {
+		backups = append(backups, fromSubvolume(subvolume))
+	}
+	return backups, nil
+}
+
+// BackupUsage takes the usage from the quota groups of the subvolumes.
+func (image *Btrfs) BackupUsage(ctx context.Context, dir string) ([]BackupMeta, error) {
+	metaSubvolumes, err := btrfs.GetSubvolumesMeta(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]BackupMeta, 0, len(*metaSubvolumes))
+	for _, metaSubvolume := range *metaSubvolumes {
+		backups = append(backups, BackupMeta{
+			Base:           *fromSubvolume(&metaSubvolume.Base),
+			Id:             metaSubvolume.Id,
+			CreatedAt:      metaSubvolume.CreatedAt,
+			SizeExclusive:  metaSubvolume.SizeExclusive,
+			SizeReferenced: metaSubvolume.SizeReferenced,
+		})
+	}
+	return backups, nil
+}
+
+func (image *Btrfs) DeleteBackup(ctx context.Context, backup *Backup) error {
+	return btrfs.DeleteSubvolume(ctx, btrfs.NewSubvolume(backup.Path, false))
+}
+
+// Dedup deduplicates the extents of the files with duperemove.
+func (image *Btrfs) Dedup(ctx context.Context, paths []string, params *duperemove.Params) error {
+	return duperemove.DeduplicatePaths(ctx, paths, params)
+}
+
+func (image *Btrfs) Usage(ctx context.Context) (*Usage, error) {
+	usage, err := btrfs.GetFileSystemUsage(ctx, image.mountPoint.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get btrfs usage info: %w", err)
+	}
+	return &Usage{Used: usage.Used, Free: usage.Free}, nil
+}
+
+// Verify scrubs the filesystem of the image, so that the checksums of all the data are checked.
+func (image *Btrfs) Verify(ctx context.Context) error {
+	return btrfs.Scrub(ctx, image.mountPoint.Path)
+}
+
+// Compact balances the chunks of the image filled less than compactBalanceUsage, since the dedup and the deleted
+// subvolumes leave them half-empty.
+func (image *Btrfs) Compact(ctx context.Context) error {
+	return btrfs.Balance(ctx, image.mountPoint.Path, compactBalanceUsage)
+}
+
+// Reclaim has nothing to do, the space of the deleted subvolumes is freed by btrfs in the background.
+func (image *Btrfs) Reclaim(ctx context.Context) error {
+	return nil
+}
+
+// Checkout returns the subvolume itself.
+func (image *Btrfs) Checkout(ctx context.Context, backup *Backup) (string, func(), error) {
+	return backup.Path, func() {}, nil
+}
+
+func fromSubvolume(subvolume *btrfs.Subvolume) *Backup {
+	return &Backup{Path: subvolume.Path, Name: subvolume.Name}
+}
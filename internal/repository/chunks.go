@@ -0,0 +1,295 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"ydb-backup-tool/internal/btrfs/deduplication/duperemove"
+	"ydb-backup-tool/internal/chunkstore"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/meta"
+	"ydb-backup-tool/internal/utils"
+)
+
+// Chunks keeps the backups in the content-addressed chunk store under Root, so it needs neither btrfs nor root.
+// A backup is created as a plain directory, and Dedup stores its files as chunks, each one once however many
+// backups have it. Only the sidecar is left in the directory then, and Checkout assembles the files from the chunks.
+type Chunks struct {
+	Dir
+	// Level is the level of DEFLATE the new chunks are compressed with
+	Level int
+
+	store       *chunkstore.Store
+	tempPath    string
+	releaseTemp func()
+}
+
+// TempPath is the directory of this process in the temporary directory of the store, the other processes may
+// be dumping into theirs meanwhile.
+func (chunks *Chunks) TempPath() string {
+	return chunks.tempPath
+}
+
+func (chunks *Chunks) Init(ctx context.Context) error {
+	if err := chunks.Open(ctx); err != nil {
+		return err
+	}
+	chunks.Close()
+	return nil
+}
+
+// Open creates the store on the first run.
+func (chunks *Chunks) Open(ctx context.Context) error {
+	store, err := chunkstore.Open(chunks.Root, chunks.Level)
+	if err != nil {
+		return err
+	}
+	chunks.store = store
+	if err := chunks.restoreDirectories(ctx); err != nil {
+		return err
+	}
+	chunks.tempPath, chunks.releaseTemp, err = store.TempDir("run_")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary directory in the store: %w", err)
+	}
+	return nil
+}
+
+// restoreDirectories recreates the directories of the stored backups which DeleteBackup has deleted, but was
+// interrupted before their manifests. The backups are kept, so that nothing is deleted without the meta file
+// knowing it.
+func (chunks *Chunks) restoreDirectories(ctx context.Context) error {
+	backupPaths, err := chunks.store.BackupPaths()
+	if err != nil {
+		return fmt.Errorf("failed to list the backups of the store: %w", err)
+	}
+	for _, backupPath := range backupPaths {
+		if _, err := os.Stat(backupPath); !os.IsNotExist(err) {
+			continue
+		}
+		manifest, err := chunks.store.ReadManifest(backupPath)
+		if err != nil {
+			return err
+		}
+		log.WithContext(ctx).Warnf("Restoring the directory of the backup `%s`, which has not been deleted completely",
+			backupPath)
+		if err := os.MkdirAll(backupPath, dirPerm); err != nil {
+			return fmt.Errorf("failed to restore the directory of the backup `%s`: %w", backupPath, err)
+		}
+		if err := meta.WriteSidecarEntry(&manifest.Backup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (chunks *Chunks) Close() {
+	if chunks.releaseTemp != nil {
+		chunks.releaseTemp()
+		chunks.releaseTemp = nil
+	}
+}
+
+// BackupUsage takes the usage of the stored backups from their chunks: the exclusive size is that of the chunks
+// no other backup has. The backups which are not stored yet are walked like the plain directories.
+func (chunks *Chunks) BackupUsage(ctx context.Context, path string) ([]BackupMeta, error) {
+	backups, err := chunks.ListBackups(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	var storeUsage map[string]*chunkstore.Usage
+	result := make([]BackupMeta, 0, len(backups))
+	for _, backup := range backups {
+		backupMeta, err := directoryMeta(ctx, backup)
+		if err != nil {
+			return nil, err
+		}
+		stored, err := chunks.store.HasManifest(backup.Path)
+		if err != nil {
+			return nil, err
+		}
+		if stored && storeUsage == nil {
+			if storeUsage, err = chunks.store.Usage(); err != nil {
+				return nil, fmt.Errorf("failed to get usage of the chunks: %w", err)
+			}
+		}
+		if usage, ok := storeUsage[backup.Path]; ok {
+			backupMeta.SizeReferenced = uint64(usage.Referenced)
+			backupMeta.SizeExclusive = uint64(usage.Exclusive)
+		} else if backupMeta.SizeReferenced, backupMeta.SizeExclusive, err = directoryUsage(ctx,
+			backup.Path); err != nil {
+			return nil, fmt.Errorf("failed to get usage of the backup `%s`: %w", backup.Name, err)
+		}
+		result = append(result, backupMeta)
+	}
+	return result, nil
+}
+
+// DeleteBackup deletes the directory before the manifest, see restoreDirectories. The chunks are left to Reclaim.
+func (chunks *Chunks) DeleteBackup(ctx context.Context, backup *Backup) error {
+	if err := chunks.Dir.DeleteBackup(ctx, backup); err != nil {
+		return err
+	}
+	return chunks.store.DeleteManifest(backup.Path)
+}
+
+// Dedup stores the files of the completed backups under the paths as chunks, the paths are the backups themselves
+// or the directories with the backups of a source. The backups which are stored already are left as they are.
+func (chunks *Chunks) Dedup(ctx context.Context, paths []string, params *duperemove.Params) error {
+	var backups []string
+	for _, path := range paths {
+		if strings.HasPrefix(filepath.Base(path), _const.BackupSubvolumePrefix) {
+			backups = append(backups, path)
+			continue
+		}
+		sourceBackups, err := chunks.ListBackups(ctx, path)
+		if err != nil {
+			return err
+		}
+		backups = append(backups, utils.Map(sourceBackups, func(b *Backup) string { return b.Path })...)
+	}
+	sort.Strings(backups)
+
+	// The chunks of the backup are not referenced until its manifest is written, the lock keeps them from
+	// the garbage collection meanwhile
+	unlock, err := chunks.store.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, path := range backups {
+		if err := chunks.storeBackup(ctx, path); err != nil {
+			return fmt.Errorf("failed to store the backup `%s`: %w", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
+
+// storeBackup writes the manifest of the backup and deletes its files, except the sidecar. The backup is stored
+// only once its sidecar says that it is completed and the staging marker is deleted.
+func (chunks *Chunks) storeBackup(ctx context.Context, path string) error {
+	stored, err := chunks.store.HasManifest(path)
+	if err != nil {
+		return err
+	}
+	if stored {
+		// The files are left behind if the backup was interrupted after the manifest was written
+		return deleteStoredFiles(path)
+	}
+	if _, err := os.Stat(filepath.Join(path, _const.BackupStagingMarkerName)); err == nil {
+		return nil
+	}
+	sidecar, err := meta.ReadSidecar(path)
+	if err != nil {
+		return err
+	}
+	if sidecar == nil || !sidecar.Completed {
+		return nil
+	}
+
+	manifest, stats, err := chunks.store.Put(ctx, path, *sidecar)
+	if err != nil {
+		return err
+	}
+	if err := chunks.store.WriteManifest(manifest); err != nil {
+		return err
+	}
+	log.WithContext(ctx).Infof("Stored the backup `%s` as %d chunk(s), %d of them new, %s written", filepath.Base(path),
+		stats.Chunks, stats.NewChunks, utils.FormatSize(stats.Written))
+	return deleteStoredFiles(path)
+}
+
+func deleteStoredFiles(path string) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == _const.BackupSidecarName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+			return fmt.Errorf("failed to delete the stored files of the backup `%s`: %w", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
+
+// Checkout assembles the files of the stored backup in the temporary directory, every chunk is checked against
+// its hash. The backup which is not stored yet is returned as is.
+func (chunks *Chunks) Checkout(ctx context.Context, backup *Backup) (string, func(), error) {
+	unlock, err := chunks.store.Lock(false)
+	if err != nil {
+		return "", nil, err
+	}
+	defer unlock()
+
+	stored, err := chunks.store.HasManifest(backup.Path)
+	if err != nil {
+		return "", nil, err
+	}
+	if !stored {
+		return backup.Path, func() {}, nil
+	}
+	manifest, err := chunks.store.ReadManifest(backup.Path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir, err := os.MkdirTemp(chunks.tempPath, "checkout_")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create a temporary directory for the backup: %w", err)
+	}
+	release := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.WithContext(ctx).Warnf("failed to delete the temporary directory `%s`: %v", dir, err)
+		}
+	}
+	if err := chunks.store.Extract(ctx, manifest, dir); err != nil {
+		release()
+		return "", nil, fmt.Errorf("failed to assemble the backup `%s`: %w", backup.Name, err)
+	}
+	return dir, release, nil
+}
+
+// Verify reads all the chunks the backups refer to and checks them against their hashes.
+func (chunks *Chunks) Verify(ctx context.Context) error {
+	unlock, err := chunks.store.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	count, err := chunks.store.Verify(ctx)
+	if err != nil {
+		return err
+	}
+	log.WithContext(ctx).Infof("Verified %d chunk(s)", count)
+	return nil
+}
+
+// Compact deletes the unreferenced chunks, as Reclaim does, the chunk files need no compaction.
+func (chunks *Chunks) Compact(ctx context.Context) error {
+	return chunks.Reclaim(ctx)
+}
+
+// Reclaim deletes the chunks which no backup refers to. It waits for the commands which are storing backups.
+func (chunks *Chunks) Reclaim(ctx context.Context) error {
+	unlock, err := chunks.store.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	stats, err := chunks.store.GC(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete the unreferenced chunks: %w", err)
+	}
+	log.WithContext(ctx).Infof("Deleted %d unreferenced chunk(s), %s freed", stats.Chunks, utils.FormatSize(stats.Freed))
+	return nil
+}
@@ -0,0 +1,219 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	comp "ydb-backup-tool/internal/btrfs/compression"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/device"
+	"ydb-backup-tool/internal/meta"
+)
+
+const (
+	dirBackupsName = "backups"
+	dirTempName    = "tmp"
+	// dirMetaName is the meta file, it is kept in the root, so that the directories need no access to the data
+	// directory of the tool
+	dirMetaName = "meta.json"
+	dirPerm     = 0o700
+)
+
+// Dir keeps the backups as plain directories under Root on any filesystem, so it needs neither btrfs nor root.
+// The unchanged files are shared with the previous backup by Dedup, and the compression is not applied.
+type Dir struct {
+	Root string
+
+	// noReflinks is set once the filesystem refuses to clone a file, the files are hardlinked from then on
+	noReflinks bool
+}
+
+func (dir *Dir) BackupsPath() string {
+	return filepath.Join(dir.Root, dirBackupsName)
+}
+
+func (dir *Dir) TempPath() string {
+	return filepath.Join(dir.Root, dirTempName)
+}
+
+func (dir *Dir) Meta() *meta.Store {
+	return &meta.Store{FilePath: filepath.Join(dir.Root, dirMetaName), BackupsPath: dir.BackupsPath()}
+}
+
+func (dir *Dir) Init(ctx context.Context) error {
+	return dir.Open(ctx)
+}
+
+// Open creates the directories of the repository on the first run.
+func (dir *Dir) Open(ctx context.Context) error {
+	for _, path := range []string{dir.Root, dir.BackupsPath(), dir.TempPath()} {
+		if err := os.MkdirAll(path, dirPerm); err != nil {
+			return fmt.Errorf("failed to create directory `%s` of the repository: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (dir *Dir) Close() {
+}
+
+func (dir *Dir) CreateBackup(ctx context.Context, path string, compression *comp.Compression) (*Backup, error) {
+	if err := os.Mkdir(path, dirPerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory of the backup `%s`: %w", path, err)
+	}
+	return NewBackup(path), nil
+}
+
+func (dir *Dir) GetBackup(ctx context.Context, path string) (*Backup, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("`%s` is not a directory", path)
+	}
+	return NewBackup(path), nil
+}
+
+// ListBackups returns the subdirectories sorted by name.
+func (dir *Dir) ListBackups(ctx context.Context, path string) ([]*Backup, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var backups []*Backup
+	for _, entry := range entries {
+		if entry.IsDir() {
+			backups = append(backups, NewBackup(filepath.Join(path, entry.Name())))
+		}
+	}
+	return backups, nil
+}
+
+// BackupUsage walks the files of the backups. The files hardlinked from other backups as well are not exclusive,
+// while the cloned ones are, since their shared extents are not visible here. The id of a backup is the inode number
+// of its directory.
+func (dir *Dir) BackupUsage(ctx context.Context, path string) ([]BackupMeta, error) {
+	backups, err := dir.ListBackups(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]BackupMeta, 0, len(backups))
+	for _, backup := range backups {
+		backupMeta, err := directoryMeta(ctx, backup)
+		if err != nil {
+			return nil, err
+		}
+		if backupMeta.SizeReferenced, backupMeta.SizeExclusive, err = directoryUsage(ctx, backup.Path); err != nil {
+			return nil, fmt.Errorf("failed to get usage of the backup `%s`: %w", backup.Name, err)
+		}
+		result = append(result, backupMeta)
+	}
+	return result, nil
+}
+
+// directoryMeta returns the backup with its creation time and id, without its usage. The creation time is taken
+// from the sidecar, or from the name `ydb_backup_<unix time>`, since the modification time of the directory changes
+// whenever a file is added or shared by Dedup. The modification time is the last resort.
+func directoryMeta(ctx context.Context, backup *Backup) (BackupMeta, error) {
+	info, err := os.Stat(backup.Path)
+	if err != nil {
+		return BackupMeta{}, err
+	}
+	backupMeta := BackupMeta{Base: *backup, CreatedAt: info.ModTime()}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		backupMeta.Id = stat.Ino
+	}
+
+	sidecar, err := meta.ReadSidecar(backup.Path)
+	if err != nil {
+		log.WithContext(ctx).Warnf("The creation time of `%s` is taken from its name: %v", backup.Name, err)
+	}
+	if sidecar != nil && !sidecar.StartedCreationAt.IsZero() {
+		backupMeta.CreatedAt = sidecar.StartedCreationAt
+		return backupMeta, nil
+	}
+	if unixTime, found := strings.CutPrefix(backup.Name, _const.BackupSubvolumePrefix); found {
+		if seconds, err := strconv.ParseInt(unixTime, 10, 64); err == nil {
+			backupMeta.CreatedAt = time.Unix(seconds, 0)
+		}
+	}
+	return backupMeta, nil
+}
+
+func directoryUsage(ctx context.Context, path string) (referenced uint64, exclusive uint64, err error) {
+	err = filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		referenced += uint64(info.Size())
+		if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Nlink <= 1 {
+			exclusive += uint64(info.Size())
+		}
+		return nil
+	})
+	return referenced, exclusive, err
+}
+
+func (dir *Dir) DeleteBackup(ctx context.Context, backup *Backup) error {
+	if err := os.RemoveAll(backup.Path); err != nil {
+		return fmt.Errorf("failed to delete the backup `%s`: %w", backup.Name, err)
+	}
+	return nil
+}
+
+func (dir *Dir) Usage(ctx context.Context) (*Usage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir.Root, &stat); err != nil {
+		return nil, fmt.Errorf("failed to get usage of `%s`: %w", dir.Root, err)
+	}
+	return &Usage{
+		Used: int64(stat.Blocks-stat.Bfree) * int64(stat.Bsize),
+		Free: int64(stat.Bavail) * int64(stat.Bsize),
+	}, nil
+}
+
+// Reserve only checks the free space, the dump is kept on the same filesystem as the backups.
+func (dir *Dir) Reserve(ctx context.Context, required int64, tempSize int64) error {
+	return device.CheckFreeSpace(dir.Root, required+tempSize)
+}
+
+// Verify has nothing to check, the files have no checksums of their own.
+func (dir *Dir) Verify(ctx context.Context) error {
+	return nil
+}
+
+// Compact has nothing to do, the space of the deleted files is freed right away.
+func (dir *Dir) Compact(ctx context.Context) error {
+	return nil
+}
+
+// Reclaim has nothing to do, the space of the deleted files is freed right away.
+func (dir *Dir) Reclaim(ctx context.Context) error {
+	return nil
+}
+
+// Checkout returns the directory of the backup itself.
+func (dir *Dir) Checkout(ctx context.Context, backup *Backup) (string, func(), error) {
+	return backup.Path, func() {}, nil
+}
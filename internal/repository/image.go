@@ -0,0 +1,191 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"ydb-backup-tool/internal/btrfs"
+	"ydb-backup-tool/internal/device"
+	"ydb-backup-tool/internal/utils"
+)
+
+// subvolumeMetadataReserve is the free space kept for the metadata of the new subvolume.
+const subvolumeMetadataReserve = 16 * 1024
+
+// Reserve extends the image if it cannot fit `required` more bytes and the metadata of a new subvolume, according
+// to Growth. The image may be remounted, so it must not be used by anything else meanwhile.
+func (image *Btrfs) Reserve(ctx context.Context, required int64, tempSize int64) error {
+	extension, err := image.extension(ctx, required)
+	if err != nil {
+		return err
+	}
+	if err := image.checkHostSpace(extension, tempSize); err != nil {
+		return err
+	}
+	if extension == 0 {
+		return nil
+	}
+
+	log.WithContext(ctx).Infof("Extending the image by %s", utils.FormatSize(extension))
+	return image.extend(ctx, extension)
+}
+
+// checkHostSpace checks that the host fits the extension of the image and the temporary dump at once.
+func (image *Btrfs) checkHostSpace(extension int64, tempSize int64) error {
+	imageDir := filepath.Dir(image.mountPoint.LoopDev.BackFile.Path)
+	if tempSize == 0 {
+		return device.CheckFreeSpace(imageDir, extension)
+	}
+
+	if err := utils.CreateDirectory(image.TempPath()); err != nil {
+		return err
+	}
+	same, err := device.SameFilesystem(imageDir, image.TempPath())
+	if err != nil {
+		return err
+	}
+	if same {
+		return device.CheckFreeSpace(imageDir, extension+tempSize)
+	}
+	if err := device.CheckFreeSpace(imageDir, extension); err != nil {
+		return err
+	}
+	return device.CheckFreeSpace(image.TempPath(), tempSize)
+}
+
+// extension returns the number of bytes to extend the image by, so that it fits `required` more bytes.
+func (image *Btrfs) extension(ctx context.Context, required int64) (int64, error) {
+	usage, err := image.Usage(ctx)
+	if err != nil {
+		return 0, err
+	}
+	deficit := required + subvolumeMetadataReserve - usage.Free
+	if deficit <= 0 {
+		return 0, nil
+	}
+
+	imageSize, err := utils.GetFileSize(image.mountPoint.LoopDev.BackFile.Path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the size of the image: %w", err)
+	}
+	return image.Growth.Extension(imageSize, deficit)
+}
+
+// extend extends the backing file and the filesystem of the mounted image. The loop device picks up the new size
+// of the file, and btrfs is resized while it is mounted. The image is remounted only if that fails, or if Growth
+// asks for it; the mount point is updated in place then.
+func (image *Btrfs) extend(ctx context.Context, extension int64) error {
+	mountPoint := image.mountPoint
+	if err := device.ExtendBackingStoreFileBy(&mountPoint.LoopDev.BackFile, extension,
+		image.Growth.Allocation); err != nil {
+		return fmt.Errorf("failed to extend backing store file: %w", err)
+	}
+
+	return growOrRemount(ctx, image.Growth.Remount, func() error {
+		return growMountedImage(ctx, mountPoint)
+	}, image.remount)
+}
+
+// growOrRemount grows the mounted image, and remounts it only if that fails, unless the growth is cancelled,
+// or if `remount` asks for it.
+func growOrRemount(ctx context.Context, remount bool, grow func() error, remountImage func() error) error {
+	if !remount {
+		err := grow()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		log.WithContext(ctx).Warnf("Failed to extend the mounted image, remounting it: %v", err)
+	}
+	return remountImage()
+}
+
+func growMountedImage(ctx context.Context, mountPoint *device.MountPoint) error {
+	if err := device.RefreshLoopDeviceCapacity(ctx, &mountPoint.LoopDev); err != nil {
+		return err
+	}
+	if mountPoint.Crypt != nil {
+		if err := device.ResizeLuks(ctx, mountPoint.Crypt); err != nil {
+			return err
+		}
+	}
+	return btrfs.ResizeFileSystem(ctx, mountPoint.Path, "max")
+}
+
+// remount attaches the extended backing file to a new loop device, the LUKS container of the encrypted image
+// is reopened with the same key. It runs with its own context, since once the image is unmounted, it must be mounted
+// back even if the backup is cancelled.
+func (image *Btrfs) remount() error {
+	mountPoint := image.mountPoint
+	remountCtx := context.Background()
+	if err := device.Unmount(remountCtx, mountPoint); err != nil {
+		return fmt.Errorf("failed to unmount %s: %w", mountPoint.Path, err)
+	}
+	if err := releaseImageDevices(remountCtx, mountPoint); err != nil {
+		// The old devices are still there, so the image is mounted back as it was
+		if mountErr := image.mountBack(remountCtx); mountErr != nil {
+			return fmt.Errorf("%w, and the image is not mounted back: %v", err, mountErr)
+		}
+		return err
+	}
+
+	newLoopDev, err := device.SetupLoopDevice(remountCtx, &mountPoint.LoopDev.BackFile)
+	if err != nil {
+		return fmt.Errorf("failed to set up a loop device for the extended backing file, "+
+			"the image is left unmounted: %w", err)
+	}
+	var newMountPoint *device.MountPoint
+	if mountPoint.Crypt != nil {
+		crypt, err := device.ReopenLuks(remountCtx, newLoopDev, mountPoint.Crypt)
+		if err != nil {
+			return fmt.Errorf("%w, the image is left unmounted", err)
+		}
+		newMountPoint, err = device.MountCryptDevice(remountCtx, newLoopDev, crypt, mountPoint.Path,
+			image.Compression)
+	} else {
+		newMountPoint, err = device.MountLoopDevice(remountCtx, newLoopDev, mountPoint.Path, image.Compression)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mount %s, the image is left unmounted: %w", mountPoint.Path, err)
+	}
+	// Update the callers' mount point as well, since the loop device has changed
+	*mountPoint = *newMountPoint
+	return btrfs.ResizeFileSystem(remountCtx, mountPoint.Path, "max")
+}
+
+// releaseImageDevices closes the LUKS container of the unmounted image and detaches its loop device.
+func releaseImageDevices(ctx context.Context, mountPoint *device.MountPoint) error {
+	if mountPoint.Crypt != nil {
+		if err := device.CloseLuks(ctx, mountPoint.Crypt); err != nil {
+			return err
+		}
+	}
+	if err := device.DetachLoopDevice(ctx, &mountPoint.LoopDev); err != nil {
+		if mountPoint.Crypt != nil {
+			// The container is closed already, so it is opened again on the old loop device
+			crypt, openErr := device.ReopenLuks(ctx, &mountPoint.LoopDev, mountPoint.Crypt)
+			if openErr != nil {
+				return fmt.Errorf("failed to detach loop device %s: %w, and to reopen the LUKS container: %v",
+					mountPoint.LoopDev.Name, err, openErr)
+			}
+			mountPoint.Crypt = crypt
+		}
+		return fmt.Errorf("failed to detach loop device %s: %w", mountPoint.LoopDev.Name, err)
+	}
+	return nil
+}
+
+func (image *Btrfs) mountBack(ctx context.Context) error {
+	mountPoint := image.mountPoint
+	var err error
+	if mountPoint.Crypt != nil {
+		_, err = device.MountCryptDevice(ctx, &mountPoint.LoopDev, mountPoint.Crypt, mountPoint.Path,
+			image.Compression)
+	} else {
+		_, err = device.MountLoopDevice(ctx, &mountPoint.LoopDev, mountPoint.Path, image.Compression)
+	}
+	return err
+}
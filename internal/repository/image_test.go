@@ -0,0 +1,48 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestGrowOrRemount(t *testing.T) {
+	growErr := errors.New("resize failed")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name            string
+		ctx             context.Context
+		remount         bool
+		growErr         error
+		expectGrown     bool
+		expectRemounted bool
+		expectErr       error
+	}{
+		{name: "grown online", ctx: context.Background(), expectGrown: true},
+		{name: "online growth failed", ctx: context.Background(), growErr: growErr, expectGrown: true,
+			expectRemounted: true},
+		{name: "cancelled", ctx: cancelled, growErr: growErr, expectGrown: true, expectErr: growErr},
+		{name: "remount asked for", ctx: context.Background(), remount: true, expectRemounted: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var grown, remounted bool
+			err := growOrRemount(test.ctx, test.remount, func() error {
+				grown = true
+				return test.growErr
+			}, func() error {
+				remounted = true
+				return nil
+			})
+			if !errors.Is(err, test.expectErr) {
+				t.Fatalf("expected %v, got %v", test.expectErr, err)
+			}
+			if grown != test.expectGrown || remounted != test.expectRemounted {
+				t.Fatalf("grown: %t, remounted: %t, expected %t and %t", grown, remounted, test.expectGrown,
+					test.expectRemounted)
+			}
+		})
+	}
+}
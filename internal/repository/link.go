@@ -0,0 +1,237 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"ydb-backup-tool/internal/btrfs/deduplication/duperemove"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/utils"
+)
+
+// errReflinkUnsupported is returned by reflink when the filesystem cannot clone the files.
+var errReflinkUnsupported = errors.New("reflinks are not supported")
+
+// linkTempPrefix starts the names of the clones and the hardlinks until they replace the files. The ones left by
+// a crash are removed by the next Dedup, which walks the backup again since its manifest has not been written.
+const linkTempPrefix = ".link_"
+
+// manifest maps the files of the backup, relative to its root, to their size and SHA-256. It is kept in the backup,
+// so that the next backup is matched against it without reading the files of the previous one again.
+type manifest struct {
+	Files map[string]manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// Dedup shares the unchanged files of each backup with the previous backup, matched by the manifest of the latter.
+// The paths are the backups themselves or the directories with the backups of a source. The files are cloned where
+// the filesystem supports reflinks, and hardlinked otherwise. The backups which have the manifest already are left
+// as they are.
+func (dir *Dir) Dedup(ctx context.Context, paths []string, params *duperemove.Params) error {
+	var groups [][]string
+	var backups []string
+	for _, path := range paths {
+		if strings.HasPrefix(filepath.Base(path), _const.BackupSubvolumePrefix) {
+			backups = append(backups, path)
+			continue
+		}
+		sourceBackups, err := dir.ListBackups(ctx, path)
+		if err != nil {
+			return err
+		}
+		groups = append(groups, utils.Map(sourceBackups, func(b *Backup) string { return b.Path }))
+	}
+	groups = append(groups, backups)
+
+	for _, group := range groups {
+		// The names end with the creation time
+		sort.Strings(group)
+		if err := dir.linkBackups(ctx, group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dir *Dir) linkBackups(ctx context.Context, backups []string) error {
+	var previousPath string
+	var previous *manifest
+	for _, path := range backups {
+		if _, err := os.Stat(filepath.Join(path, _const.BackupStagingMarkerName)); err == nil {
+			continue
+		}
+		current, err := readManifest(path)
+		if err != nil {
+			log.WithContext(ctx).Warnf("The manifest of `%s` is written again: %v", path, err)
+		}
+		if current == nil {
+			if current, err = dir.linkBackup(ctx, path, previousPath, previous); err != nil {
+				return fmt.Errorf("failed to share the files of the backup `%s`: %w", filepath.Base(path), err)
+			}
+		}
+		previousPath, previous = path, current
+	}
+	return nil
+}
+
+// linkBackup shares the files of the backup which are in the manifest of the previous backup with the same size
+// and hash, and writes the manifest of the backup.
+func (dir *Dir) linkBackup(ctx context.Context, path string, previousPath string,
+	previous *manifest) (*manifest, error) {
+	current := &manifest{Files: map[string]manifestFile{}}
+	var linked int
+	var shared int64
+	err := filepath.WalkDir(path, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), linkTempPrefix) {
+			log.WithContext(ctx).Warnf("Removing `%s` left by the interrupted deduplication", filePath)
+			return os.Remove(filePath)
+		}
+		relativePath, err := filepath.Rel(path, filePath)
+		if err != nil {
+			return err
+		}
+		if relativePath == _const.BackupSidecarName || relativePath == _const.BackupManifestName {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		hash, err := hashFile(filePath)
+		if err != nil {
+			return err
+		}
+		file := manifestFile{Size: info.Size(), Hash: hash}
+		key := filepath.ToSlash(relativePath)
+		current.Files[key] = file
+
+		if previous == nil || file.Size == 0 || previous.Files[key] != file {
+			return nil
+		}
+		if err := dir.shareFile(ctx, filepath.Join(previousPath, relativePath), filePath, info); err != nil {
+			return fmt.Errorf("failed to share `%s`: %w", relativePath, err)
+		}
+		linked++
+		shared += file.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeManifest(path, current); err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		log.WithContext(ctx).Infof("Shared %d of %d file(s) of `%s` with the previous backup, %s", linked, len(current.Files),
+			filepath.Base(path), utils.FormatSize(shared))
+	}
+	return current, nil
+}
+
+// shareFile replaces the file with the clone of the identical file of the previous backup, or with the hardlink to
+// it on the filesystems without reflinks. The file is replaced by a rename, so it is never left half-written, and
+// the temporary file is removed if the rename fails.
+func (dir *Dir) shareFile(ctx context.Context, source string, target string, info fs.FileInfo) (err error) {
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(sourceInfo, info) {
+		return nil
+	}
+
+	tempPath := filepath.Join(filepath.Dir(target), linkTempPrefix+filepath.Base(target))
+	if err := os.Remove(tempPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tempPath)
+		}
+	}()
+
+	if !dir.noReflinks {
+		err := reflink(source, tempPath, info.Mode().Perm())
+		if err == nil {
+			return os.Rename(tempPath, target)
+		}
+		if !errors.Is(err, errReflinkUnsupported) {
+			return err
+		}
+		log.WithContext(ctx).Infof("The filesystem of `%s` does not support reflinks, the unchanged files are hardlinked",
+			dir.Root)
+		dir.noReflinks = true
+	}
+	if err := os.Link(source, tempPath); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, target)
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// readManifest returns nil if the backup has no manifest.
+func readManifest(path string) (*manifest, error) {
+	content, err := os.ReadFile(filepath.Join(path, _const.BackupManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result manifest
+	if err := json.Unmarshal(content, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse the manifest: %w", err)
+	}
+	return &result, nil
+}
+
+func writeManifest(path string, current *manifest) error {
+	content, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	manifestPath := filepath.Join(path, _const.BackupManifestName)
+	tempPath := manifestPath + ".tmp"
+	if err := os.WriteFile(tempPath, content, 0o644); err != nil {
+		return fmt.Errorf("failed to write the manifest `%s`: %w", manifestPath, err)
+	}
+	return os.Rename(tempPath, manifestPath)
+}
@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDedupAfterInterruption(t *testing.T) {
+	dir := &Dir{Root: t.TempDir()}
+	ctx := context.Background()
+	if err := dir.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var backups []string
+	for _, name := range []string{"ydb_backup_1", "ydb_backup_2"} {
+		path := filepath.Join(dir.BackupsPath(), name)
+		if err := os.MkdirAll(filepath.Join(path, "table"), dirPerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(path, "table", "data_00.csv"), []byte("id\n1\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		backups = append(backups, path)
+	}
+	// The crash has left the temporary link in the second backup
+	stale := filepath.Join(backups[1], "table", linkTempPrefix+"data_00.csv")
+	if err := os.WriteFile(stale, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dir.Dedup(ctx, []string{dir.BackupsPath()}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Fatalf("the temporary link is left: %v", err)
+	}
+	current, err := readManifest(backups[1])
+	if err != nil || current == nil || len(current.Files) != 1 {
+		t.Fatalf("unexpected manifest: %+v, %v", current, err)
+	}
+	first, err := os.Stat(filepath.Join(backups[0], "table", "data_00.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.Stat(filepath.Join(backups[1], "table", "data_00.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The clones are separate files, so only the hardlinks are seen here
+	if dir.noReflinks && !os.SameFile(first, second) {
+		t.Fatal("the unchanged file is not hardlinked")
+	}
+}
+
+func TestDirectoryMetaCreatedAt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ydb_backup_1700000000")
+	if err := os.Mkdir(path, dirPerm); err != nil {
+		t.Fatal(err)
+	}
+	backupMeta, err := directoryMeta(context.Background(), NewBackup(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backupMeta.CreatedAt.Unix() != 1700000000 {
+		t.Fatalf("the creation time is %s instead of the one in the name", backupMeta.CreatedAt)
+	}
+}
@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"io/fs"
+	"os"
+)
+
+// reflink clones the source into a new target file with FICLONE, so that they share the extents until either is
+// changed. It returns errReflinkUnsupported if the filesystem cannot do it, e.g. ext4 or two filesystems.
+func reflink(source string, target string, perm fs.FileMode) (err error) {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	targetFile, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := targetFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(target)
+		}
+	}()
+
+	err = unix.IoctlFileClone(int(targetFile.Fd()), int(sourceFile.Fd()))
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EINVAL) ||
+		errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.ENOSYS) {
+		return errReflinkUnsupported
+	}
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package repository
+
+import "io/fs"
+
+func reflink(source string, target string, perm fs.FileMode) error {
+	return errReflinkUnsupported
+}
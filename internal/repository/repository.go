@@ -0,0 +1,110 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+	comp "ydb-backup-tool/internal/btrfs/compression"
+	"ydb-backup-tool/internal/btrfs/deduplication/duperemove"
+	_const "ydb-backup-tool/internal/const"
+	"ydb-backup-tool/internal/meta"
+)
+
+// Backup is the subvolume or the directory of a backup. The backups of each source are kept in such a subvolume
+// or directory as well.
+type Backup struct {
+	Path string
+	Name string
+}
+
+// BackupMeta is the backup with its creation time and the space it takes.
+type BackupMeta struct {
+	Base           Backup
+	Id             uint64
+	CreatedAt      time.Time
+	SizeExclusive  uint64
+	SizeReferenced uint64
+}
+
+// Usage is the space of the filesystem the backups are kept on.
+type Usage struct {
+	Used int64
+	Free int64
+}
+
+func NewBackup(path string) *Backup {
+	return &Backup{Path: path, Name: filepath.Base(path)}
+}
+
+// Repository stores the backups, the commands never touch the storage under them otherwise. The meta file of
+// the backups is kept alongside, see Meta.
+type Repository interface {
+	// Init creates the empty repository. Open creates it on the first run as well, so Init is needed only to create
+	// it in advance or with the options Open does not have.
+	Init(ctx context.Context) error
+	// Open makes the backups available under BackupsPath, creating the repository on the first run.
+	Open(ctx context.Context) error
+	// Close releases what Open has acquired. The errors are only logged, since the backups are stored already.
+	Close()
+
+	// BackupsPath is the directory with the backups of all sources.
+	BackupsPath() string
+	// TempPath is the directory for the dumps and the other temporary files, it is cleared before each command.
+	TempPath() string
+	// Meta is the meta file with the backups under BackupsPath.
+	Meta() *meta.Store
+
+	// CreateBackup creates the empty backup at the path, the compression is applied to the files written into it
+	// where the repository supports it.
+	CreateBackup(ctx context.Context, path string, compression *comp.Compression) (*Backup, error)
+	// GetBackup returns nil if there is no backup at the path.
+	GetBackup(ctx context.Context, path string) (*Backup, error)
+	// ListBackups returns the backups right in the directory, not the ones nested deeper.
+	ListBackups(ctx context.Context, dir string) ([]*Backup, error)
+	// BackupUsage is ListBackups with the creation time and the usage of the backups.
+	BackupUsage(ctx context.Context, dir string) ([]BackupMeta, error)
+	DeleteBackup(ctx context.Context, backup *Backup) error
+	// Dedup shares the identical data of the backups under the paths.
+	Dedup(ctx context.Context, paths []string, params *duperemove.Params) error
+	Usage(ctx context.Context) (*Usage, error)
+	// Reserve makes room for `required` more bytes of backups, e.g. extends the image, and fails with
+	// device.ErrInsufficientSpace if the host cannot fit them along with the temporary dump of `tempSize` bytes.
+	Reserve(ctx context.Context, required int64, tempSize int64) error
+	// Verify checks that the stored data reads back intact, e.g. scrubs the filesystem.
+	Verify(ctx context.Context) error
+	// Compact gives back the space the deleted and deduplicated backups have left unused, e.g. balances
+	// the filesystem.
+	Compact(ctx context.Context) error
+	// Reclaim frees the space of the deleted backups where DeleteBackup leaves it taken, it is much cheaper
+	// than Compact.
+	Reclaim(ctx context.Context) error
+	// Checkout makes the files of the backup available in a directory, e.g. to restore from them, and release
+	// deletes what was made for that.
+	Checkout(ctx context.Context, backup *Backup) (dir string, release func(), err error)
+}
+
+// ListAllBackups returns the backups right in the directory with backups and in the directories of the sources
+// in it.
+func ListAllBackups(ctx context.Context, repo Repository, backupsPath string) ([]*Backup, error) {
+	backups, err := repo.ListBackups(ctx, backupsPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get list of subvolumes: %w", err)
+	}
+
+	var result []*Backup
+	for _, backup := range backups {
+		if strings.HasPrefix(backup.Name, _const.BackupSubvolumePrefix) {
+			result = append(result, backup)
+			continue
+		}
+
+		sourceBackups, err := repo.ListBackups(ctx, backup.Path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get list of subvolumes of the source `%s`: %w", backup.Name, err)
+		}
+		result = append(result, sourceBackups...)
+	}
+	return result, nil
+}
@@ -0,0 +1,37 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestListAllBackups(t *testing.T) {
+	dir := &Dir{Root: t.TempDir()}
+	ctx := context.Background()
+	if err := dir.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// The backup created before the sources were introduced is right in the directory with backups
+	for _, path := range []string{"ydb_backup_1", "orders/ydb_backup_2", "orders/ydb_backup_3", "logs"} {
+		if err := os.MkdirAll(filepath.Join(dir.BackupsPath(), path), dirPerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := ListAllBackups(ctx, dir, dir.BackupsPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, backup := range backups {
+		names = append(names, backup.Name)
+	}
+	sort.Strings(names)
+	if expected := []string{"ydb_backup_1", "ydb_backup_2", "ydb_backup_3"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("listed %v, expected %v", names, expected)
+	}
+}
@@ -0,0 +1,172 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MinPartSize is the minimal size of every part of the multipart upload but the last one
+	MinPartSize = 5 * 1024 * 1024
+	// MaxParts is the maximal number of the parts of the multipart upload
+	MaxParts = 10000
+)
+
+// Part is the uploaded part of the multipart upload.
+type Part struct {
+	Number int
+	Size   int64
+	// ETag is without quotes, it is the hex MD5 of the part unless the storage encrypts the objects
+	ETag string
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+// CreateMultipartUpload starts the multipart upload of the object and returns its ID.
+func (client *Client) CreateMultipartUpload(ctx context.Context, key string, contentType string) (string, error) {
+	var result initiateMultipartUploadResult
+	err := client.doXML(ctx, &request{method: http.MethodPost, key: key, query: url.Values{"uploads": {""}},
+		headers: map[string]string{"Content-Type": contentType}}, &result)
+	if err != nil {
+		return "", fmt.Errorf("failed to start the upload of `%s`: %w", key, err)
+	}
+	if result.UploadID == "" {
+		return "", fmt.Errorf("failed to start the upload of `%s`: no upload ID in the response", key)
+	}
+	return result.UploadID, nil
+}
+
+// UploadPart uploads the part, numbered from 1. The storage checks the part against its MD5 and SHA-256 sent
+// along. The returned ETag is not the MD5 on some storages, e.g. with the encryption on the server side, so
+// a mismatch is only logged.
+func (client *Client) UploadPart(ctx context.Context, key string, uploadID string, number int,
+	data []byte) (*Part, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	response, err := client.do(ctx, &request{method: http.MethodPut, key: key, query: query, body: data})
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload the part %d of `%s`: %w", number, key, err)
+	}
+	_ = response.Body.Close()
+
+	sum := md5.Sum(data)
+	part := &Part{Number: number, Size: int64(len(data)), ETag: hex.EncodeToString(sum[:])}
+	etag := strings.Trim(response.Header.Get("ETag"), `"`)
+	if etag != "" && etag != part.ETag {
+		log.WithContext(ctx).Warnf("The part %d of `%s` is uploaded with ETag %s, which is not its MD5 %s", number, key, etag,
+			part.ETag)
+		// The upload is completed with the ETags the storage has returned
+		part.ETag = etag
+	}
+	return part, nil
+}
+
+type listPartsResult struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		Size       int64  `xml:"Size"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+	IsTruncated          bool `xml:"IsTruncated"`
+	NextPartNumberMarker int  `xml:"NextPartNumberMarker"`
+}
+
+// ListParts returns the parts uploaded so far, ErrNotFound is returned when the upload is completed or aborted.
+func (client *Client) ListParts(ctx context.Context, key string, uploadID string) ([]Part, error) {
+	var parts []Part
+	query := url.Values{"uploadId": {uploadID}}
+	for {
+		var result listPartsResult
+		if err := client.doXML(ctx, &request{method: http.MethodGet, key: key, query: query}, &result); err != nil {
+			return nil, fmt.Errorf("failed to list the uploaded parts of `%s`: %w", key, err)
+		}
+		for _, part := range result.Parts {
+			parts = append(parts, Part{Number: part.PartNumber, Size: part.Size, ETag: strings.Trim(part.ETag, `"`)})
+		}
+		if !result.IsTruncated || result.NextPartNumberMarker == 0 {
+			break
+		}
+		query.Set("part-number-marker", strconv.Itoa(result.NextPartNumberMarker))
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Number < parts[j].Number
+	})
+	return parts, nil
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	ETag string `xml:"ETag"`
+}
+
+// CompleteMultipartUpload assembles the object from the parts, sorted by number. The ETag of the object is checked
+// against the MD5 of the parts, see MultipartETag, a mismatch is only logged, as in UploadPart.
+func (client *Client) CompleteMultipartUpload(ctx context.Context, key string, uploadID string,
+	parts []Part) (string, error) {
+	var body completeMultipartUpload
+	for _, part := range parts {
+		body.Parts = append(body.Parts, struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		}{PartNumber: part.Number, ETag: `"` + part.ETag + `"`})
+	}
+	encoded, err := xml.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	var result completeMultipartUploadResult
+	err = client.doXML(ctx, &request{method: http.MethodPost, key: key, query: url.Values{"uploadId": {uploadID}},
+		headers: map[string]string{"Content-Type": "application/xml"}, body: encoded}, &result)
+	if err != nil {
+		return "", fmt.Errorf("failed to complete the upload of `%s`: %w", key, err)
+	}
+
+	etag := strings.Trim(result.ETag, `"`)
+	if expected, err := MultipartETag(parts); err != nil || etag != expected {
+		log.WithContext(ctx).Warnf("The upload of `%s` is completed with ETag %s, which is not the MD5 of its parts %s",
+			key, etag, expected)
+	}
+	return etag, nil
+}
+
+// AbortMultipartUpload deletes the parts uploaded so far.
+func (client *Client) AbortMultipartUpload(ctx context.Context, key string, uploadID string) error {
+	response, err := client.do(ctx, &request{method: http.MethodDelete, key: key,
+		query: url.Values{"uploadId": {uploadID}}})
+	if err != nil {
+		return fmt.Errorf("failed to abort the upload of `%s`: %w", key, err)
+	}
+	return response.Body.Close()
+}
+
+// MultipartETag returns the ETag S3 gives to the object uploaded in the parts: the MD5 of the concatenated MD5s
+// of the parts and the number of the parts.
+func MultipartETag(parts []Part) (string, error) {
+	hash := md5.New()
+	for _, part := range parts {
+		sum, err := hex.DecodeString(part.ETag)
+		if err != nil {
+			return "", fmt.Errorf("malformed ETag of the part %d: %w", part.Number, err)
+		}
+		hash.Write(sum)
+	}
+	return hex.EncodeToString(hash.Sum(nil)) + "-" + strconv.Itoa(len(parts)), nil
+}
@@ -0,0 +1,264 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when the object or the multipart upload does not exist.
+var ErrNotFound = errors.New("not found in the bucket")
+
+const (
+	// DefaultRegion is used by MinIO and most of the S3-compatible storages unless configured otherwise
+	DefaultRegion = "us-east-1"
+
+	maxAttempts  = 4
+	retryBackoff = time.Second
+)
+
+// Client is a minimal client of the S3 API, enough to upload and download the archives of the backups.
+type Client struct {
+	// Endpoint is the URL of the storage, e.g. https://storage.yandexcloud.net
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket as the first segment of the path instead of the subdomain of the endpoint,
+	// it is required by MinIO
+	PathStyle bool
+	HTTP      *http.Client
+}
+
+// Error is the error response of the storage.
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("storage responded with %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("storage responded with %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// ObjectInfo describes the object in the bucket.
+type ObjectInfo struct {
+	Key  string
+	Size int64
+	// ETag is without quotes
+	ETag string
+}
+
+type request struct {
+	method  string
+	key     string
+	query   url.Values
+	headers map[string]string
+	body    []byte
+}
+
+// do sends the request, retrying the network errors and the errors of the storage which are likely transient.
+// The body of the response is closed unless the status is successful.
+func (client *Client) do(ctx context.Context, req *request) (*http.Response, error) {
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 {
+			log.WithContext(ctx).Debugf("retrying %s %s after: %v", req.method, req.key, lastErr)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(retryBackoff * time.Duration(1<<(attempt-2))):
+			}
+		}
+
+		response, err := client.send(ctx, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if response.StatusCode >= 200 && response.StatusCode < 300 {
+			return response, nil
+		}
+
+		responseErr := readError(response)
+		if response.StatusCode < 500 && response.StatusCode != http.StatusTooManyRequests {
+			return nil, responseErr
+		}
+		lastErr = responseErr
+	}
+	return nil, lastErr
+}
+
+func (client *Client) send(ctx context.Context, req *request) (*http.Response, error) {
+	endpoint, err := url.Parse(client.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint of the storage `%s`: %w", client.Endpoint, err)
+	}
+
+	path := "/" + req.key
+	if client.PathStyle {
+		path = "/" + client.Bucket + path
+	} else {
+		endpoint.Host = client.Bucket + "." + endpoint.Host
+	}
+	endpoint.Path = path
+	endpoint.RawPath = encodeURI(path, false)
+	endpoint.RawQuery = canonicalQuery(req.query)
+
+	httpRequest, err := http.NewRequestWithContext(ctx, req.method, endpoint.String(), bytes.NewReader(req.body))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.ContentLength = int64(len(req.body))
+	for name, value := range req.headers {
+		httpRequest.Header.Set(name, value)
+	}
+	if req.body != nil {
+		sum := md5.Sum(req.body)
+		httpRequest.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	client.sign(httpRequest, hashHex(req.body), time.Now())
+
+	httpClient := client.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(httpRequest)
+}
+
+func readError(response *http.Response) error {
+	defer response.Body.Close()
+	responseErr := &Error{StatusCode: response.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	_ = xml.Unmarshal(body, responseErr)
+	return responseErr
+}
+
+// PutObject uploads the small object in a single request.
+func (client *Client) PutObject(ctx context.Context, key string, body []byte, contentType string) error {
+	response, err := client.do(ctx, &request{method: http.MethodPut, key: key, body: body,
+		headers: map[string]string{"Content-Type": contentType}})
+	if err != nil {
+		return fmt.Errorf("failed to upload `%s`: %w", key, err)
+	}
+	return response.Body.Close()
+}
+
+// GetObject downloads the object starting at the offset.
+func (client *Client) GetObject(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	req := &request{method: http.MethodGet, key: key}
+	if offset > 0 {
+		req.headers = map[string]string{"Range": "bytes=" + strconv.FormatInt(offset, 10) + "-"}
+	}
+	response, err := client.do(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download `%s`: %w", key, err)
+	}
+	if offset > 0 && response.StatusCode != http.StatusPartialContent {
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("failed to download `%s`: the storage does not support ranges", key)
+	}
+	return response.Body, nil
+}
+
+// HeadObject returns the size and the ETag of the object.
+func (client *Client) HeadObject(ctx context.Context, key string) (*ObjectInfo, error) {
+	response, err := client.do(ctx, &request{method: http.MethodHead, key: key})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get `%s`: %w", key, err)
+	}
+	_ = response.Body.Close()
+	return &ObjectInfo{Key: key, Size: response.ContentLength, ETag: strings.Trim(response.Header.Get("ETag"), `"`)},
+		nil
+}
+
+// DeleteObject deletes the object, a missing object is not an error.
+func (client *Client) DeleteObject(ctx context.Context, key string) error {
+	response, err := client.do(ctx, &request{method: http.MethodDelete, key: key})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete `%s`: %w", key, err)
+	}
+	return response.Body.Close()
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+		ETag string `xml:"ETag"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// ListObjects returns the objects with the prefix.
+func (client *Client) ListObjects(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		var result listBucketResult
+		if err := client.doXML(ctx, &request{method: http.MethodGet, query: query}, &result); err != nil {
+			return nil, fmt.Errorf("failed to list `%s`: %w", prefix, err)
+		}
+		for _, content := range result.Contents {
+			objects = append(objects, ObjectInfo{Key: content.Key, Size: content.Size,
+				ETag: strings.Trim(content.ETag, `"`)})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// doXML sends the request and parses the XML response. The error in the response with the successful status,
+// which CompleteMultipartUpload may return, is an error as well.
+func (client *Client) doXML(ctx context.Context, req *request, result any) error {
+	response, err := client.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(body, &root); err != nil {
+		return fmt.Errorf("malformed response of the storage: %w", err)
+	}
+	if root.XMLName.Local == "Error" {
+		responseErr := &Error{StatusCode: response.StatusCode}
+		_ = xml.Unmarshal(body, responseErr)
+		return responseErr
+	}
+	return xml.Unmarshal(body, result)
+}
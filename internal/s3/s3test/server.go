@@ -0,0 +1,271 @@
+// Package s3test is the in-memory storage serving the part of the S3 API the client uses, for the tests.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Bucket is the only bucket of the storage, it is addressed in the path.
+const Bucket = "bucket"
+
+// Server keeps the objects and the multipart uploads in memory. The requests are not authenticated.
+type Server struct {
+	*httptest.Server
+
+	// ETag returns the ETag of the object or the part, the hex MD5 of the data by default
+	ETag func(data []byte) string
+	// FailPart fails the upload of the part with the number, unless it is zero
+	FailPart int
+	// TruncateAfter cuts the body of the downloaded object after the number of bytes for the next
+	// TruncateTimes downloads, as a broken connection does
+	TruncateAfter int64
+	TruncateTimes int
+
+	mutex   sync.Mutex
+	objects map[string][]byte
+	etags   map[string]string
+	uploads map[string]*upload
+	nextID  int
+	// PartUploads counts the uploads of the parts by number
+	PartUploads map[int]int
+}
+
+type upload struct {
+	key   string
+	parts map[int][]byte
+}
+
+// NewServer starts the storage, it is closed by the caller.
+func NewServer() *Server {
+	server := &Server{objects: map[string][]byte{}, etags: map[string]string{},
+		uploads: map[string]*upload{}, PartUploads: map[int]int{}}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serve))
+	return server
+}
+
+// Object returns the content of the object, or nil if there is no such object.
+func (server *Server) Object(key string) []byte {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.objects[key]
+}
+
+func (server *Server) etag(data []byte) string {
+	if server.ETag != nil {
+		return server.ETag(data)
+	}
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (server *Server) serve(w http.ResponseWriter, r *http.Request) {
+	key, found := strings.CutPrefix(r.URL.Path, "/"+Bucket)
+	if !found {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key = strings.TrimPrefix(key, "/")
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if digest := r.Header.Get("Content-MD5"); digest != "" {
+		sum := md5.Sum(body)
+		if digest != base64.StdEncoding.EncodeToString(sum[:]) {
+			writeError(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+	}
+	query := r.URL.Query()
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		server.listObjects(w, query.Get("prefix"))
+	case query.Has("uploads") && r.Method == http.MethodPost:
+		server.nextID++
+		id := strconv.Itoa(server.nextID)
+		server.uploads[id] = &upload{key: key, parts: map[int][]byte{}}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadID string   `xml:"UploadId"`
+		}{UploadID: id})
+	case query.Has("uploadId"):
+		upload, ok := server.uploads[query.Get("uploadId")]
+		if !ok || upload.key != key {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		server.serveUpload(w, r, query, upload, body)
+	case r.Method == http.MethodPut:
+		server.objects[key] = body
+		server.etags[key] = server.etag(body)
+		w.Header().Set("ETag", `"`+server.etags[key]+`"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		server.serveObject(w, r, key)
+	case r.Method == http.MethodDelete:
+		delete(server.objects, key)
+		delete(server.etags, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (server *Server) serveUpload(w http.ResponseWriter, r *http.Request, query url.Values, upload *upload,
+	body []byte) {
+	id := query.Get("uploadId")
+	switch r.Method {
+	case http.MethodPut:
+		number, err := strconv.Atoi(query.Get("partNumber"))
+		if err != nil || number < 1 {
+			writeError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		if number == server.FailPart {
+			writeError(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		server.PartUploads[number]++
+		upload.parts[number] = body
+		w.Header().Set("ETag", `"`+server.etag(body)+`"`)
+	case http.MethodGet:
+		type part struct {
+			PartNumber int    `xml:"PartNumber"`
+			Size       int64  `xml:"Size"`
+			ETag       string `xml:"ETag"`
+		}
+		var result struct {
+			XMLName xml.Name `xml:"ListPartsResult"`
+			Parts   []part   `xml:"Part"`
+		}
+		for number, data := range upload.parts {
+			result.Parts = append(result.Parts, part{PartNumber: number, Size: int64(len(data)),
+				ETag: `"` + server.etag(data) + `"`})
+		}
+		sort.Slice(result.Parts, func(i, j int) bool {
+			return result.Parts[i].PartNumber < result.Parts[j].PartNumber
+		})
+		writeXML(w, result)
+	case http.MethodPost:
+		var request struct {
+			Parts []struct {
+				PartNumber int    `xml:"PartNumber"`
+				ETag       string `xml:"ETag"`
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &request); err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var object []byte
+		hash := md5.New()
+		for _, part := range request.Parts {
+			data, ok := upload.parts[part.PartNumber]
+			if !ok || strings.Trim(part.ETag, `"`) != server.etag(data) {
+				writeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object = append(object, data...)
+			sum := md5.Sum(data)
+			hash.Write(sum[:])
+		}
+		etag := hex.EncodeToString(hash.Sum(nil)) + "-" + strconv.Itoa(len(request.Parts))
+		if server.ETag != nil {
+			etag = server.ETag(object)
+		}
+		server.objects[upload.key] = object
+		server.etags[upload.key] = etag
+		delete(server.uploads, id)
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			ETag    string   `xml:"ETag"`
+		}{ETag: `"` + etag + `"`})
+	case http.MethodDelete:
+		delete(server.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (server *Server) serveObject(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := server.objects[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	status := http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeHeader, "bytes="), "-"))
+		if err != nil || offset > len(object) {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		object = object[offset:]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+	w.Header().Set("ETag", `"`+server.etags[key]+`"`)
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if server.TruncateTimes > 0 && int64(len(object)) > server.TruncateAfter {
+		// The declared length is not reached, so the client sees the connection broken
+		server.TruncateTimes--
+		object = object[:server.TruncateAfter]
+	}
+	_, _ = w.Write(object)
+}
+
+func (server *Server) listObjects(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+		ETag string `xml:"ETag"`
+	}
+	var result struct {
+		XMLName  xml.Name  `xml:"ListBucketResult"`
+		Contents []content `xml:"Contents"`
+	}
+	for key, object := range server.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{Key: key, Size: int64(len(object)),
+				ETag: `"` + server.etags[key] + `"`})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool {
+		return result.Contents[i].Key < result.Contents[j].Key
+	})
+	writeXML(w, result)
+}
+
+func writeXML(w http.ResponseWriter, value any) {
+	var buffer bytes.Buffer
+	if err := xml.NewEncoder(&buffer).Encode(value); err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write(buffer.Bytes())
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, http.StatusText(status))
+}
@@ -0,0 +1,241 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression with the standard five fields: minute, hour, day of month, month and
+// day of week.
+type Schedule struct {
+	expr       string
+	minutes    uint64
+	hours      uint64
+	daysOfMon  uint64
+	months     uint64
+	daysOfWeek uint64
+	// As in cron, when both day fields are restricted, a day matches either of them
+	domStar bool
+	dowStar bool
+}
+
+type field struct {
+	name string
+	min  int
+	max  int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+var shortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// The search of the next activation time gives up after this horizon, e.g. for `0 0 31 2 *`
+const searchHorizon = 5 * 366 * 24 * time.Hour
+
+func Parse(expr string) (*Schedule, error) {
+	normalized := strings.TrimSpace(expr)
+	if shortcut, ok := shortcuts[strings.ToLower(normalized)]; ok {
+		normalized = shortcut
+	}
+
+	parts := strings.Fields(normalized)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("cron expression `%s` must have %d fields", expr, len(fields))
+	}
+
+	bits := make([]uint64, len(fields))
+	for i, part := range parts {
+		value, err := parseField(part, fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression `%s`: %w", expr, err)
+		}
+		bits[i] = value
+	}
+
+	// Sunday may be written both as 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &Schedule{
+		expr:       expr,
+		minutes:    bits[0],
+		hours:      bits[1],
+		daysOfMon:  bits[2],
+		months:     bits[3],
+		daysOfWeek: bits[4],
+		domStar:    parts[2] == "*",
+		dowStar:    parts[4] == "*",
+	}, nil
+}
+
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// Next returns the first activation time strictly after `t`, or the zero time if there is none. The schedule follows
+// the wall clock of the location of `t`: a time skipped by the daylight saving shift is activated right after the
+// shift, and a time repeated by it is activated once, at its first occurrence.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	// The wall clock is searched in UTC, which has no shifts, and the matches are converted back to the location
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC).Add(time.Minute)
+	limit := wall.Add(searchHorizon)
+
+	for wall = s.nextWall(wall, limit); !wall.IsZero(); wall = s.nextWall(wall.Add(time.Minute), limit) {
+		if next := wallToLocal(wall, loc); next.After(t) {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// nextWall returns the first matching wall clock time from `next` on, or the zero time if there is none before
+// the limit.
+func (s *Schedule) nextWall(next time.Time, limit time.Time) time.Time {
+	for next.Before(limit) {
+		if s.months&(1<<uint(next.Month())) == 0 {
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.matchesDay(next) {
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.hours&(1<<uint(next.Hour())) == 0 {
+			next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.minutes&(1<<uint(next.Minute())) == 0 {
+			next = next.Add(time.Minute)
+			continue
+		}
+		return next
+	}
+
+	return time.Time{}
+}
+
+// The daylight saving shifts never move the clock by more than this
+const maxShift = 3 * time.Hour
+
+// wallToLocal returns the first moment the clock of the location shows the wall clock time, given in UTC. If the clock
+// skips the time, the moment of the shift is returned.
+func wallToLocal(wall time.Time, loc *time.Location) time.Time {
+	_, offset := wall.In(loc).Zone()
+	estimate := wall.Add(-time.Duration(offset) * time.Second)
+
+	// The offsets in effect around the moment, two of them if there is a shift
+	minOffset, maxOffset := offset, offset
+	var found time.Time
+	for _, probe := range []time.Duration{-maxShift, 0, maxShift} {
+		_, offset := estimate.Add(probe).In(loc).Zone()
+		if offset < minOffset {
+			minOffset = offset
+		}
+		if offset > maxOffset {
+			maxOffset = offset
+		}
+		local := wall.Add(-time.Duration(offset) * time.Second).In(loc)
+		if wallClock(local).Equal(wall) && (found.IsZero() || local.Before(found)) {
+			found = local
+		}
+	}
+	if !found.IsZero() {
+		return found
+	}
+
+	// The clock jumps over the time somewhere between the moments it would be shown with either of the offsets
+	for moment := wall.Add(-time.Duration(maxOffset) * time.Second); ; moment = moment.Add(time.Minute) {
+		if local := moment.In(loc); wallClock(local).After(wall) ||
+			!moment.Before(wall.Add(-time.Duration(minOffset)*time.Second)) {
+			return local
+		}
+	}
+}
+
+// wallClock returns the time shown by the clock of the location of `t`, in UTC.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+func (s *Schedule) matchesDay(t time.Time) bool {
+	domMatch := s.daysOfMon&(1<<uint(t.Day())) != 0
+	dowMatch := s.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+func parseField(expr string, f field) (uint64, error) {
+	var result uint64
+	for _, part := range strings.Split(expr, ",") {
+		rangeExpr, step := part, 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			parsedStep, err := strconv.Atoi(part[idx+1:])
+			if err != nil || parsedStep <= 0 {
+				return 0, fmt.Errorf("invalid step `%s` in the %s field", part[idx+1:], f.name)
+			}
+			rangeExpr, step = part[:idx], parsedStep
+		}
+
+		var from, to int
+		switch {
+		case rangeExpr == "*":
+			from, to = f.min, f.max
+		case strings.Contains(rangeExpr, "-"):
+			bounds := strings.SplitN(rangeExpr, "-", 2)
+			var err error
+			if from, err = parseValue(bounds[0], f); err != nil {
+				return 0, err
+			}
+			if to, err = parseValue(bounds[1], f); err != nil {
+				return 0, err
+			}
+			if from > to {
+				return 0, fmt.Errorf("invalid range `%s` in the %s field", rangeExpr, f.name)
+			}
+		default:
+			value, err := parseValue(rangeExpr, f)
+			if err != nil {
+				return 0, err
+			}
+			from, to = value, value
+			// `5/15` means starting from 5 with the step of 15
+			if strings.Contains(part, "/") {
+				to = f.max
+			}
+		}
+
+		for value := from; value <= to; value += step {
+			result |= 1 << uint(value)
+		}
+	}
+
+	return result, nil
+}
+
+func parseValue(value string, f field) (int, error) {
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < f.min || parsed > f.max {
+		return 0, fmt.Errorf("value `%s` is out of range %d-%d in the %s field", value, f.min, f.max, f.name)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,72 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "* * * * 8", "@often"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("`%s` is parsed", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(loc *time.Location, year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, loc)
+	}
+	// 2024-03-31 and 2024-10-27 are the daylight saving shifts in Berlin, the times of the repeated hour are told
+	// apart by the offset
+	inBerlin := func(offset int, month time.Month, day, hour, minute int) time.Time {
+		return at(time.FixedZone("", offset*60*60), 2024, month, day, hour, minute).In(berlin)
+	}
+
+	for _, test := range []struct {
+		name     string
+		expr     string
+		from     time.Time
+		expected time.Time
+	}{
+		{"step", "*/15 * * * *", at(time.UTC, 2024, 5, 10, 10, 7), at(time.UTC, 2024, 5, 10, 10, 15)},
+		{"step from the exact time", "*/15 * * * *", at(time.UTC, 2024, 5, 10, 10, 15),
+			at(time.UTC, 2024, 5, 10, 10, 30)},
+		{"step from a value", "5/15 * * * *", at(time.UTC, 2024, 5, 10, 10, 7), at(time.UTC, 2024, 5, 10, 10, 20)},
+		{"step from a value to the next hour", "5/15 * * * *", at(time.UTC, 2024, 5, 10, 10, 50),
+			at(time.UTC, 2024, 5, 10, 11, 5)},
+		// 2024-05-10 is a Friday
+		{"weekdays", "0 9 * * 1-5", at(time.UTC, 2024, 5, 10, 10, 0), at(time.UTC, 2024, 5, 13, 9, 0)},
+		{"Sunday as 7", "0 0 * * 7", at(time.UTC, 2024, 5, 10, 10, 0), at(time.UTC, 2024, 5, 12, 0, 0)},
+		{"day of month or week", "0 0 13 * 5", at(time.UTC, 2024, 5, 10, 10, 0), at(time.UTC, 2024, 5, 13, 0, 0)},
+		{"day of week or month", "0 0 13 * 5", at(time.UTC, 2024, 5, 13, 10, 0), at(time.UTC, 2024, 5, 17, 0, 0)},
+		{"day of month only", "0 0 13 * *", at(time.UTC, 2024, 5, 13, 10, 0), at(time.UTC, 2024, 6, 13, 0, 0)},
+		{"leap day", "0 0 29 2 *", at(time.UTC, 2024, 5, 10, 10, 0), at(time.UTC, 2028, 2, 29, 0, 0)},
+		{"never", "0 0 31 2 *", at(time.UTC, 2024, 5, 10, 10, 0), time.Time{}},
+		{"shortcut", "@daily", at(time.UTC, 2024, 12, 31, 10, 0), at(time.UTC, 2025, 1, 1, 0, 0)},
+		{"skipped time", "30 2 * * *", at(berlin, 2024, 3, 30, 12, 0), inBerlin(2, 3, 31, 3, 0)},
+		{"after the skipped time", "30 2 * * *", inBerlin(2, 3, 31, 3, 0), at(berlin, 2024, 4, 1, 2, 30)},
+		{"hourly across the skipped hour", "0 * * * *", inBerlin(1, 3, 31, 1, 30),
+			inBerlin(2, 3, 31, 3, 0)},
+		{"repeated time", "30 2 * * *", at(berlin, 2024, 10, 26, 12, 0), inBerlin(2, 10, 27, 2, 30)},
+		{"after the repeated time", "30 2 * * *", inBerlin(2, 10, 27, 2, 30),
+			at(berlin, 2024, 10, 28, 2, 30)},
+		{"hourly across the repeated hour", "0 * * * *", inBerlin(2, 10, 27, 2, 30),
+			inBerlin(1, 10, 27, 3, 0)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := Parse(test.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next := schedule.Next(test.from); !next.Equal(test.expected) {
+				t.Fatalf("the next time after %s is %s, want %s", test.from, next, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// CopyTree copies the file or the directory with its files, symlinks and permissions. The contents of the files
+// are cloned when the filesystem supports it, see copyFileContents.
+func CopyTree(ctx context.Context, source string, target string) error {
+	return filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		targetPath := filepath.Join(target, relativePath)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(targetPath, info.Mode().Perm())
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, targetPath)
+		case info.Mode().IsRegular():
+			return CopyFile(path, targetPath, info.Mode().Perm())
+		default:
+			return fmt.Errorf("cannot copy `%s`, it is neither a file, a directory nor a symlink", path)
+		}
+	})
+}
+
+// CopyFile copies the regular file, the target must not exist.
+func CopyFile(source string, target string, perm fs.FileMode) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	targetFile, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := copyFileContents(targetFile, sourceFile); err != nil {
+		_ = targetFile.Close()
+		return fmt.Errorf("failed to copy `%s` to `%s`: %w", source, target, err)
+	}
+	return targetFile.Close()
+}
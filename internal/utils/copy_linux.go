@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"syscall"
+)
+
+// Chunk of a single copy_file_range call
+const copyFileRangeChunk = 1 << 30
+
+// copyFileContents clones the extents with FICLONE, so that on btrfs the copy takes no space and no time. Otherwise,
+// copy_file_range copies the data in the kernel, and the plain copy is the last resort, e.g. for old kernels.
+func copyFileContents(target *os.File, source *os.File) error {
+	if err := unix.IoctlFileClone(int(target.Fd()), int(source.Fd())); err == nil {
+		return nil
+	}
+
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	remaining := info.Size()
+	for remaining > 0 {
+		chunk := remaining
+		if chunk > copyFileRangeChunk {
+			chunk = copyFileRangeChunk
+		}
+		n, err := unix.CopyFileRange(int(source.Fd()), nil, int(target.Fd()), nil, int(chunk), 0)
+		if err != nil {
+			// Nothing is copied yet, so the offsets of both files are still at the start
+			if remaining == info.Size() && isCopyFileRangeUnsupported(err) {
+				_, err = io.Copy(target, source)
+			}
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		remaining -= int64(n)
+	}
+	return nil
+}
+
+func isCopyFileRangeUnsupported(err error) bool {
+	return errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EINVAL) ||
+		errors.Is(err, syscall.EOPNOTSUPP)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package utils
+
+import (
+	"io"
+	"os"
+)
+
+// copyFileContents copies the data, the files are cloned only on Linux.
+func copyFileContents(target *os.File, source *os.File) error {
+	_, err := io.Copy(target, source)
+	return err
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ErrBinaryMissing is returned when a required external tool is not installed.
+var ErrBinaryMissing = errors.New("required binary is not found in $PATH")
+
+// CommandError describes a failed external command. Its message is short, the full command line and the output
+// of the command to stderr are available for the verbose output.
+type CommandError struct {
+	Path     string
+	Args     []string
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	name := filepath.Base(e.Path)
+	if e.ExitCode >= 0 {
+		return fmt.Sprintf("`%s` exited with code %d", name, e.ExitCode)
+	}
+	return fmt.Sprintf("`%s` failed: %v", name, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Details returns the command line and the last lines written by the command to stderr.
+func (e *CommandError) Details() string {
+	details := "command: " + strings.Join(append([]string{e.Path}, e.Args...), " ")
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		details += "\nstderr: " + stderr
+	}
+	return details
+}
+
+// RunCommand runs the command and returns *CommandError if it fails.
+func RunCommand(cmd *exec.Cmd) error {
+	stderr := captureStderr(cmd)
+	if err := cmd.Run(); err != nil {
+		return newCommandError(cmd, err, stderr.String())
+	}
+	return nil
+}
+
+// OutputCommand runs the command, returns its stdout and *CommandError if it fails.
+func OutputCommand(cmd *exec.Cmd) ([]byte, error) {
+	stderr := captureStderr(cmd)
+	out, err := cmd.Output()
+	if err != nil {
+		return out, newCommandError(cmd, err, stderr.String())
+	}
+	return out, nil
+}
+
+// Only the tail of stderr is kept, it is enough to explain the failure
+const stderrLimit = 4096
+
+type tailBuffer struct {
+	bytes.Buffer
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n, err := b.Buffer.Write(p)
+	if b.Len() > stderrLimit {
+		b.Next(b.Len() - stderrLimit)
+	}
+	return n, err
+}
+
+func captureStderr(cmd *exec.Cmd) *tailBuffer {
+	stderr := &tailBuffer{}
+	switch cmd.Stderr {
+	case nil:
+		cmd.Stderr = stderr
+	case os.Stderr:
+		// Debug mode: keep printing to the terminal
+		cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	}
+	return stderr
+}
+
+func newCommandError(cmd *exec.Cmd, err error, stderr string) *CommandError {
+	exitCode := -1
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+	var args []string
+	if len(cmd.Args) > 1 {
+		args = cmd.Args[1:]
+	}
+	return &CommandError{Path: cmd.Path, Args: args, ExitCode: exitCode, Stderr: stderr, Err: err}
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// SecretSource tells where a secret is taken from, in the order of precedence: the file, the environment variable
+// and the prompt on the terminal.
+type SecretSource struct {
+	File string
+	// Env is the name of the environment variable with the secret
+	Env string
+	// Prompt is shown on the terminal when neither the file nor the environment variable is set
+	Prompt string
+}
+
+// Load returns the secret. The contents of the file are used as is, the new secret is prompted for twice to rule
+// out a typo. ErrNotTerminal is returned when the secret must be prompted for, but there is no terminal.
+func (source *SecretSource) Load(isNew bool) ([]byte, error) {
+	var secret []byte
+	var err error
+	switch {
+	case source.File != "":
+		if secret, err = os.ReadFile(source.File); err != nil {
+			return nil, fmt.Errorf("failed to read the file `%s`: %w", source.File, err)
+		}
+	case os.Getenv(source.Env) != "":
+		secret = []byte(os.Getenv(source.Env))
+	default:
+		if secret, err = ReadSecret(source.Prompt + ": "); err != nil {
+			return nil, err
+		}
+		if isNew {
+			confirmation, err := ReadSecret("Repeat: ")
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(secret, confirmation) {
+				return nil, errors.New("the entered values do not match")
+			}
+		}
+	}
+
+	if len(secret) == 0 {
+		return nil, errors.New("the secret is empty")
+	}
+	return secret, nil
+}
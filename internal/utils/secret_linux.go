@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+)
+
+// ErrNotTerminal is returned when a secret must be prompted for, but the standard input is not a terminal.
+var ErrNotTerminal = errors.New("the standard input is not a terminal")
+
+// ReadSecret prints the prompt to stderr and reads a line from the terminal with the echo turned off.
+func ReadSecret(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, ErrNotTerminal
+	}
+
+	silent := *termios
+	silent.Lflag &^= unix.ECHO
+	silent.Lflag |= unix.ICANON | unix.ISIG
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &silent); err != nil {
+		return nil, fmt.Errorf("failed to turn off the echo of the terminal: %w", err)
+	}
+	defer func() {
+		_ = unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+		fmt.Fprintln(os.Stderr)
+	}()
+
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from the terminal: %w", err)
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package utils
+
+import "errors"
+
+// ErrNotTerminal is returned when a secret must be prompted for, but the standard input is not a terminal.
+var ErrNotTerminal = errors.New("the standard input is not a terminal")
+
+// ReadSecret is supported only on Linux, where the echo of the terminal can be turned off.
+func ReadSecret(prompt string) ([]byte, error) {
+	return nil, ErrNotTerminal
+}
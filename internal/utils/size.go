@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// ParseSize parses the number of bytes with an optional binary unit, e.g. 512M, 10G or 1TiB.
+func ParseSize(value string) (int64, error) {
+	unit := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B"), "I")
+	number := strings.TrimRight(unit, "KMGT")
+	multiplier, ok := sizeUnits[unit[len(number):]]
+	if !ok || number == "" {
+		return 0, fmt.Errorf("invalid size `%s`, expected a number of bytes with an optional K, M, G or T unit", value)
+	}
+
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size `%s`, expected a number of bytes with an optional K, M, G or T unit", value)
+	}
+	if size > 0 && multiplier > (1<<63-1)/size {
+		return 0, fmt.Errorf("size `%s` is too large", value)
+	}
+	return size * multiplier, nil
+}
+
+// FormatSize returns the number of bytes in the largest binary unit which keeps it above 1, e.g. 1.5GiB.
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
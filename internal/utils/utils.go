@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -9,6 +10,9 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func CreateDirectory(dir string) error {
@@ -86,7 +90,7 @@ func DeleteFile(path string) error {
 	return nil
 }
 
-func MoveFilesFromDirToDir(source string, target string) error {
+func MoveFilesFromDirToDir(ctx context.Context, source string, target string) error {
 	entries, err := os.ReadDir(source)
 	if err != nil {
 		return fmt.Errorf("failed to get entries from the dir `%s`", entries)
@@ -95,29 +99,35 @@ func MoveFilesFromDirToDir(source string, target string) error {
 	for _, entry := range entries {
 		oldPath := path.Join(source, entry.Name())
 		newPath := path.Join(target, entry.Name())
-		if err := MoveFile(oldPath, newPath); err != nil {
-			return fmt.Errorf("failed to move entry from `%s` to `%s`", oldPath, newPath)
+		if err := MoveFile(ctx, oldPath, newPath); err != nil {
+			return fmt.Errorf("failed to move entry from `%s` to `%s`: %w", oldPath, newPath, err)
 		}
 	}
 
 	return nil
 }
 
-func MoveFile(source string, target string) error {
-	if _, err := os.Stat(source); os.IsNotExist(err) {
+// MoveFile renames the file or the directory. When the target is on another filesystem, it is copied, see CopyTree,
+// and the source is deleted.
+func MoveFile(ctx context.Context, source string, target string) error {
+	if _, err := os.Lstat(source); os.IsNotExist(err) {
 		return fmt.Errorf("failed to move as %s does not exist", source)
 	}
 
-	mvPath, err := GetBinary("mv")
-	if err != nil {
-		return err
+	err := os.Rename(source, target)
+	if err == nil {
+		return nil
 	}
-
-	cmd := BuildCommand(mvPath, source, target)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to move file from %s to %s", source, target)
+	if !errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("failed to move file from %s to %s: %w", source, target, err)
 	}
 
+	if err := CopyTree(ctx, source, target); err != nil {
+		return fmt.Errorf("failed to copy file from %s to %s: %w", source, target, err)
+	}
+	if err := os.RemoveAll(source); err != nil {
+		return fmt.Errorf("failed to delete %s after copying it: %w", source, err)
+	}
 	return nil
 }
 
@@ -130,33 +140,66 @@ func DeleteDirectory(path string) error {
 	return nil
 }
 
+// JoinInside returns the path of the entry of an archive or a manifest inside the directory. It fails when the name
+// leads out of the directory, either by itself or through a symlink extracted before.
+func JoinInside(dir string, name string) (string, error) {
+	name = filepath.Clean(filepath.FromSlash(name))
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("`%s` is outside of the directory", name)
+	}
+	parent := dir
+	components := strings.Split(name, string(filepath.Separator))
+	for _, component := range components[:len(components)-1] {
+		parent = filepath.Join(parent, component)
+		info, err := os.Lstat(parent)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("`%s` is under the symlink `%s`", name, component)
+		}
+	}
+	return filepath.Join(dir, name), nil
+}
+
 func GetBinary(binaryName string) (string, error) {
 	path, err := exec.LookPath(binaryName)
 	if err != nil {
-		return "", fmt.Errorf("`%s` is not found in %%PATH%%", binaryName)
+		return "", fmt.Errorf("%w: `%s`", ErrBinaryMissing, binaryName)
 	}
 
 	return path, nil
 }
 
-func BuildCommand(binaryPath string, args ...string) *exec.Cmd {
-	cmd := exec.Command(binaryPath, args...)
+// BuildCommand creates a command which is killed together with its children when the context is done.
+func BuildCommand(ctx context.Context, binaryPath string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, binaryPath, args...)
 	if IsDebugEnabled() {
 		cmd.Stderr = os.Stderr
 	}
+	// A separate process group keeps the external tools from receiving Ctrl-C directly,
+	// so that they are stopped by the tool itself in a deterministic order
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 10 * time.Second
 
 	return cmd
 }
 
-func Sync() error {
+func Sync(ctx context.Context) error {
 	syncPath, err := GetBinary("sync")
 	if err != nil {
 		return err
 	}
 
-	syncCmd := BuildCommand(syncPath)
-	if err := syncCmd.Run(); err != nil {
-		return errors.New("cannot sync synchronize data on the disk with the main memory using `sync`")
+	syncCmd := BuildCommand(ctx, syncPath)
+	if err := RunCommand(syncCmd); err != nil {
+		return fmt.Errorf("cannot sync synchronize data on the disk with the main memory using `sync`: %w", err)
 	}
 
 	return nil
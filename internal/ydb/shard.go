@@ -0,0 +1,164 @@
+package ydb
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"ydb-backup-tool/internal/utils"
+)
+
+// ConsistencyLevelDatabase makes `ydb tools dump` take a single snapshot of all the tables of the dump.
+const ConsistencyLevelDatabase = "database"
+
+// shardsDirName keeps the shards of the dump until they are merged into the final layout.
+const shardsDirName = ".shards"
+
+// ListDirectory returns the names of the objects in the directory of the database, except for the system ones,
+// e.g. `.sys`. The names are listed one per line, since they may have spaces.
+func ListDirectory(ctx context.Context, ydbParams *YdbParams, dirPath string) ([]string, error) {
+	ydbPath, err := utils.GetBinary("ydb")
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-e", ydbParams.Endpoint, "-d", ydbParams.Name}
+	args = addAuthParams(ydbParams, args)
+	args = append(args, "scheme", "ls", "-1", dirPath)
+
+	ydbCmd := utils.BuildCommand(ctx, ydbPath, args...)
+	out, err := utils.OutputCommand(ydbCmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the YDB directory `%s`: %w", dirPath, err)
+	}
+
+	return parseSchemeList(string(out)), nil
+}
+
+func parseSchemeList(out string) []string {
+	var names []string
+	for _, line := range strings.Split(out, "\n") {
+		name := strings.TrimSuffix(line, "\r")
+		if name != "" && !strings.HasPrefix(name, ".") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// excludeShards drops the top-level objects matching `DumpParams.Exclude`. The pattern is matched against the full
+// paths of the objects, as `ydb tools dump` does, so it means the same within each shard, and the excluded shards
+// are not dumped at all. The patterns Go cannot compile are left to `ydb tools dump` alone.
+func excludeShards(ctx context.Context, ydbParams *YdbParams, dumpParams *DumpParams, names []string) []string {
+	if dumpParams.Exclude == "" {
+		return names
+	}
+	pattern, err := regexp.Compile(dumpParams.Exclude)
+	if err != nil {
+		log.WithContext(ctx).Warnf("The shards are not matched against `--ydb-dump-exclude`: %v", err)
+		return names
+	}
+
+	var included []string
+	for _, name := range names {
+		if fullPath := objectPath(ydbParams, dumpParams.Path, name); pattern.MatchString(fullPath) {
+			log.WithContext(ctx).Infof("The shard `%s` is excluded from the dump", fullPath)
+		} else {
+			included = append(included, name)
+		}
+	}
+	return included
+}
+
+// objectPath returns the full path of the object in the directory, which is either absolute or relative to the
+// database.
+func objectPath(ydbParams *YdbParams, dirPath string, name string) string {
+	if strings.HasPrefix(dirPath, "/") {
+		return path.Join(dirPath, name)
+	}
+	return path.Join(ydbParams.Name, dirPath, name)
+}
+
+// dumpSharded dumps every top-level object under `DumpParams.Path` separately, up to `Parallelism` of them at once,
+// and merges them into the layout of a single dump. The first failure cancels the other dumps. When the path cannot
+// be split, it is dumped as a whole.
+func dumpSharded(ctx context.Context, ydbParams *YdbParams, dumpParams *DumpParams, outputPath string) error {
+	names, err := ListDirectory(ctx, ydbParams, dumpParams.Path)
+	if err != nil {
+		log.WithContext(ctx).Warnf("Dumping `%s` as a whole, since it cannot be split: %v", dumpParams.Path, err)
+		return dumpPath(ctx, ydbParams, dumpParams, dumpParams.Path, outputPath)
+	}
+	names = excludeShards(ctx, ydbParams, dumpParams, names)
+	if len(names) < 2 {
+		return dumpPath(ctx, ydbParams, dumpParams, dumpParams.Path, outputPath)
+	}
+
+	if dumpParams.ConsistencyLevel == ConsistencyLevelDatabase && !dumpParams.SchemeOnly {
+		log.WithContext(ctx).Warnf("The dump is split into %d shards, `--ydb-dump-consistency-level=database` is "+
+			"preserved only within each shard, the shards are taken at different moments", len(names))
+	}
+
+	shardsPath := filepath.Join(outputPath, shardsDirName)
+	if err := os.MkdirAll(shardsPath, 0o755); err != nil {
+		return fmt.Errorf("failed to create a directory for the shards of the dump: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(shardsPath); err != nil {
+			log.WithContext(ctx).Warnf("failed to delete the shards directory `%s`: %v", shardsPath, err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parallelism := dumpParams.Parallelism
+	if parallelism > len(names) {
+		parallelism = len(names)
+	}
+	// The shards cancelled by the failure of another shard are not reported
+	var firstErr error
+	var failOnce sync.Once
+	workers := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.WithContext(ctx).Infof("Dumping the shard `%s`", name)
+			shardPath := filepath.Join(shardsPath, name)
+			if err := dumpPath(ctx, ydbParams, dumpParams, path.Join(dumpParams.Path, name), shardPath); err != nil {
+				failOnce.Do(func() {
+					firstErr = fmt.Errorf("shard `%s`: %w", name, err)
+					cancel()
+				})
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Each shard is the dump of a top-level object, it goes to the same place as in a single dump
+	for _, name := range names {
+		if err := os.Rename(filepath.Join(shardsPath, name), filepath.Join(outputPath, name)); err != nil {
+			return fmt.Errorf("failed to merge the shard `%s` into the dump: %w", name, err)
+		}
+	}
+	return nil
+}
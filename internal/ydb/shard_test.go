@@ -0,0 +1,41 @@
+package ydb
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseSchemeList(t *testing.T) {
+	names := parseSchemeList("orders\r\nmy table\n.sys\n\nlogs\n")
+	if expected := []string{"orders", "my table", "logs"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("parsed %q, expected %q", names, expected)
+	}
+}
+
+func TestExcludeShards(t *testing.T) {
+	ydbParams := &YdbParams{Name: "/local"}
+	names := []string{"orders", "logs", "logs_archive"}
+	tests := []struct {
+		dumpPath string
+		exclude  string
+		expected []string
+	}{
+		{dumpPath: ".", exclude: "", expected: names},
+		{dumpPath: ".", exclude: "^/local/logs$", expected: []string{"orders", "logs_archive"}},
+		{dumpPath: "app", exclude: "^/local/app/logs", expected: []string{"orders"}},
+		{dumpPath: "/local/app", exclude: "/orders$", expected: []string{"logs", "logs_archive"}},
+		// The pattern of a table inside the shard leaves the shard to `ydb tools dump`
+		{dumpPath: ".", exclude: "^/local/orders/2024$", expected: names},
+		// Go cannot compile the lookahead of PCRE
+		{dumpPath: ".", exclude: "^/local/(?!orders)", expected: names},
+	}
+	for _, test := range tests {
+		dumpParams := &DumpParams{Path: test.dumpPath, Exclude: test.exclude}
+		included := excludeShards(context.Background(), ydbParams, dumpParams, names)
+		if !reflect.DeepEqual(included, test.expected) {
+			t.Errorf("`%s` under `%s`: included %q, expected %q", test.exclude, test.dumpPath, included,
+				test.expected)
+		}
+	}
+}
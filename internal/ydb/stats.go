@@ -0,0 +1,63 @@
+package ydb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"ydb-backup-tool/internal/utils"
+)
+
+// DataSize returns the size of the data under `DumpParams.Path` by the statistics of the partitions of the tables.
+// It is the size stored by the database, so the size of the dump is only proportional to it.
+func DataSize(ctx context.Context, ydbParams *YdbParams, dumpParams *DumpParams) (int64, error) {
+	ydbPath, err := utils.GetBinary("ydb")
+	if err != nil {
+		return 0, err
+	}
+
+	query := "SELECT SUM(DataSize) AS DataSize FROM `.sys/partition_stats`"
+	if prefix := dataSizePrefix(ydbParams.Name, dumpParams.Path); prefix != "" {
+		query += fmt.Sprintf(" WHERE StartsWith(Path, %s) OR Path = %s", yqlString(prefix+"/"), yqlString(prefix))
+	}
+
+	args := []string{"-e", ydbParams.Endpoint, "-d", ydbParams.Name}
+	args = addAuthParams(ydbParams, args)
+	args = append(args, "table", "query", "execute", "-t", "scan", "--format", "json-unicode", "-q", query)
+
+	ydbCmd := utils.BuildCommand(ctx, ydbPath, args...)
+	out, err := utils.OutputCommand(ydbCmd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the statistics of the database: %w", err)
+	}
+
+	var row struct {
+		DataSize *int64
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(string(out))), &row); err != nil {
+		return 0, fmt.Errorf("failed to parse the statistics of the database: %w", err)
+	}
+	if row.DataSize == nil {
+		return 0, nil
+	}
+	return *row.DataSize, nil
+}
+
+// dataSizePrefix returns the absolute path of the dumped directory, or an empty string for the whole database.
+func dataSizePrefix(database string, dumpPath string) string {
+	if dumpPath == "" || dumpPath == "." || dumpPath == "/" || dumpPath == database {
+		return ""
+	}
+	if !strings.HasPrefix(dumpPath, "/") {
+		dumpPath = path.Join(database, dumpPath)
+	}
+	return path.Clean(dumpPath)
+}
+
+// yqlString returns the string literal of YQL, the backslashes are escaped first, so that the escapes of the quotes
+// are not doubled.
+func yqlString(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
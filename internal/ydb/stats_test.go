@@ -0,0 +1,39 @@
+package ydb
+
+import "testing"
+
+func TestDataSizePrefix(t *testing.T) {
+	tests := []struct {
+		dumpPath string
+		expected string
+	}{
+		{dumpPath: ".", expected: ""},
+		{dumpPath: "/local", expected: ""},
+		{dumpPath: "app", expected: "/local/app"},
+		{dumpPath: "app/", expected: "/local/app"},
+		{dumpPath: "/local/app/../logs", expected: "/local/logs"},
+	}
+	for _, test := range tests {
+		if prefix := dataSizePrefix("/local", test.dumpPath); prefix != test.expected {
+			t.Errorf("the prefix of `%s` is %q, expected %q", test.dumpPath, prefix, test.expected)
+		}
+	}
+}
+
+func TestYqlString(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{value: "/local/app", expected: `"/local/app"`},
+		{value: `/local/my "app"`, expected: `"/local/my \"app\""`},
+		// The backslash would escape the closing quote
+		{value: `/local/app\`, expected: `"/local/app\\"`},
+		{value: `/local/a\"b`, expected: `"/local/a\\\"b"`},
+	}
+	for _, test := range tests {
+		if literal := yqlString(test.value); literal != test.expected {
+			t.Errorf("the literal of %q is %s, expected %s", test.value, literal, test.expected)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package ydb
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"ydb-backup-tool/internal/utils"
@@ -22,6 +23,11 @@ type DumpParams struct {
 	ConsistencyLevel string
 	AvoidCopy        bool
 	SchemeOnly       bool
+	// Parallelism above 1 splits the dump by the top-level objects under `Path`, see dumpSharded
+	Parallelism int
+	// Direct dumps the database straight into the subvolume of the backup instead of the temporary directory, so
+	// that the dump is never copied. The image is not extended during such a dump.
+	Direct bool
 }
 
 type RestoreParams struct {
@@ -35,15 +41,30 @@ type Backup struct {
 	Path string
 }
 
-func Dump(ydbParams *YdbParams, dumpParams *DumpParams, path string) (*Backup, error) {
-	ydbPath, err := utils.GetBinary("ydb")
+func Dump(ctx context.Context, ydbParams *YdbParams, dumpParams *DumpParams, path string) (*Backup, error) {
+	var err error
+	if dumpParams.Parallelism > 1 {
+		err = dumpSharded(ctx, ydbParams, dumpParams, path)
+	} else {
+		err = dumpPath(ctx, ydbParams, dumpParams, dumpParams.Path, path)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	return &Backup{Path: path}, nil
+}
+
+// dumpPath dumps the directory or the table of the database into the output directory.
+func dumpPath(ctx context.Context, ydbParams *YdbParams, dumpParams *DumpParams, dbPath string, outputPath string) error {
+	ydbPath, err := utils.GetBinary("ydb")
+	if err != nil {
+		return err
+	}
+
 	args := []string{"-e", ydbParams.Endpoint, "-d", ydbParams.Name}
 	args = addAuthParams(ydbParams, args)
-	args = append(args, "tools", "dump", "-o", path, "-p", dumpParams.Path,
+	args = append(args, "tools", "dump", "-o", outputPath, "-p", dbPath,
 		"--consistency-level", dumpParams.ConsistencyLevel)
 	if dumpParams.Exclude != "" {
 		args = append(args, "--exclude", dumpParams.Exclude)
@@ -56,15 +77,15 @@ func Dump(ydbParams *YdbParams, dumpParams *DumpParams, path string) (*Backup, e
 	}
 
 	// Perform full backup of YDB
-	ydbCmd := utils.BuildCommand(ydbPath, args...)
-	if err := ydbCmd.Run(); err != nil {
-		return nil, fmt.Errorf("failed to perform YDB dump")
+	ydbCmd := utils.BuildCommand(ctx, ydbPath, args...)
+	if err := utils.RunCommand(ydbCmd); err != nil {
+		return fmt.Errorf("failed to perform YDB dump of `%s`: %w", dbPath, err)
 	}
 
-	return &Backup{Path: path}, nil
+	return nil
 }
 
-func Restore(ydbParams *YdbParams, restoreParams *RestoreParams, sourcePath string) error {
+func Restore(ctx context.Context, ydbParams *YdbParams, restoreParams *RestoreParams, sourcePath string) error {
 	ydbPath, err := utils.GetBinary("ydb")
 	if err != nil {
 		return err
@@ -80,9 +101,9 @@ func Restore(ydbParams *YdbParams, restoreParams *RestoreParams, sourcePath stri
 	}
 
 	// Perform restore of YDB
-	ydbCmd := utils.BuildCommand(ydbPath, args...)
-	if err := ydbCmd.Run(); err != nil {
-		return fmt.Errorf("failed to restore YDB from the backup `%s`", sourcePath)
+	ydbCmd := utils.BuildCommand(ctx, ydbPath, args...)
+	if err := utils.RunCommand(ydbCmd); err != nil {
+		return fmt.Errorf("failed to restore YDB from the backup `%s`: %w", sourcePath, err)
 	}
 
 	return nil